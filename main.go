@@ -37,6 +37,7 @@ import (
 	"github.com/skygeario/skygear-server/pkg/server/plugin/hook"
 	_ "github.com/skygeario/skygear-server/pkg/server/plugin/http"
 	"github.com/skygeario/skygear-server/pkg/server/plugin/provider"
+	"github.com/skygeario/skygear-server/pkg/server/plugin/webhook"
 	_ "github.com/skygeario/skygear-server/pkg/server/plugin/zmq"
 	pp "github.com/skygeario/skygear-server/pkg/server/preprocessor"
 	"github.com/skygeario/skygear-server/pkg/server/pubsub"
@@ -69,7 +70,8 @@ func main() {
 	initLogger(config)
 
 	log.Infof("Starting Skygear Server(%s)...", skyversion.Version())
-	connOpener := ensureDB(config) // Fatal on DB failed
+	dbConfig := initDBConfig(config)
+	connOpener := ensureDB(config, dbConfig) // Fatal on DB failed
 
 	if config.App.Slave {
 		log.Infof("Skygear Server is running in slave mode.")
@@ -104,6 +106,8 @@ func main() {
 		Config:           config,
 	}
 
+	initWebhook(config, pluginContext.HookRegistry)
+
 	var internalHub *pubsub.Hub
 	if !config.App.Slave {
 		internalHub = pubsub.NewHub()
@@ -133,6 +137,7 @@ func main() {
 		DBImpl:        config.DB.ImplName,
 		Option:        config.DB.Option,
 		DevMode:       config.App.DevMode,
+		Config:        dbConfig,
 	}
 	preprocessorRegistry["plugin_ready"] = &pp.EnsurePluginReadyPreprocessor{
 		PluginContext: &pluginContext,
@@ -309,7 +314,109 @@ func main() {
 	}
 }
 
-func ensureDB(config skyconfig.Configuration) func() (skydb.Conn, error) {
+// initDBConfig returns the configuration of records read from the
+// environment. Settings taking functions, which cannot be read from the
+// environment, are left unset.
+func initDBConfig(config skyconfig.Configuration) skydb.Config {
+	dbConfig := skydb.Config{
+		DefaultSorts:         map[string][]skydb.Sort{},
+		FieldOrders:          map[string]map[string][]string{},
+		DeletePolicies:       map[string]map[string]skydb.DeletePolicy{},
+		RetentionPolicies:    map[string]skydb.RetentionPolicy{},
+		ChangelogRetention:   config.Record.ChangelogRetention,
+		SpecialFloatPolicies: map[string]skydb.SpecialFloatPolicy{},
+		WriteRateLimits:      map[string]skydb.WriteRateLimit{},
+		Rollups:              map[string]skydb.Rollup{},
+		SchemaVersions:       map[string]int{},
+		LenientDecoding:      map[string]bool{},
+		FieldMasks:           map[string]map[string]skydb.FieldMask{},
+	}
+
+	for recordType, record := range config.Record.Types {
+		for _, keyPath := range record.DefaultSorts {
+			sort := skydb.Sort{KeyPath: keyPath, Order: skydb.Asc}
+			if strings.HasPrefix(keyPath, "-") {
+				sort = skydb.Sort{KeyPath: keyPath[1:], Order: skydb.Desc}
+			}
+			dbConfig.DefaultSorts[recordType] = append(dbConfig.DefaultSorts[recordType], sort)
+		}
+
+		if len(record.FieldOrders) > 0 {
+			dbConfig.FieldOrders[recordType] = record.FieldOrders
+		}
+
+		deletePolicies := map[string]skydb.DeletePolicy{}
+		for _, field := range record.DeleteCascade {
+			deletePolicies[field] = skydb.DeleteCascade
+		}
+		for _, field := range record.DeleteSetNull {
+			deletePolicies[field] = skydb.DeleteSetNull
+		}
+		if len(deletePolicies) > 0 {
+			dbConfig.DeletePolicies[recordType] = deletePolicies
+		}
+
+		if record.RetentionMaxAge > 0 || record.RetentionMaxCount > 0 {
+			dbConfig.RetentionPolicies[recordType] = skydb.RetentionPolicy{
+				MaxAge:   record.RetentionMaxAge,
+				MaxCount: record.RetentionMaxCount,
+			}
+		}
+
+		if record.SpecialFloats == "encode" {
+			dbConfig.SpecialFloatPolicies[recordType] = skydb.EncodeSpecialFloats
+		}
+
+		if record.WriteRate > 0 {
+			dbConfig.WriteRateLimits[recordType] = skydb.WriteRateLimit{
+				Rate:  record.WriteRate,
+				Burst: record.WriteBurst,
+			}
+		}
+
+		if record.RollupSourceType != "" {
+			aggregates := map[string]skydb.AggFunc{
+				"sum": skydb.SumAgg,
+				"avg": skydb.AvgAgg,
+				"min": skydb.MinAgg,
+				"max": skydb.MaxAgg,
+			}
+			dbConfig.Rollups[recordType] = skydb.Rollup{
+				SourceType: record.RollupSourceType,
+				GroupKey:   record.RollupGroupKey,
+				Aggregate:  aggregates[record.RollupAggregate],
+				Field:      record.RollupField,
+			}
+		}
+
+		if record.SchemaVersion > 0 {
+			dbConfig.SchemaVersions[recordType] = record.SchemaVersion
+		}
+
+		if record.LenientDecoding {
+			dbConfig.LenientDecoding[recordType] = true
+		}
+
+		if len(record.FieldMasks) > 0 {
+			masks := map[string]skydb.FieldMask{}
+			for field, mask := range record.FieldMasks {
+				var replacement interface{}
+				if mask.Replacement != "" {
+					replacement = mask.Replacement
+				}
+				masks[field] = skydb.FieldMask{
+					Roles:       mask.Roles,
+					Replacement: replacement,
+				}
+			}
+			dbConfig.FieldMasks[recordType] = masks
+		}
+	}
+
+	return dbConfig
+}
+
+func ensureDB(config skyconfig.Configuration, dbConfig skydb.Config) func() (skydb.Conn, error) {
 	connOpener := func() (skydb.Conn, error) {
 		return skydb.Open(
 			config.DB.ImplName,
@@ -317,6 +424,7 @@ func ensureDB(config skyconfig.Configuration) func() (skydb.Conn, error) {
 			config.App.AccessControl,
 			config.DB.Option,
 			config.App.DevMode,
+			dbConfig,
 		)
 	}
 
@@ -448,14 +556,38 @@ func initSubscription(config skyconfig.Configuration, connOpener func() (skydb.C
 		notifiers = append(notifiers, subscription.NewPushNotifier(pushSender))
 	}
 
+	var notifier subscription.Notifier = subscription.NewMultiNotifier(notifiers...)
+	if config.Subscription.BatchWindow > 0 {
+		window := time.Duration(config.Subscription.BatchWindow) * time.Millisecond
+		notifier = subscription.NewBatchingNotifier(notifier, window, config.Subscription.MaxBatchSize)
+	}
+
 	subscriptionService := &subscription.Service{
 		ConnOpener: connOpener,
-		Notifier:   subscription.NewMultiNotifier(notifiers...),
+		Notifier:   notifier,
 	}
 	log.Infoln("Subscription Service listening...")
 	go subscriptionService.Run()
 }
 
+// initWebhook registers the webhooks of config as hooks of hooks, which
+// are executed by the record handlers after records are saved or deleted.
+func initWebhook(config skyconfig.Configuration, hooks *hook.Registry) {
+	if len(config.Webhook.Hooks) == 0 {
+		return
+	}
+
+	webhooks := webhook.NewRegistry(hooks, config.Webhook.Workers, config.Webhook.QueueSize)
+	webhooks.MaxAttempts = config.Webhook.MaxAttempts
+	for name, webhookConfig := range config.Webhook.Hooks {
+		kind := hook.Kind(webhookConfig.Event)
+		if err := webhooks.Register(kind, webhookConfig.RecordType, webhookConfig.URL); err != nil {
+			log.Fatalf("Failed to register webhook %s: %v", name, err)
+		}
+		log.Infof("Registered webhook %s for %s of %s", name, kind, webhookConfig.RecordType)
+	}
+}
+
 func initPlugin(config skyconfig.Configuration, ctx *plugin.Context) {
 	log.Infof("Supported plugin transports: %s", strings.Join(plugin.SupportedTransports(), ", "))
 
@@ -36,6 +36,14 @@ type Store interface {
 	GeneratePostFileRequest(name string) (*PostFileRequest, error)
 }
 
+// RangeReader is implemented by a Store which reads part of a file, such
+// that a range of a large file can be served without reading the rest.
+type RangeReader interface {
+	// GetFileRangeReader returns a reader for reading at most length
+	// bytes of the named file from offset.
+	GetFileRangeReader(name string, offset, length int64) (io.ReadCloser, error)
+}
+
 // URLSigner signs a signature and returns a URL accessible to that asset.
 type URLSigner interface {
 	// SignedURL returns a url with access to the named file. If asset
@@ -49,6 +49,29 @@ func (s *fileStore) GetFileReader(name string) (io.ReadCloser, error) {
 	return os.Open(path)
 }
 
+// GetFileRangeReader returns a reader for reading part of a file
+func (s *fileStore) GetFileRangeReader(name string, offset, length int64) (io.ReadCloser, error) {
+	path := filepath.Join(s.dir, name)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(offset, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &limitedReadCloser{io.LimitReader(f, length), f}, nil
+}
+
+// limitedReadCloser reads from a limited reader of a file, and closes the
+// file when it is closed.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
 // PutFileReader stores a file from reader onto file system
 func (s *fileStore) PutFileReader(name string, src io.Reader, length int64, contentType string) error {
 	path := filepath.Join(s.dir, name)
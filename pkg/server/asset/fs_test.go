@@ -0,0 +1,46 @@
+package asset
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFileStoreRange(t *testing.T) {
+	Convey("fileStore", t, func() {
+		dir, err := ioutil.TempDir("", "skygear-asset")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		So(ioutil.WriteFile(filepath.Join(dir, "asset"), []byte("0123456789"), 0644), ShouldBeNil)
+		store := NewFileStore(dir, "", "", true).(RangeReader)
+
+		Convey("reads a range of a file", func() {
+			reader, err := store.GetFileRangeReader("asset", 2, 5)
+			So(err, ShouldBeNil)
+			defer reader.Close()
+
+			data, err := ioutil.ReadAll(reader)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "23456")
+		})
+
+		Convey("reads a range up to the end of a file", func() {
+			reader, err := store.GetFileRangeReader("asset", 8, 5)
+			So(err, ShouldBeNil)
+			defer reader.Close()
+
+			data, err := ioutil.ReadAll(reader)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "89")
+		})
+
+		Convey("errors on a file not found", func() {
+			_, err := store.GetFileRangeReader("notexist", 0, 5)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
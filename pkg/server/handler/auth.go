@@ -519,6 +519,7 @@ func (ctx *createUserWithRecordContext) execute(info *skydb.UserInfo) skyerr.Err
 		return skyerr.NewError(skyerr.NotSupported, "database impl does not support transaction")
 	}
 
+	txHooks := txHookQueue{}
 	txErr := withTransaction(txDB, func() error {
 		if err := ctx.DBConn.CreateUser(info); err != nil {
 			if err == skydb.ErrUserDuplicated {
@@ -539,6 +540,7 @@ func (ctx *createUserWithRecordContext) execute(info *skydb.UserInfo) skyerr.Err
 			Atomic:       false,
 			Context:      ctx.Context,
 			UserInfo:     info,
+			TxHooks:      &txHooks,
 			RecordsToSave: []*skydb.Record{
 				&userRecord,
 			},
@@ -552,6 +554,7 @@ func (ctx *createUserWithRecordContext) execute(info *skydb.UserInfo) skyerr.Err
 	})
 
 	if txErr == nil {
+		txHooks.flush()
 		return nil
 	}
 
@@ -16,6 +16,7 @@ package handler
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -118,6 +119,25 @@ func (h *GetFileHandler) Handle(payload *router.Payload, response *router.Respon
 	}
 
 	response.Header().Set("Content-Type", asset.ContentType)
+
+	// Only a store reading part of a file serves a range of it. Otherwise
+	// the Range header is ignored and the whole file is served.
+	if rangeStore, ok := store.(skyAsset.RangeReader); ok {
+		response.Header().Set("Accept-Ranges", "bytes")
+		if rangeHeader := payload.Req.Header.Get("Range"); rangeHeader != "" {
+			offset, length, err := parseByteRange(rangeHeader, asset.Size)
+			if err == errRangeNotSatisfiable {
+				response.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", asset.Size))
+				response.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				response.Write(nil)
+				return
+			} else if err == nil {
+				serveFileRange(rangeStore, fileName, asset.Size, offset, length, response)
+				return
+			}
+		}
+	}
+
 	response.Header().Set("Content-Length", strconv.FormatInt(asset.Size, 10))
 
 	reader, err := store.GetFileReader(fileName)
@@ -136,6 +156,87 @@ func (h *GetFileHandler) Handle(payload *router.Payload, response *router.Respon
 	}
 }
 
+// serveFileRange writes length bytes of the file from offset as a partial
+// response.
+func serveFileRange(store skyAsset.RangeReader, fileName string, size, offset, length int64, response *router.Response) {
+	reader, err := store.GetFileRangeReader(fileName, offset, length)
+	if err != nil {
+		log.Errorf("Failed to get file range reader: %v", err)
+
+		response.Err = skyerr.NewResourceFetchFailureErr("asset", fileName)
+		return
+	}
+	defer reader.Close()
+
+	response.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	response.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+	response.WriteHeader(http.StatusPartialContent)
+	if _, err := io.Copy(response, reader); err != nil {
+		log.Errorf("Error writing file range to response: %v", err)
+	}
+}
+
+// errRangeNotSatisfiable is returned by parseByteRange if the range does
+// not overlap the file.
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// parseByteRange parses the value of a Range header of a single byte
+// range, such as "bytes=0-499", "bytes=500-" or "bytes=-500", and returns
+// the offset and length of the range within a file of size bytes.
+//
+// Multiple ranges are not supported and are returned as an error, like
+// malformed ranges.
+func parseByteRange(header string, size int64) (offset int64, length int64, err error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return 0, 0, errors.New("unsupported range unit")
+	}
+	spec := strings.TrimSpace(header[len(prefix):])
+	if strings.Contains(spec, ",") {
+		return 0, 0, errors.New("multiple ranges are not supported")
+	}
+
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, 0, errors.New("malformed range")
+	}
+	startStr, endStr := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+	if startStr == "" {
+		// A suffix range specifies the length of the end of the file.
+		suffix, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, 0, errors.New("malformed range")
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, errRangeNotSatisfiable
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, suffix, nil
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errors.New("malformed range")
+	}
+	end := size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, errors.New("malformed range")
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, errRangeNotSatisfiable
+	}
+	return start, end - start + 1, nil
+}
+
 // UploadFileHandler receives and persists a file to be associated by Record.
 //
 // Example curl (PUT):
@@ -112,6 +112,14 @@ func (store *bufferedAssetStore) GetFileReader(name string) (io.ReadCloser, erro
 	return ioutil.NopCloser(store.buf), nil
 }
 
+func (store *bufferedAssetStore) GetFileRangeReader(name string, offset, length int64) (io.ReadCloser, error) {
+	data := store.buf.Bytes()[offset:]
+	if int64(len(data)) > length {
+		data = data[:length]
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
 func (store *bufferedAssetStore) PutFileReader(name string, src io.Reader, length int64, contentType string) error {
 	store.name = name
 	store.length = length
@@ -369,3 +377,105 @@ func TestGetFileHandler(t *testing.T) {
 		})
 	})
 }
+
+func TestGetFileHandlerRange(t *testing.T) {
+	Convey("GetFileHandler", t, func() {
+		assetConn := &naiveAssetConn{}
+		assetConn.savedAsset = map[string]*skydb.Asset{
+			"assetName": {
+				Name:        "assetName",
+				ContentType: "plain/text",
+				Size:        10,
+			},
+		}
+
+		store := newBufferedStore()
+		io.WriteString(store.buf, "I am a boy")
+
+		r := newmodGateway("(.+)")
+		r.Handle("GET", &GetFileHandler{
+			AssetStore: store,
+		}, func(p *router.Payload) {
+			p.DBConn = assetConn
+		})
+
+		get := func(rangeHeader string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("GET", "http://skygear.test/assetName", nil)
+			req.Header.Set("Range", rangeHeader)
+			return r.Do(req)
+		}
+
+		Convey("GET a range of file", func() {
+			resp := get("bytes=2-3")
+			So(resp.Code, ShouldEqual, http.StatusPartialContent)
+			So(resp.Body.String(), ShouldEqual, "am")
+			So(resp.Header().Get("Content-Length"), ShouldEqual, "2")
+			So(resp.Header().Get("Content-Range"), ShouldEqual, "bytes 2-3/10")
+		})
+
+		Convey("GET a suffix range of file", func() {
+			resp := get("bytes=-3")
+			So(resp.Code, ShouldEqual, http.StatusPartialContent)
+			So(resp.Body.String(), ShouldEqual, "boy")
+			So(resp.Header().Get("Content-Range"), ShouldEqual, "bytes 7-9/10")
+		})
+
+		Convey("GET whole file for multiple ranges", func() {
+			resp := get("bytes=0-1,3-4")
+			So(resp.Code, ShouldEqual, http.StatusOK)
+			So(resp.Body.String(), ShouldEqual, "I am a boy")
+			So(resp.Header().Get("Accept-Ranges"), ShouldEqual, "bytes")
+		})
+
+		Convey("errors on range after end of file", func() {
+			resp := get("bytes=10-")
+			So(resp.Code, ShouldEqual, http.StatusRequestedRangeNotSatisfiable)
+			So(resp.Header().Get("Content-Range"), ShouldEqual, "bytes */10")
+		})
+	})
+}
+
+func TestParseByteRange(t *testing.T) {
+	Convey("parseByteRange", t, func() {
+		Convey("parses range with start and end", func() {
+			offset, length, err := parseByteRange("bytes=0-499", 1000)
+			So(err, ShouldBeNil)
+			So(offset, ShouldEqual, 0)
+			So(length, ShouldEqual, 500)
+		})
+
+		Convey("parses range with end after end of file", func() {
+			offset, length, err := parseByteRange("bytes=900-1999", 1000)
+			So(err, ShouldBeNil)
+			So(offset, ShouldEqual, 900)
+			So(length, ShouldEqual, 100)
+		})
+
+		Convey("parses open-ended range", func() {
+			offset, length, err := parseByteRange("bytes=500-", 1000)
+			So(err, ShouldBeNil)
+			So(offset, ShouldEqual, 500)
+			So(length, ShouldEqual, 500)
+		})
+
+		Convey("parses suffix range", func() {
+			offset, length, err := parseByteRange("bytes=-2000", 1000)
+			So(err, ShouldBeNil)
+			So(offset, ShouldEqual, 0)
+			So(length, ShouldEqual, 1000)
+		})
+
+		Convey("errors on range not satisfiable", func() {
+			_, _, err := parseByteRange("bytes=1000-", 1000)
+			So(err, ShouldEqual, errRangeNotSatisfiable)
+		})
+
+		Convey("errors on malformed range", func() {
+			for _, header := range []string{"items=0-1", "bytes=1", "bytes=2-1", "bytes=a-b"} {
+				_, _, err := parseByteRange(header, 1000)
+				So(err, ShouldNotBeNil)
+				So(err, ShouldNotEqual, errRangeNotSatisfiable)
+			}
+		})
+	})
+}
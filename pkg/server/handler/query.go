@@ -110,10 +110,18 @@ func (parser *QueryParser) predicateOperatorFromString(operatorString string) sk
 		return skydb.Like
 	case "ilike":
 		return skydb.ILike
+	case "ieq":
+		return skydb.EqualIgnoreCase
 	case "in":
 		return skydb.In
 	case "func":
 		return skydb.Functional
+	case "any":
+		return skydb.AnyMatch
+	case "isnull":
+		return skydb.IsNull
+	case "isabsent":
+		return skydb.IsAbsent
 	default:
 		panic(fmt.Errorf("unrecognized operator = %s", operatorString))
 	}
@@ -135,6 +143,19 @@ func (parser *QueryParser) predicateFromRaw(rawPredicate []interface{}) skydb.Pr
 	}
 	if predicate.Operator == skydb.Functional {
 		predicate.Children = append(predicate.Children, parser.parseExpression(rawPredicate))
+	} else if predicate.Operator == skydb.AnyMatch {
+		if len(rawPredicate) != 3 {
+			panic(fmt.Errorf("got len(any predicate) = %v, want 3", len(rawPredicate)))
+		}
+		expr := parser.parseExpression(rawPredicate[1])
+		if expr.Type != skydb.KeyPath || strings.Contains(expr.Value.(string), ".") {
+			panic(fmt.Errorf("got any predicate operand = %v, want a key path", rawPredicate[1]))
+		}
+		subRawPredicate, ok := rawPredicate[2].([]interface{})
+		if !ok {
+			panic(fmt.Errorf("got non-predicate in any predicate"))
+		}
+		predicate.Children = append(predicate.Children, expr, parser.predicateFromRaw(subRawPredicate))
 	} else if predicate.Operator.IsCompound() {
 		for i := 1; i < len(rawPredicate); i++ {
 			subRawPredicate, ok := rawPredicate[i].([]interface{})
@@ -205,6 +226,12 @@ func (parser *QueryParser) parseFunc(s []interface{}) (f skydb.Func, err error)
 		f, err = parser.parseUserRelationFunc(s[2:])
 	case "userDiscover":
 		f, err = parser.parseUserDiscoverFunc(s[2:])
+	case "withinPolygon":
+		f, err = parser.parseWithinPolygonFunc(s[2:])
+	case "arrayLength":
+		f, err = parser.parseArrayLengthFunc(s[2:])
+	case "referenceType":
+		f, err = parser.parseReferenceTypeFunc(s[2:])
 	case "":
 		return nil, errors.New("empty function name")
 	default:
@@ -282,6 +309,82 @@ func (parser *QueryParser) parseUserDiscoverFunc(s []interface{}) (skydb.UserDis
 	}, nil
 }
 
+func (parser *QueryParser) parseWithinPolygonFunc(s []interface{}) (skydb.WithinPolygonFunc, error) {
+	emptyWithinPolygonFunc := skydb.WithinPolygonFunc{}
+	if len(s) != 2 {
+		return emptyWithinPolygonFunc, fmt.Errorf("want 2 arguments for within polygon func, got %d", len(s))
+	}
+
+	var field string
+	if err := skyconv.MapFrom(s[0], (*skyconv.MapKeyPath)(&field)); err != nil {
+		return emptyWithinPolygonFunc, fmt.Errorf("invalid key path: %v", err)
+	}
+
+	rawPolygon, ok := s[1].([]interface{})
+	if !ok {
+		return emptyWithinPolygonFunc, fmt.Errorf("got polygon's type = %T, want array", s[1])
+	}
+
+	polygon := make([]skydb.Location, len(rawPolygon))
+	for i, rawVertex := range rawPolygon {
+		if err := skyconv.MapFrom(rawVertex, (*skyconv.MapLocation)(&polygon[i])); err != nil {
+			return emptyWithinPolygonFunc, fmt.Errorf("invalid location: %v", err)
+		}
+	}
+
+	return skydb.WithinPolygonFunc{
+		Field:   field,
+		Polygon: polygon,
+	}, nil
+}
+
+func (parser *QueryParser) parseArrayLengthFunc(s []interface{}) (skydb.ArrayLengthFunc, error) {
+	emptyArrayLengthFunc := skydb.ArrayLengthFunc{}
+	if len(s) != 1 && len(s) != 2 {
+		return emptyArrayLengthFunc, fmt.Errorf("want 1 or 2 arguments for array length func, got %d", len(s))
+	}
+
+	var field string
+	if err := skyconv.MapFrom(s[0], (*skyconv.MapKeyPath)(&field)); err != nil {
+		return emptyArrayLengthFunc, fmt.Errorf("invalid key path: %v", err)
+	}
+
+	var nonArrayAsEmpty bool
+	if len(s) == 2 {
+		var ok bool
+		if nonArrayAsEmpty, ok = s[1].(bool); !ok {
+			return emptyArrayLengthFunc, fmt.Errorf("got non-array-as-empty flag's type = %T, want bool", s[1])
+		}
+	}
+
+	return skydb.ArrayLengthFunc{
+		Field:           field,
+		NonArrayAsEmpty: nonArrayAsEmpty,
+	}, nil
+}
+
+func (parser *QueryParser) parseReferenceTypeFunc(s []interface{}) (skydb.ReferenceTypeFunc, error) {
+	emptyReferenceTypeFunc := skydb.ReferenceTypeFunc{}
+	if len(s) != 2 {
+		return emptyReferenceTypeFunc, fmt.Errorf("want 2 arguments for reference type func, got %d", len(s))
+	}
+
+	var field string
+	if err := skyconv.MapFrom(s[0], (*skyconv.MapKeyPath)(&field)); err != nil {
+		return emptyReferenceTypeFunc, fmt.Errorf("invalid key path: %v", err)
+	}
+
+	recordType, ok := s[1].(string)
+	if !ok {
+		return emptyReferenceTypeFunc, fmt.Errorf("got record type's type = %T, want string", s[1])
+	}
+
+	return skydb.ReferenceTypeFunc{
+		Field: field,
+		Type:  recordType,
+	}, nil
+}
+
 func (parser *QueryParser) queryFromRaw(rawQuery map[string]interface{}, query *skydb.Query) (err skyerr.Error) {
 	defer func() {
 		// use panic to escape from inner error
@@ -342,6 +445,10 @@ func (parser *QueryParser) queryFromRaw(rawQuery map[string]interface{}, query *
 		query.GetCount = getCount
 	}
 
+	if includeDistance, ok := rawQuery["include_distance"].(bool); ok {
+		query.IncludeDistance = includeDistance
+	}
+
 	if offset, _ := rawQuery["offset"].(float64); offset > 0 {
 		query.Offset = uint64(offset)
 	}
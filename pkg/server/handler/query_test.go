@@ -126,6 +126,78 @@ func TestQueryFromRaw(t *testing.T) {
 				},
 			})
 		})
+
+		Convey("functional predicate with within polygon", func() {
+			parser := &QueryParser{
+				UserID: "USER_ID",
+			}
+			query := skydb.Query{}
+			err := parser.queryFromRaw(map[string]interface{}{
+				"record_type": "note",
+				"predicate": []interface{}{
+					"func",
+					"withinPolygon",
+					map[string]interface{}{"$type": "keypath", "$val": "location"},
+					[]interface{}{
+						map[string]interface{}{"$type": "geo", "$lng": float64(0), "$lat": float64(0)},
+						map[string]interface{}{"$type": "geo", "$lng": float64(10), "$lat": float64(0)},
+						map[string]interface{}{"$type": "geo", "$lng": float64(10), "$lat": float64(10)},
+					},
+				},
+			}, &query)
+			So(err, ShouldBeNil)
+			So(query, ShouldResemble, skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.Functional,
+					Children: []interface{}{
+						skydb.Expression{
+							Type: skydb.Function,
+							Value: skydb.WithinPolygonFunc{
+								Field: "location",
+								Polygon: []skydb.Location{
+									skydb.NewLocation(0, 0),
+									skydb.NewLocation(10, 0),
+									skydb.NewLocation(10, 10),
+								},
+							},
+						},
+					},
+				},
+			})
+		})
+
+		Convey("functional predicate with reference type", func() {
+			parser := &QueryParser{
+				UserID: "USER_ID",
+			}
+			query := skydb.Query{}
+			err := parser.queryFromRaw(map[string]interface{}{
+				"record_type": "task",
+				"predicate": []interface{}{
+					"func",
+					"referenceType",
+					map[string]interface{}{"$type": "keypath", "$val": "parent"},
+					"project",
+				},
+			}, &query)
+			So(err, ShouldBeNil)
+			So(query, ShouldResemble, skydb.Query{
+				Type: "task",
+				Predicate: skydb.Predicate{
+					Operator: skydb.Functional,
+					Children: []interface{}{
+						skydb.Expression{
+							Type: skydb.Function,
+							Value: skydb.ReferenceTypeFunc{
+								Field: "parent",
+								Type:  "project",
+							},
+						},
+					},
+				},
+			})
+		})
 	})
 
 }
@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/mitchellh/mapstructure"
@@ -80,6 +81,11 @@ func (s serializedError) MarshalJSON() ([]byte, error) {
 type recordSavePayload struct {
 	Atomic bool `mapstructure:"atomic"`
 
+	// ConflictPolicy is the policy resolving conflicts of records saved
+	// conditionally. A record is saved conditionally if it comes with
+	// `_updated_at`, and optionally `_modified_at` for last_write_wins.
+	ConflictPolicy string `mapstructure:"conflict_policy"`
+
 	// RawMaps stores the original incoming `records`.
 	RawMaps []map[string]interface{} `mapstructure:"records"`
 
@@ -90,6 +96,10 @@ type recordSavePayload struct {
 	// Records contains the successfully de-serialized record
 	Records []*skydb.Record
 
+	// ClientVersions contains the version information of records saved
+	// conditionally
+	ClientVersions map[skydb.RecordID]clientVersion
+
 	// Errs is the array of de-serialization errors
 	Errs []skyerr.Error
 
@@ -122,10 +132,15 @@ func (payload *recordSavePayload) Validate() skyerr.Error {
 		return skyerr.NewInvalidArgument("expected list of record", []string{"records"})
 	}
 
+	if !conflictPolicy(payload.ConflictPolicy).IsValid() {
+		return skyerr.NewInvalidArgument("unknown conflict policy", []string{"conflict_policy"})
+	}
+
 	payload.Clean = true
 	payload.Errs = []skyerr.Error{}
 	payload.IncomingItems = []interface{}{}
 	payload.Records = []*skydb.Record{}
+	payload.ClientVersions = map[skydb.RecordID]clientVersion{}
 	for _, recordMap := range payload.RawMaps {
 		var record skydb.Record
 		if err := payload.InitRecord(recordMap, &record); err != nil {
@@ -182,6 +197,14 @@ func (payload *recordSavePayload) InitRecord(m map[string]interface{}, r *skydb.
 		r.ACL = acl
 	}
 
+	if payload.ConflictPolicy != "" {
+		if version, ok, err := parseClientVersion(m); err != nil {
+			return err
+		} else if ok {
+			payload.ClientVersions[r.ID] = version
+		}
+	}
+
 	payload.purgeReservedKey(m)
 	data := map[string]interface{}{}
 	if err := (*skyconv.MapData)(&data).FromMap(m); err != nil {
@@ -192,6 +215,39 @@ func (payload *recordSavePayload) InitRecord(m map[string]interface{}, r *skydb.
 	return nil
 }
 
+func parseClientVersion(m map[string]interface{}) (version clientVersion, ok bool, err skyerr.Error) {
+	rawBase, ok := m["_updated_at"]
+	if !ok || rawBase == nil {
+		return clientVersion{}, false, nil
+	}
+
+	if version.BaseUpdatedAt, err = parseVersionTime(rawBase, "_updated_at"); err != nil {
+		return clientVersion{}, false, err
+	}
+
+	if rawModified, ok := m["_modified_at"]; ok && rawModified != nil {
+		if version.ModifiedAt, err = parseVersionTime(rawModified, "_modified_at"); err != nil {
+			return clientVersion{}, false, err
+		}
+	}
+
+	return version, true, nil
+}
+
+func parseVersionTime(i interface{}, key string) (time.Time, skyerr.Error) {
+	timeStr, ok := i.(string)
+	if !ok {
+		return time.Time{}, skyerr.NewInvalidArgument(key+" must be a datetime string", []string{key})
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, timeStr)
+	if err != nil {
+		return time.Time{}, skyerr.NewInvalidArgument(key+" must be a datetime string", []string{key})
+	}
+
+	return t.In(time.UTC), nil
+}
+
 /*
 RecordSaveHandler is dummy implementation on save/modify Records
 curl -X POST -H "Content-Type: application/json" \
@@ -282,15 +338,17 @@ func (h *RecordSaveHandler) Handle(payload *router.Payload, response *router.Res
 	log.Debugf("Working with accessModel %v", h.AccessModel)
 
 	req := recordModifyRequest{
-		Db:            payload.Database,
-		Conn:          payload.DBConn,
-		AssetStore:    h.AssetStore,
-		HookRegistry:  h.HookRegistry,
-		UserInfo:      payload.UserInfo,
-		RecordsToSave: p.Records,
-		Atomic:        p.Atomic,
-		WithMasterKey: payload.HasMasterKey(),
-		Context:       payload.Context,
+		Db:             payload.Database,
+		Conn:           payload.DBConn,
+		AssetStore:     h.AssetStore,
+		HookRegistry:   h.HookRegistry,
+		UserInfo:       payload.UserInfo,
+		RecordsToSave:  p.Records,
+		ConflictPolicy: conflictPolicy(p.ConflictPolicy),
+		ClientVersions: p.ClientVersions,
+		Atomic:         p.Atomic,
+		WithMasterKey:  payload.HasMasterKey(),
+		Context:        payload.Context,
 	}
 	resp := recordModifyResponse{
 		ErrMap: map[skydb.RecordID]skyerr.Error{},
@@ -458,7 +516,23 @@ func (h *RecordFetchHandler) Handle(payload *router.Payload, response *router.Re
 				)
 			}
 		} else {
-			if payload.HasMasterKey() || record.Accessible(payload.UserInfo, skydb.ReadLevel) {
+			accessible := payload.HasMasterKey()
+			if !accessible {
+				var err error
+				accessible, err = recordAccessible(db, &record, payload.UserInfo, skydb.ReadLevel)
+				if err != nil {
+					results[i] = newSerializedError(
+						recordID.String(),
+						skyerr.NewResourceFetchFailureErr("record", recordID.String()),
+					)
+					continue
+				}
+			}
+
+			if accessible {
+				if !payload.HasMasterKey() {
+					record.MaskFields(db.FieldMasks(record.ID.Type), payload.UserInfo)
+				}
 				injectSigner(&record, h.AssetStore)
 				results[i] = (*skyconv.JSONRecord)(&record)
 			} else {
@@ -554,7 +628,10 @@ func (h *RecordQueryHandler) Handle(payload *router.Payload, response *router.Re
 	db := payload.Database
 
 	results, err := db.Query(&p.Query)
-	if err != nil {
+	if err == skydb.ErrQueryTimeout {
+		response.Err = skyerr.NewError(skyerr.QueryTimeout, err.Error())
+		return
+	} else if err != nil {
 		response.Err = skyerr.MakeError(err)
 		return
 	}
@@ -574,6 +651,12 @@ func (h *RecordQueryHandler) Handle(payload *router.Payload, response *router.Re
 	eagers := eagerIDs(db, records, p.Query)
 	eagerRecords := doQueryEager(db, eagers)
 
+	maskFields := func(record *skydb.Record) {
+		if !payload.HasMasterKey() {
+			record.MaskFields(db.FieldMasks(record.ID.Type), payload.UserInfo)
+		}
+	}
+
 	output := make([]interface{}, len(records))
 	for i := range records {
 		record := records[i]
@@ -590,6 +673,7 @@ func (h *RecordQueryHandler) Handle(payload *router.Payload, response *router.Re
 				id := eagers[keyPath][i]
 				eagerRecord := eagerRecords[keyPath][id.Key]
 				if eagerRecord != nil {
+					maskFields(eagerRecord)
 					injectSigner(eagerRecord, h.AssetStore)
 					transientValue = (*skyconv.JSONRecord)(eagerRecord)
 				}
@@ -601,6 +685,7 @@ func (h *RecordQueryHandler) Handle(payload *router.Payload, response *router.Re
 			record.Transient[transientKey] = transientValue
 		}
 
+		maskFields(&record)
 		injectSigner(&record, h.AssetStore)
 		output[i] = (*skyconv.JSONRecord)(&record)
 	}
@@ -15,6 +15,7 @@
 package handler
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -71,8 +72,9 @@ func TestRecordDeleteHandler(t *testing.T) {
 		So(db.Save(&noteReadonly), ShouldBeNil)
 		So(db.Save(&user), ShouldBeNil)
 
+		var database skydb.Database = db
 		router := handlertest.NewSingleRouteRouter(&RecordDeleteHandler{}, func(p *router.Payload) {
-			p.Database = db
+			p.Database = database
 			p.UserInfo = &skydb.UserInfo{
 				ID: "user0",
 			}
@@ -130,6 +132,222 @@ func TestRecordDeleteHandler(t *testing.T) {
 			}`)
 		})
 
+		Convey("returns error when record is referenced", func() {
+			database = referencedDatabase{db}
+			resp := router.POST(`{
+	"ids": ["note/0"]
+}`)
+			So(resp.Body.Bytes(), ShouldEqualJSON, `{
+	"result": [{
+		"_id": "note/0",
+		"_type": "error",
+		"code": 113,
+		"message": "skydb: Record is referenced by other records",
+		"name": "ConstraintViolated"
+	}]
+}`)
+		})
+	})
+}
+
+// referencedDatabase is a Database in which every record is referenced
+// by other records with the DeleteRestrict policy.
+type referencedDatabase struct {
+	*skydbtest.MapDB
+}
+
+func (db referencedDatabase) Delete(id skydb.RecordID) error {
+	return skydb.ErrRecordReferenced
+}
+
+func TestRecordDefaultACL(t *testing.T) {
+	timeNow = func() time.Time { return ZeroTime }
+	defer func() {
+		timeNow = timeNowUTC
+	}()
+
+	Convey("Database with default ACL", t, func() {
+		db := skydbtest.NewMapDB()
+		db.SetDefaultACL(skydb.RecordACL{
+			skydb.NewRecordACLEntryPublic(skydb.ReadLevel),
+		})
+		So(db.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("note", "shared"),
+			OwnerID: "owner",
+		}), ShouldBeNil)
+		So(db.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("note", "open"),
+			OwnerID: "owner",
+			ACL: skydb.RecordACL{
+				skydb.NewRecordACLEntryPublic(skydb.WriteLevel),
+			},
+		}), ShouldBeNil)
+		So(db.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("note", "mine"),
+			OwnerID: "user0",
+		}), ShouldBeNil)
+
+		injectDBFunc := func(p *router.Payload) {
+			p.DBConn = skydbtest.NewMapConn()
+			p.Database = db
+			p.UserInfo = &skydb.UserInfo{
+				ID: "user0",
+			}
+		}
+
+		Convey("denies modifying record without ACL", func() {
+			resp := handlertest.NewSingleRouteRouter(&RecordSaveHandler{}, injectDBFunc).POST(`{
+				"records": [{
+					"_id": "note/shared",
+					"content": "hello"
+				}]
+			}`)
+			So(resp.Body.Bytes(), ShouldEqualJSON, `{
+				"result": [{
+					"_id": "note/shared",
+					"_type": "error",
+					"code": 102,
+					"message": "no permission to modify",
+					"name": "PermissionDenied"
+				}]
+			}`)
+		})
+
+		Convey("applies record ACL over default ACL and grants owner", func() {
+			resp := handlertest.NewSingleRouteRouter(&RecordDeleteHandler{}, injectDBFunc).POST(`{
+				"ids": ["note/shared", "note/open", "note/mine"]
+			}`)
+			So(resp.Body.Bytes(), ShouldEqualJSON, `{
+				"result": [
+					{"_id": "note/shared", "_type": "error", "code": 102, "message": "no permission to delete", "name": "PermissionDenied"},
+					{"_id": "note/open", "_type": "record"},
+					{"_id": "note/mine", "_type": "record"}
+				]
+			}`)
+		})
+
+		Convey("denies reading record without ACL", func() {
+			db.SetDefaultACL(skydb.RecordACL{
+				skydb.NewRecordACLEntryRole("admin", skydb.ReadLevel),
+			})
+			resp := handlertest.NewSingleRouteRouter(&RecordFetchHandler{}, injectDBFunc).POST(`{
+				"ids": ["note/shared"]
+			}`)
+			So(resp.Body.Bytes(), ShouldEqualJSON, `{
+				"result": [{
+					"_id": "note/shared",
+					"_type": "error",
+					"code": 102,
+					"message": "no permission to read",
+					"name": "PermissionDenied"
+				}]
+			}`)
+		})
+	})
+}
+
+func TestRecordFetchFieldMask(t *testing.T) {
+	Convey("Database with field masks", t, func() {
+		db := skydbtest.NewMapDB()
+		db.FieldMaskMap = map[string]map[string]skydb.FieldMask{
+			"employee": {
+				"ssn": {
+					Roles: []string{"hr"},
+				},
+				"notes": {
+					Roles:       []string{"hr", "manager"},
+					Replacement: "***",
+				},
+			},
+		}
+		So(db.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("employee", "john"),
+			OwnerID: "john",
+			Data: map[string]interface{}{
+				"name":  "John",
+				"ssn":   "078-05-1120",
+				"notes": "on probation",
+			},
+		}), ShouldBeNil)
+
+		fetch := func(userinfo *skydb.UserInfo) []byte {
+			r := handlertest.NewSingleRouteRouter(&RecordFetchHandler{}, func(p *router.Payload) {
+				p.DBConn = skydbtest.NewMapConn()
+				p.Database = db
+				p.UserInfo = userinfo
+			})
+			return r.POST(`{"ids": ["employee/john"]}`).Body.Bytes()
+		}
+
+		Convey("returns masked fields to privileged reader", func() {
+			So(fetch(&skydb.UserInfo{
+				ID:    "admin",
+				Roles: []string{"hr"},
+			}), ShouldEqualJSON, `{
+				"result": [{
+					"_id": "employee/john",
+					"_type": "record",
+					"_access": null,
+					"_ownerID": "john",
+					"name": "John",
+					"ssn": "078-05-1120",
+					"notes": "on probation"
+				}]
+			}`)
+		})
+
+		Convey("returns masked fields to record owner", func() {
+			So(fetch(&skydb.UserInfo{
+				ID: "john",
+			}), ShouldEqualJSON, `{
+				"result": [{
+					"_id": "employee/john",
+					"_type": "record",
+					"_access": null,
+					"_ownerID": "john",
+					"name": "John",
+					"ssn": "078-05-1120",
+					"notes": "on probation"
+				}]
+			}`)
+		})
+
+		Convey("masks fields from unprivileged reader", func() {
+			So(fetch(&skydb.UserInfo{
+				ID:    "jane",
+				Roles: []string{"manager"},
+			}), ShouldEqualJSON, `{
+				"result": [{
+					"_id": "employee/john",
+					"_type": "record",
+					"_access": null,
+					"_ownerID": "john",
+					"name": "John",
+					"notes": "on probation"
+				}]
+			}`)
+		})
+
+		Convey("masks fields from unauthenticated reader", func() {
+			So(fetch(nil), ShouldEqualJSON, `{
+				"result": [{
+					"_id": "employee/john",
+					"_type": "record",
+					"_access": null,
+					"_ownerID": "john",
+					"name": "John",
+					"notes": "***"
+				}]
+			}`)
+		})
+
+		Convey("keeps stored record intact", func() {
+			fetch(nil)
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("employee", "john"), &record), ShouldBeNil)
+			So(record.Data["ssn"], ShouldEqual, "078-05-1120")
+			So(record.Data["notes"], ShouldEqual, "on probation")
+		})
 	})
 }
 
@@ -302,6 +520,37 @@ func TestRecordSaveHandler(t *testing.T) {
 				}]
 			}`)
 		})
+		Convey("Returns all field type conflicts among records", func() {
+			resp := r.POST(`{
+				"records": [{
+					"_id": "note/id1",
+					"title": "string",
+					"order": 1
+				}, {
+					"_id": "note/id2",
+					"title": 1,
+					"order": "string"
+				}]
+			}`)
+
+			var body struct {
+				Error struct {
+					Name string `json:"name"`
+					Info struct {
+						Errors []skydb.FieldError `json:"errors"`
+					} `json:"info"`
+				} `json:"error"`
+			}
+			So(json.Unmarshal(resp.Body.Bytes(), &body), ShouldBeNil)
+			So(body.Error.Name, ShouldEqual, "IncompatibleSchema")
+			fieldErrs := body.Error.Info.Errors
+			So(len(fieldErrs), ShouldEqual, 2)
+			So(fieldErrs[0].Field, ShouldEqual, "order")
+			So(fieldErrs[0].Code, ShouldEqual, skydb.FieldTypeConflict)
+			So(fieldErrs[1].Field, ShouldEqual, "title")
+			So(fieldErrs[1].Code, ShouldEqual, skydb.FieldTypeConflict)
+		})
+
 		Convey("REGRESSION #119: Returns record invalid error if _id is missing or malformated", func() {
 			resp := r.POST(`{
 				"records": [{
@@ -546,6 +795,14 @@ func (db bogusFieldDatabase) Save(record *skydb.Record) error {
 	return db.SaveFunc(record)
 }
 
+func (db bogusFieldDatabase) SaveWithResult(record *skydb.Record) (skydb.SaveResult, error) {
+	return skydb.SaveResult{Record: record}, db.SaveFunc(record)
+}
+
+func (db bogusFieldDatabase) DefaultACL() (skydb.RecordACL, error) {
+	return nil, nil
+}
+
 func TestRecordSaveBogusField(t *testing.T) {
 	timeNow = func() time.Time {
 		return ZeroTime
@@ -713,6 +970,10 @@ type queryResultsDatabase struct {
 
 func (db *queryResultsDatabase) IsReadOnly() bool { return false }
 
+func (db *queryResultsDatabase) FieldMasks(recordType string) map[string]skydb.FieldMask {
+	return nil
+}
+
 func (db *queryResultsDatabase) ID() string {
 	if db.databaseID == "" {
 		return skydb.PublicDatabaseIdentifier
@@ -774,6 +1035,79 @@ func TestRecordQueryResults(t *testing.T) {
 	})
 }
 
+func TestRecordQueryWithDistance(t *testing.T) {
+	Convey("Given a Database with records of distance", t, func() {
+		record := skydb.Record{
+			ID: skydb.NewRecordID("note", "0"),
+			Transient: map[string]interface{}{
+				"_distance": float64(157.25),
+			},
+		}
+
+		db := &queryResultsDatabase{}
+		db.records = []skydb.Record{record}
+
+		r := handlertest.NewSingleRouteRouter(&RecordQueryHandler{}, func(p *router.Payload) {
+			p.Database = db
+		})
+
+		Convey("returns distance of each record", func() {
+			resp := r.POST(`{
+				"record_type": "note",
+				"predicate": [
+					"lt",
+					["func", "distance", {"$type": "keypath", "$val": "location"}, {"$type": "geo", "$lng": 1, "$lat": 2}],
+					500
+				],
+				"include_distance": true
+			}`)
+
+			So(resp.Body.String(), ShouldEqualJSON, `{
+				"result": [{
+					"_type": "record",
+					"_id": "note/0",
+					"_access": null,
+					"_transient": {
+						"_distance": 157.25
+					}
+				}]
+			}`)
+			So(resp.Code, ShouldEqual, 200)
+		})
+	})
+}
+
+type timeoutQueryDatabase struct {
+	skydb.Database
+}
+
+func (db *timeoutQueryDatabase) Query(query *skydb.Query) (*skydb.Rows, error) {
+	return nil, skydb.ErrQueryTimeout
+}
+
+func TestRecordQueryTimeout(t *testing.T) {
+	Convey("Given a Database timing out queries", t, func() {
+		r := handlertest.NewSingleRouteRouter(&RecordQueryHandler{}, func(p *router.Payload) {
+			p.Database = &timeoutQueryDatabase{}
+		})
+
+		Convey("returns QueryTimeout error", func() {
+			resp := r.POST(`{
+				"record_type": "note"
+			}`)
+
+			So(resp.Body.String(), ShouldEqualJSON, `{
+				"error": {
+					"code": 122,
+					"message": "skydb: Query exceeded the maximum query duration",
+					"name": "QueryTimeout"
+				}
+			}`)
+			So(resp.Code, ShouldEqual, 504)
+		})
+	})
+}
+
 func TestRecordQuery(t *testing.T) {
 	Convey("Given a Database", t, func() {
 		db := &queryDatabase{}
@@ -993,28 +1327,190 @@ func TestRecordQuery(t *testing.T) {
 
 			So(response.Err, ShouldBeNil)
 			So(db.lastquery.Predicate, ShouldResemble, skydb.Predicate{
-				Operator: skydb.And,
+				Operator: skydb.And,
+				Children: []interface{}{
+					skydb.Predicate{
+						Operator: skydb.Equal,
+						Children: []interface{}{
+							skydb.Expression{skydb.KeyPath, "content"},
+							skydb.Expression{skydb.Literal, "text"},
+						},
+					},
+					skydb.Predicate{
+						Operator: skydb.GreaterThan,
+						Children: []interface{}{
+							skydb.Expression{skydb.KeyPath, "noteOrder"},
+							skydb.Expression{skydb.Literal, float64(1)},
+						},
+					},
+					skydb.Predicate{
+						Operator: skydb.NotEqual,
+						Children: []interface{}{
+							skydb.Expression{skydb.KeyPath, "content"},
+							skydb.Expression{skydb.Literal, nil},
+						},
+					},
+				},
+			})
+		})
+
+		Convey("Queries records by case-insensitive equality", func() {
+			payload := router.Payload{
+				Data: map[string]interface{}{
+					"record_type": "note",
+					"predicate": []interface{}{
+						"ieq",
+						map[string]interface{}{
+							"$type": "keypath",
+							"$val":  "username",
+						},
+						"Alice",
+					},
+				},
+				Database: db,
+			}
+			response := router.Response{}
+
+			handler := &RecordQueryHandler{}
+			handler.Handle(&payload, &response)
+
+			So(response.Err, ShouldBeNil)
+			So(db.lastquery.Predicate, ShouldResemble, skydb.Predicate{
+				Operator: skydb.EqualIgnoreCase,
+				Children: []interface{}{
+					skydb.Expression{Type: skydb.KeyPath, Value: "username"},
+					skydb.Expression{Type: skydb.Literal, Value: "Alice"},
+				},
+			})
+		})
+
+		Convey("Queries records by array elements", func() {
+			payload := router.Payload{
+				Data: map[string]interface{}{
+					"record_type": "order",
+					"predicate": []interface{}{
+						"any",
+						map[string]interface{}{
+							"$type": "keypath",
+							"$val":  "items",
+						},
+						[]interface{}{
+							"gt",
+							map[string]interface{}{
+								"$type": "keypath",
+								"$val":  "quantity",
+							},
+							float64(2),
+						},
+					},
+				},
+				Database: db,
+			}
+			response := router.Response{}
+
+			handler := &RecordQueryHandler{}
+			handler.Handle(&payload, &response)
+
+			So(response.Err, ShouldBeNil)
+			So(db.lastquery.Predicate, ShouldResemble, skydb.Predicate{
+				Operator: skydb.AnyMatch,
+				Children: []interface{}{
+					skydb.Expression{Type: skydb.KeyPath, Value: "items"},
+					skydb.Predicate{
+						Operator: skydb.GreaterThan,
+						Children: []interface{}{
+							skydb.Expression{Type: skydb.KeyPath, Value: "quantity"},
+							skydb.Expression{Type: skydb.Literal, Value: float64(2)},
+						},
+					},
+				},
+			})
+		})
+
+		Convey("Rejects array element predicate on non-keypath", func() {
+			payload := router.Payload{
+				Data: map[string]interface{}{
+					"record_type": "order",
+					"predicate": []interface{}{
+						"any",
+						"items",
+						[]interface{}{
+							"eq",
+							map[string]interface{}{
+								"$type": "keypath",
+								"$val":  "quantity",
+							},
+							float64(2),
+						},
+					},
+				},
+				Database: db,
+			}
+			response := router.Response{}
+
+			handler := &RecordQueryHandler{}
+			handler.Handle(&payload, &response)
+
+			So(response.Err, ShouldNotBeNil)
+		})
+
+		Convey("Queries records with null fields", func() {
+			payload := router.Payload{
+				Data: map[string]interface{}{
+					"record_type": "note",
+					"predicate": []interface{}{
+						"isnull",
+						map[string]interface{}{
+							"$type": "keypath",
+							"$val":  "content",
+						},
+					},
+				},
+				Database: db,
+			}
+			response := router.Response{}
+
+			handler := &RecordQueryHandler{}
+			handler.Handle(&payload, &response)
+
+			So(response.Err, ShouldBeNil)
+			So(db.lastquery.Predicate, ShouldResemble, skydb.Predicate{
+				Operator: skydb.IsNull,
+				Children: []interface{}{
+					skydb.Expression{
+						Type:  skydb.KeyPath,
+						Value: "content",
+					},
+				},
+			})
+		})
+
+		Convey("Queries records with absent fields", func() {
+			payload := router.Payload{
+				Data: map[string]interface{}{
+					"record_type": "note",
+					"predicate": []interface{}{
+						"isabsent",
+						map[string]interface{}{
+							"$type": "keypath",
+							"$val":  "content",
+						},
+					},
+				},
+				Database: db,
+			}
+			response := router.Response{}
+
+			handler := &RecordQueryHandler{}
+			handler.Handle(&payload, &response)
+
+			So(response.Err, ShouldBeNil)
+			So(db.lastquery.Predicate, ShouldResemble, skydb.Predicate{
+				Operator: skydb.IsAbsent,
 				Children: []interface{}{
-					skydb.Predicate{
-						Operator: skydb.Equal,
-						Children: []interface{}{
-							skydb.Expression{skydb.KeyPath, "content"},
-							skydb.Expression{skydb.Literal, "text"},
-						},
-					},
-					skydb.Predicate{
-						Operator: skydb.GreaterThan,
-						Children: []interface{}{
-							skydb.Expression{skydb.KeyPath, "noteOrder"},
-							skydb.Expression{skydb.Literal, float64(1)},
-						},
-					},
-					skydb.Predicate{
-						Operator: skydb.NotEqual,
-						Children: []interface{}{
-							skydb.Expression{skydb.KeyPath, "content"},
-							skydb.Expression{skydb.Literal, nil},
-						},
+					skydb.Expression{
+						Type:  skydb.KeyPath,
+						Value: "content",
 					},
 				},
 			})
@@ -1065,6 +1561,47 @@ func TestRecordQuery(t *testing.T) {
 			})
 		})
 
+		Convey("Queries records by array length func", func() {
+			payload := router.Payload{
+				Data: map[string]interface{}{
+					"record_type": "note",
+					"predicate": []interface{}{
+						"gt",
+						[]interface{}{
+							"func",
+							"arrayLength",
+							map[string]interface{}{
+								"$type": "keypath",
+								"$val":  "items",
+							},
+							true,
+						},
+						float64(3),
+					},
+				},
+				Database: db,
+			}
+			response := router.Response{}
+
+			handler := &RecordQueryHandler{}
+			handler.Handle(&payload, &response)
+
+			So(response.Err, ShouldBeNil)
+			So(db.lastquery.Predicate, ShouldResemble, skydb.Predicate{
+				Operator: skydb.GreaterThan,
+				Children: []interface{}{
+					skydb.Expression{
+						Type: skydb.Function,
+						Value: skydb.ArrayLengthFunc{
+							Field:           "items",
+							NonArrayAsEmpty: true,
+						},
+					},
+					skydb.Expression{Type: skydb.Literal, Value: float64(3)},
+				},
+			})
+		})
+
 		Convey("Return calculated distance", func() {
 			payload := router.Payload{
 				Data: map[string]interface{}{
@@ -1104,6 +1641,55 @@ func TestRecordQuery(t *testing.T) {
 			})
 		})
 
+		Convey("Return distance from location of geo query", func() {
+			payload := router.Payload{
+				Data: map[string]interface{}{
+					"record_type": "note",
+					"predicate": []interface{}{
+						"lt",
+						[]interface{}{
+							"func",
+							"distance",
+							map[string]interface{}{
+								"$type": "keypath",
+								"$val":  "location",
+							},
+							map[string]interface{}{
+								"$type": "geo",
+								"$lng":  float64(1),
+								"$lat":  float64(2),
+							},
+						},
+						float64(500),
+					},
+					"sort": []interface{}{
+						[]interface{}{
+							map[string]interface{}{
+								"$type": "keypath",
+								"$val":  "_distance",
+							},
+							"asc",
+						},
+					},
+					"include_distance": true,
+				},
+				Database: db,
+			}
+			response := router.Response{}
+
+			handler := &RecordQueryHandler{}
+			handler.Handle(&payload, &response)
+
+			So(response.Err, ShouldBeNil)
+			So(db.lastquery.IncludeDistance, ShouldBeTrue)
+			So(db.lastquery.Sorts, ShouldResemble, []skydb.Sort{
+				{
+					KeyPath: "_distance",
+					Order:   skydb.Ascending,
+				},
+			})
+		})
+
 		Convey("Return records with desired keys only", func() {
 			payload := router.Payload{
 				Data: map[string]interface{}{
@@ -1243,6 +1829,12 @@ func (db *singleRecordDatabase) Save(record *skydb.Record) error {
 	return nil
 }
 
+func (db *singleRecordDatabase) SaveWithResult(record *skydb.Record) (skydb.SaveResult, error) {
+	previous := db.record
+	*record = db.record
+	return skydb.SaveResult{Record: record, Previous: &previous}, nil
+}
+
 func (db *singleRecordDatabase) QueryCount(query *skydb.Query) (uint64, error) {
 	return uint64(1), nil
 }
@@ -1255,6 +1847,14 @@ func (db *singleRecordDatabase) Extend(recordType string, schema skydb.RecordSch
 	return false, nil
 }
 
+func (db *singleRecordDatabase) DefaultACL() (skydb.RecordACL, error) {
+	return nil, nil
+}
+
+func (db *singleRecordDatabase) FieldMasks(recordType string) map[string]skydb.FieldMask {
+	return nil
+}
+
 func TestRecordOwnerIDSerialization(t *testing.T) {
 	timeNow = func() time.Time { return ZeroTime }
 	defer func() {
@@ -1417,6 +2017,194 @@ func TestRecordMetaData(t *testing.T) {
 	})
 }
 
+func TestRecordSaveConflictPolicy(t *testing.T) {
+	Convey("RecordSaveHandler with conflict policy", t, func() {
+		db := skydbtest.NewMapDB()
+		conn := skydbtest.NewMapConn()
+		timeNow = func() time.Time { return time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC) }
+		defer func() {
+			timeNow = timeNowUTC
+		}()
+
+		r := handlertest.NewSingleRouteRouter(&RecordSaveHandler{}, func(payload *router.Payload) {
+			payload.DBConn = conn
+			payload.Database = db
+			payload.UserInfoID = "requestUserID"
+			payload.UserInfo = &skydb.UserInfo{
+				ID: "requestUserID",
+			}
+		})
+
+		// the server record is updated after the client fetched it
+		// at 15:04:02
+		db.Save(&skydb.Record{
+			ID:        skydb.NewRecordID("note", "id"),
+			OwnerID:   "requestUserID",
+			CreatedAt: time.Date(2006, 1, 2, 15, 4, 1, 0, time.UTC),
+			CreatorID: "creatorID",
+			UpdatedAt: time.Date(2006, 1, 2, 15, 4, 3, 0, time.UTC),
+			UpdaterID: "updaterID",
+			Data: map[string]interface{}{
+				"content": "server",
+			},
+		})
+
+		serverResult := `{
+			"result": [{
+				"_id": "note/id",
+				"_type": "record",
+				"_access": null,
+				"_ownerID": "requestUserID",
+				"_created_at": "2006-01-02T15:04:01Z",
+				"_created_by": "creatorID",
+				"_updated_at": "2006-01-02T15:04:03Z",
+				"_updated_by": "updaterID",
+				"content": "server"
+			}]
+		}`
+		clientResult := `{
+			"result": [{
+				"_id": "note/id",
+				"_type": "record",
+				"_access": null,
+				"_ownerID": "requestUserID",
+				"_created_at": "2006-01-02T15:04:01Z",
+				"_created_by": "creatorID",
+				"_updated_at": "2006-01-02T15:04:05Z",
+				"_updated_by": "requestUserID",
+				"content": "client"
+			}]
+		}`
+
+		getContent := func() interface{} {
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id"), &record), ShouldBeNil)
+			return record.Data["content"]
+		}
+
+		Convey("keeps server record with server_wins", func() {
+			resp := r.POST(`{
+				"conflict_policy": "server_wins",
+				"records": [{
+					"_id": "note/id",
+					"_updated_at": "2006-01-02T15:04:02Z",
+					"content": "client"
+				}]
+			}`)
+			So(resp.Body.String(), ShouldEqualJSON, serverResult)
+			So(getContent(), ShouldEqual, "server")
+		})
+
+		Convey("saves client change with client_wins", func() {
+			resp := r.POST(`{
+				"conflict_policy": "client_wins",
+				"records": [{
+					"_id": "note/id",
+					"_updated_at": "2006-01-02T15:04:02Z",
+					"content": "client"
+				}]
+			}`)
+			So(resp.Body.String(), ShouldEqualJSON, clientResult)
+			So(getContent(), ShouldEqual, "client")
+		})
+
+		Convey("saves later client change with last_write_wins", func() {
+			resp := r.POST(`{
+				"conflict_policy": "last_write_wins",
+				"records": [{
+					"_id": "note/id",
+					"_updated_at": "2006-01-02T15:04:02Z",
+					"_modified_at": "2006-01-02T15:04:04Z",
+					"content": "client"
+				}]
+			}`)
+			So(resp.Body.String(), ShouldEqualJSON, clientResult)
+			So(getContent(), ShouldEqual, "client")
+		})
+
+		Convey("keeps later server record with last_write_wins", func() {
+			resp := r.POST(`{
+				"conflict_policy": "last_write_wins",
+				"records": [{
+					"_id": "note/id",
+					"_updated_at": "2006-01-02T15:04:02Z",
+					"_modified_at": "2006-01-02T15:04:02Z",
+					"content": "client"
+				}]
+			}`)
+			So(resp.Body.String(), ShouldEqualJSON, serverResult)
+			So(getContent(), ShouldEqual, "server")
+		})
+
+		Convey("saves client change without conflict", func() {
+			resp := r.POST(`{
+				"conflict_policy": "server_wins",
+				"records": [{
+					"_id": "note/id",
+					"_updated_at": "2006-01-02T15:04:03Z",
+					"content": "client"
+				}]
+			}`)
+			So(resp.Body.String(), ShouldEqualJSON, clientResult)
+			So(getContent(), ShouldEqual, "client")
+		})
+
+		Convey("does not overwrite server record updated after fetch", func() {
+			racingDB := &racingUpdateDB{db}
+			r := handlertest.NewSingleRouteRouter(&RecordSaveHandler{}, func(payload *router.Payload) {
+				payload.DBConn = conn
+				payload.Database = racingDB
+				payload.UserInfoID = "requestUserID"
+				payload.UserInfo = &skydb.UserInfo{
+					ID: "requestUserID",
+				}
+			})
+
+			resp := r.POST(`{
+				"conflict_policy": "client_wins",
+				"records": [{
+					"_id": "note/id",
+					"_updated_at": "2006-01-02T15:04:03Z",
+					"content": "client"
+				}]
+			}`)
+			So(resp.Body.String(), ShouldContainSubstring, `"name":"ConstraintViolated"`)
+			So(getContent(), ShouldEqual, "concurrent")
+		})
+
+		Convey("rejects unknown conflict policy", func() {
+			resp := r.POST(`{
+				"conflict_policy": "unknown",
+				"records": [{
+					"_id": "note/id",
+					"content": "client"
+				}]
+			}`)
+			So(resp.Code, ShouldEqual, 400)
+			So(getContent(), ShouldEqual, "server")
+		})
+	})
+}
+
+// racingUpdateDB updates the record after it is fetched, as if by
+// another writer.
+type racingUpdateDB struct {
+	*skydbtest.MapDB
+}
+
+func (db *racingUpdateDB) Get(id skydb.RecordID, record *skydb.Record) error {
+	if err := db.MapDB.Get(id, record); err != nil {
+		return err
+	}
+
+	concurrent := *record
+	concurrent.UpdatedAt = concurrent.UpdatedAt.Add(time.Second)
+	concurrent.Data = map[string]interface{}{
+		"content": "concurrent",
+	}
+	return db.MapDB.Save(&concurrent)
+}
+
 type urlOnlyAssetStore struct{}
 
 func (s *urlOnlyAssetStore) GetFileReader(name string) (io.ReadCloser, error) {
@@ -1527,6 +2315,10 @@ type referencedRecordDatabase struct {
 
 func (db *referencedRecordDatabase) IsReadOnly() bool { return false }
 
+func (db *referencedRecordDatabase) FieldMasks(recordType string) map[string]skydb.FieldMask {
+	return nil
+}
+
 func (db *referencedRecordDatabase) ID() string {
 	if db.databaseID == "" {
 		return skydb.PublicDatabaseIdentifier
@@ -1571,6 +2363,10 @@ func (db *referencedRecordDatabase) Save(record *skydb.Record) error {
 	return nil
 }
 
+func (db *referencedRecordDatabase) SaveWithResult(record *skydb.Record) (skydb.SaveResult, error) {
+	return skydb.SaveResult{Record: record}, nil
+}
+
 func (db *referencedRecordDatabase) QueryCount(query *skydb.Query) (uint64, error) {
 	return uint64(1), nil
 }
@@ -1955,6 +2751,43 @@ func TestHookExecution(t *testing.T) {
 			So(called, ShouldBeTrue)
 		})
 
+		Convey("AfterSave should be fed record replaced by the save", func() {
+			racingDB := &racingUpdateDB{db}
+			r := handlertest.NewSingleRouteRouter(&RecordSaveHandler{
+				HookRegistry: registry,
+			}, func(p *router.Payload) {
+				p.DBConn = conn
+				p.Database = racingDB
+				p.UserInfo = &skydb.UserInfo{
+					ID: "user0",
+				}
+			})
+
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("record", "id"),
+				OwnerID: "user0",
+				Data: map[string]interface{}{
+					"content": "old",
+				},
+			}), ShouldBeNil)
+
+			var previous *skydb.Record
+			registry.Register(hook.AfterSave, "record", func(ctx context.Context, record *skydb.Record, originalRecord *skydb.Record) skyerr.Error {
+				previous = originalRecord
+				return nil
+			})
+
+			r.POST(`{
+				"records": [{
+					"_id": "record/id",
+					"content": "new"
+				}]
+			}`)
+
+			So(previous, ShouldNotBeNil)
+			So(previous.Data["content"], ShouldEqual, "concurrent")
+		})
+
 		Convey("BeforeSave should set originalRecord as nil for new record", func() {
 			called := false
 			registry.Register(hook.BeforeSave, "record", func(ctx context.Context, record *skydb.Record, originalRecord *skydb.Record) skyerr.Error {
@@ -2020,6 +2853,14 @@ func (db *selectiveDatabase) Save(record *skydb.Record) error {
 	return db.Database.Save(record)
 }
 
+func (db *selectiveDatabase) SaveWithResult(record *skydb.Record) (skydb.SaveResult, error) {
+	if err := db.filterFunc("SAVE", record.ID, record); err != nil {
+		return skydb.SaveResult{}, err
+	}
+
+	return db.Database.SaveWithResult(record)
+}
+
 func (db *selectiveDatabase) Delete(id skydb.RecordID) error {
 	if err := db.filterFunc("DELETE", id, nil); err != nil {
 		return err
@@ -2033,6 +2874,10 @@ func (db *selectiveDatabase) Begin() error {
 }
 
 func (db *selectiveDatabase) Commit() error {
+	if err := db.filterFunc("COMMIT", skydb.RecordID{}, nil); err != nil {
+		return err
+	}
+
 	return db.Database.(skydb.TxDatabase).Commit()
 }
 
@@ -2298,6 +3143,66 @@ func TestAtomicOperation(t *testing.T) {
 	})
 }
 
+func TestAtomicOperationHooks(t *testing.T) {
+	Convey("Atomic Operation with hooks", t, func() {
+		registry := hook.NewRegistry()
+		afterHook := hooktest.StackingHook{}
+		registry.Register(hook.AfterSave, "note", afterHook.Func)
+
+		conn := skydbtest.NewMapConn()
+		backingDB := skydbtest.NewMapDB()
+		txDB := skydbtest.NewMockTxDatabase(backingDB)
+		db := newSelectiveDatabase(txDB)
+
+		r := handlertest.NewSingleRouteRouter(&RecordSaveHandler{
+			HookRegistry: registry,
+		}, func(payload *router.Payload) {
+			payload.DBConn = conn
+			payload.Database = db
+			payload.UserInfo = &skydb.UserInfo{
+				ID: "user0",
+			}
+		})
+
+		Convey("executes AfterSave hooks after commit", func() {
+			db.SetFilter(func(op string, recordID skydb.RecordID, record *skydb.Record) skyerr.Error {
+				if op == "COMMIT" {
+					So(afterHook.Records, ShouldBeEmpty)
+				}
+				return nil
+			})
+
+			r.POST(`{
+				"records": [{"_id": "note/0"}, {"_id": "note/1"}],
+				"atomic": true
+			}`)
+
+			So(txDB.DidCommit, ShouldBeTrue)
+			So(len(afterHook.Records), ShouldEqual, 2)
+			So(afterHook.Records[0].ID, ShouldResemble, skydb.NewRecordID("note", "0"))
+			So(afterHook.Records[1].ID, ShouldResemble, skydb.NewRecordID("note", "1"))
+		})
+
+		Convey("does not execute AfterSave hooks if transaction fails to commit", func() {
+			db.SetFilter(func(op string, recordID skydb.RecordID, record *skydb.Record) skyerr.Error {
+				if op == "COMMIT" {
+					return skyerr.NewError(skyerr.UnexpectedError, "commit failed")
+				}
+				return nil
+			})
+
+			resp := r.POST(`{
+				"records": [{"_id": "note/0"}, {"_id": "note/1"}],
+				"atomic": true
+			}`)
+
+			So(resp.Body.String(), ShouldContainSubstring, "AtomicOperationFailure")
+			So(txDB.DidCommit, ShouldBeFalse)
+			So(afterHook.Records, ShouldBeEmpty)
+		})
+	})
+}
+
 func TestDeriveDeltaRecord(t *testing.T) {
 	Convey("DeriveDeltaRecord", t, func() {
 		Convey("set ACL when delta is non-nil", func() {
@@ -37,9 +37,14 @@ func atomicModifyFunc(req *recordModifyRequest, resp *recordModifyResponse, mFun
 			return
 		}
 
+		txHooks := txHookQueue{}
+		req.TxHooks = &txHooks
 		txErr := withTransaction(txDB, func() error {
 			return mFunc(req, resp)
 		})
+		if txErr == nil {
+			txHooks.flush()
+		}
 
 		if len(resp.ErrMap) > 0 {
 			info := map[string]interface{}{}
@@ -79,6 +84,25 @@ func withTransaction(txDB skydb.TxDatabase, do func() error) (err error) {
 	return
 }
 
+// txHookQueue holds hook executions deferred in a transaction, such that
+// their side effects only happen after the transaction is committed.
+// The queue is simply discarded if the transaction is rolled back.
+type txHookQueue struct {
+	funcs []func()
+}
+
+func (q *txHookQueue) add(f func()) {
+	q.funcs = append(q.funcs, f)
+}
+
+func (q *txHookQueue) flush() {
+	funcs := q.funcs
+	q.funcs = nil
+	for _, f := range funcs {
+		f()
+	}
+}
+
 type recordModifyRequest struct {
 	Db            skydb.Database
 	Conn          skydb.Conn
@@ -89,13 +113,84 @@ type recordModifyRequest struct {
 	Context       context.Context
 	UserInfo      *skydb.UserInfo
 
+	// TxHooks, if not nil, defers the execution of after hooks until
+	// the enclosing transaction is committed
+	TxHooks *txHookQueue
+
 	// Save only
-	RecordsToSave []*skydb.Record
+	RecordsToSave  []*skydb.Record
+	ConflictPolicy conflictPolicy
+	ClientVersions map[skydb.RecordID]clientVersion
 
 	// Delete Only
 	RecordIDsToDelete []skydb.RecordID
 }
 
+// conflictPolicy specifies how a conflict is resolved on conditional save.
+//
+// A conditional save is a save of a record that comes with the version of
+// the record the client change is based on. The save is in conflict if
+// the record on the server has been updated since that version.
+type conflictPolicy string
+
+const (
+	// noConflictPolicy disables conditional save. The client change
+	// is always saved.
+	noConflictPolicy conflictPolicy = ""
+
+	// serverWins keeps the server record on conflict.
+	serverWins conflictPolicy = "server_wins"
+
+	// clientWins saves the client change on conflict.
+	clientWins conflictPolicy = "client_wins"
+
+	// lastWriteWins saves the client change on conflict only if the
+	// client change is made after the last update of the server record.
+	lastWriteWins conflictPolicy = "last_write_wins"
+)
+
+func (p conflictPolicy) IsValid() bool {
+	switch p {
+	case noConflictPolicy, serverWins, clientWins, lastWriteWins:
+		return true
+	}
+	return false
+}
+
+// clientVersion is the version information of a record supplied by
+// the client on conditional save.
+type clientVersion struct {
+	// BaseUpdatedAt is the update time of the server record on which
+	// the client change is based.
+	BaseUpdatedAt time.Time
+
+	// ModifiedAt is the time the client change is made. It is zero if
+	// the client does not supply one.
+	ModifiedAt time.Time
+}
+
+// resolveConflict returns whether the client change should be saved
+// over the server record. The client change is always saved if it is
+// not in conflict with the server record.
+func resolveConflict(policy conflictPolicy, version clientVersion, serverRecord *skydb.Record, now time.Time) bool {
+	if !serverRecord.UpdatedAt.After(version.BaseUpdatedAt) {
+		return true
+	}
+
+	switch policy {
+	case serverWins:
+		return false
+	case lastWriteWins:
+		modifiedAt := version.ModifiedAt
+		if modifiedAt.IsZero() {
+			modifiedAt = now
+		}
+		return modifiedAt.After(serverRecord.UpdatedAt)
+	default:
+		return true
+	}
+}
+
 type recordModifyResponse struct {
 	ErrMap           map[skydb.RecordID]skyerr.Error
 	SchemaUpdated    bool
@@ -156,7 +251,15 @@ func (f recordFetcher) fetchOrCreateRecord(recordID skydb.RecordID, userInfo *sk
 	}
 
 	record = &dbRecord
-	if !f.withMasterKey && !dbRecord.Accessible(userInfo, skydb.WriteLevel) {
+	if f.withMasterKey {
+		return
+	}
+
+	accessible, dbErr := recordAccessible(f.db, &dbRecord, userInfo, skydb.WriteLevel)
+	if dbErr != nil {
+		return nil, skyerr.NewError(skyerr.UnexpectedError, dbErr.Error())
+	}
+	if !accessible {
 		err = skyerr.NewError(
 			skyerr.PermissionDenied,
 			"no permission to modify",
@@ -166,6 +269,21 @@ func (f recordFetcher) fetchOrCreateRecord(recordID skydb.RecordID, userInfo *sk
 	return
 }
 
+// recordAccessible checks whether the user has the access level on the
+// record. A record without ACL is governed by the default ACL of the
+// database.
+func recordAccessible(db skydb.Database, record *skydb.Record, userInfo *skydb.UserInfo, level skydb.ACLLevel) (bool, error) {
+	if record.ACL != nil {
+		return record.Accessible(userInfo, level), nil
+	}
+
+	defaultACL, err := db.DefaultACL()
+	if err != nil {
+		return false, err
+	}
+	return record.AccessibleWithDefaultACL(userInfo, level, defaultACL), nil
+}
+
 func removeRecordFieldTypeHints(r *skydb.Record) {
 	for k, v := range r.Data {
 		switch v.(type) {
@@ -183,6 +301,11 @@ func removeRecordFieldTypeHints(r *skydb.Record) {
 // 3. Clean up some transport only data (sequence for example) away from record
 // 4. Populate meta data and save the record (like updated_at/by)
 // 5. Execute after save hooks with original record and new record
+//
+// On conditional save, a record whose conflict is resolved in favour of the
+// server record is not saved, and the server record is returned instead.
+// Other records are saved only if the server record is not updated since
+// it was fetched.
 func recordSaveHandler(req *recordModifyRequest, resp *recordModifyResponse) skyerr.Error {
 	db := req.Db
 	records := req.RecordsToSave
@@ -191,6 +314,9 @@ func recordSaveHandler(req *recordModifyRequest, resp *recordModifyResponse) sky
 
 	// fetch records
 	originalRecordMap := map[skydb.RecordID]*skydb.Record{}
+	serverWinsRecordMap := map[skydb.RecordID]bool{}
+	serverUpdatedAtMap := map[skydb.RecordID]time.Time{}
+	previousRecordMap := map[skydb.RecordID]*skydb.Record{}
 	records = executeRecordFunc(records, resp.ErrMap, func(record *skydb.Record) (err skyerr.Error) {
 		dbRecord, err := fetcher.fetchOrCreateRecord(record.ID, req.UserInfo)
 
@@ -203,6 +329,15 @@ func recordSaveHandler(req *recordModifyRequest, resp *recordModifyResponse) sky
 		injectSigner(&origRecord, req.AssetStore)
 		originalRecordMap[origRecord.ID] = &origRecord
 
+		if version, ok := req.ClientVersions[record.ID]; ok && req.ConflictPolicy != noConflictPolicy {
+			if !resolveConflict(req.ConflictPolicy, version, dbRecord, timeNow()) {
+				serverWinsRecordMap[record.ID] = true
+				*record = *dbRecord
+				return
+			}
+			serverUpdatedAtMap[record.ID] = dbRecord.UpdatedAt
+		}
+
 		mergeRecord(dbRecord, record)
 		*record = *dbRecord
 
@@ -212,6 +347,10 @@ func recordSaveHandler(req *recordModifyRequest, resp *recordModifyResponse) sky
 	// execute before save hooks
 	if req.HookRegistry != nil {
 		records = executeRecordFunc(records, resp.ErrMap, func(record *skydb.Record) (err skyerr.Error) {
+			if serverWinsRecordMap[record.ID] {
+				return
+			}
+
 			originalRecord, ok := originalRecordMap[record.ID]
 			// FIXME: Hot-fix for issues #528
 			// Defaults for record attributes should be provided
@@ -232,6 +371,9 @@ func recordSaveHandler(req *recordModifyRequest, resp *recordModifyResponse) sky
 		if myerr, ok := err.(skyerr.Error); ok {
 			return myerr
 		}
+		if myerr, ok := validationSkyError(skyerr.IncompatibleSchema, err); ok {
+			return myerr
+		}
 		return skyerr.NewError(skyerr.IncompatibleSchema, "failed to migrate record schema")
 	}
 
@@ -242,6 +384,11 @@ func recordSaveHandler(req *recordModifyRequest, resp *recordModifyResponse) sky
 
 	// save records
 	records = executeRecordFunc(records, resp.ErrMap, func(record *skydb.Record) (err skyerr.Error) {
+		if serverWinsRecordMap[record.ID] {
+			injectSigner(record, req.AssetStore)
+			return
+		}
+
 		now := timeNow()
 
 		var deltaRecord skydb.Record
@@ -259,7 +406,29 @@ func recordSaveHandler(req *recordModifyRequest, resp *recordModifyResponse) sky
 
 		deriveDeltaRecord(&deltaRecord, originalRecord, record)
 
-		if dbErr := db.Save(&deltaRecord); dbErr != nil {
+		var dbErr error
+		if serverUpdatedAt, ok := serverUpdatedAtMap[record.ID]; ok {
+			dbErr = db.SaveIfMatch(&deltaRecord, serverUpdatedAt)
+		} else {
+			// The record may be modified since it is fetched, so the
+			// after save hooks are passed the record replaced by the save.
+			var result skydb.SaveResult
+			result, dbErr = db.SaveWithResult(&deltaRecord)
+			if dbErr == nil {
+				if result.Previous != nil {
+					injectSigner(result.Previous, req.AssetStore)
+				}
+				previousRecordMap[record.ID] = result.Previous
+			}
+		}
+
+		if dbErr == skydb.ErrUniqueConstraintViolation {
+			err = skyerr.NewError(skyerr.Duplicated, dbErr.Error())
+		} else if dbErr == skydb.ErrRecordConflict {
+			err = skyerr.NewError(skyerr.ConstraintViolated, dbErr.Error())
+		} else if dbErr == skydb.ErrEnumConstraintViolation {
+			err = skyerr.NewError(skyerr.ConstraintViolated, dbErr.Error())
+		} else if dbErr != nil {
 			err = skyerr.NewError(skyerr.UnexpectedError, dbErr.Error())
 		}
 		injectSigner(&deltaRecord, req.AssetStore)
@@ -275,11 +444,15 @@ func recordSaveHandler(req *recordModifyRequest, resp *recordModifyResponse) sky
 	// execute after save hooks
 	if req.HookRegistry != nil {
 		records = executeRecordFunc(records, resp.ErrMap, func(record *skydb.Record) (err skyerr.Error) {
-			originalRecord, _ := originalRecordMap[record.ID]
-			err = req.HookRegistry.ExecuteHooks(req.Context, hook.AfterSave, record, originalRecord)
-			if err != nil {
-				log.Errorf("Error occurred while executing hooks: %s", err)
+			if serverWinsRecordMap[record.ID] {
+				return
+			}
+
+			originalRecord, ok := previousRecordMap[record.ID]
+			if !ok {
+				originalRecord = originalRecordMap[record.ID]
 			}
+			err = req.executeAfterHooks(hook.AfterSave, record, originalRecord)
 			return
 		})
 	}
@@ -290,6 +463,29 @@ func recordSaveHandler(req *recordModifyRequest, resp *recordModifyResponse) sky
 	return nil
 }
 
+// executeAfterHooks executes after hooks of the specified kind on record.
+//
+// If the request is made in a transaction, the execution is deferred until
+// the transaction is committed. Errors of deferred hooks are only logged
+// since the record is modified by then.
+func (req *recordModifyRequest) executeAfterHooks(kind hook.Kind, record *skydb.Record, originalRecord *skydb.Record) skyerr.Error {
+	if req.TxHooks != nil {
+		req.TxHooks.add(func() {
+			err := req.HookRegistry.ExecuteHooks(req.Context, kind, record, originalRecord)
+			if err != nil {
+				log.Errorf("Error occurred while executing hooks: %s", err)
+			}
+		})
+		return nil
+	}
+
+	err := req.HookRegistry.ExecuteHooks(req.Context, kind, record, originalRecord)
+	if err != nil {
+		log.Errorf("Error occurred while executing hooks: %s", err)
+	}
+	return err
+}
+
 type recordFunc func(*skydb.Record) skyerr.Error
 
 func executeRecordFunc(recordsIn []*skydb.Record, errMap map[skydb.RecordID]skyerr.Error, rFunc recordFunc) (recordsOut []*skydb.Record) {
@@ -419,15 +615,17 @@ func recordDeleteHandler(req *recordModifyRequest, resp *recordModifyResponse) s
 			} else {
 				resp.ErrMap[recordID] = skyerr.NewError(skyerr.UnexpectedError, dbErr.Error())
 			}
+		} else if req.WithMasterKey {
+			records = append(records, &record)
+		} else if accessible, dbErr := recordAccessible(db, &record, req.UserInfo, skydb.WriteLevel); dbErr != nil {
+			resp.ErrMap[recordID] = skyerr.NewError(skyerr.UnexpectedError, dbErr.Error())
+		} else if accessible {
+			records = append(records, &record)
 		} else {
-			if req.WithMasterKey || record.Accessible(req.UserInfo, skydb.WriteLevel) {
-				records = append(records, &record)
-			} else {
-				resp.ErrMap[recordID] = skyerr.NewError(
-					skyerr.PermissionDenied,
-					"no permission to delete",
-				)
-			}
+			resp.ErrMap[recordID] = skyerr.NewError(
+				skyerr.PermissionDenied,
+				"no permission to delete",
+			)
 		}
 	}
 
@@ -440,7 +638,9 @@ func recordDeleteHandler(req *recordModifyRequest, resp *recordModifyResponse) s
 
 	records = executeRecordFunc(records, resp.ErrMap, func(record *skydb.Record) (err skyerr.Error) {
 
-		if dbErr := db.Delete(record.ID); dbErr != nil {
+		if dbErr := db.Delete(record.ID); dbErr == skydb.ErrRecordReferenced {
+			return skyerr.NewError(skyerr.ConstraintViolated, dbErr.Error())
+		} else if dbErr != nil {
 			return skyerr.NewError(skyerr.UnexpectedError, dbErr.Error())
 		}
 		return nil
@@ -452,10 +652,7 @@ func recordDeleteHandler(req *recordModifyRequest, resp *recordModifyResponse) s
 
 	if req.HookRegistry != nil {
 		records = executeRecordFunc(records, resp.ErrMap, func(record *skydb.Record) (err skyerr.Error) {
-			err = req.HookRegistry.ExecuteHooks(req.Context, hook.AfterDelete, record, nil)
-			if err != nil {
-				log.Errorf("Error occurred while executing hooks: %s", err)
-			}
+			err = req.executeAfterHooks(hook.AfterDelete, record, nil)
 			return
 		})
 	}
@@ -468,23 +665,27 @@ func recordDeleteHandler(req *recordModifyRequest, resp *recordModifyResponse) s
 
 type schemaMerger struct {
 	finalSchema skydb.RecordSchema
-	err         error
+	errs        skydb.ValidationError
+	conflicted  map[string]bool
 }
 
 func newSchemaMerger() schemaMerger {
-	return schemaMerger{finalSchema: skydb.RecordSchema{}}
+	return schemaMerger{
+		finalSchema: skydb.RecordSchema{},
+		conflicted:  map[string]bool{},
+	}
 }
 
 func (m *schemaMerger) Extend(schema skydb.RecordSchema) {
-	if m.err != nil {
-		return
-	}
-
 	for key, dataType := range schema {
 		if originalType, ok := m.finalSchema[key]; ok {
 			if originalType != dataType {
-				m.err = fmt.Errorf("type conflict on column = %s, %s -> %s", key, originalType, dataType)
-				return
+				if !m.conflicted[key] {
+					m.conflicted[key] = true
+					m.errs.Add(key, skydb.FieldTypeConflict,
+						fmt.Sprintf("type conflict on column = %s, %v -> %v", key, originalType, dataType))
+				}
+				continue
 			}
 		}
 
@@ -493,7 +694,20 @@ func (m *schemaMerger) Extend(schema skydb.RecordSchema) {
 }
 
 func (m schemaMerger) Schema() (skydb.RecordSchema, error) {
-	return m.finalSchema, m.err
+	return m.finalSchema, m.errs.Err()
+}
+
+// validationSkyError converts err to a skyerr.Error with the problems
+// of each field in its info if err is a skydb.ValidationError.
+func validationSkyError(code skyerr.ErrorCode, err error) (skyerr.Error, bool) {
+	validationErr, ok := err.(*skydb.ValidationError)
+	if !ok {
+		return nil, false
+	}
+
+	return skyerr.NewErrorWithInfo(code, validationErr.Error(), map[string]interface{}{
+		"errors": validationErr.Errors,
+	}), true
 }
 
 func deriveRecordSchema(m skydb.Data) skydb.RecordSchema {
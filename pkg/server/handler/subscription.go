@@ -78,7 +78,13 @@ func (p *jsonPredicate) MarshalJSON() ([]byte, error) {
 	}
 
 	var results []interface{}
-	if p.Operator.IsCompound() {
+	if p.Operator == skydb.AnyMatch {
+		keyPath, elementPredicate := (*skydb.Predicate)(p).GetAnyMatchOperands()
+		results = append(results,
+			opString(p.Operator),
+			skyconv.ToMap(skyconv.MapKeyPath(keyPath)),
+			(*jsonPredicate)(&elementPredicate))
+	} else if p.Operator.IsCompound() {
 		results = append(results, opString(p.Operator))
 		for i, child := range p.Children {
 			childPred, ok := child.(skydb.Predicate)
@@ -160,8 +166,16 @@ func opString(op skydb.Operator) string {
 		return "like"
 	case skydb.ILike:
 		return "ilike"
+	case skydb.EqualIgnoreCase:
+		return "ieq"
 	case skydb.In:
 		return "in"
+	case skydb.AnyMatch:
+		return "any"
+	case skydb.IsNull:
+		return "isnull"
+	case skydb.IsAbsent:
+		return "isabsent"
 	default:
 		return "UNKNOWN_OPERATOR"
 	}
@@ -176,6 +190,13 @@ func funcSlice(i interface{}) []interface{} {
 			skyconv.ToMap(skyconv.MapKeyPath(f.Field)),
 			skyconv.ToMap(skyconv.MapLocation(f.Location)),
 		}
+	case skydb.ArrayLengthFunc:
+		return []interface{}{
+			"func",
+			"arrayLength",
+			skyconv.ToMap(skyconv.MapKeyPath(f.Field)),
+			f.NonArrayAsEmpty,
+		}
 	default:
 		panic(fmt.Errorf("got unrecgonized skydb.Func = %T", i))
 	}
@@ -0,0 +1,379 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+)
+
+// TextQueryError is returned when a text query cannot be parsed.
+type TextQueryError struct {
+	// Pos is the byte offset in the text query at which the error occurs.
+	Pos     int
+	Message string
+}
+
+func (e *TextQueryError) Error() string {
+	return fmt.Sprintf("text query: at position %d: %s", e.Pos, e.Message)
+}
+
+// QueryFromText parses a text query of records of recordType into query.
+//
+// A text query is a list of conditions separated by spaces, all of which
+// a record must match, like:
+//
+//	status:open priority>3 sort:-updatedAt limit:20
+//
+// A condition compares a field with a value by one of the operators
+// ":" (or "="), "!=", ">", ">=", "<" and "<=". A value is a number,
+// true, false, null, a double-quoted string, or any other word as a
+// string. A word containing "*" compared by ":" matches any string in
+// which "*" is replaced by any characters.
+//
+// Conditions are negated by a leading "-", combined by "OR", and grouped
+// by parentheses. The conditions "sort:field" (or "sort:-field" for
+// descending order), "limit:n" and "offset:n" set the corresponding
+// options of query instead, and are only allowed outside of groups.
+//
+// The parsed query is built and validated like a JSON query, so that
+// the text query is subject to the same restrictions.
+func (parser *QueryParser) QueryFromText(recordType, text string, query *skydb.Query) error {
+	p := textQueryParser{
+		text: text,
+		rawQuery: map[string]interface{}{
+			"record_type": recordType,
+		},
+	}
+
+	rawPredicate, err := p.parseOr(0)
+	if err != nil {
+		return err
+	}
+	if p.pos < len(p.text) {
+		return p.errorf("unexpected %q", p.text[p.pos])
+	}
+	if rawPredicate != nil {
+		p.rawQuery["predicate"] = rawPredicate
+	}
+
+	if err := parser.queryFromRaw(p.rawQuery, query); err != nil {
+		return err
+	}
+	return nil
+}
+
+// textQueryParser parses a text query into the raw query accepted by
+// QueryParser.queryFromRaw.
+type textQueryParser struct {
+	text     string
+	pos      int
+	rawQuery map[string]interface{}
+}
+
+var textQueryOperators = []struct {
+	text     string
+	operator string
+}{
+	// longer operators come first such that they are matched first
+	{">=", "gte"},
+	{"<=", "lte"},
+	{"!=", "neq"},
+	{">", "gt"},
+	{"<", "lt"},
+	{":", "eq"},
+	{"=", "eq"},
+}
+
+func (p *textQueryParser) errorf(format string, args ...interface{}) error {
+	return &TextQueryError{
+		Pos:     p.pos,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (p *textQueryParser) skipSpaces() {
+	for p.pos < len(p.text) && isTextQuerySpace(p.text[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *textQueryParser) peek() byte {
+	if p.pos < len(p.text) {
+		return p.text[p.pos]
+	}
+	return 0
+}
+
+// atOr reports whether the next word is the keyword OR.
+func (p *textQueryParser) atOr() bool {
+	if !strings.HasPrefix(p.text[p.pos:], "OR") {
+		return false
+	}
+	end := p.pos + len("OR")
+	return end == len(p.text) || isTextQuerySpace(p.text[end]) || p.text[end] == '('
+}
+
+// parseOr parses conditions combined by OR. It returns nil if there are
+// no conditions but options.
+func (p *textQueryParser) parseOr(depth int) (interface{}, error) {
+	children := []interface{}{}
+	for {
+		start := p.pos
+		child, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+
+		p.skipSpaces()
+		if !p.atOr() {
+			if len(children) == 0 {
+				return child, nil
+			}
+			if child == nil {
+				return nil, p.errorf("expected a condition after OR")
+			}
+			return append([]interface{}{"or"}, append(children, child)...), nil
+		}
+
+		if child == nil {
+			p.pos = start
+			return nil, p.errorf("expected a condition before OR")
+		}
+		children = append(children, child)
+		p.pos += len("OR")
+	}
+}
+
+// parseAnd parses conditions separated by spaces until OR, a closing
+// parenthesis or the end of text.
+func (p *textQueryParser) parseAnd(depth int) (interface{}, error) {
+	children := []interface{}{}
+	for {
+		p.skipSpaces()
+		if p.pos == len(p.text) || p.peek() == ')' || p.atOr() {
+			break
+		}
+
+		child, err := p.parseUnary(depth, false)
+		if err != nil {
+			return nil, err
+		}
+		if child != nil {
+			children = append(children, child)
+		}
+	}
+
+	switch len(children) {
+	case 0:
+		return nil, nil
+	case 1:
+		return children[0], nil
+	default:
+		return append([]interface{}{"and"}, children...), nil
+	}
+}
+
+// parseUnary parses a condition, a negated condition or a group of
+// conditions. It returns nil if an option is parsed instead.
+func (p *textQueryParser) parseUnary(depth int, negated bool) (interface{}, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		start := p.pos
+		child, err := p.parseUnary(depth, true)
+		if err != nil {
+			return nil, err
+		}
+		if child == nil {
+			p.pos = start
+			return nil, p.errorf("expected a condition after -")
+		}
+		return []interface{}{"not", child}, nil
+	case '(':
+		start := p.pos
+		p.pos++
+		child, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected ) to close ( at position %d", start)
+		}
+		p.pos++
+		if child == nil {
+			p.pos = start
+			return nil, p.errorf("expected a condition in parentheses")
+		}
+		return child, nil
+	}
+
+	return p.parseCondition(depth, negated)
+}
+
+func (p *textQueryParser) parseCondition(depth int, negated bool) (interface{}, error) {
+	start := p.pos
+	key := p.parseKey()
+	if key == "" {
+		return nil, p.errorf("expected a field name")
+	}
+
+	operator := ""
+	for _, op := range textQueryOperators {
+		if strings.HasPrefix(p.text[p.pos:], op.text) {
+			operator = op.operator
+			p.pos += len(op.text)
+			break
+		}
+	}
+	if operator == "" {
+		return nil, p.errorf("expected an operator after %q", key)
+	}
+
+	switch key {
+	case "sort", "limit", "offset":
+		if p.text[p.pos-1] != ':' {
+			break
+		}
+		if depth > 0 || negated {
+			p.pos = start
+			return nil, p.errorf("%s is not allowed in a group or negated", key)
+		}
+		return nil, p.parseOption(key)
+	}
+
+	valuePos := p.pos
+	value, quoted, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	if s, ok := value.(string); ok && !quoted && operator == "eq" && strings.Contains(s, "*") {
+		operator = "like"
+		value = strings.Replace(s, "*", "%", -1)
+	}
+
+	if p.pos == valuePos {
+		return nil, p.errorf("expected a value after %q", p.text[start:p.pos])
+	}
+
+	return []interface{}{
+		operator,
+		map[string]interface{}{"$type": "keypath", "$val": key},
+		value,
+	}, nil
+}
+
+func (p *textQueryParser) parseOption(key string) error {
+	valuePos := p.pos
+	if key == "sort" {
+		order := "asc"
+		if p.peek() == '-' {
+			order = "desc"
+			p.pos++
+		}
+		field := p.parseKey()
+		if field == "" {
+			return p.errorf("expected a field name to sort")
+		}
+
+		sorts, _ := p.rawQuery["sort"].([]interface{})
+		p.rawQuery["sort"] = append(sorts, []interface{}{
+			map[string]interface{}{"$type": "keypath", "$val": field},
+			order,
+		})
+		return nil
+	}
+
+	word := p.parseWord()
+	n, err := strconv.ParseUint(word, 10, 64)
+	if err != nil {
+		p.pos = valuePos
+		return p.errorf("expected a non-negative integer for %s", key)
+	}
+	if _, ok := p.rawQuery[key]; ok {
+		p.pos = valuePos
+		return p.errorf("%s is specified more than once", key)
+	}
+	p.rawQuery[key] = float64(n)
+	return nil
+}
+
+func (p *textQueryParser) parseKey() string {
+	start := p.pos
+	for p.pos < len(p.text) && isTextQueryKeyChar(p.text[p.pos]) {
+		p.pos++
+	}
+	return p.text[start:p.pos]
+}
+
+// parseWord parses characters until a space or a closing parenthesis.
+func (p *textQueryParser) parseWord() string {
+	start := p.pos
+	for p.pos < len(p.text) && !isTextQuerySpace(p.text[p.pos]) && p.text[p.pos] != ')' {
+		p.pos++
+	}
+	return p.text[start:p.pos]
+}
+
+// parseValue parses a value, and reports whether it is a quoted string.
+func (p *textQueryParser) parseValue() (value interface{}, quoted bool, err error) {
+	if p.peek() == '"' {
+		start := p.pos
+		p.pos++
+		buf := []byte{}
+		for {
+			if p.pos == len(p.text) {
+				p.pos = start
+				return nil, false, p.errorf("unterminated string")
+			}
+			c := p.text[p.pos]
+			p.pos++
+			if c == '"' {
+				return string(buf), true, nil
+			}
+			if c == '\\' && p.pos < len(p.text) {
+				c = p.text[p.pos]
+				p.pos++
+			}
+			buf = append(buf, c)
+		}
+	}
+
+	word := p.parseWord()
+	switch word {
+	case "true":
+		return true, false, nil
+	case "false":
+		return false, false, nil
+	case "null":
+		return nil, false, nil
+	}
+	if number, err := strconv.ParseFloat(word, 64); err == nil {
+		return number, false, nil
+	}
+	return word, false, nil
+}
+
+func isTextQuerySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isTextQueryKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.'
+}
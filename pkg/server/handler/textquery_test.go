@@ -0,0 +1,173 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"testing"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestQueryFromText(t *testing.T) {
+	Convey("QueryFromText", t, func() {
+		parser := &QueryParser{}
+		keyPath := func(key string) skydb.Expression {
+			return skydb.Expression{Type: skydb.KeyPath, Value: key}
+		}
+		literal := func(value interface{}) skydb.Expression {
+			return skydb.Expression{Type: skydb.Literal, Value: value}
+		}
+		comparison := func(operator skydb.Operator, key string, value interface{}) skydb.Predicate {
+			return skydb.Predicate{
+				Operator: operator,
+				Children: []interface{}{keyPath(key), literal(value)},
+			}
+		}
+
+		Convey("parses conditions, sorts and limit", func() {
+			query := skydb.Query{}
+			err := parser.QueryFromText("note", `status:open priority>3 sort:-updatedAt limit:20`, &query)
+			So(err, ShouldBeNil)
+
+			limit := uint64(20)
+			So(query, ShouldResemble, skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.And,
+					Children: []interface{}{
+						comparison(skydb.Equal, "status", "open"),
+						comparison(skydb.GreaterThan, "priority", float64(3)),
+					},
+				},
+				Sorts: []skydb.Sort{
+					{KeyPath: "updatedAt", Order: skydb.Desc},
+				},
+				Limit: &limit,
+			})
+		})
+
+		Convey("parses a single condition", func() {
+			query := skydb.Query{}
+			So(parser.QueryFromText("note", `  priority<=3  `, &query), ShouldBeNil)
+			So(query.Predicate, ShouldResemble, comparison(skydb.LessThanOrEqual, "priority", float64(3)))
+		})
+
+		Convey("parses options only", func() {
+			query := skydb.Query{}
+			So(parser.QueryFromText("note", `sort:title sort:-priority offset:10`, &query), ShouldBeNil)
+			So(query.Predicate.IsEmpty(), ShouldBeTrue)
+			So(query.Sorts, ShouldResemble, []skydb.Sort{
+				{KeyPath: "title", Order: skydb.Asc},
+				{KeyPath: "priority", Order: skydb.Desc},
+			})
+			So(query.Offset, ShouldEqual, 10)
+		})
+
+		Convey("parses values", func() {
+			query := skydb.Query{}
+			err := parser.QueryFromText("note", `a:true b=false c!=null d>=-1.5 e:"hello world" f:"say \"hi\"" g:12abc`, &query)
+			So(err, ShouldBeNil)
+			So(query.Predicate, ShouldResemble, skydb.Predicate{
+				Operator: skydb.And,
+				Children: []interface{}{
+					comparison(skydb.Equal, "a", true),
+					comparison(skydb.Equal, "b", false),
+					comparison(skydb.NotEqual, "c", nil),
+					comparison(skydb.GreaterThanOrEqual, "d", float64(-1.5)),
+					comparison(skydb.Equal, "e", "hello world"),
+					comparison(skydb.Equal, "f", `say "hi"`),
+					comparison(skydb.Equal, "g", "12abc"),
+				},
+			})
+		})
+
+		Convey("parses wildcards as like", func() {
+			query := skydb.Query{}
+			So(parser.QueryFromText("note", `title:hello* content:"a*"`, &query), ShouldBeNil)
+			So(query.Predicate, ShouldResemble, skydb.Predicate{
+				Operator: skydb.And,
+				Children: []interface{}{
+					comparison(skydb.Like, "title", "hello%"),
+					comparison(skydb.Equal, "content", "a*"),
+				},
+			})
+		})
+
+		Convey("parses negation, OR and groups", func() {
+			query := skydb.Query{}
+			err := parser.QueryFromText("note", `-status:closed (priority>3 OR assignee:me) OR urgent:true`, &query)
+			So(err, ShouldBeNil)
+			So(query.Predicate, ShouldResemble, skydb.Predicate{
+				Operator: skydb.Or,
+				Children: []interface{}{
+					skydb.Predicate{
+						Operator: skydb.And,
+						Children: []interface{}{
+							skydb.Predicate{
+								Operator: skydb.Not,
+								Children: []interface{}{
+									comparison(skydb.Equal, "status", "closed"),
+								},
+							},
+							skydb.Predicate{
+								Operator: skydb.Or,
+								Children: []interface{}{
+									comparison(skydb.GreaterThan, "priority", float64(3)),
+									comparison(skydb.Equal, "assignee", "me"),
+								},
+							},
+						},
+					},
+					comparison(skydb.Equal, "urgent", true),
+				},
+			})
+		})
+
+		Convey("reports errors with position", func() {
+			cases := []struct {
+				text    string
+				pos     int
+				message string
+			}{
+				{`status`, 6, `expected an operator after "status"`},
+				{`status: open`, 7, `expected a value after "status:"`},
+				{`:open`, 0, `expected a field name`},
+				{`a:1 OR`, 6, `expected a condition after OR`},
+				{`OR a:1`, 0, `expected a condition before OR`},
+				{`(a:1 b:2`, 8, `expected ) to close ( at position 0`},
+				{`a:1)`, 3, `unexpected ')'`},
+				{`()`, 0, `expected a condition in parentheses`},
+				{`title:"hello`, 6, `unterminated string`},
+				{`limit:ten`, 6, `expected a non-negative integer for limit`},
+				{`limit:1 limit:2`, 14, `limit is specified more than once`},
+				{`(a:1 sort:b)`, 5, `sort is not allowed in a group or negated`},
+				{`-sort:b`, 1, `sort is not allowed in a group or negated`},
+				{`sort:-`, 6, `expected a field name to sort`},
+			}
+			for _, c := range cases {
+				query := skydb.Query{}
+				err := parser.QueryFromText("note", c.text, &query)
+				So(err, ShouldResemble, &TextQueryError{Pos: c.pos, Message: c.message})
+			}
+		})
+
+		Convey("reports errors of invalid query", func() {
+			query := skydb.Query{}
+			So(parser.QueryFromText("", `a:1`, &query), ShouldNotBeNil)
+			So(parser.QueryFromText("note", `a.b:1`, &query), ShouldNotBeNil)
+		})
+	})
+}
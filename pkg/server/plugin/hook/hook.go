@@ -16,6 +16,7 @@ package hook
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/skygeario/skygear-server/pkg/server/skydb"
@@ -39,7 +40,41 @@ const (
 // The supplied record is fully fetched for all four kind of hooks.
 type Func func(context.Context, *skydb.Record, *skydb.Record) skyerr.Error
 
-type recordTypeHookMap map[string][]Func
+// ValidateFunc defines the interface of a function validating a record
+// before it is saved.
+//
+// Problems with the fields of record are added to errs. The save is
+// rejected if any problems are added.
+type ValidateFunc func(ctx context.Context, record *skydb.Record, originalRecord *skydb.Record, errs *skydb.ValidationError)
+
+// prioritizedFunc is a hook with the priority it is registered with.
+type prioritizedFunc struct {
+	priority int
+	hook     Func
+}
+
+type recordTypeHookMap map[string][]prioritizedFunc
+
+type contextKey string
+
+var skipHooksContextKey contextKey = "SkipHooks"
+
+// WithHooksSkipped returns a copy of ctx in which executing hooks is a no-op.
+//
+// It is intended for bulk operations like import, restore and migration,
+// in which records are persisted without the side effects of hooks.
+func WithHooksSkipped(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipHooksContextKey, true)
+}
+
+// HooksSkipped reports whether hooks are skipped in ctx.
+func HooksSkipped(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	skipped, _ := ctx.Value(skipHooksContextKey).(bool)
+	return skipped
+}
 
 // Registry is a registry of hooks by record type.
 //
@@ -69,7 +104,18 @@ func NewRegistry() *Registry {
 
 // Register adds the specific hook for the supplied recordType to be executed
 // at the moment provided by kind.
+//
+// It is equivalent to RegisterWithPriority with a priority of 0.
 func (r *Registry) Register(kind Kind, recordType string, hook Func) error {
+	return r.RegisterWithPriority(kind, recordType, 0, hook)
+}
+
+// RegisterWithPriority adds the specific hook like Register, but executes
+// it in the order of priority among the hooks of recordType and kind.
+//
+// Hooks with a lower priority are executed first. Hooks of the same
+// priority are executed in the order they are registered.
+func (r *Registry) RegisterWithPriority(kind Kind, recordType string, priority int, hook Func) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	recordTypeHookMap, err := r.recordTypeHookMap(kind)
@@ -77,16 +123,48 @@ func (r *Registry) Register(kind Kind, recordType string, hook Func) error {
 		return err
 	}
 
-	recordTypeHookMap[recordType] = append(recordTypeHookMap[recordType], hook)
+	hooks := recordTypeHookMap[recordType]
+	i := sort.Search(len(hooks), func(i int) bool {
+		return hooks[i].priority > priority
+	})
+	hooks = append(hooks, prioritizedFunc{})
+	copy(hooks[i+1:], hooks[i:])
+	hooks[i] = prioritizedFunc{priority, hook}
+	recordTypeHookMap[recordType] = hooks
 	return nil
 }
 
+// RegisterValidator adds validate as a BeforeSave hook of recordType
+// executed in the order of priority like RegisterWithPriority.
+//
+// If validate adds any problems, the save is aborted with an
+// InvalidArgument error listing the problems of each field in its info,
+// and hooks after it are not executed.
+func (r *Registry) RegisterValidator(recordType string, priority int, validate ValidateFunc) error {
+	return r.RegisterWithPriority(BeforeSave, recordType, priority, func(ctx context.Context, record *skydb.Record, originalRecord *skydb.Record) skyerr.Error {
+		errs := skydb.ValidationError{}
+		validate(ctx, record, originalRecord, &errs)
+		if err := errs.Err(); err != nil {
+			return skyerr.NewErrorWithInfo(skyerr.InvalidArgument, err.Error(), map[string]interface{}{
+				"errors": errs.Errors,
+			})
+		}
+		return nil
+	})
+}
+
 // ExecuteHooks executes registered hooks for the type of supplied record to
 // be executed at the specific kind of moment.
 //
 // If one of the hooks returns an error, it halts execution of other hooks and
 // return sthat error untouched.
+//
+// No hooks are executed if hooks are skipped in ctx by WithHooksSkipped.
 func (r *Registry) ExecuteHooks(ctx context.Context, kind Kind, record *skydb.Record, oldRecord *skydb.Record) skyerr.Error {
+	if HooksSkipped(ctx) {
+		return nil
+	}
+
 	hooks, err := r.hooks(kind, record.ID.Type)
 	if err != nil {
 		return skyerr.NewError(skyerr.UnexpectedError, "Error getting database hooks")
@@ -111,7 +189,9 @@ func (r *Registry) hooks(kind Kind, recordType string) (m []Func, err error) {
 	}
 
 	hooks := make([]Func, len(recordTypeHookMap[recordType]))
-	copy(hooks, recordTypeHookMap[recordType])
+	for i, prioritized := range recordTypeHookMap[recordType] {
+		hooks[i] = prioritized.hook
+	}
 	return hooks, nil
 }
 
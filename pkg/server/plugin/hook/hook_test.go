@@ -19,6 +19,7 @@ import (
 
 	"github.com/skygeario/skygear-server/pkg/server/plugin/hook/hooktest"
 	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	"github.com/skygeario/skygear-server/pkg/server/skyerr"
 	. "github.com/smartystreets/goconvey/convey"
 	"golang.org/x/net/context"
 )
@@ -125,6 +126,82 @@ func TestHookRegistry(t *testing.T) {
 			So(hook2.Context[0].Value(HelloContextKey), ShouldEqual, "world")
 		})
 
+		Convey("executes hooks in the order of priority", func() {
+			order := []string{}
+			appendHook := func(name string) Func {
+				return func(context.Context, *skydb.Record, *skydb.Record) skyerr.Error {
+					order = append(order, name)
+					return nil
+				}
+			}
+			registry.RegisterWithPriority(BeforeSave, "note", 10, appendHook("late"))
+			registry.Register(BeforeSave, "note", appendHook("default"))
+			registry.RegisterWithPriority(BeforeSave, "note", -10, appendHook("early"))
+			registry.RegisterWithPriority(BeforeSave, "note", 10, appendHook("late2"))
+
+			record := &skydb.Record{
+				ID: skydb.NewRecordID("note", "id"),
+			}
+			So(registry.ExecuteHooks(ctx, BeforeSave, record, nil), ShouldBeNil)
+			So(order, ShouldResemble, []string{"early", "default", "late", "late2"})
+		})
+
+		Convey("executes validators", func() {
+			order := []string{}
+			registry.RegisterValidator("note", 2, func(ctx context.Context, record *skydb.Record, originalRecord *skydb.Record, errs *skydb.ValidationError) {
+				order = append(order, "content")
+				errs.Add("content", "Required", "content is required")
+			})
+			registry.RegisterValidator("note", 1, func(ctx context.Context, record *skydb.Record, originalRecord *skydb.Record, errs *skydb.ValidationError) {
+				order = append(order, "title")
+				if _, ok := record.Data["title"]; !ok {
+					errs.Add("title", "Required", "title is required")
+				}
+				if _, ok := record.Data["body"]; !ok {
+					errs.Add("body", "Required", "body is required")
+				}
+			})
+			registry.RegisterWithPriority(BeforeSave, "note", 3, beforeSave.Func)
+
+			Convey("stopping at the first validator with problems", func() {
+				record := &skydb.Record{
+					ID:   skydb.NewRecordID("note", "id"),
+					Data: skydb.Data{},
+				}
+				err := registry.ExecuteHooks(ctx, BeforeSave, record, nil)
+				So(err, ShouldNotBeNil)
+				So(err.Code(), ShouldEqual, skyerr.InvalidArgument)
+				So(err.Message(), ShouldEqual, "body is required; title is required")
+				So(err.Info(), ShouldResemble, map[string]interface{}{
+					"errors": []skydb.FieldError{
+						{Field: "body", Code: "Required", Message: "body is required"},
+						{Field: "title", Code: "Required", Message: "title is required"},
+					},
+				})
+				So(order, ShouldResemble, []string{"title"})
+				So(beforeSave.Records, ShouldBeEmpty)
+			})
+
+			Convey("continuing to the next validator without problems", func() {
+				record := &skydb.Record{
+					ID: skydb.NewRecordID("note", "id"),
+					Data: skydb.Data{
+						"title": "Hello",
+						"body":  "World",
+					},
+				}
+				err := registry.ExecuteHooks(ctx, BeforeSave, record, nil)
+				So(err, ShouldNotBeNil)
+				So(err.Info(), ShouldResemble, map[string]interface{}{
+					"errors": []skydb.FieldError{
+						{Field: "content", Code: "Required", Message: "content is required"},
+					},
+				})
+				So(order, ShouldResemble, []string{"title", "content"})
+				So(beforeSave.Records, ShouldBeEmpty)
+			})
+		})
+
 		Convey("executes no hooks", func() {
 			record := &skydb.Record{
 				ID: skydb.NewRecordID("record", "id"),
@@ -134,6 +211,28 @@ func TestHookRegistry(t *testing.T) {
 			}, ShouldNotPanic)
 		})
 
+		Convey("executes no hooks when hooks are skipped", func() {
+			registry.Register(BeforeSave, "record", beforeSave.Func)
+			registry.Register(AfterSave, "record", afterSave.Func)
+			registry.Register(BeforeDelete, "record", beforeDelete.Func)
+			registry.Register(AfterDelete, "record", afterDelete.Func)
+
+			record := &skydb.Record{
+				ID: skydb.NewRecordID("record", "id"),
+			}
+			skippedCtx := WithHooksSkipped(ctx)
+			So(HooksSkipped(skippedCtx), ShouldBeTrue)
+			So(HooksSkipped(ctx), ShouldBeFalse)
+
+			for _, kind := range []Kind{BeforeSave, AfterSave, BeforeDelete, AfterDelete} {
+				So(registry.ExecuteHooks(skippedCtx, kind, record, nil), ShouldBeNil)
+			}
+			So(beforeSave.Records, ShouldBeEmpty)
+			So(afterSave.Records, ShouldBeEmpty)
+			So(beforeDelete.Records, ShouldBeEmpty)
+			So(afterDelete.Records, ShouldBeEmpty)
+		})
+
 		Convey("panics executing nil record", func() {
 			So(func() {
 				registry.ExecuteHooks(ctx, AfterDelete, nil, nil)
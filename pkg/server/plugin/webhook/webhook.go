@@ -0,0 +1,191 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webhook delivers record events to external HTTP endpoints.
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/skygeario/skygear-server/pkg/server/logging"
+	"github.com/skygeario/skygear-server/pkg/server/plugin/hook"
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	"github.com/skygeario/skygear-server/pkg/server/skydb/skyconv"
+	"github.com/skygeario/skygear-server/pkg/server/skyerr"
+)
+
+var log = logging.LoggerEntry("webhook")
+
+// Payload is the JSON body POSTed to a webhook.
+type Payload struct {
+	Event          hook.Kind           `json:"event"`
+	Record         *skyconv.JSONRecord `json:"record"`
+	OriginalRecord *skyconv.JSONRecord `json:"original_record"`
+}
+
+type delivery struct {
+	url  string
+	body []byte
+}
+
+// Registry registers webhooks as hooks of a hook.Registry, and delivers
+// the events of the hooks to the webhooks.
+//
+// Events are delivered asynchronously by a fixed number of workers, so
+// that the operation executing the hooks is not blocked by the webhooks.
+// An event is dropped if the delivery queue is full, or if it cannot be
+// delivered after MaxAttempts attempts.
+type Registry struct {
+	// MaxAttempts is the maximum number of attempts to deliver an event.
+	MaxAttempts int
+
+	// RetryInterval is the interval before retrying to deliver an event,
+	// which is multiplied by the number of failed attempts.
+	RetryInterval time.Duration
+
+	// Client is the http.Client delivering events.
+	Client *http.Client
+
+	hooks  *hook.Registry
+	queue  chan delivery
+	mutex  sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewRegistry returns a Registry that registers webhooks to hooks, and
+// starts workers to deliver events queued up to queueSize.
+func NewRegistry(hooks *hook.Registry, workers int, queueSize int) *Registry {
+	r := &Registry{
+		MaxAttempts:   3,
+		RetryInterval: time.Second,
+		Client:        &http.Client{Timeout: 30 * time.Second},
+		hooks:         hooks,
+		queue:         make(chan delivery, queueSize),
+	}
+
+	r.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go r.work()
+	}
+	return r
+}
+
+// Register registers a webhook of url to be notified of records of
+// recordType at the moment provided by kind, which must be either
+// hook.AfterSave or hook.AfterDelete.
+func (r *Registry) Register(kind hook.Kind, recordType string, url string) error {
+	if kind != hook.AfterSave && kind != hook.AfterDelete {
+		return fmt.Errorf("webhook cannot be registered for %s", kind)
+	}
+
+	return r.hooks.Register(kind, recordType, func(ctx context.Context, record *skydb.Record, originalRecord *skydb.Record) skyerr.Error {
+		r.enqueue(kind, url, record, originalRecord)
+		return nil
+	})
+}
+
+// Close stops accepting events, and waits until all queued events are
+// delivered.
+func (r *Registry) Close() {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return
+	}
+	r.closed = true
+	close(r.queue)
+	r.mutex.Unlock()
+
+	r.wg.Wait()
+}
+
+func (r *Registry) enqueue(kind hook.Kind, url string, record *skydb.Record, originalRecord *skydb.Record) {
+	// The payload is serialized before returning, as the records may be
+	// modified after executing the hook.
+	body, err := json.Marshal(Payload{
+		Event:          kind,
+		Record:         (*skyconv.JSONRecord)(record),
+		OriginalRecord: (*skyconv.JSONRecord)(originalRecord),
+	})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"url":    url,
+			"record": record.ID,
+			"err":    err,
+		}).Errorln("Failed to serialize webhook payload")
+		return
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.closed {
+		return
+	}
+
+	select {
+	case r.queue <- delivery{url, body}:
+	default:
+		log.WithFields(logrus.Fields{
+			"url":    url,
+			"record": record.ID,
+		}).Errorln("Webhook queue is full, dropping event")
+	}
+}
+
+func (r *Registry) work() {
+	defer r.wg.Done()
+	for d := range r.queue {
+		r.deliver(d)
+	}
+}
+
+func (r *Registry) deliver(d delivery) {
+	var err error
+	for attempt := 1; attempt <= r.MaxAttempts; attempt++ {
+		if err = r.post(d); err == nil {
+			return
+		}
+
+		if attempt < r.MaxAttempts {
+			time.Sleep(time.Duration(attempt) * r.RetryInterval)
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"url": d.url,
+		"err": err,
+	}).Errorf("Failed to deliver webhook after %d attempts", r.MaxAttempts)
+}
+
+func (r *Registry) post(d delivery) error {
+	resp, err := r.Client.Post(d.url, "application/json", bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("got status code %d", resp.StatusCode)
+	}
+	return nil
+}
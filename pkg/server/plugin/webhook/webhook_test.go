@@ -0,0 +1,145 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skygeario/skygear-server/pkg/server/plugin/hook"
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/context"
+)
+
+// recordingServer records the bodies of requests it receives, and fails
+// the first failures requests.
+type recordingServer struct {
+	mutex    sync.Mutex
+	failures int
+	bodies   []map[string]interface{}
+}
+
+func (s *recordingServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, _ := ioutil.ReadAll(req.Body)
+	body := map[string]interface{}{}
+	json.Unmarshal(data, &body)
+	s.bodies = append(s.bodies, body)
+
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	Convey("Registry", t, func() {
+		server := &recordingServer{}
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		hooks := hook.NewRegistry()
+		registry := NewRegistry(hooks, 2, 10)
+		registry.RetryInterval = time.Millisecond
+		defer registry.Close()
+
+		record := &skydb.Record{
+			ID:      skydb.NewRecordID("note", "id"),
+			OwnerID: "user0",
+			Data: skydb.Data{
+				"content": "hello",
+			},
+		}
+		ctx := context.Background()
+
+		Convey("posts records of matching events", func() {
+			So(registry.Register(hook.AfterSave, "note", ts.URL), ShouldBeNil)
+
+			So(hooks.ExecuteHooks(ctx, hook.AfterSave, record, nil), ShouldBeNil)
+			So(hooks.ExecuteHooks(ctx, hook.AfterDelete, record, nil), ShouldBeNil)
+			So(hooks.ExecuteHooks(ctx, hook.AfterSave, &skydb.Record{
+				ID: skydb.NewRecordID("comment", "id"),
+			}, nil), ShouldBeNil)
+			registry.Close()
+
+			So(server.bodies, ShouldHaveLength, 1)
+			So(server.bodies[0]["event"], ShouldEqual, "afterSave")
+			So(server.bodies[0]["original_record"], ShouldBeNil)
+			payloadRecord := server.bodies[0]["record"].(map[string]interface{})
+			So(payloadRecord["_id"], ShouldEqual, "note/id")
+			So(payloadRecord["content"], ShouldEqual, "hello")
+		})
+
+		Convey("posts records modified after executing hooks as executed", func() {
+			So(registry.Register(hook.AfterSave, "note", ts.URL), ShouldBeNil)
+
+			So(hooks.ExecuteHooks(ctx, hook.AfterSave, record, nil), ShouldBeNil)
+			record.Data["content"] = "modified"
+			registry.Close()
+
+			So(server.bodies, ShouldHaveLength, 1)
+			payloadRecord := server.bodies[0]["record"].(map[string]interface{})
+			So(payloadRecord["content"], ShouldEqual, "hello")
+		})
+
+		Convey("retries on failure", func() {
+			server.failures = 2
+			So(registry.Register(hook.AfterDelete, "note", ts.URL), ShouldBeNil)
+
+			So(hooks.ExecuteHooks(ctx, hook.AfterDelete, record, nil), ShouldBeNil)
+			registry.Close()
+
+			So(server.bodies, ShouldHaveLength, 3)
+			So(server.bodies[2], ShouldResemble, server.bodies[0])
+			So(server.bodies[2]["event"], ShouldEqual, "afterDelete")
+		})
+
+		Convey("gives up after max attempts", func() {
+			server.failures = 5
+			So(registry.Register(hook.AfterSave, "note", ts.URL), ShouldBeNil)
+
+			So(hooks.ExecuteHooks(ctx, hook.AfterSave, record, nil), ShouldBeNil)
+			registry.Close()
+
+			So(server.bodies, ShouldHaveLength, 3)
+		})
+
+		Convey("does not block executing hooks when queue is full", func() {
+			blocking := make(chan struct{})
+			blockingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				<-blocking
+			}))
+			defer blockingServer.Close()
+
+			So(registry.Register(hook.AfterSave, "note", blockingServer.URL), ShouldBeNil)
+			for i := 0; i < 20; i++ {
+				So(hooks.ExecuteHooks(ctx, hook.AfterSave, record, nil), ShouldBeNil)
+			}
+			close(blocking)
+		})
+
+		Convey("rejects events other than after save and delete", func() {
+			So(registry.Register(hook.BeforeSave, "note", ts.URL), ShouldNotBeNil)
+		})
+	})
+}
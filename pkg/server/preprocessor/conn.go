@@ -25,17 +25,20 @@ import (
 type ConnPreprocessor struct {
 	AppName       string
 	AccessControl string
-	DBOpener      func(string, string, string, string, bool) (skydb.Conn, error)
+	DBOpener      func(string, string, string, string, bool, skydb.Config) (skydb.Conn, error)
 	DBImpl        string
 	Option        string
 	DevMode       bool
+
+	// Config is the record configuration of the app passed to DBOpener.
+	Config skydb.Config
 }
 
 func (p ConnPreprocessor) Preprocess(payload *router.Payload, response *router.Response) int {
 	log.Debugf("Opening DBConn: {%v %v %v}", p.DBImpl, p.AppName, p.Option)
 
 	canMigrate := payload.HasMasterKey() || p.DevMode
-	conn, err := p.DBOpener(p.DBImpl, p.AppName, p.AccessControl, p.Option, canMigrate)
+	conn, err := p.DBOpener(p.DBImpl, p.AppName, p.AccessControl, p.Option, canMigrate, p.Config)
 	if err != nil {
 		response.Err = skyerr.NewError(skyerr.UnexpectedUnableToOpenDatabase, err.Error())
 		return http.StatusServiceUnavailable
@@ -42,6 +42,7 @@ func defaultStatusCode(err skyerr.Error) int {
 		skyerr.NotImplemented:          http.StatusNotImplemented,
 		skyerr.PluginUnavailable:       http.StatusServiceUnavailable,
 		skyerr.PluginTimeout:           http.StatusGatewayTimeout,
+		skyerr.QueryTimeout:            http.StatusGatewayTimeout,
 		skyerr.RecordQueryInvalid:      http.StatusBadRequest,
 	}[err.Code()]
 	if !ok {
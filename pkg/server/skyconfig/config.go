@@ -22,6 +22,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/skygeario/skygear-server/pkg/server/uuid"
@@ -47,6 +48,65 @@ type PluginConfig struct {
 	Args      []string
 }
 
+// WebhookConfig is a webhook notified of records of RecordType at the
+// moment of Event, which is either "afterSave" or "afterDelete".
+type WebhookConfig struct {
+	URL        string
+	Event      string
+	RecordType string
+}
+
+// RecordConfig is the configuration of the records of a record type.
+//
+// Settings taking functions, such as virtual fields, schema migrators,
+// query engines and read hooks, cannot be read from the environment and
+// are not configured here.
+type RecordConfig struct {
+	// DefaultSorts are key paths, sorted in descending order if prefixed
+	// by "-".
+	DefaultSorts []string
+
+	// FieldOrders are the orders of the values of fields, keyed by field
+	// name.
+	FieldOrders map[string][]string
+
+	// DeleteCascade and DeleteSetNull are the reference fields with the
+	// cascade and set null delete policies respectively.
+	DeleteCascade []string
+	DeleteSetNull []string
+
+	RetentionMaxAge   time.Duration
+	RetentionMaxCount int
+
+	// SpecialFloats is either "reject" or "encode".
+	SpecialFloats string
+
+	WriteRate  float64
+	WriteBurst int
+
+	// Rollup derives records of the record type from records of
+	// RollupSourceType if set. RollupAggregate is one of "count", "sum",
+	// "avg", "min" and "max".
+	RollupSourceType string
+	RollupGroupKey   string
+	RollupAggregate  string
+	RollupField      string
+
+	SchemaVersion   int
+	LenientDecoding bool
+
+	// FieldMasks are keyed by field name.
+	FieldMasks map[string]*FieldMaskConfig
+}
+
+// FieldMaskConfig masks a field from readers without one of Roles. The
+// masked field is replaced by Replacement, or removed if Replacement is
+// empty.
+type FieldMaskConfig struct {
+	Roles       []string
+	Replacement string
+}
+
 // Configuration is Skygear's configuration
 // The configuration will load in following order:
 // 1. The ENV
@@ -122,9 +182,31 @@ type Configuration struct {
 		SentryDSN   string
 		SentryLevel string
 	} `json:"-"`
+	Subscription struct {
+		// BatchWindow is the number of milliseconds notices to a device
+		// are grouped into a single notification. Notices are sent
+		// immediately if it is zero.
+		BatchWindow  int `json:"batch_window"`
+		MaxBatchSize int `json:"max_batch_size"`
+	} `json:"subscription"`
 	Zmq struct {
 		Timeout int `json:"timeout"`
 	} `json:"zmq"`
+	Webhook struct {
+		// Workers is the number of webhook events delivered at once,
+		// and QueueSize is the number of events waiting for delivery,
+		// beyond which events are dropped.
+		Workers     int                       `json:"workers"`
+		QueueSize   int                       `json:"queue_size"`
+		MaxAttempts int                       `json:"max_attempts"`
+		Hooks       map[string]*WebhookConfig `json:"-"`
+	} `json:"webhook"`
+	Record struct {
+		// ChangelogRetention is the duration changes of records are
+		// kept for. Changes are kept indefinitely if it is zero.
+		ChangelogRetention time.Duration            `json:"-"`
+		Types              map[string]*RecordConfig `json:"-"`
+	} `json:"-"`
 	Plugin map[string]*PluginConfig `json:"-"`
 }
 
@@ -153,7 +235,14 @@ func NewConfiguration() Configuration {
 	}
 	config.LOG.RouterByteLimit = 100000
 	config.LogHook.SentryLevel = "error"
+	config.Subscription.BatchWindow = 0
+	config.Subscription.MaxBatchSize = 100
 	config.Zmq.Timeout = 30
+	config.Webhook.Workers = 4
+	config.Webhook.QueueSize = 100
+	config.Webhook.MaxAttempts = 3
+	config.Webhook.Hooks = map[string]*WebhookConfig{}
+	config.Record.Types = map[string]*RecordConfig{}
 	config.Plugin = map[string]*PluginConfig{}
 	return config
 }
@@ -181,6 +270,47 @@ func (config *Configuration) Validate() error {
 	if config.APNS.Enable && !regexp.MustCompile("^(sandbox|production)$").MatchString(config.APNS.Env) {
 		return fmt.Errorf("APNS_ENV must be sandbox or production")
 	}
+	for name, webhook := range config.Webhook.Hooks {
+		if webhook.URL == "" {
+			return fmt.Errorf("%s_URL is not set", name)
+		}
+		if webhook.Event != "afterSave" && webhook.Event != "afterDelete" {
+			return fmt.Errorf("%s_EVENT must be afterSave or afterDelete", name)
+		}
+		if webhook.RecordType == "" {
+			return fmt.Errorf("%s_RECORD_TYPE is not set", name)
+		}
+	}
+	for name, record := range config.Record.Types {
+		if err := record.validate(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (record *RecordConfig) validate(name string) error {
+	if record.SpecialFloats != "" && record.SpecialFloats != "reject" && record.SpecialFloats != "encode" {
+		return fmt.Errorf("%s_SPECIAL_FLOATS must be reject or encode", name)
+	}
+	if (record.WriteRate != 0 || record.WriteBurst != 0) && (record.WriteRate <= 0 || record.WriteBurst <= 0) {
+		return fmt.Errorf("%s_WRITE_RATE and %s_WRITE_BURST must both be positive", name, name)
+	}
+	if record.RollupSourceType == "" {
+		return nil
+	}
+	if record.RollupGroupKey == "" {
+		return fmt.Errorf("%s_ROLLUP_GROUP_KEY is not set", name)
+	}
+	switch record.RollupAggregate {
+	case "", "count":
+	case "sum", "avg", "min", "max":
+		if record.RollupField == "" {
+			return fmt.Errorf("%s_ROLLUP_FIELD is not set", name)
+		}
+	default:
+		return fmt.Errorf("%s_ROLLUP_AGGREGATE must be count, sum, avg, min or max", name)
+	}
 	return nil
 }
 
@@ -239,7 +369,10 @@ func (config *Configuration) ReadFromEnv() {
 	config.readAPNS()
 	config.readGCM()
 	config.readLog()
+	config.readSubscription()
 	config.readPlugins()
+	config.readWebhooks()
+	config.readRecords()
 }
 
 func (config *Configuration) readHost() {
@@ -423,6 +556,16 @@ func (config *Configuration) readLog() {
 	}
 }
 
+func (config *Configuration) readSubscription() {
+	if window, err := strconv.Atoi(os.Getenv("SUBSCRIPTION_BATCH_WINDOW")); err == nil {
+		config.Subscription.BatchWindow = window
+	}
+
+	if size, err := strconv.Atoi(os.Getenv("SUBSCRIPTION_MAX_BATCH_SIZE")); err == nil {
+		config.Subscription.MaxBatchSize = size
+	}
+}
+
 func (config *Configuration) readPlugins() {
 	timeoutStr := os.Getenv("ZMQ_TIMEOUT")
 	timeout, err := strconv.Atoi(timeoutStr)
@@ -447,3 +590,99 @@ func (config *Configuration) readPlugins() {
 		config.Plugin[p] = pluginConfig
 	}
 }
+
+func (config *Configuration) readWebhooks() {
+	if workers, err := strconv.Atoi(os.Getenv("WEBHOOK_WORKERS")); err == nil {
+		config.Webhook.Workers = workers
+	}
+
+	if size, err := strconv.Atoi(os.Getenv("WEBHOOK_QUEUE_SIZE")); err == nil {
+		config.Webhook.QueueSize = size
+	}
+
+	if attempts, err := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS")); err == nil {
+		config.Webhook.MaxAttempts = attempts
+	}
+
+	webhook := os.Getenv("WEBHOOKS")
+	if webhook == "" {
+		return
+	}
+
+	webhooks := strings.Split(webhook, ",")
+	for _, w := range webhooks {
+		config.Webhook.Hooks[w] = &WebhookConfig{
+			URL:        os.Getenv(w + "_URL"),
+			Event:      os.Getenv(w + "_EVENT"),
+			RecordType: os.Getenv(w + "_RECORD_TYPE"),
+		}
+	}
+}
+
+// splitList splits a comma-separated list, which is nil if str is empty.
+func splitList(str string) []string {
+	if str == "" {
+		return nil
+	}
+	return strings.Split(str, ",")
+}
+
+func (config *Configuration) readRecords() {
+	if retention, err := time.ParseDuration(os.Getenv("CHANGELOG_RETENTION")); err == nil {
+		config.Record.ChangelogRetention = retention
+	}
+
+	recordTypes := os.Getenv("RECORD_TYPES")
+	if recordTypes == "" {
+		return
+	}
+
+	for _, t := range strings.Split(recordTypes, ",") {
+		record := &RecordConfig{
+			DefaultSorts:     splitList(os.Getenv(t + "_DEFAULT_SORTS")),
+			FieldOrders:      map[string][]string{},
+			DeleteCascade:    splitList(os.Getenv(t + "_DELETE_CASCADE")),
+			DeleteSetNull:    splitList(os.Getenv(t + "_DELETE_SET_NULL")),
+			SpecialFloats:    os.Getenv(t + "_SPECIAL_FLOATS"),
+			RollupSourceType: os.Getenv(t + "_ROLLUP_SOURCE_TYPE"),
+			RollupGroupKey:   os.Getenv(t + "_ROLLUP_GROUP_KEY"),
+			RollupAggregate:  os.Getenv(t + "_ROLLUP_AGGREGATE"),
+			RollupField:      os.Getenv(t + "_ROLLUP_FIELD"),
+			FieldMasks:       map[string]*FieldMaskConfig{},
+		}
+
+		for _, field := range splitList(os.Getenv(t + "_ORDERED_FIELDS")) {
+			record.FieldOrders[field] = splitList(os.Getenv(t + "_" + field + "_ORDER"))
+		}
+
+		if maxAge, err := time.ParseDuration(os.Getenv(t + "_RETENTION_MAX_AGE")); err == nil {
+			record.RetentionMaxAge = maxAge
+		}
+		if maxCount, err := strconv.Atoi(os.Getenv(t + "_RETENTION_MAX_COUNT")); err == nil {
+			record.RetentionMaxCount = maxCount
+		}
+
+		if rate, err := strconv.ParseFloat(os.Getenv(t+"_WRITE_RATE"), 64); err == nil {
+			record.WriteRate = rate
+		}
+		if burst, err := strconv.Atoi(os.Getenv(t + "_WRITE_BURST")); err == nil {
+			record.WriteBurst = burst
+		}
+
+		if version, err := strconv.Atoi(os.Getenv(t + "_SCHEMA_VERSION")); err == nil {
+			record.SchemaVersion = version
+		}
+		if lenient, err := parseBool(os.Getenv(t + "_LENIENT_DECODING")); err == nil {
+			record.LenientDecoding = lenient
+		}
+
+		for _, field := range splitList(os.Getenv(t + "_MASKED_FIELDS")) {
+			record.FieldMasks[field] = &FieldMaskConfig{
+				Roles:       splitList(os.Getenv(t + "_" + field + "_MASK_ROLES")),
+				Replacement: os.Getenv(t + "_" + field + "_MASK_REPLACEMENT"),
+			}
+		}
+
+		config.Record.Types[t] = record
+	}
+}
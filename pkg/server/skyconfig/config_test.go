@@ -3,6 +3,7 @@ package skyconfig
 import (
 	"os"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -154,5 +155,106 @@ func TestRequiredConfig(t *testing.T) {
 			os.Setenv("BUG_TRANSPORT", "")
 			os.Setenv("BUG_PATH", "")
 		})
+
+		Convey("Read webhook config correctly", func() {
+			config := NewConfigurationWithKeys()
+			os.Setenv("WEBHOOKS", "ORDER")
+			os.Setenv("ORDER_URL", "http://example.com/order")
+			os.Setenv("ORDER_EVENT", "afterSave")
+			os.Setenv("ORDER_RECORD_TYPE", "order")
+			os.Setenv("WEBHOOK_WORKERS", "2")
+
+			config.readWebhooks()
+			So(config.Webhook.Workers, ShouldEqual, 2)
+			So(config.Webhook.QueueSize, ShouldEqual, 100)
+			So(config.Webhook.Hooks["ORDER"], ShouldResemble, &WebhookConfig{
+				"http://example.com/order",
+				"afterSave",
+				"order",
+			})
+			So(config.Validate(), ShouldBeNil)
+
+			config.Webhook.Hooks["ORDER"].Event = "beforeSave"
+			So(config.Validate(), ShouldNotBeNil)
+
+			os.Setenv("WEBHOOKS", "")
+			os.Setenv("ORDER_URL", "")
+			os.Setenv("ORDER_EVENT", "")
+			os.Setenv("ORDER_RECORD_TYPE", "")
+			os.Setenv("WEBHOOK_WORKERS", "")
+		})
+
+		Convey("Read record config correctly", func() {
+			config := NewConfigurationWithKeys()
+			os.Setenv("CHANGELOG_RETENTION", "720h")
+			os.Setenv("RECORD_TYPES", "note,daily")
+			os.Setenv("note_DEFAULT_SORTS", "-priority,title")
+			os.Setenv("note_ORDERED_FIELDS", "priority")
+			os.Setenv("note_priority_ORDER", "low,medium,high")
+			os.Setenv("note_DELETE_CASCADE", "attachment")
+			os.Setenv("note_RETENTION_MAX_COUNT", "1000")
+			os.Setenv("note_SPECIAL_FLOATS", "encode")
+			os.Setenv("note_WRITE_RATE", "0.5")
+			os.Setenv("note_WRITE_BURST", "10")
+			os.Setenv("note_LENIENT_DECODING", "yes")
+			os.Setenv("note_MASKED_FIELDS", "email")
+			os.Setenv("note_email_MASK_ROLES", "admin,support")
+			os.Setenv("daily_ROLLUP_SOURCE_TYPE", "note")
+			os.Setenv("daily_ROLLUP_GROUP_KEY", "day")
+
+			config.readRecords()
+			So(config.Record.ChangelogRetention, ShouldEqual, 720*time.Hour)
+			So(config.Record.Types["note"], ShouldResemble, &RecordConfig{
+				DefaultSorts: []string{"-priority", "title"},
+				FieldOrders: map[string][]string{
+					"priority": {"low", "medium", "high"},
+				},
+				DeleteCascade:     []string{"attachment"},
+				RetentionMaxCount: 1000,
+				SpecialFloats:     "encode",
+				WriteRate:         0.5,
+				WriteBurst:        10,
+				LenientDecoding:   true,
+				FieldMasks: map[string]*FieldMaskConfig{
+					"email": {
+						Roles: []string{"admin", "support"},
+					},
+				},
+			})
+			So(config.Record.Types["daily"], ShouldResemble, &RecordConfig{
+				FieldOrders:      map[string][]string{},
+				RollupSourceType: "note",
+				RollupGroupKey:   "day",
+				FieldMasks:       map[string]*FieldMaskConfig{},
+			})
+			So(config.Validate(), ShouldBeNil)
+
+			config.Record.Types["note"].SpecialFloats = "ignore"
+			So(config.Validate(), ShouldNotBeNil)
+			config.Record.Types["note"].SpecialFloats = ""
+
+			config.Record.Types["note"].WriteBurst = 0
+			So(config.Validate(), ShouldNotBeNil)
+			config.Record.Types["note"].WriteBurst = 10
+
+			config.Record.Types["daily"].RollupAggregate = "sum"
+			So(config.Validate(), ShouldNotBeNil)
+
+			os.Setenv("CHANGELOG_RETENTION", "")
+			os.Setenv("RECORD_TYPES", "")
+			os.Setenv("note_DEFAULT_SORTS", "")
+			os.Setenv("note_ORDERED_FIELDS", "")
+			os.Setenv("note_priority_ORDER", "")
+			os.Setenv("note_DELETE_CASCADE", "")
+			os.Setenv("note_RETENTION_MAX_COUNT", "")
+			os.Setenv("note_SPECIAL_FLOATS", "")
+			os.Setenv("note_WRITE_RATE", "")
+			os.Setenv("note_WRITE_BURST", "")
+			os.Setenv("note_LENIENT_DECODING", "")
+			os.Setenv("note_MASKED_FIELDS", "")
+			os.Setenv("note_email_MASK_ROLES", "")
+			os.Setenv("daily_ROLLUP_SOURCE_TYPE", "")
+			os.Setenv("daily_ROLLUP_GROUP_KEY", "")
+		})
 	})
 }
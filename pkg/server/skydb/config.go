@@ -0,0 +1,209 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skydb
+
+import (
+	"time"
+)
+
+// Config is the configuration of the records of an app, passed to Open
+// and shared by the Databases of the Conn opened.
+//
+// Maps are keyed by record type, and then by field name where a setting
+// applies to a field. Open copies the Config, such that modifying it
+// afterwards does not affect Conns opened.
+type Config struct {
+	// DefaultSorts are the sorts applied by Query to records of the
+	// record type when the query specifies no sorts.
+	DefaultSorts map[string][]Sort
+
+	// FieldOrders are the orders of the values of string fields, such as
+	// "low", "medium" and "high" of an enum-like field. Query sorts the
+	// field and compares it in range predicates by the position of its
+	// value instead of alphabetically. Values not in the order are
+	// ordered after all of them.
+	FieldOrders map[string]map[string][]string
+
+	// QueryEngines are the query engines to which Query delegates queries
+	// of the record type matched by the engine. Other queries are
+	// executed by the Database itself.
+	QueryEngines map[string]QueryEngine
+
+	// DeletePolicies are what deleting a record does to records whose
+	// reference field references the deleted record. The delete policy
+	// of a reference field is DeleteRestrict unless configured. The
+	// policies take effect once Extend is called on the record type.
+	DeletePolicies map[string]map[string]DeletePolicy
+
+	// RetentionPolicies are enforced by Database.ApplyRetention. Records
+	// of a record type without a policy are kept indefinitely.
+	RetentionPolicies map[string]RetentionPolicy
+
+	// ChangelogRetention is the duration changes are kept for
+	// Database.Changes, enforced by Database.ApplyRetention. A zero
+	// ChangelogRetention keeps changes indefinitely.
+	ChangelogRetention time.Duration
+
+	// SpecialFloatPolicies are how Save and Create handle NaN and
+	// infinite numbers. The policy is RejectSpecialFloats unless
+	// configured.
+	SpecialFloatPolicies map[string]SpecialFloatPolicy
+
+	// WriteRateLimits limit the rate Save and Create write records. A
+	// write exceeding the limit returns ErrRateLimited without writing
+	// the record. A write takes a token of the limit when it is made,
+	// which is refunded if the write fails or its transaction is rolled
+	// back. Reads, ValidateSave and records written by the Database
+	// itself, such as by ImportBundle, are not limited.
+	WriteRateLimits map[string]WriteRateLimit
+
+	// Rollups maintain records of the derived record type they are keyed
+	// by. Writes of records of the source record type update the
+	// derived records of the groups the records are in before and after
+	// the change, in the same transaction, whatever writes the records.
+	// A rollup takes effect once Extend is called on its source record
+	// type, which derives the records from the existing records.
+	Rollups map[string]Rollup
+
+	// VirtualFields are computed for each record returned by Get,
+	// GetByIDs, Query and Save, and are never persisted. A virtual field
+	// takes precedence over a stored field of the same name. Virtual
+	// fields cannot be queried or sorted.
+	VirtualFields map[string]map[string]VirtualFieldFunc
+
+	// SchemaVersions are the current schema versions of record types.
+	// Records saved are stamped with the version, and records written
+	// under an older version are up-converted on read by SchemaMigrators.
+	SchemaVersions map[string]int
+
+	// SchemaMigrators up-convert records from the schema version they
+	// are keyed by to the next version. Records saved before the record
+	// type is versioned are of version 0.
+	//
+	// Get, GetByIDs and Query apply migrators one version after another
+	// until a record reaches the current schema version, or a migrator is
+	// missing. Up-converted records are not written back.
+	SchemaMigrators map[string]map[int]SchemaMigratorFunc
+
+	// LenientDecoding are the record types decoded leniently. By default,
+	// Get, GetByIDs and Query fail on a record with a field that cannot
+	// be decoded. Decoded leniently, the record is returned without such
+	// fields, which are listed in its DroppedFields instead.
+	LenientDecoding map[string]bool
+
+	// FieldMasks are applied by the access-aware reads of handlers to
+	// records returned to unprivileged readers. Records are stored
+	// intact.
+	FieldMasks map[string]map[string]FieldMask
+
+	// ReadHooks are called with each record returned by Get, GetByIDs
+	// and Query.
+	//
+	// Hooks observe reads without blocking them. They are called
+	// asynchronously by a fixed number of workers, and records read
+	// while the workers are busy and their queue is full are not passed
+	// to hooks.
+	ReadHooks []ReadHookFunc
+
+	// Observer is notified of the operations of the Databases of the
+	// Conn opened. Operations are not observed if Observer is nil.
+	Observer OperationObserver
+}
+
+// Copy returns a copy of the Config, which shares no maps or slices with
+// it.
+func (c Config) Copy() Config {
+	copied := Config{
+		DefaultSorts:         map[string][]Sort{},
+		FieldOrders:          map[string]map[string][]string{},
+		QueryEngines:         map[string]QueryEngine{},
+		DeletePolicies:       map[string]map[string]DeletePolicy{},
+		RetentionPolicies:    map[string]RetentionPolicy{},
+		SpecialFloatPolicies: map[string]SpecialFloatPolicy{},
+		WriteRateLimits:      map[string]WriteRateLimit{},
+		Rollups:              map[string]Rollup{},
+		VirtualFields:        map[string]map[string]VirtualFieldFunc{},
+		SchemaVersions:       map[string]int{},
+		SchemaMigrators:      map[string]map[int]SchemaMigratorFunc{},
+		LenientDecoding:      map[string]bool{},
+		FieldMasks:           map[string]map[string]FieldMask{},
+		ChangelogRetention:   c.ChangelogRetention,
+		ReadHooks:            append([]ReadHookFunc{}, c.ReadHooks...),
+		Observer:             c.Observer,
+	}
+
+	for recordType, sorts := range c.DefaultSorts {
+		copied.DefaultSorts[recordType] = append([]Sort{}, sorts...)
+	}
+	for recordType, orders := range c.FieldOrders {
+		copiedOrders := map[string][]string{}
+		for fieldName, values := range orders {
+			copiedOrders[fieldName] = append([]string{}, values...)
+		}
+		copied.FieldOrders[recordType] = copiedOrders
+	}
+	for recordType, engine := range c.QueryEngines {
+		copied.QueryEngines[recordType] = engine
+	}
+	for recordType, policies := range c.DeletePolicies {
+		copiedPolicies := map[string]DeletePolicy{}
+		for fieldName, policy := range policies {
+			copiedPolicies[fieldName] = policy
+		}
+		copied.DeletePolicies[recordType] = copiedPolicies
+	}
+	for recordType, policy := range c.RetentionPolicies {
+		copied.RetentionPolicies[recordType] = policy
+	}
+	for recordType, policy := range c.SpecialFloatPolicies {
+		copied.SpecialFloatPolicies[recordType] = policy
+	}
+	for recordType, limit := range c.WriteRateLimits {
+		copied.WriteRateLimits[recordType] = limit
+	}
+	for derivedType, rollup := range c.Rollups {
+		copied.Rollups[derivedType] = rollup
+	}
+	for recordType, fields := range c.VirtualFields {
+		copiedFields := map[string]VirtualFieldFunc{}
+		for fieldName, fn := range fields {
+			copiedFields[fieldName] = fn
+		}
+		copied.VirtualFields[recordType] = copiedFields
+	}
+	for recordType, version := range c.SchemaVersions {
+		copied.SchemaVersions[recordType] = version
+	}
+	for recordType, migrators := range c.SchemaMigrators {
+		copiedMigrators := map[int]SchemaMigratorFunc{}
+		for fromVersion, fn := range migrators {
+			copiedMigrators[fromVersion] = fn
+		}
+		copied.SchemaMigrators[recordType] = copiedMigrators
+	}
+	for recordType, lenient := range c.LenientDecoding {
+		copied.LenientDecoding[recordType] = lenient
+	}
+	for recordType, masks := range c.FieldMasks {
+		copiedMasks := map[string]FieldMask{}
+		for fieldName, mask := range masks {
+			mask.Roles = append([]string{}, mask.Roles...)
+			copiedMasks[fieldName] = mask
+		}
+		copied.FieldMasks[recordType] = copiedMasks
+	}
+
+	return copied
+}
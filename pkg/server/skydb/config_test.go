@@ -0,0 +1,63 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skydb
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfigCopy(t *testing.T) {
+	Convey("Config.Copy", t, func() {
+		sorts := []Sort{{KeyPath: "noteOrder", Order: Desc}}
+		values := []string{"low", "high"}
+		roles := []string{"hr"}
+		config := Config{
+			DefaultSorts: map[string][]Sort{"note": sorts},
+			FieldOrders: map[string]map[string][]string{
+				"task": {"priority": values},
+			},
+			FieldMasks: map[string]map[string]FieldMask{
+				"employee": {"ssn": {Roles: roles}},
+			},
+			WriteRateLimits: map[string]WriteRateLimit{
+				"note": {Rate: 1, Burst: 1},
+			},
+		}
+
+		copied := config.Copy()
+		sorts[0].KeyPath = "title"
+		values[0] = "medium"
+		roles[0] = "manager"
+		config.DefaultSorts["event"] = sorts
+		config.WriteRateLimits["note"] = WriteRateLimit{Rate: 2, Burst: 2}
+
+		Convey("does not share slices", func() {
+			So(copied.DefaultSorts["note"][0].KeyPath, ShouldEqual, "noteOrder")
+			So(copied.FieldOrders["task"]["priority"], ShouldResemble, []string{"low", "high"})
+			So(copied.FieldMasks["employee"]["ssn"].Roles, ShouldResemble, []string{"hr"})
+		})
+
+		Convey("does not share maps", func() {
+			So(copied.DefaultSorts, ShouldNotContainKey, "event")
+			So(copied.WriteRateLimits["note"], ShouldResemble, WriteRateLimit{Rate: 1, Burst: 1})
+		})
+
+		Convey("copies empty config", func() {
+			So(Config{}.Copy().DefaultSorts, ShouldBeEmpty)
+		})
+	})
+}
@@ -16,6 +16,7 @@ package skydb
 
 import (
 	"errors"
+	"io"
 	"time"
 )
 
@@ -46,6 +47,12 @@ var ZeroTime = time.Time{}
 // DBHookFunc specifies the interface of a database hook function
 type DBHookFunc func(Database, *Record, RecordHookEvent)
 
+// ReadHookFunc specifies the interface of a function observing records
+// read from a Database, as configured by Config.ReadHooks.
+//
+// The record is a copy of the record returned to the reader.
+type ReadHookFunc func(record *Record)
+
 // QueryConfig provides optional parameters for queries.
 // result is unlimited if Limit=0
 type QueryConfig struct {
@@ -153,6 +160,27 @@ type Conn interface {
 	PrivateDB(userKey string) Database
 	UnionDB() Database
 
+	// OpenSnapshot opens a SnapshotDatabase over the current state of
+	// the public Database, for reading a consistent picture of records
+	// while writes continue on the Conn.
+	OpenSnapshot() (SnapshotDatabase, error)
+
+	// ExportBundle writes the configuration and records of the container
+	// to w as a bundle, which can be read by ImportBundle of a Conn of
+	// another container to reproduce them. The container is read at a
+	// snapshot, as by OpenSnapshot.
+	//
+	// Users and devices are tied to the accounts and installations of the
+	// container, and are not included in the bundle. Subscriptions belong
+	// to devices, so ExportBundle returns an error instead of writing a
+	// bundle without them if the container has any.
+	ExportBundle(w io.Writer) error
+
+	// ImportBundle reads a bundle written by ExportBundle from r, and
+	// creates the record types, configuration and records in it in the
+	// container.
+	ImportBundle(r io.Reader) error
+
 	// Subscribe registers the specified recordEventChan to receive
 	// RecordEvent from the Conn implementation
 	Subscribe(recordEventChan chan RecordEvent) error
@@ -193,3 +221,19 @@ type RecordEvent struct {
 	Record *Record
 	Event  RecordHookEvent
 }
+
+// Change describes a change on Record emitted by Database.Changes.
+//
+// For RecordCreated or RecordUpdated event, Record is the newly
+// created / updated Record. For RecordDeleted, Record is the Record
+// being deleted.
+//
+// Seq is a unique sequence number of the change. It can be passed to
+// Database.Changes to resume receiving changes after this change. Changes
+// are delivered in the order they become final, which does not always
+// follow Seq.
+type Change struct {
+	Seq    uint64
+	Record *Record
+	Event  RecordHookEvent
+}
@@ -17,12 +17,110 @@ package skydb
 import (
 	"errors"
 	"io"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 // ErrRecordNotFound is returned from Get and Delete when Database
 // cannot find the Record by the specified key
 var ErrRecordNotFound = errors.New("skydb: Record not found for the specified key")
 
+// ErrRecordDuplicated is returned from Create and RenameRecord when
+// a Record with the specified key already exists
+var ErrRecordDuplicated = errors.New("skydb: Record with the specified key already exists")
+
+// ErrUniqueConstraintViolation is returned from Save and Create when the
+// Record has the same value as another Record on a field with a unique
+// constraint
+var ErrUniqueConstraintViolation = errors.New("skydb: Record violates a unique constraint")
+
+// ErrEnumConstraintViolation is returned from Save and Create when the
+// Record has a value not in the allowed values of a field with an enum
+// constraint
+var ErrEnumConstraintViolation = errors.New("skydb: Record has a value not allowed by an enum constraint")
+
+// ErrLeaseHeld is returned by Database.AcquireLease if the record is
+// leased by another holder and the lease has not expired.
+var ErrLeaseHeld = errors.New("skydb: Record is leased by another holder")
+
+// ErrLeaseNotHeld is returned by Database.ReleaseLease if the record is
+// not leased with the specified token.
+var ErrLeaseNotHeld = errors.New("skydb: Record is not leased with the specified token")
+
+// ErrFieldNotArray is returned by Database.ArrayAppend and
+// Database.ArrayRemove if the field holds a value other than an array.
+var ErrFieldNotArray = errors.New("skydb: Field value is not an array")
+
+// ErrRecordReferenced is returned by Database.Delete if the record is
+// referenced by other records through a field of the DeleteRestrict
+// policy.
+var ErrRecordReferenced = errors.New("skydb: Record is referenced by other records")
+
+// ErrRecordConflict is returned by Database.SaveIfMatch and
+// Database.DeleteIfMatch if the record has been updated since the expected
+// time.
+var ErrRecordConflict = errors.New("skydb: Record has been updated since the expected time")
+
+// ErrQueryTimeout is returned by Database.Query if the query exceeds
+// the maximum query duration the Conn is opened with.
+var ErrQueryTimeout = errors.New("skydb: Query exceeded the maximum query duration")
+
+// ErrRateLimited is returned by Database.Save and Database.Create if writes
+// to the record type exceed its WriteRateLimit.
+var ErrRateLimited = errors.New("skydb: Writes to the record type exceeded the rate limit")
+
+// ErrSpecialFloat is returned by Database.Save and Database.Create if a
+// field of the record holds NaN or an infinite number, and the record type
+// has the RejectSpecialFloats policy.
+var ErrSpecialFloat = errors.New("skydb: Record contains NaN or infinite number")
+
+// SpecialFloatPolicy specifies how Save and Create handle the special
+// float values NaN, +Inf and -Inf, which JSON cannot represent.
+type SpecialFloatPolicy int
+
+const (
+	// RejectSpecialFloats makes Save and Create return ErrSpecialFloat.
+	RejectSpecialFloats SpecialFloatPolicy = iota
+
+	// EncodeSpecialFloats saves special floats. A number field stores them
+	// as is. In a JSON field they are stored as {"$float": "NaN"},
+	// {"$float": "Inf"} or {"$float": "-Inf"}, which Get and Query decode
+	// back to the special floats.
+	EncodeSpecialFloats
+)
+
+// CollisionPolicy specifies how Create handles a Record with the specified
+// key that already exists.
+type CollisionPolicy int
+
+const (
+	// FailOnCollision makes Create return ErrRecordDuplicated.
+	FailOnCollision CollisionPolicy = iota
+
+	// SuffixOnCollision makes Create append a numeric suffix to the key,
+	// as in "slug-2", "slug-3" and so on, until the key is unique.
+	SuffixOnCollision
+)
+
+// DeletePolicy specifies what deleting a record does to the records
+// referencing it through a reference field, whether the record is
+// deleted by Delete, DeleteByQuery or ApplyRetention.
+type DeletePolicy int
+
+const (
+	// DeleteRestrict fails the deletion with ErrRecordReferenced.
+	DeleteRestrict DeletePolicy = iota
+
+	// DeleteCascade deletes the referencing records as well, applying
+	// the delete policies of the fields referencing them in turn.
+	DeleteCascade
+
+	// DeleteSetNull sets the referencing field to null, updating the
+	// referencing records.
+	DeleteSetNull
+)
+
 // EmptyRows is a convenient variable that acts as an empty Rows.
 // Useful for skydb implementators and testing.
 var EmptyRows = NewRows(emptyRowsIter(0))
@@ -66,6 +164,65 @@ const (
 	UnionDatabase
 )
 
+// SaveResult is the result of Database.SaveWithResult.
+type SaveResult struct {
+	// Record is the saved Record.
+	Record *Record
+
+	// Previous is the Record before it is saved. It is nil if the
+	// Record is created.
+	Previous *Record
+}
+
+// SavePreview is the result of Database.ValidateSave.
+type SavePreview struct {
+	// Record is the Record as it would be saved, including metadata and
+	// virtual fields. Sequence fields not supplied are not assigned, since
+	// a sequence would be advanced by assigning them.
+	Record *Record
+
+	// Previous is the Record before the save. It is nil if the Record
+	// would be created.
+	Previous *Record
+
+	// ChangedKeys are the sorted keys of the fields whose values would
+	// be changed by the save.
+	ChangedKeys []string
+}
+
+// UpsertStatus is the outcome of upserting a Record by Database.UpsertAll.
+type UpsertStatus int
+
+const (
+	// UpsertCreated means the Record is created.
+	UpsertCreated UpsertStatus = iota
+
+	// UpsertUpdated means an existing Record is updated.
+	UpsertUpdated
+
+	// UpsertFailed means the Record is not saved.
+	UpsertFailed
+)
+
+// UpsertResult is the result of upserting a Record by Database.UpsertAll.
+type UpsertResult struct {
+	// Record is the upserted Record.
+	Record *Record
+
+	Status UpsertStatus
+
+	// Err is the reason the Record is not saved if Status is
+	// UpsertFailed.
+	Err error
+}
+
+// BatchUpsertResult is the result of Database.UpsertAll.
+type BatchUpsertResult struct {
+	// Results are the results of the Records in the order they are
+	// supplied.
+	Results []UpsertResult
+}
+
 // Database represents a collection of record (either public or private)
 // in a container.
 type Database interface {
@@ -98,35 +255,268 @@ type Database interface {
 	Get(id RecordID, record *Record) error
 	GetByIDs(ids []RecordID) (*Rows, error)
 
+	// GetMap fetches the Records of the specified type identified by the
+	// supplied keys. Found Records are returned in a map keyed by record
+	// key, and keys that do not identify any Record are returned as
+	// missing keys in the order they are supplied.
+	GetMap(recordType string, keys []string) (map[string]*Record, []string, error)
+
 	// Save updates the supplied Record in the Database if Record with
 	// the same key exists, else such Record is created.
 	//
+	// Fields absent from the Record are left unmodified. A field saved
+	// with a nil value is returned with a nil value by Get and Query,
+	// while a field never saved is absent from the returned Record.
+	// Both match a query for null values.
+	//
 	// Save returns an error if the underlying implementation failed to
 	// create / modify the Record.
 	Save(record *Record) error
 
+	// SaveWithResult is like Save, but also returns the Record as it was
+	// before the save.
+	//
+	// The previous Record is read and locked in the same transaction as
+	// the save, which is begun implicitly if the Database is not in one,
+	// so that no concurrent save is made between the read and the write.
+	// Use this to compute the changes made by the save without a separate
+	// Get.
+	SaveWithResult(record *Record) (SaveResult, error)
+
+	// UpsertAll saves each of the supplied Records, matching it with an
+	// existing Record of the same type by the value of the field at
+	// matchKeyPath rather than by key. A matched Record is updated and
+	// the supplied Record takes its key; otherwise the Record is created,
+	// with a generated key if it has none.
+	//
+	// The field must have a unique constraint added by
+	// AddUniqueConstraint. All Records are upserted in a single
+	// transaction. A Record that fails to be saved is reported in its
+	// UpsertResult without affecting the others. UpsertAll returns an
+	// error only when the batch cannot be upserted at all, in which case
+	// nothing is saved.
+	UpsertAll(records []*Record, matchKeyPath string) (BatchUpsertResult, error)
+
+	// ValidateSave previews what Save would do to the supplied Record
+	// without saving it. The Record is validated against the schema and
+	// the constraints of its record type as Save does, but nothing is
+	// written, such that no record events are emitted and no sequence or
+	// write rate limit is consumed.
+	//
+	// ValidateSave returns the error Save would return. The supplied
+	// Record is not modified.
+	ValidateSave(record *Record) (SavePreview, error)
+
+	// Create creates the supplied Record in the Database. Unlike Save, it
+	// never modifies an existing Record with the same key; policy specifies
+	// how such collision is handled.
+	//
+	// Checking for collision and creating the Record are done atomically,
+	// such that concurrent creates of the same key never overwrite each
+	// other. On success, the key of record is set to the final key.
+	Create(record *Record, policy CollisionPolicy) error
+
 	// Delete removes the Record identified by the key in the Database.
 	//
 	// Delete returns an ErrRecordNotFound if the Record identified by
 	// the supplied key does not exist in the Database.
 	// It also returns an error if the underlying implementation
 	// failed to remove the Record.
+	//
+	// Records referencing the Record are handled according to the
+	// DeletePolicy of their reference fields, regardless of the Database
+	// they belong to.
 	Delete(id RecordID) error
 
+	// SaveIfMatch updates the supplied Record like Save, only if the
+	// stored Record was last updated at updatedAt, such that a Record
+	// updated by another writer since it was read is not overwritten.
+	// The Record is locked while it is compared and saved.
+	//
+	// SaveIfMatch returns ErrRecordConflict if the Record was updated
+	// at another time, and ErrRecordNotFound if it does not exist.
+	SaveIfMatch(record *Record, updatedAt time.Time) error
+
+	// DeleteIfMatch deletes the Record identified by the supplied key
+	// like Delete, only if the Record was last updated at updatedAt,
+	// such that a Record updated by another writer since it was read is
+	// not deleted. The Record is locked while it is compared and deleted.
+	//
+	// DeleteIfMatch returns ErrRecordConflict if the Record was updated
+	// at another time, and ErrRecordNotFound if it does not exist.
+	// Referencing records are handled only if the Record is deleted.
+	DeleteIfMatch(id RecordID, updatedAt time.Time) error
+
+	// RenameField moves the value of field oldKey to field newKey for
+	// all records of the record type in the Database, and returns the
+	// number of records migrated. Records without a value of oldKey
+	// are skipped. The UpdatedAt of migrated records is set to the time
+	// of the rename, such that caches and conditional writes see them
+	// as changed.
+	//
+	// Unlike RenameSchema, the schema of oldKey is kept. The schema
+	// is extended with newKey if it does not exist.
+	RenameField(recordType, oldKey, newKey string) (migrated int, err error)
+
+	// SwapRecords exchanges the data of the two records of the same record
+	// type in a single atomic operation, so that each record holds the
+	// other's prior data. The owner and ACL of a record go with its
+	// data, while record IDs and other metadata are kept.
+	//
+	// ErrRecordNotFound is returned if either record does not exist, in
+	// which case neither record is modified.
+	SwapRecords(idA, idB RecordID) error
+
+	// RenameRecord changes the key of the record identified by id to
+	// newKey. Reference fields of records referencing the record, of
+	// any record type and user, are changed to reference newKey in the
+	// same atomic operation.
+	//
+	// ErrRecordNotFound is returned if the record does not exist, and
+	// ErrRecordDuplicated if a record of newKey exists.
+	RenameRecord(id RecordID, newKey string) error
+
+	// AcquireLease claims exclusive access to the record identified by id
+	// for the duration of ttl, and returns a token identifying the lease.
+	// The lease is advisory: it does not prevent other operations on the
+	// record, but it allows servers to coordinate work on the record.
+	//
+	// ErrLeaseHeld is returned if another unexpired lease exists on the
+	// record. An expired lease is reclaimed by the new holder.
+	AcquireLease(id RecordID, ttl time.Duration) (token string, err error)
+
+	// ReleaseLease releases the lease on the record identified by id
+	// acquired with token. ErrLeaseNotHeld is returned if the record is
+	// not leased with token, such as when the lease has expired and is
+	// reclaimed by another holder.
+	ReleaseLease(id RecordID, token string) error
+
+	// ArrayAppend appends values to the array field of the record in a
+	// single atomic operation, so that concurrent appends are not lost.
+	// The field is set to a new array if it has no value. If unique is
+	// true, values already in the array are not appended again.
+	//
+	// ErrRecordNotFound is returned if the record does not exist, and
+	// ErrFieldNotArray is returned if the field holds a non-array value.
+	ArrayAppend(id RecordID, field string, unique bool, values ...interface{}) error
+
+	// ArrayRemove removes all occurrences of values from the array field
+	// of the record in a single atomic operation. Errors are returned as
+	// in ArrayAppend.
+	ArrayRemove(id RecordID, field string, values ...interface{}) error
+
+	// DeleteByQuery removes all records matching the supplied query from
+	// the Database in a single operation, and returns the number of records
+	// removed. Sorts, Limit and Offset of the query are ignored.
+	//
+	// Like Delete, a record change notification is sent for each record
+	// removed.
+	DeleteByQuery(query *Query) (deleted int, err error)
+
+	// UpdateByQuery applies patch to all records matching the supplied
+	// query, and returns the number of records updated. Sorts, Limit and
+	// Offset of the query are ignored. Keys of patch must be existing
+	// non-reserved fields of the record type.
+	//
+	// The patch is applied to all records atomically; if it fails, no
+	// record is updated. Like Save, a record change notification is sent
+	// for each record updated.
+	UpdateByQuery(query *Query, patch map[string]interface{}) (updated int, err error)
+
 	// Query executes the supplied query against the Database and returns
 	// an Rows to iterate the results.
 	Query(query *Query) (*Rows, error)
 
+	// SetDefaultACL sets the ACL governing access to records of the
+	// Database that have no ACL of their own. The default ACL is
+	// persisted in the container, and an ACL set on a record overrides
+	// it.
+	//
+	// Specify a nil acl to remove the default ACL, such that records
+	// without ACL are accessible to everyone.
+	SetDefaultACL(acl RecordACL) error
+
+	// DefaultACL returns the default ACL of the Database, or nil if no
+	// default ACL is set.
+	DefaultACL() (RecordACL, error)
+
+	// ApplyRetention deletes records exceeding the retention policies of
+	// their record types, oldest first by creation time, and returns the
+	// number of records deleted. Records of all users are subject to the
+	// policies.
+	//
+	// Changes older than the changelog retention are removed from the
+	// changelog as well, and are no longer emitted by Changes.
+	ApplyRetention() (purged int, err error)
+
+	// FieldMasks returns the masks of fields of the record type, keyed
+	// by field name.
+	FieldMasks(recordType string) map[string]FieldMask
+
 	// QueryCount executes the supplied query against the Database and returns
 	// the number of records matching the query's predicate.
 	QueryCount(query *Query) (uint64, error)
 
+	// QueryKeys executes the supplied query against the Database and returns
+	// the IDs and update times of the matching records, without reading
+	// the record data.
+	QueryKeys(query *Query) ([]RecordKey, error)
+
+	// FindReferencing returns an Rows to iterate all records having a
+	// reference field pointing to the record identified by targetID, such
+	// as all comments on a post. Records of different record types are
+	// returned one record type after another.
+	FindReferencing(targetID RecordID) (*Rows, error)
+
+	// QueryETag executes the supplied query against the Database and returns
+	// a hash over the content of the matching records, suitable for use as
+	// an HTTP ETag of the query result.
+	//
+	// The hash changes whenever a matching record is modified, added or
+	// removed, whether or not its update time is changed. Sorts, Limit
+	// and Offset of the query are ignored, so the hash covers all
+	// matching records rather than a page of them.
+	QueryETag(query *Query) (string, error)
+
+	// GroupCount executes the supplied query against the Database and returns
+	// the number of matching records for each distinct value of the field
+	// at keyPath. The query narrows the records counted, such that a
+	// query with only a record type counts all records of the type.
+	//
+	// Records without a value for the field, including those saved with
+	// a nil value, are counted under the nil key with IncludeMissing, and
+	// are not counted with ExcludeMissing.
+	//
+	// If having is not nil, only groups whose count satisfies having are
+	// returned.
+	GroupCount(query *Query, keyPath string, missing MissingGroupPolicy, having *HavingCount) (map[interface{}]uint64, error)
+
+	// QueryGrouped executes the supplied query against the Database and
+	// returns the matching records partitioned by the value of the field
+	// at groupKey. Records in each group are ordered by the query's sorts.
+	//
+	// Records without a value for the field are grouped under the nil key.
+	// Limit and Offset of the query apply to all matching records before
+	// they are grouped.
+	QueryGrouped(query *Query, groupKey string) (map[interface{}][]Record, error)
+
+	// Aggregate executes the supplied query against the Database and returns
+	// the result of the aggregate function over the numeric field at keyPath
+	// of the matching records.
+	//
+	// Records without a value for the field are not aggregated. The number
+	// of such records is returned as skipped.
+	Aggregate(query *Query, keyPath string, fn AggFunc) (result float64, skipped uint64, err error)
+
 	// Extend extends the Database record schema such that a record
 	// arrived subsequently with that schema can be saved
 	//
 	// Extend returns an bool indicating whether the schema is really extended.
 	// Extend also returns an error if the specified schema conflicts with
 	// existing schema in the Database
+	//
+	// Extend also makes the reference fields of the record type enforce
+	// the configured DeletePolicy.
 	Extend(recordType string, schema RecordSchema) (extended bool, err error)
 
 	// RenameSchema renames a column of the Database record schema
@@ -135,12 +525,80 @@ type Database interface {
 	// DeleteSchema removes a column of the Database record schema
 	DeleteSchema(recordType, columnName string) error
 
+	// Changes returns a channel emitting a Change for every record created,
+	// updated or deleted in the Database after the change of sinceSeq.
+	// Past changes are replayed before changes made from now on. The
+	// channel is closed when ctx is cancelled.
+	//
+	// A change is emitted once no transaction that began before it is in
+	// progress, such that changes committed late are not skipped. Resuming
+	// after a change emits every later change exactly once.
+	//
+	// Specify a sinceSeq of 0 to receive all changes kept by the Database.
+	// To resume after a disconnect, specify the Seq of the last processed
+	// Change. A sinceSeq no longer kept replays all changes kept.
+	Changes(ctx context.Context, sinceSeq uint64) (<-chan Change, error)
+
+	// HighWaterMark returns the Seq of the last change Changes would
+	// emit now, or 0 if there is none. A client that has processed the
+	// Change of this Seq is up to date.
+	HighWaterMark() (uint64, error)
+
+	// CreateIndex creates the index on a record type of the Database
+	CreateIndex(recordType string, index Index) error
+
+	// DropIndex removes the index with the specified name from a record
+	// type of the Database
+	DropIndex(recordType, indexName string) error
+
+	// RebuildIndex rebuilds the index with the specified name on a record
+	// type of the Database without blocking writes to the record type.
+	//
+	// A new index is built in the background while records continue to be
+	// saved and deleted, and then replaces the existing index atomically.
+	// It cannot be called in a transaction.
+	RebuildIndex(recordType, indexName string) error
+
+	// VerifyIndexes cross-checks the entries of every index on record
+	// types of the Database against the records, and returns the
+	// inconsistencies found. Records of all users are checked.
+	//
+	// VerifyIndexes only reads, leaving an inconsistent index as is; use
+	// RebuildIndex to fix it. It cannot be called in a transaction. An
+	// index that duplicates another index of the same key may not be
+	// verified.
+	VerifyIndexes() ([]Inconsistency, error)
+
+	// AddUniqueConstraint makes the field at keyPath unique among records
+	// of a record type of the Database. Save and Create of a record with
+	// the same value as another record on that field return
+	// ErrUniqueConstraintViolation.
+	//
+	// AddUniqueConstraint returns an error if existing records already
+	// have duplicated values on that field.
+	AddUniqueConstraint(recordType, keyPath string) error
+
+	// AddEnumConstraint restricts the field at keyPath of a record type of
+	// the Database to the supplied values. Save and Create of a record with
+	// any other value on that field return ErrEnumConstraintViolation.
+	// Records without a value on that field are allowed.
+	//
+	// Values must be strings for a string field, or numbers for a number
+	// or integer field. AddEnumConstraint returns an error if existing
+	// records already have values not in values.
+	AddEnumConstraint(recordType, keyPath string, values []interface{}) error
+
 	// GetSchema returns the record schema of a record type
 	GetSchema(recordType string) (RecordSchema, error)
 
 	// FetchRecordTypes returns a list of all existing record type
 	GetRecordSchemas() (map[string]RecordSchema, error)
 
+	// ListTypes returns the sorted record types having records in the
+	// Database. Record types without records, such as those only created
+	// by Extend, are not returned.
+	ListTypes() ([]string, error)
+
 	GetSubscription(key string, deviceID string, subscription *Subscription) error
 	SaveSubscription(subscription *Subscription) error
 	DeleteSubscription(key string, deviceID string) error
@@ -169,6 +627,54 @@ type TxDatabase interface {
 	Rollback() error
 }
 
+// SnapshotDatabase is a read-only Database over the state of the public
+// Database at the time the snapshot is opened by Conn.OpenSnapshot.
+//
+// Changes made after that are not visible to the SnapshotDatabase, and
+// reading it does not block them. Saving and deleting records return
+// ErrDatabaseIsReadOnly, and other modifications fail.
+type SnapshotDatabase interface {
+	Database
+
+	// Close releases the snapshot. The SnapshotDatabase cannot be used
+	// after Close.
+	Close() error
+}
+
+// RetentionPolicy specifies which records of a record type are kept.
+//
+// Records created more than MaxAge ago, and records older than the newest
+// MaxCount records, are deleted by Database.ApplyRetention. A zero MaxAge
+// or MaxCount does not limit the records kept.
+type RetentionPolicy struct {
+	MaxAge   time.Duration
+	MaxCount int
+}
+
+// WriteRateLimit limits the rate of writes to a record type by a token
+// bucket, which holds up to Burst writes and is refilled at Rate writes
+// per second. Writes are shared by all Databases of the same app.
+type WriteRateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Rollup derives a record type from records of SourceType grouped by
+// the value of GroupKey. Each group has a derived record with fields
+// "group", the value of GroupKey, and "value", the number of records
+// in the group or, if Aggregate is non-zero, Aggregate of Field of
+// the records.
+//
+// The key of a derived record is the value of GroupKey in text, such
+// that a rollup of records grouped by a field holding the day they are
+// created in has a record for each day.
+type Rollup struct {
+	SourceType string
+	GroupKey   string
+	Aggregate  AggFunc
+	Field      string
+}
+
 // Rows implements a scanner-like interface for easy iteration on a
 // result set returned from a query
 type Rows struct {
@@ -178,6 +684,8 @@ type Rows struct {
 	record      Record
 	nexted      bool
 	recordCount *uint64
+	scanned     uint64
+	last        *Record
 }
 
 // NewRows creates a new Rows.
@@ -215,9 +723,18 @@ func (r *Rows) Scan() bool {
 		return false
 	}
 
+	r.scanned++
+	last := r.record
+	r.last = &last
 	return true
 }
 
+// Position returns the Cursor after the records scanned so far, such that
+// the Query returning the Rows can be resumed from it by ResumeQuery.
+func (r *Rows) Position() Cursor {
+	return Cursor{Last: r.last, Count: r.scanned}
+}
+
 // Record returns the current record in Rows.
 //
 // It must be called after calling Scan and Scan returned true.
@@ -244,6 +761,79 @@ func (r *Rows) Err() error {
 	return r.lasterr
 }
 
+// ScanAll reads all remaining records in Rows, and closes Rows afterwards.
+//
+// ScanAll stops reading when ctx is done. By default it then returns
+// ctx.Err() without any records. If allowPartial is true, it returns the
+// records read so far instead, with complete set to false to indicate
+// that the result is incomplete.
+func (r *Rows) ScanAll(ctx context.Context, allowPartial bool) (records []Record, complete bool, err error) {
+	defer r.Close()
+
+	records = []Record{}
+	for {
+		select {
+		case <-ctx.Done():
+			if allowPartial {
+				return records, false, nil
+			}
+			return nil, false, ctx.Err()
+		default:
+		}
+
+		if !r.Scan() {
+			break
+		}
+		records = append(records, r.Record())
+	}
+
+	if err := r.Err(); err != nil {
+		return nil, false, err
+	}
+
+	return records, true, nil
+}
+
+// Cursor is a position in the result set of a Query, as returned by
+// Rows.Position.
+//
+// A Cursor is relative to the Query whose Rows returns it. It holds the
+// last record preceding the position, such that the resumed query seeks
+// past the values of the sort keys and the _id of that record rather than
+// skipping a number of records. Records added or removed before the
+// position therefore do not shift the records after it.
+type Cursor struct {
+	// Last is the last record preceding the position, or nil if the
+	// position is at the beginning of the result set.
+	Last *Record
+
+	// Count is the number of records preceding the position.
+	Count uint64
+}
+
+// ResumeQuery returns a copy of query which returns the records of query
+// after cursor.
+//
+// The resumed query returns records ordered after cursor.Last by the
+// Sorts of query followed by _id. Offset of query applies to the
+// records before cursor only, and Limit is reduced by the records
+// preceding cursor.
+func ResumeQuery(query *Query, cursor Cursor) *Query {
+	resumed := *query
+	if cursor.Last != nil {
+		resumed.After = cursor.Last
+		resumed.Offset = 0
+	}
+	if query.Limit != nil {
+		limit := uint64(0)
+		if *query.Limit > cursor.Count {
+			limit = *query.Limit - cursor.Count
+		}
+		resumed.Limit = &limit
+	}
+	return &resumed
+}
+
 // RowsIter is an iterator on results returned by execution of a query.
 type RowsIter interface {
 	// Close closes the rows iterator
@@ -0,0 +1,189 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skydb
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/context"
+)
+
+// cancellingRows cancels the context after the specified number of
+// records are read.
+type cancellingRows struct {
+	*MemoryRows
+	cancel      context.CancelFunc
+	cancelAfter int
+}
+
+func (rs *cancellingRows) Next(record *Record) error {
+	if rs.CurrentRowIndex == rs.cancelAfter {
+		rs.cancel()
+	}
+	return rs.MemoryRows.Next(record)
+}
+
+func TestRowsScanAll(t *testing.T) {
+	Convey("Rows.ScanAll", t, func() {
+		records := []Record{
+			{ID: NewRecordID("note", "0")},
+			{ID: NewRecordID("note", "1")},
+			{ID: NewRecordID("note", "2")},
+			{ID: NewRecordID("note", "3")},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		rows := NewRows(&cancellingRows{
+			MemoryRows:  NewMemoryRows(records),
+			cancel:      cancel,
+			cancelAfter: 2,
+		})
+
+		Convey("returns all records without cancellation", func() {
+			result, complete, err := NewRows(NewMemoryRows(records)).ScanAll(context.Background(), false)
+			So(err, ShouldBeNil)
+			So(complete, ShouldBeTrue)
+			So(result, ShouldResemble, records)
+		})
+
+		Convey("returns context error on cancellation", func() {
+			result, complete, err := rows.ScanAll(ctx, false)
+			So(err, ShouldEqual, context.Canceled)
+			So(complete, ShouldBeFalse)
+			So(result, ShouldBeNil)
+		})
+
+		Convey("returns partial records on cancellation if allowed", func() {
+			result, complete, err := rows.ScanAll(ctx, true)
+			So(err, ShouldBeNil)
+			So(complete, ShouldBeFalse)
+			So(result, ShouldResemble, records[:3])
+		})
+	})
+}
+
+// queryMemoryRows returns Rows of records ordered by _id, in which the
+// After, Offset and Limit of query are applied.
+func queryMemoryRows(records []Record, query *Query) *Rows {
+	if query.After != nil {
+		after := []Record{}
+		for _, record := range records {
+			if record.ID.Key > query.After.ID.Key {
+				after = append(after, record)
+			}
+		}
+		records = after
+	}
+	if query.Offset > uint64(len(records)) {
+		records = nil
+	} else {
+		records = records[query.Offset:]
+	}
+	if query.Limit != nil && *query.Limit < uint64(len(records)) {
+		records = records[:*query.Limit]
+	}
+	return NewRows(NewMemoryRows(records))
+}
+
+func TestRowsPosition(t *testing.T) {
+	Convey("Rows.Position", t, func() {
+		records := []Record{
+			{ID: NewRecordID("note", "0")},
+			{ID: NewRecordID("note", "1")},
+			{ID: NewRecordID("note", "2")},
+			{ID: NewRecordID("note", "3")},
+			{ID: NewRecordID("note", "4")},
+		}
+
+		scan := func(rows *Rows, n int) []Record {
+			scanned := []Record{}
+			for len(scanned) < n && rows.Scan() {
+				scanned = append(scanned, rows.Record())
+			}
+			return scanned
+		}
+
+		Convey("starts at the beginning", func() {
+			rows := NewRows(NewMemoryRows(records))
+			So(rows.Position(), ShouldResemble, Cursor{})
+		})
+
+		Convey("does not advance past the end", func() {
+			rows := NewRows(NewMemoryRows(records))
+			scan(rows, 10)
+			So(rows.Position(), ShouldResemble, Cursor{Last: &records[4], Count: 5})
+		})
+
+		Convey("resumes a query without gaps or repeats", func() {
+			query := &Query{Type: "note", Offset: 1}
+			rows := queryMemoryRows(records, query)
+			first := scan(rows, 2)
+			cursor := rows.Position()
+			rows.Close()
+			So(cursor, ShouldResemble, Cursor{Last: &records[2], Count: 2})
+
+			rows = queryMemoryRows(records, ResumeQuery(query, cursor))
+			second := scan(rows, 10)
+			So(append(first, second...), ShouldResemble, records[1:])
+		})
+
+		Convey("resumes a query after the last record", func() {
+			query := &Query{Type: "note"}
+			rows := queryMemoryRows(records, query)
+			first := scan(rows, 2)
+			cursor := rows.Position()
+			rows.Close()
+
+			// a record before the position is removed in between
+			rows = queryMemoryRows(records[1:], ResumeQuery(query, cursor))
+			second := scan(rows, 10)
+			So(append(first, second...), ShouldResemble, records)
+		})
+
+		Convey("resumes a query with limit", func() {
+			limit := uint64(3)
+			query := &Query{Type: "note", Limit: &limit}
+			rows := queryMemoryRows(records, query)
+			first := scan(rows, 1)
+			cursor := rows.Position()
+
+			resumed := ResumeQuery(query, cursor)
+			So(*resumed.Limit, ShouldEqual, 2)
+			So(*query.Limit, ShouldEqual, 3)
+
+			rows = queryMemoryRows(records, resumed)
+			second := scan(rows, 10)
+			So(append(first, second...), ShouldResemble, records[:3])
+		})
+
+		Convey("resumes a resumed query", func() {
+			query := &Query{Type: "note"}
+			rows := queryMemoryRows(records, query)
+			first := scan(rows, 2)
+
+			query = ResumeQuery(query, rows.Position())
+			rows = queryMemoryRows(records, query)
+			second := scan(rows, 1)
+
+			query = ResumeQuery(query, rows.Position())
+			rows = queryMemoryRows(records, query)
+			third := scan(rows, 10)
+
+			So(append(append(first, second...), third...), ShouldResemble, records)
+		})
+	})
+}
@@ -63,11 +63,49 @@ func GetAccessModel(accessString string) AccessModel {
 // optionString is passed to the driver and is implementation specific.
 // For example, in a SQL implementation it will be something
 // like "sql://localhost/db0"
-func Open(implName string, appName string, accessString string, optionString string, migrate bool) (Conn, error) {
+//
+// config is the configuration of the records of the app, shared by the
+// Databases of the Conn.
+//
+// If config.Observer is set, the operations of the Databases of the Conn
+// are reported to it.
+//
+// Errors are returned as *DriverOpenError, so that misconfiguration can be
+// reported at startup together with the driver that failed.
+func Open(implName string, appName string, accessString string, optionString string, migrate bool, config Config) (Conn, error) {
 	accessModel := GetAccessModel(accessString)
-	if driver, ok := drivers[implName]; ok {
-		return driver.Open(appName, accessModel, optionString, migrate)
+	driver, ok := drivers[implName]
+	if !ok {
+		return nil, &DriverOpenError{
+			Driver:  implName,
+			AppName: appName,
+			Err:     fmt.Errorf("Implementation not registered: %v", implName),
+		}
+	}
+
+	conn, err := driver.Open(appName, accessModel, optionString, migrate, config)
+	if err != nil {
+		return nil, &DriverOpenError{
+			Driver:  implName,
+			AppName: appName,
+			Err:     err,
+		}
 	}
+	if config.Observer != nil {
+		conn = newObservedConn(conn, config.Observer)
+	}
+	return conn, nil
+}
+
+// DriverOpenError is returned by Open when a Conn cannot be opened, such
+// as when the driver is not registered or the underlying database is
+// unreachable.
+type DriverOpenError struct {
+	Driver  string
+	AppName string
+	Err     error
+}
 
-	return nil, fmt.Errorf("Implementation not registered: %v", implName)
+func (e *DriverOpenError) Error() string {
+	return fmt.Sprintf("skydb: failed to open driver %s for app %s: %v", e.Driver, e.AppName, e.Err)
 }
@@ -15,6 +15,7 @@
 package skydb
 
 import (
+	"errors"
 	"testing"
 )
 
@@ -29,7 +30,7 @@ type fakeDriver struct {
 	Driver
 }
 
-func (driver fakeDriver) Open(appName string, accessModel AccessModel, optionString string, migrate bool) (Conn, error) {
+func (driver fakeDriver) Open(appName string, accessModel AccessModel, optionString string, migrate bool, config Config) (Conn, error) {
 	return fakeConn{
 		AppName:      appName,
 		AccessModel:  accessModel,
@@ -37,12 +38,20 @@ func (driver fakeDriver) Open(appName string, accessModel AccessModel, optionStr
 	}, nil
 }
 
+type failingDriver struct {
+	Driver
+}
+
+func (driver failingDriver) Open(appName string, accessModel AccessModel, optionString string, migrate bool, config Config) (Conn, error) {
+	return nil, errors.New("connection refused")
+}
+
 func TestOpen(t *testing.T) {
 	defer unregisterAllDrivers()
 
 	Register("fakeImpl", fakeDriver{})
 
-	if driver, err := Open("fakeImpl", "com.example.app.test", "role", "fakeOption", true); err != nil {
+	if driver, err := Open("fakeImpl", "com.example.app.test", "role", "fakeOption", true, Config{}); err != nil {
 		t.Fatalf("got err: %v, want a driver", err.Error())
 	} else {
 		if driver, ok := driver.(fakeConn); !ok {
@@ -60,3 +69,29 @@ func TestOpen(t *testing.T) {
 		}
 	}
 }
+
+func TestOpenError(t *testing.T) {
+	defer unregisterAllDrivers()
+
+	Register("failingImpl", failingDriver{})
+
+	_, err := Open("failingImpl", "com.example.app.test", "role", "fakeOption", true, Config{})
+	openErr, ok := err.(*DriverOpenError)
+	if !ok {
+		t.Fatalf("got err = %#v, want a *DriverOpenError", err)
+	}
+	if openErr.Driver != "failingImpl" {
+		t.Fatalf("got openErr.Driver = %v, want \"failingImpl\"", openErr.Driver)
+	}
+	if openErr.AppName != "com.example.app.test" {
+		t.Fatalf("got openErr.AppName = %v, want \"com.example.app.test\"", openErr.AppName)
+	}
+	if openErr.Err.Error() != "connection refused" {
+		t.Fatalf("got openErr.Err = %v, want \"connection refused\"", openErr.Err)
+	}
+
+	_, err = Open("notexistImpl", "com.example.app.test", "role", "fakeOption", true, Config{})
+	if openErr, ok := err.(*DriverOpenError); !ok || openErr.Driver != "notexistImpl" {
+		t.Fatalf("got err = %#v, want a *DriverOpenError of driver \"notexistImpl\"", err)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skydb
+
+// Index represents an index over one or more fields of a record type.
+//
+// An index over more than one key path is a composite index. It is
+// maintained by the Database on Save and Delete, and is consulted by
+// queries whose predicate covers the indexed fields.
+//
+// If Predicate is not empty, the index is a partial index containing only
+// records matching Predicate. It is consulted only by queries whose
+// predicate implies Predicate. Predicate may only compare fields of the
+// record type with literals.
+type Index struct {
+	Name      string
+	KeyPaths  []string
+	Predicate Predicate
+}
+
+// InconsistencyKind is the kind of discrepancy between an index and the
+// records it indexes.
+type InconsistencyKind int
+
+const (
+	// MissingIndexEntry means that a record covered by an index cannot be
+	// reached from the index.
+	MissingIndexEntry InconsistencyKind = iota
+
+	// StaleIndexEntry means that an index reaches a record through an
+	// entry that no longer matches the record, such as an entry keyed by
+	// a former value of an indexed field.
+	StaleIndexEntry
+)
+
+func (kind InconsistencyKind) String() string {
+	switch kind {
+	case MissingIndexEntry:
+		return "missing"
+	case StaleIndexEntry:
+		return "stale"
+	default:
+		return "unknown"
+	}
+}
+
+// Inconsistency is a discrepancy between an index and a record of the
+// record type it indexes, as reported by Database.VerifyIndexes.
+type Inconsistency struct {
+	RecordType string
+	IndexName  string
+	RecordID   RecordID
+	Kind       InconsistencyKind
+}
@@ -6,6 +6,8 @@ package mock_skydb
 import (
 	gomock "github.com/golang/mock/gomock"
 	skydb "github.com/skygeario/skygear-server/pkg/server/skydb"
+	context "golang.org/x/net/context"
+	io "io"
 	time "time"
 )
 
@@ -100,6 +102,16 @@ func (_mr *_MockConnRecorder) DeleteUser(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DeleteUser", arg0)
 }
 
+func (_m *MockConn) ExportBundle(_param0 io.Writer) error {
+	ret := _m.ctrl.Call(_m, "ExportBundle", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockConnRecorder) ExportBundle(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ExportBundle", arg0)
+}
+
 func (_m *MockConn) GetAdminRoles() ([]string, error) {
 	ret := _m.ctrl.Call(_m, "GetAdminRoles")
 	ret0, _ := ret[0].([]string)
@@ -183,6 +195,27 @@ func (_mr *_MockConnRecorder) GetUserByUsernameEmail(arg0, arg1, arg2 interface{
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUserByUsernameEmail", arg0, arg1, arg2)
 }
 
+func (_m *MockConn) ImportBundle(_param0 io.Reader) error {
+	ret := _m.ctrl.Call(_m, "ImportBundle", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockConnRecorder) ImportBundle(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ImportBundle", arg0)
+}
+
+func (_m *MockConn) OpenSnapshot() (skydb.SnapshotDatabase, error) {
+	ret := _m.ctrl.Call(_m, "OpenSnapshot")
+	ret0, _ := ret[0].(skydb.SnapshotDatabase)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockConnRecorder) OpenSnapshot() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "OpenSnapshot")
+}
+
 func (_m *MockConn) PrivateDB(_param0 string) skydb.Database {
 	ret := _m.ctrl.Call(_m, "PrivateDB", _param0)
 	ret0, _ := ret[0].(skydb.Database)
@@ -357,6 +390,101 @@ func (_m *MockDatabase) EXPECT() *_MockDatabaseRecorder {
 	return _m.recorder
 }
 
+func (_m *MockDatabase) AcquireLease(_param0 skydb.RecordID, _param1 time.Duration) (string, error) {
+	ret := _m.ctrl.Call(_m, "AcquireLease", _param0, _param1)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) AcquireLease(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AcquireLease", arg0, arg1)
+}
+
+func (_m *MockDatabase) AddEnumConstraint(_param0 string, _param1 string, _param2 []interface{}) error {
+	ret := _m.ctrl.Call(_m, "AddEnumConstraint", _param0, _param1, _param2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDatabaseRecorder) AddEnumConstraint(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AddEnumConstraint", arg0, arg1, arg2)
+}
+
+func (_m *MockDatabase) AddUniqueConstraint(_param0 string, _param1 string) error {
+	ret := _m.ctrl.Call(_m, "AddUniqueConstraint", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDatabaseRecorder) AddUniqueConstraint(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AddUniqueConstraint", arg0, arg1)
+}
+
+func (_m *MockDatabase) Aggregate(_param0 *skydb.Query, _param1 string, _param2 skydb.AggFunc) (float64, uint64, error) {
+	ret := _m.ctrl.Call(_m, "Aggregate", _param0, _param1, _param2)
+	ret0, _ := ret[0].(float64)
+	ret1, _ := ret[1].(uint64)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockDatabaseRecorder) Aggregate(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Aggregate", arg0, arg1, arg2)
+}
+
+func (_m *MockDatabase) ApplyRetention() (int, error) {
+	ret := _m.ctrl.Call(_m, "ApplyRetention")
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) ApplyRetention() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ApplyRetention")
+}
+
+func (_m *MockDatabase) ArrayAppend(_param0 skydb.RecordID, _param1 string, _param2 bool, _param3 ...interface{}) error {
+	_s := []interface{}{_param0, _param1, _param2}
+	for _, _x := range _param3 {
+		_s = append(_s, _x)
+	}
+	ret := _m.ctrl.Call(_m, "ArrayAppend", _s...)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDatabaseRecorder) ArrayAppend(arg0, arg1, arg2 interface{}, arg3 ...interface{}) *gomock.Call {
+	_s := append([]interface{}{arg0, arg1, arg2}, arg3...)
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ArrayAppend", _s...)
+}
+
+func (_m *MockDatabase) ArrayRemove(_param0 skydb.RecordID, _param1 string, _param2 ...interface{}) error {
+	_s := []interface{}{_param0, _param1}
+	for _, _x := range _param2 {
+		_s = append(_s, _x)
+	}
+	ret := _m.ctrl.Call(_m, "ArrayRemove", _s...)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDatabaseRecorder) ArrayRemove(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	_s := append([]interface{}{arg0, arg1}, arg2...)
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ArrayRemove", _s...)
+}
+
+func (_m *MockDatabase) Changes(_param0 context.Context, _param1 uint64) (<-chan skydb.Change, error) {
+	ret := _m.ctrl.Call(_m, "Changes", _param0, _param1)
+	ret0, _ := ret[0].(<-chan skydb.Change)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) Changes(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Changes", arg0, arg1)
+}
+
 func (_m *MockDatabase) Conn() skydb.Conn {
 	ret := _m.ctrl.Call(_m, "Conn")
 	ret0, _ := ret[0].(skydb.Conn)
@@ -367,6 +495,26 @@ func (_mr *_MockDatabaseRecorder) Conn() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Conn")
 }
 
+func (_m *MockDatabase) Create(_param0 *skydb.Record, _param1 skydb.CollisionPolicy) error {
+	ret := _m.ctrl.Call(_m, "Create", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDatabaseRecorder) Create(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Create", arg0, arg1)
+}
+
+func (_m *MockDatabase) CreateIndex(_param0 string, _param1 skydb.Index) error {
+	ret := _m.ctrl.Call(_m, "CreateIndex", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDatabaseRecorder) CreateIndex(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateIndex", arg0, arg1)
+}
+
 func (_m *MockDatabase) DatabaseType() skydb.DatabaseType {
 	ret := _m.ctrl.Call(_m, "DatabaseType")
 	ret0, _ := ret[0].(skydb.DatabaseType)
@@ -377,6 +525,17 @@ func (_mr *_MockDatabaseRecorder) DatabaseType() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DatabaseType")
 }
 
+func (_m *MockDatabase) DefaultACL() (skydb.RecordACL, error) {
+	ret := _m.ctrl.Call(_m, "DefaultACL")
+	ret0, _ := ret[0].(skydb.RecordACL)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) DefaultACL() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DefaultACL")
+}
+
 func (_m *MockDatabase) Delete(_param0 skydb.RecordID) error {
 	ret := _m.ctrl.Call(_m, "Delete", _param0)
 	ret0, _ := ret[0].(error)
@@ -387,6 +546,27 @@ func (_mr *_MockDatabaseRecorder) Delete(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Delete", arg0)
 }
 
+func (_m *MockDatabase) DeleteByQuery(_param0 *skydb.Query) (int, error) {
+	ret := _m.ctrl.Call(_m, "DeleteByQuery", _param0)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) DeleteByQuery(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DeleteByQuery", arg0)
+}
+
+func (_m *MockDatabase) DeleteIfMatch(_param0 skydb.RecordID, _param1 time.Time) error {
+	ret := _m.ctrl.Call(_m, "DeleteIfMatch", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDatabaseRecorder) DeleteIfMatch(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DeleteIfMatch", arg0, arg1)
+}
+
 func (_m *MockDatabase) DeleteSchema(_param0 string, _param1 string) error {
 	ret := _m.ctrl.Call(_m, "DeleteSchema", _param0, _param1)
 	ret0, _ := ret[0].(error)
@@ -407,6 +587,16 @@ func (_mr *_MockDatabaseRecorder) DeleteSubscription(arg0, arg1 interface{}) *go
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DeleteSubscription", arg0, arg1)
 }
 
+func (_m *MockDatabase) DropIndex(_param0 string, _param1 string) error {
+	ret := _m.ctrl.Call(_m, "DropIndex", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDatabaseRecorder) DropIndex(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DropIndex", arg0, arg1)
+}
+
 func (_m *MockDatabase) Extend(_param0 string, _param1 skydb.RecordSchema) (bool, error) {
 	ret := _m.ctrl.Call(_m, "Extend", _param0, _param1)
 	ret0, _ := ret[0].(bool)
@@ -418,6 +608,27 @@ func (_mr *_MockDatabaseRecorder) Extend(arg0, arg1 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Extend", arg0, arg1)
 }
 
+func (_m *MockDatabase) FieldMasks(_param0 string) map[string]skydb.FieldMask {
+	ret := _m.ctrl.Call(_m, "FieldMasks", _param0)
+	ret0, _ := ret[0].(map[string]skydb.FieldMask)
+	return ret0
+}
+
+func (_mr *_MockDatabaseRecorder) FieldMasks(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "FieldMasks", arg0)
+}
+
+func (_m *MockDatabase) FindReferencing(_param0 skydb.RecordID) (*skydb.Rows, error) {
+	ret := _m.ctrl.Call(_m, "FindReferencing", _param0)
+	ret0, _ := ret[0].(*skydb.Rows)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) FindReferencing(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "FindReferencing", arg0)
+}
+
 func (_m *MockDatabase) Get(_param0 skydb.RecordID, _param1 *skydb.Record) error {
 	ret := _m.ctrl.Call(_m, "Get", _param0, _param1)
 	ret0, _ := ret[0].(error)
@@ -439,6 +650,18 @@ func (_mr *_MockDatabaseRecorder) GetByIDs(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetByIDs", arg0)
 }
 
+func (_m *MockDatabase) GetMap(_param0 string, _param1 []string) (map[string]*skydb.Record, []string, error) {
+	ret := _m.ctrl.Call(_m, "GetMap", _param0, _param1)
+	ret0, _ := ret[0].(map[string]*skydb.Record)
+	ret1, _ := ret[1].([]string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockDatabaseRecorder) GetMap(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetMap", arg0, arg1)
+}
+
 func (_m *MockDatabase) GetMatchingSubscriptions(_param0 *skydb.Record) []skydb.Subscription {
 	ret := _m.ctrl.Call(_m, "GetMatchingSubscriptions", _param0)
 	ret0, _ := ret[0].([]skydb.Subscription)
@@ -491,6 +714,28 @@ func (_mr *_MockDatabaseRecorder) GetSubscriptionsByDeviceID(arg0 interface{}) *
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetSubscriptionsByDeviceID", arg0)
 }
 
+func (_m *MockDatabase) GroupCount(_param0 *skydb.Query, _param1 string, _param2 skydb.MissingGroupPolicy, _param3 *skydb.HavingCount) (map[interface{}]uint64, error) {
+	ret := _m.ctrl.Call(_m, "GroupCount", _param0, _param1, _param2, _param3)
+	ret0, _ := ret[0].(map[interface{}]uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) GroupCount(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GroupCount", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockDatabase) HighWaterMark() (uint64, error) {
+	ret := _m.ctrl.Call(_m, "HighWaterMark")
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) HighWaterMark() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "HighWaterMark")
+}
+
 func (_m *MockDatabase) ID() string {
 	ret := _m.ctrl.Call(_m, "ID")
 	ret0, _ := ret[0].(string)
@@ -511,6 +756,17 @@ func (_mr *_MockDatabaseRecorder) IsReadOnly() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "IsReadOnly")
 }
 
+func (_m *MockDatabase) ListTypes() ([]string, error) {
+	ret := _m.ctrl.Call(_m, "ListTypes")
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) ListTypes() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ListTypes")
+}
+
 func (_m *MockDatabase) Query(_param0 *skydb.Query) (*skydb.Rows, error) {
 	ret := _m.ctrl.Call(_m, "Query", _param0)
 	ret0, _ := ret[0].(*skydb.Rows)
@@ -533,6 +789,80 @@ func (_mr *_MockDatabaseRecorder) QueryCount(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "QueryCount", arg0)
 }
 
+func (_m *MockDatabase) QueryETag(_param0 *skydb.Query) (string, error) {
+	ret := _m.ctrl.Call(_m, "QueryETag", _param0)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) QueryETag(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "QueryETag", arg0)
+}
+
+func (_m *MockDatabase) QueryGrouped(_param0 *skydb.Query, _param1 string) (map[interface{}][]skydb.Record, error) {
+	ret := _m.ctrl.Call(_m, "QueryGrouped", _param0, _param1)
+	ret0, _ := ret[0].(map[interface{}][]skydb.Record)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) QueryGrouped(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "QueryGrouped", arg0, arg1)
+}
+
+func (_m *MockDatabase) QueryKeys(_param0 *skydb.Query) ([]skydb.RecordKey, error) {
+	ret := _m.ctrl.Call(_m, "QueryKeys", _param0)
+	ret0, _ := ret[0].([]skydb.RecordKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) QueryKeys(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "QueryKeys", arg0)
+}
+
+func (_m *MockDatabase) RebuildIndex(_param0 string, _param1 string) error {
+	ret := _m.ctrl.Call(_m, "RebuildIndex", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDatabaseRecorder) RebuildIndex(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RebuildIndex", arg0, arg1)
+}
+
+func (_m *MockDatabase) ReleaseLease(_param0 skydb.RecordID, _param1 string) error {
+	ret := _m.ctrl.Call(_m, "ReleaseLease", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDatabaseRecorder) ReleaseLease(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ReleaseLease", arg0, arg1)
+}
+
+func (_m *MockDatabase) RenameField(_param0 string, _param1 string, _param2 string) (int, error) {
+	ret := _m.ctrl.Call(_m, "RenameField", _param0, _param1, _param2)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) RenameField(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RenameField", arg0, arg1, arg2)
+}
+
+func (_m *MockDatabase) RenameRecord(_param0 skydb.RecordID, _param1 string) error {
+	ret := _m.ctrl.Call(_m, "RenameRecord", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDatabaseRecorder) RenameRecord(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RenameRecord", arg0, arg1)
+}
+
 func (_m *MockDatabase) RenameSchema(_param0 string, _param1 string, _param2 string) error {
 	ret := _m.ctrl.Call(_m, "RenameSchema", _param0, _param1, _param2)
 	ret0, _ := ret[0].(error)
@@ -553,6 +883,16 @@ func (_mr *_MockDatabaseRecorder) Save(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Save", arg0)
 }
 
+func (_m *MockDatabase) SaveIfMatch(_param0 *skydb.Record, _param1 time.Time) error {
+	ret := _m.ctrl.Call(_m, "SaveIfMatch", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDatabaseRecorder) SaveIfMatch(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SaveIfMatch", arg0, arg1)
+}
+
 func (_m *MockDatabase) SaveSubscription(_param0 *skydb.Subscription) error {
 	ret := _m.ctrl.Call(_m, "SaveSubscription", _param0)
 	ret0, _ := ret[0].(error)
@@ -563,6 +903,59 @@ func (_mr *_MockDatabaseRecorder) SaveSubscription(arg0 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SaveSubscription", arg0)
 }
 
+func (_m *MockDatabase) SaveWithResult(_param0 *skydb.Record) (skydb.SaveResult, error) {
+	ret := _m.ctrl.Call(_m, "SaveWithResult", _param0)
+	ret0, _ := ret[0].(skydb.SaveResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) SaveWithResult(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SaveWithResult", arg0)
+}
+
+func (_m *MockDatabase) SetDefaultACL(_param0 skydb.RecordACL) error {
+	ret := _m.ctrl.Call(_m, "SetDefaultACL", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDatabaseRecorder) SetDefaultACL(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDefaultACL", arg0)
+}
+
+func (_m *MockDatabase) SwapRecords(_param0 skydb.RecordID, _param1 skydb.RecordID) error {
+	ret := _m.ctrl.Call(_m, "SwapRecords", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDatabaseRecorder) SwapRecords(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SwapRecords", arg0, arg1)
+}
+
+func (_m *MockDatabase) UpdateByQuery(_param0 *skydb.Query, _param1 map[string]interface{}) (int, error) {
+	ret := _m.ctrl.Call(_m, "UpdateByQuery", _param0, _param1)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) UpdateByQuery(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UpdateByQuery", arg0, arg1)
+}
+
+func (_m *MockDatabase) UpsertAll(_param0 []*skydb.Record, _param1 string) (skydb.BatchUpsertResult, error) {
+	ret := _m.ctrl.Call(_m, "UpsertAll", _param0, _param1)
+	ret0, _ := ret[0].(skydb.BatchUpsertResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) UpsertAll(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UpsertAll", arg0, arg1)
+}
+
 func (_m *MockDatabase) UserRecordType() string {
 	ret := _m.ctrl.Call(_m, "UserRecordType")
 	ret0, _ := ret[0].(string)
@@ -572,3 +965,25 @@ func (_m *MockDatabase) UserRecordType() string {
 func (_mr *_MockDatabaseRecorder) UserRecordType() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "UserRecordType")
 }
+
+func (_m *MockDatabase) ValidateSave(_param0 *skydb.Record) (skydb.SavePreview, error) {
+	ret := _m.ctrl.Call(_m, "ValidateSave", _param0)
+	ret0, _ := ret[0].(skydb.SavePreview)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) ValidateSave(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ValidateSave", arg0)
+}
+
+func (_m *MockDatabase) VerifyIndexes() ([]skydb.Inconsistency, error) {
+	ret := _m.ctrl.Call(_m, "VerifyIndexes")
+	ret0, _ := ret[0].([]skydb.Inconsistency)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDatabaseRecorder) VerifyIndexes() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "VerifyIndexes")
+}
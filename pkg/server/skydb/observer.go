@@ -0,0 +1,492 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skydb
+
+import (
+	"context"
+	"time"
+)
+
+// OperationObserver is notified of every Database operation performed
+// through a Conn, such that an embedding server can collect metrics such
+// as operation counts, error counts and latencies.
+//
+// It is set by Config.Observer. Operations are observed as called on
+// the Database, so an operation that performs others internally, such
+// as UpsertAll saving records, is observed once.
+type OperationObserver interface {
+	// ObserveOperation is called after the Database operation named
+	// operation (e.g. "Get") completes. err is the error returned by
+	// the operation, which is nil on success.
+	ObserveOperation(operation string, duration time.Duration, err error)
+}
+
+// OperationObserverFunc is an adaptor to use an ordinary function as
+// an OperationObserver.
+type OperationObserverFunc func(operation string, duration time.Duration, err error)
+
+// ObserveOperation calls f(operation, duration, err).
+func (f OperationObserverFunc) ObserveOperation(operation string, duration time.Duration, err error) {
+	f(operation, duration, err)
+}
+
+// observedConn wraps a Conn such that the operations of its Databases
+// are reported to an OperationObserver.
+type observedConn struct {
+	Conn
+	observer OperationObserver
+}
+
+func newObservedConn(conn Conn, observer OperationObserver) Conn {
+	return &observedConn{
+		Conn:     conn,
+		observer: observer,
+	}
+}
+
+func (c *observedConn) PublicDB() Database {
+	return c.observeDatabase(c.Conn.PublicDB())
+}
+
+func (c *observedConn) PrivateDB(userKey string) Database {
+	return c.observeDatabase(c.Conn.PrivateDB(userKey))
+}
+
+func (c *observedConn) UnionDB() Database {
+	return c.observeDatabase(c.Conn.UnionDB())
+}
+
+func (c *observedConn) OpenSnapshot() (SnapshotDatabase, error) {
+	snapshot, err := c.Conn.OpenSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &observedSnapshotDatabase{
+		observedDatabase: &observedDatabase{
+			Database: snapshot,
+			conn:     c,
+		},
+		snapshot: snapshot,
+	}, nil
+}
+
+func (c *observedConn) observeDatabase(db Database) Database {
+	observed := &observedDatabase{
+		Database: db,
+		conn:     c,
+	}
+	if txDB, ok := db.(TxDatabase); ok {
+		return &observedTxDatabase{
+			observedDatabase: observed,
+			txDB:             txDB,
+		}
+	}
+	return observed
+}
+
+// observedTxDatabase is an observedDatabase of a Database supporting
+// transaction.
+type observedTxDatabase struct {
+	*observedDatabase
+	txDB TxDatabase
+}
+
+func (db *observedTxDatabase) Begin() error {
+	return db.txDB.Begin()
+}
+
+func (db *observedTxDatabase) Commit() error {
+	return db.txDB.Commit()
+}
+
+func (db *observedTxDatabase) Rollback() error {
+	return db.txDB.Rollback()
+}
+
+// observedSnapshotDatabase is an observedDatabase of a SnapshotDatabase.
+type observedSnapshotDatabase struct {
+	*observedDatabase
+	snapshot SnapshotDatabase
+}
+
+func (db *observedSnapshotDatabase) Close() error {
+	return db.snapshot.Close()
+}
+
+// observedDatabase reports each operation of the wrapped Database to the
+// OperationObserver of its Conn. Accessors of the Database, such as ID,
+// are not reported.
+type observedDatabase struct {
+	Database
+	conn *observedConn
+}
+
+func (db *observedDatabase) observe(operation string, startTime time.Time, err error) {
+	db.conn.observer.ObserveOperation(operation, time.Since(startTime), err)
+}
+
+func (db *observedDatabase) Conn() Conn {
+	return db.conn
+}
+
+func (db *observedDatabase) Get(id RecordID, record *Record) error {
+	startTime := time.Now()
+	err := db.Database.Get(id, record)
+	db.observe("Get", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) GetByIDs(ids []RecordID) (*Rows, error) {
+	startTime := time.Now()
+	result, err := db.Database.GetByIDs(ids)
+	db.observe("GetByIDs", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) GetMap(recordType string, keys []string) (map[string]*Record, []string, error) {
+	startTime := time.Now()
+	result, missing, err := db.Database.GetMap(recordType, keys)
+	db.observe("GetMap", startTime, err)
+	return result, missing, err
+}
+
+func (db *observedDatabase) Save(record *Record) error {
+	startTime := time.Now()
+	err := db.Database.Save(record)
+	db.observe("Save", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) SaveWithResult(record *Record) (SaveResult, error) {
+	startTime := time.Now()
+	result, err := db.Database.SaveWithResult(record)
+	db.observe("SaveWithResult", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) UpsertAll(records []*Record, matchKeyPath string) (BatchUpsertResult, error) {
+	startTime := time.Now()
+	result, err := db.Database.UpsertAll(records, matchKeyPath)
+	db.observe("UpsertAll", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) ValidateSave(record *Record) (SavePreview, error) {
+	startTime := time.Now()
+	result, err := db.Database.ValidateSave(record)
+	db.observe("ValidateSave", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) Create(record *Record, policy CollisionPolicy) error {
+	startTime := time.Now()
+	err := db.Database.Create(record, policy)
+	db.observe("Create", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) Delete(id RecordID) error {
+	startTime := time.Now()
+	err := db.Database.Delete(id)
+	db.observe("Delete", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) SaveIfMatch(record *Record, updatedAt time.Time) error {
+	startTime := time.Now()
+	err := db.Database.SaveIfMatch(record, updatedAt)
+	db.observe("SaveIfMatch", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) DeleteIfMatch(id RecordID, updatedAt time.Time) error {
+	startTime := time.Now()
+	err := db.Database.DeleteIfMatch(id, updatedAt)
+	db.observe("DeleteIfMatch", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) RenameField(recordType, oldKey, newKey string) (int, error) {
+	startTime := time.Now()
+	result, err := db.Database.RenameField(recordType, oldKey, newKey)
+	db.observe("RenameField", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) SwapRecords(idA, idB RecordID) error {
+	startTime := time.Now()
+	err := db.Database.SwapRecords(idA, idB)
+	db.observe("SwapRecords", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) RenameRecord(id RecordID, newKey string) error {
+	startTime := time.Now()
+	err := db.Database.RenameRecord(id, newKey)
+	db.observe("RenameRecord", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) AcquireLease(id RecordID, ttl time.Duration) (string, error) {
+	startTime := time.Now()
+	result, err := db.Database.AcquireLease(id, ttl)
+	db.observe("AcquireLease", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) ReleaseLease(id RecordID, token string) error {
+	startTime := time.Now()
+	err := db.Database.ReleaseLease(id, token)
+	db.observe("ReleaseLease", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) ArrayAppend(id RecordID, field string, unique bool, values ...interface{}) error {
+	startTime := time.Now()
+	err := db.Database.ArrayAppend(id, field, unique, values...)
+	db.observe("ArrayAppend", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) ArrayRemove(id RecordID, field string, values ...interface{}) error {
+	startTime := time.Now()
+	err := db.Database.ArrayRemove(id, field, values...)
+	db.observe("ArrayRemove", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) DeleteByQuery(query *Query) (int, error) {
+	startTime := time.Now()
+	result, err := db.Database.DeleteByQuery(query)
+	db.observe("DeleteByQuery", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) UpdateByQuery(query *Query, patch map[string]interface{}) (int, error) {
+	startTime := time.Now()
+	result, err := db.Database.UpdateByQuery(query, patch)
+	db.observe("UpdateByQuery", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) Query(query *Query) (*Rows, error) {
+	startTime := time.Now()
+	result, err := db.Database.Query(query)
+	db.observe("Query", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) SetDefaultACL(acl RecordACL) error {
+	startTime := time.Now()
+	err := db.Database.SetDefaultACL(acl)
+	db.observe("SetDefaultACL", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) DefaultACL() (RecordACL, error) {
+	startTime := time.Now()
+	result, err := db.Database.DefaultACL()
+	db.observe("DefaultACL", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) ApplyRetention() (int, error) {
+	startTime := time.Now()
+	result, err := db.Database.ApplyRetention()
+	db.observe("ApplyRetention", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) QueryCount(query *Query) (uint64, error) {
+	startTime := time.Now()
+	result, err := db.Database.QueryCount(query)
+	db.observe("QueryCount", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) QueryKeys(query *Query) ([]RecordKey, error) {
+	startTime := time.Now()
+	result, err := db.Database.QueryKeys(query)
+	db.observe("QueryKeys", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) FindReferencing(targetID RecordID) (*Rows, error) {
+	startTime := time.Now()
+	result, err := db.Database.FindReferencing(targetID)
+	db.observe("FindReferencing", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) QueryETag(query *Query) (string, error) {
+	startTime := time.Now()
+	result, err := db.Database.QueryETag(query)
+	db.observe("QueryETag", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) GroupCount(query *Query, keyPath string, missing MissingGroupPolicy, having *HavingCount) (map[interface{}]uint64, error) {
+	startTime := time.Now()
+	result, err := db.Database.GroupCount(query, keyPath, missing, having)
+	db.observe("GroupCount", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) QueryGrouped(query *Query, groupKey string) (map[interface{}][]Record, error) {
+	startTime := time.Now()
+	result, err := db.Database.QueryGrouped(query, groupKey)
+	db.observe("QueryGrouped", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) Aggregate(query *Query, keyPath string, fn AggFunc) (float64, uint64, error) {
+	startTime := time.Now()
+	result, skipped, err := db.Database.Aggregate(query, keyPath, fn)
+	db.observe("Aggregate", startTime, err)
+	return result, skipped, err
+}
+
+func (db *observedDatabase) Extend(recordType string, schema RecordSchema) (bool, error) {
+	startTime := time.Now()
+	result, err := db.Database.Extend(recordType, schema)
+	db.observe("Extend", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) RenameSchema(recordType, oldColumnName, newColumnName string) error {
+	startTime := time.Now()
+	err := db.Database.RenameSchema(recordType, oldColumnName, newColumnName)
+	db.observe("RenameSchema", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) DeleteSchema(recordType, columnName string) error {
+	startTime := time.Now()
+	err := db.Database.DeleteSchema(recordType, columnName)
+	db.observe("DeleteSchema", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) Changes(ctx context.Context, sinceSeq uint64) (<-chan Change, error) {
+	startTime := time.Now()
+	result, err := db.Database.Changes(ctx, sinceSeq)
+	db.observe("Changes", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) HighWaterMark() (uint64, error) {
+	startTime := time.Now()
+	result, err := db.Database.HighWaterMark()
+	db.observe("HighWaterMark", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) CreateIndex(recordType string, index Index) error {
+	startTime := time.Now()
+	err := db.Database.CreateIndex(recordType, index)
+	db.observe("CreateIndex", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) DropIndex(recordType, indexName string) error {
+	startTime := time.Now()
+	err := db.Database.DropIndex(recordType, indexName)
+	db.observe("DropIndex", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) RebuildIndex(recordType, indexName string) error {
+	startTime := time.Now()
+	err := db.Database.RebuildIndex(recordType, indexName)
+	db.observe("RebuildIndex", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) VerifyIndexes() ([]Inconsistency, error) {
+	startTime := time.Now()
+	result, err := db.Database.VerifyIndexes()
+	db.observe("VerifyIndexes", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) AddUniqueConstraint(recordType, keyPath string) error {
+	startTime := time.Now()
+	err := db.Database.AddUniqueConstraint(recordType, keyPath)
+	db.observe("AddUniqueConstraint", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) AddEnumConstraint(recordType, keyPath string, values []interface{}) error {
+	startTime := time.Now()
+	err := db.Database.AddEnumConstraint(recordType, keyPath, values)
+	db.observe("AddEnumConstraint", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) GetSchema(recordType string) (RecordSchema, error) {
+	startTime := time.Now()
+	result, err := db.Database.GetSchema(recordType)
+	db.observe("GetSchema", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) GetRecordSchemas() (map[string]RecordSchema, error) {
+	startTime := time.Now()
+	result, err := db.Database.GetRecordSchemas()
+	db.observe("GetRecordSchemas", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) ListTypes() ([]string, error) {
+	startTime := time.Now()
+	result, err := db.Database.ListTypes()
+	db.observe("ListTypes", startTime, err)
+	return result, err
+}
+
+func (db *observedDatabase) GetSubscription(key string, deviceID string, subscription *Subscription) error {
+	startTime := time.Now()
+	err := db.Database.GetSubscription(key, deviceID, subscription)
+	db.observe("GetSubscription", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) SaveSubscription(subscription *Subscription) error {
+	startTime := time.Now()
+	err := db.Database.SaveSubscription(subscription)
+	db.observe("SaveSubscription", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) DeleteSubscription(key string, deviceID string) error {
+	startTime := time.Now()
+	err := db.Database.DeleteSubscription(key, deviceID)
+	db.observe("DeleteSubscription", startTime, err)
+	return err
+}
+
+func (db *observedDatabase) GetSubscriptionsByDeviceID(deviceID string) []Subscription {
+	startTime := time.Now()
+	result := db.Database.GetSubscriptionsByDeviceID(deviceID)
+	db.observe("GetSubscriptionsByDeviceID", startTime, nil)
+	return result
+}
+
+func (db *observedDatabase) GetMatchingSubscriptions(record *Record) []Subscription {
+	startTime := time.Now()
+	result := db.Database.GetMatchingSubscriptions(record)
+	db.observe("GetMatchingSubscriptions", startTime, nil)
+	return result
+}
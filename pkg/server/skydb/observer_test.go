@@ -0,0 +1,173 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skydb
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type observerTestDatabase struct {
+	Database
+	saved []RecordID
+}
+
+func (db *observerTestDatabase) ID() string {
+	return "_public"
+}
+
+func (db *observerTestDatabase) Get(id RecordID, record *Record) error {
+	if id.Key == "notexist" {
+		return ErrRecordNotFound
+	}
+	record.ID = id
+	return nil
+}
+
+func (db *observerTestDatabase) Save(record *Record) error {
+	db.saved = append(db.saved, record.ID)
+	return nil
+}
+
+func (db *observerTestDatabase) UpsertAll(records []*Record, matchKeyPath string) (BatchUpsertResult, error) {
+	for _, record := range records {
+		if err := db.Save(record); err != nil {
+			return BatchUpsertResult{}, err
+		}
+	}
+	return BatchUpsertResult{}, nil
+}
+
+type observerTestTxDatabase struct {
+	observerTestDatabase
+	begun bool
+}
+
+func (db *observerTestTxDatabase) Begin() error {
+	db.begun = true
+	return nil
+}
+
+func (db *observerTestTxDatabase) Commit() error {
+	return nil
+}
+
+func (db *observerTestTxDatabase) Rollback() error {
+	return nil
+}
+
+type observerTestConn struct {
+	Conn
+	db Database
+}
+
+func (c observerTestConn) PublicDB() Database {
+	return c.db
+}
+
+func (c observerTestConn) PrivateDB(userKey string) Database {
+	return c.db
+}
+
+func TestOperationObserver(t *testing.T) {
+	Convey("Conn opened with an Observer", t, func() {
+		defer unregisterAllDrivers()
+
+		underlying := &observerTestDatabase{}
+		Register("observerImpl", DriverFunc(func(appName string, accessModel AccessModel, optionString string, migrate bool, config Config) (Conn, error) {
+			return observerTestConn{db: underlying}, nil
+		}))
+
+		counts := map[string]int{}
+		errCounts := map[string]int{}
+		config := Config{
+			Observer: OperationObserverFunc(func(operation string, duration time.Duration, err error) {
+				counts[operation]++
+				if err != nil {
+					errCounts[operation]++
+				}
+			}),
+		}
+		conn, err := Open("observerImpl", "com.example.app.test", "role", "", false, config)
+		So(err, ShouldBeNil)
+		db := conn.PublicDB()
+
+		Convey("observes operations and their errors", func() {
+			So(db.Get(NewRecordID("note", "id1"), &Record{}), ShouldBeNil)
+			So(db.Get(NewRecordID("note", "notexist"), &Record{}), ShouldEqual, ErrRecordNotFound)
+			So(db.Save(&Record{ID: NewRecordID("note", "id1")}), ShouldBeNil)
+
+			So(counts, ShouldResemble, map[string]int{
+				"Get":  2,
+				"Save": 1,
+			})
+			So(errCounts, ShouldResemble, map[string]int{
+				"Get": 1,
+			})
+		})
+
+		Convey("observes an operation once without its nested operations", func() {
+			_, err := db.UpsertAll([]*Record{
+				{ID: NewRecordID("note", "id1")},
+				{ID: NewRecordID("note", "id2")},
+			}, "_id")
+			So(err, ShouldBeNil)
+
+			So(underlying.saved, ShouldHaveLength, 2)
+			So(counts, ShouldResemble, map[string]int{
+				"UpsertAll": 1,
+			})
+		})
+
+		Convey("observes operations of Databases of the Conn of a Database", func() {
+			So(db.Conn().PrivateDB("userid").Save(&Record{ID: NewRecordID("note", "id1")}), ShouldBeNil)
+			So(counts, ShouldResemble, map[string]int{
+				"Save": 1,
+			})
+		})
+
+		Convey("does not observe accessors", func() {
+			So(db.ID(), ShouldEqual, "_public")
+			So(counts, ShouldBeEmpty)
+		})
+
+		Convey("returns a Database supporting transaction only if the underlying one does", func() {
+			_, ok := db.(TxDatabase)
+			So(ok, ShouldBeFalse)
+
+			txUnderlying := &observerTestTxDatabase{}
+			txConn := newObservedConn(observerTestConn{db: txUnderlying}, config.Observer)
+			txDB, ok := txConn.PublicDB().(TxDatabase)
+			So(ok, ShouldBeTrue)
+			So(txDB.Begin(), ShouldBeNil)
+			So(txUnderlying.begun, ShouldBeTrue)
+		})
+	})
+
+	Convey("Conn opened without an Observer is not wrapped", t, func() {
+		defer unregisterAllDrivers()
+
+		Register("observerImpl", DriverFunc(func(appName string, accessModel AccessModel, optionString string, migrate bool, config Config) (Conn, error) {
+			return observerTestConn{db: &observerTestDatabase{}}, nil
+		}))
+
+		conn, err := Open("observerImpl", "com.example.app.test", "role", "", false, Config{})
+		So(err, ShouldBeNil)
+		_, ok := conn.(observerTestConn)
+		So(ok, ShouldBeTrue)
+	})
+}
@@ -19,6 +19,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"strings"
 
 	sq "github.com/lann/squirrel"
 	"github.com/lib/pq"
@@ -42,6 +44,12 @@ func (f *predicateSqlizerFactory) newPredicateSqlizer(p skydb.Predicate) (sq.Sql
 	if p.Operator == skydb.Functional {
 		return f.newFunctionalPredicateSqlizer(p)
 	}
+	if p.Operator == skydb.AnyMatch {
+		return f.newAnyMatchPredicateSqlizer(p)
+	}
+	if p.Operator == skydb.IsNull || p.Operator == skydb.IsAbsent {
+		return f.newPresencePredicateSqlizer(p)
+	}
 	if p.Operator.IsCompound() {
 		return f.newCompoundPredicateSqlizer(p)
 	}
@@ -93,6 +101,16 @@ func (f *predicateSqlizerFactory) newFunctionalPredicateSqlizer(predicate skydb.
 		return f.newUserRelationFunctionalPredicateSqlizer(fn)
 	case skydb.UserDiscoverFunc:
 		return f.newUserDiscoverFunctionalPredicateSqlizer(fn)
+	case skydb.WithinPolygonFunc:
+		return &withinPolygonPredicateSqlizer{
+			f.primaryTable,
+			fn.Field,
+			fn.Polygon,
+		}, nil
+	case skydb.ReferenceTypeFunc:
+		return f.newReferenceTypeFunctionalPredicateSqlizer(fn)
+	case skydb.OwnerFunc:
+		return f.newOwnerFunctionalPredicateSqlizer(fn)
 	default:
 		panic("the specified function cannot be used as a functional predicate")
 	}
@@ -124,6 +142,53 @@ func (f *predicateSqlizerFactory) newUserRelationFunctionalPredicateSqlizer(fn s
 	}, nil
 }
 
+// newReferenceTypeFunctionalPredicateSqlizer matches records having a
+// reference in the field. A reference column only refers to records
+// of a single type, so the type is checked against the schema rather
+// than the value.
+func (f *predicateSqlizerFactory) newReferenceTypeFunctionalPredicateSqlizer(fn skydb.ReferenceTypeFunc) (sq.Sqlizer, error) {
+	schema, err := f.db.remoteColumnTypes(f.primaryTable)
+	if err != nil {
+		return nil, err
+	}
+
+	field, ok := schema[fn.Field]
+	if !ok || field.Type != skydb.TypeReference || field.ReferenceType != fn.Type {
+		return FalseSqlizer{}, nil
+	}
+
+	return sq.Expr(fullQuoteIdentifier(f.primaryTable, fn.Field) + " IS NOT NULL"), nil
+}
+
+// newOwnerFunctionalPredicateSqlizer matches records owned by any of
+// the owners, and records readable without a user if public records are
+// included, as governed by the default ACL for records without ACL.
+func (f *predicateSqlizerFactory) newOwnerFunctionalPredicateSqlizer(fn skydb.OwnerFunc) (sq.Sqlizer, error) {
+	sqlizers := sq.Or{}
+	if len(fn.OwnerIDs) > 0 {
+		ownerIDs := make([]interface{}, len(fn.OwnerIDs))
+		for i, ownerID := range fn.OwnerIDs {
+			ownerIDs[i] = ownerID
+		}
+		inCause, inArgs := literalToSQLOperand(ownerIDs)
+		sqlizers = append(sqlizers,
+			sq.Expr(fullQuoteIdentifier(f.primaryTable, "_owner_id")+" IN "+inCause, inArgs...))
+	}
+
+	if fn.IncludePublic {
+		sqlizer, err := f.newAccessControlSqlizer(nil, skydb.ReadLevel)
+		if err != nil {
+			return nil, err
+		}
+		sqlizers = append(sqlizers, sqlizer)
+	}
+
+	if len(sqlizers) == 0 {
+		return FalseSqlizer{}, nil
+	}
+	return sqlizers, nil
+}
+
 func (f *predicateSqlizerFactory) newUserDiscoverFunctionalPredicateSqlizer(fn skydb.UserDiscoverFunc) (sq.Sqlizer, error) {
 	if f.db.UserRecordType() != f.primaryTable {
 		return nil, skyerr.NewErrorf(skyerr.RecordQueryInvalid,
@@ -183,9 +248,60 @@ func (f *predicateSqlizerFactory) newUserDiscoverFunctionalPredicateSqlizer(fn s
 }
 
 func (f *predicateSqlizerFactory) newAccessControlSqlizer(user *skydb.UserInfo, aclLevel skydb.ACLLevel) (sq.Sqlizer, error) {
+	defaultACL, err := f.db.DefaultACL()
+	if err != nil {
+		return nil, err
+	}
 	return &accessPredicateSqlizer{
 		user,
 		aclLevel,
+		defaultACL,
+	}, nil
+}
+
+// newAnyMatchPredicateSqlizer matches records having an element in the
+// array field that satisfies the element predicate.
+func (f *predicateSqlizerFactory) newAnyMatchPredicateSqlizer(p skydb.Predicate) (sq.Sqlizer, error) {
+	keyPath, elementPredicate := p.GetAnyMatchOperands()
+	array, err := f.newExpressionSqlizerForKeyPath(skydb.Expression{
+		Type:  skydb.KeyPath,
+		Value: keyPath,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newAnyMatchPredicateSqlizer(&array, elementPredicate, 0)
+}
+
+// newPresencePredicateSqlizer matches records having the field saved as
+// null, or never saved, by whether the field is in the null fields.
+func (f *predicateSqlizerFactory) newPresencePredicateSqlizer(p skydb.Predicate) (sq.Sqlizer, error) {
+	expr := p.Children[0].(skydb.Expression)
+	field, err := f.newExpressionSqlizerForKeyPath(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	column, _, err := field.ToSql()
+	if err != nil {
+		return nil, err
+	}
+	components := expr.KeyPathComponents()
+	name, err := json.Marshal([]string{components[len(components)-1]})
+	if err != nil {
+		return nil, err
+	}
+
+	var isNullField sq.Sqlizer = sq.Expr(
+		fmt.Sprintf("COALESCE(%s, '[]'::jsonb) @> ?::jsonb", fullQuoteIdentifier(field.alias, nullFieldsColumn)),
+		string(name),
+	)
+	if p.Operator == skydb.IsAbsent {
+		isNullField = NotSqlizer{isNullField}
+	}
+	return sq.And{
+		sq.Expr(fmt.Sprintf("%s IS NULL", column)),
+		isNullField,
 	}, nil
 }
 
@@ -193,6 +309,9 @@ func (f *predicateSqlizerFactory) newComparisonPredicateSqlizer(p skydb.Predicat
 	if sqlizer, ok := f.tryOptimizeDistancePredicate(p); ok {
 		return sqlizer, nil
 	}
+	if sqlizer, ok := f.tryFieldOrderPredicate(p); ok {
+		return sqlizer, nil
+	}
 
 	sqlizers := []expressionSqlizer{}
 	for _, child := range p.Children {
@@ -206,9 +325,89 @@ func (f *predicateSqlizerFactory) newComparisonPredicateSqlizer(p skydb.Predicat
 	if p.Operator == skydb.In {
 		return &containsComparisonPredicateSqlizer{sqlizers}, nil
 	}
+	if p.Operator == skydb.EqualIgnoreCase {
+		for _, child := range p.Children {
+			if !f.isStringExpression(child.(skydb.Expression)) {
+				// non-string operands are compared with normal equality
+				return &comparisonPredicateSqlizer{sqlizers, skydb.Equal}, nil
+			}
+		}
+	}
 	return &comparisonPredicateSqlizer{sqlizers, p.Operator}, nil
 }
 
+// tryFieldOrderPredicate compares a field having an order of values with
+// a string by their positions in the order, instead of alphabetically.
+func (f *predicateSqlizerFactory) tryFieldOrderPredicate(p skydb.Predicate) (sq.Sqlizer, bool) {
+	switch p.Operator {
+	case skydb.GreaterThan, skydb.LessThan, skydb.GreaterThanOrEqual, skydb.LessThanOrEqual:
+	default:
+		return nil, false
+	}
+
+	var values []string
+	for _, child := range p.Children {
+		expr := child.(skydb.Expression)
+		if expr.IsKeyPath() && values == nil {
+			values = f.db.fieldOrder(f.primaryTable, expr.Value.(string))
+		}
+	}
+	if values == nil {
+		return nil, false
+	}
+
+	operands := []string{}
+	for _, child := range p.Children {
+		expr := child.(skydb.Expression)
+		switch {
+		case expr.IsKeyPath() && f.db.fieldOrder(f.primaryTable, expr.Value.(string)) != nil:
+			column := fullQuoteIdentifier(f.primaryTable, expr.Value.(string))
+			operands = append(operands, fieldOrderRankSQL(column, values))
+		case expr.IsLiteralString():
+			operands = append(operands, fmt.Sprintf("%d", fieldOrderRank(values, expr.Value.(string))))
+		default:
+			return nil, false
+		}
+	}
+
+	operator, err := comparisonOperatorSQL(p.Operator)
+	if err != nil {
+		return nil, false
+	}
+	return sq.Expr(operands[0] + " " + operator + " " + operands[1]), true
+}
+
+// isStringExpression returns whether the expression is a string literal
+// or a key path to a string field.
+func (f *predicateSqlizerFactory) isStringExpression(expr skydb.Expression) bool {
+	if expr.IsLiteralString() {
+		return true
+	}
+	if !expr.IsKeyPath() {
+		return false
+	}
+
+	recordType := f.primaryTable
+	components := expr.KeyPathComponents()
+	for i, component := range components {
+		schema, err := f.db.remoteColumnTypes(recordType)
+		if err != nil {
+			return false
+		}
+
+		field, ok := schema[component]
+		if !ok {
+			return false
+		}
+
+		if i == len(components)-1 {
+			return field.Type == skydb.TypeString
+		}
+		recordType = field.ReferenceType
+	}
+	return false
+}
+
 // tryOptimizeDistancePredicate returns a sqlizer that is more efficient
 // at querying whether two points are within certain distance.
 //
@@ -217,15 +416,22 @@ func (f *predicateSqlizerFactory) newComparisonPredicateSqlizer(p skydb.Predicat
 func (f *predicateSqlizerFactory) tryOptimizeDistancePredicate(p skydb.Predicate) (sq.Sqlizer, bool) {
 	var tryFunc skydb.Expression
 	var tryValue skydb.Expression
-	if p.Operator == skydb.LessThan {
+	var operator string
+	switch p.Operator {
+	case skydb.LessThan, skydb.LessThanOrEqual:
 		tryFunc = p.Children[0].(skydb.Expression)
 		tryValue = p.Children[1].(skydb.Expression)
-	} else if p.Operator == skydb.GreaterThan {
+	case skydb.GreaterThan, skydb.GreaterThanOrEqual:
 		tryFunc = p.Children[1].(skydb.Expression)
 		tryValue = p.Children[0].(skydb.Expression)
-	} else {
+	default:
 		return nil, false
 	}
+	if p.Operator == skydb.LessThan || p.Operator == skydb.GreaterThan {
+		operator = "<"
+	} else {
+		operator = "<="
+	}
 
 	distanceFunc, ok := tryFunc.Value.(skydb.DistanceFunc)
 	if !ok {
@@ -241,6 +447,7 @@ func (f *predicateSqlizerFactory) tryOptimizeDistancePredicate(p skydb.Predicate
 		f.primaryTable,
 		distanceFunc.Field,
 		distanceFunc.Location,
+		operator,
 		distanceValue,
 	}, true
 }
@@ -379,9 +586,13 @@ func newPredicateSqlizerFactory(db *database, primaryTable string) *predicateSql
 //
 // Record accessible by user rickmak or admin role
 // `_access @> '[{"role":"rickmak"}]' OR _access @> '[{"role":"admin"}]'`¬
+//
+// Records without ACL are governed by defaultACL, or accessible to
+// everyone if defaultACL is nil.
 type accessPredicateSqlizer struct {
-	user  *skydb.UserInfo
-	level skydb.ACLLevel
+	user       *skydb.UserInfo
+	level      skydb.ACLLevel
+	defaultACL skydb.RecordACL
 }
 
 func (p accessPredicateSqlizer) ToSql() (string, []interface{}, error) {
@@ -418,7 +629,11 @@ func (p accessPredicateSqlizer) ToSql() (string, []interface{}, error) {
 		b.WriteString(`_access @> '[{"public": true, "level": "write"}]' OR `)
 	}
 
-	b.WriteString(`_access IS NULL)`)
+	if p.defaultACL == nil || p.defaultACL.Accessible(p.user, p.level) {
+		b.WriteString(`_access IS NULL)`)
+	} else {
+		b.WriteString(`FALSE)`)
+	}
 
 	return b.String(), args, nil
 }
@@ -529,7 +744,7 @@ func (p *comparisonPredicateSqlizer) ToSql() (sql string, args []interface{}, er
 		if err != nil {
 			return "", nil, err
 		}
-		buffer.WriteString(sqlOperand)
+		buffer.WriteString(p.operandSQL(sqlOperand))
 		args = append(args, opArgs...)
 
 		if rhs.IsLiteralNull() {
@@ -545,7 +760,7 @@ func (p *comparisonPredicateSqlizer) ToSql() (sql string, args []interface{}, er
 		if err != nil {
 			return "", nil, err
 		}
-		buffer.WriteString(sqlOperand)
+		buffer.WriteString(p.operandSQL(sqlOperand))
 		args = append(args, opArgs...)
 
 		sql = buffer.String()
@@ -556,11 +771,19 @@ func (p *comparisonPredicateSqlizer) ToSql() (sql string, args []interface{}, er
 	return
 }
 
+// operandSQL returns the SQL of an operand as compared by the operator.
+func (p *comparisonPredicateSqlizer) operandSQL(sqlOperand string) string {
+	if p.operator == skydb.EqualIgnoreCase {
+		return "lower(" + sqlOperand + ")"
+	}
+	return sqlOperand
+}
+
 func (p *comparisonPredicateSqlizer) writeOperator(buffer *bytes.Buffer) error {
 	switch p.operator {
 	default:
 		return fmt.Errorf("comparison operator `%v` is not supported", p.operator)
-	case skydb.Equal:
+	case skydb.Equal, skydb.EqualIgnoreCase:
 		buffer.WriteString(`=`)
 	case skydb.GreaterThan:
 		buffer.WriteString(`>`)
@@ -628,6 +851,14 @@ func funcToSQLOperand(alias string, fun skydb.Func) (string, []interface{}) {
 			fullQuoteIdentifier(alias, f.Field))
 		args := []interface{}{f.Location.Lng(), f.Location.Lat()}
 		return sql, args
+	case skydb.ArrayLengthFunc:
+		column := fullQuoteIdentifier(alias, f.Field)
+		sql := fmt.Sprintf("CASE WHEN jsonb_typeof(to_jsonb(%s)) = 'array' THEN jsonb_array_length(to_jsonb(%s)) END",
+			column, column)
+		if f.NonArrayAsEmpty {
+			sql = fmt.Sprintf("COALESCE(%s, 0)", sql)
+		}
+		return sql, []interface{}{}
 	case skydb.CountFunc:
 		var sql string
 		if f.OverallRecords {
@@ -683,8 +914,20 @@ func sortOrderBySQL(alias string, sort skydb.Sort) (string, error) {
 
 	switch {
 	case sort.KeyPath != "":
-		expr = fullQuoteIdentifier(alias, sort.KeyPath)
+		var err error
+		expr, err = missingAsSQL(fullQuoteIdentifier(alias, sort.KeyPath), sort)
+		if err != nil {
+			return "", err
+		}
+		expr += collateSQL(sort.Collation)
 	case sort.Func != nil:
+		if sort.Collation != "" {
+			return "", errors.New("invalid Sort: Collation applies to KeyPath only")
+		}
+		if sort.MissingAs != nil {
+			return "", errors.New("invalid Sort: MissingAs applies to KeyPath only")
+		}
+
 		var err error
 		expr, err = funcOrderBySQL(alias, sort.Func)
 		if err != nil {
@@ -702,6 +945,29 @@ func sortOrderBySQL(alias string, sort skydb.Sort) (string, error) {
 	return fmt.Sprintf(expr + " " + order), nil
 }
 
+// missingAsSQL returns expr with null values replaced by the MissingAs
+// value of sort, or expr itself if sort has no MissingAs value.
+func missingAsSQL(expr string, sort skydb.Sort) (string, error) {
+	if sort.MissingAs == nil {
+		return expr, nil
+	}
+
+	literal, err := quoteLiteral(sort.MissingAs)
+	if err != nil {
+		return "", fmt.Errorf("invalid Sort: MissingAs: %s", err)
+	}
+	return fmt.Sprintf("COALESCE(%s, %s)", expr, literal), nil
+}
+
+// collateSQL returns the COLLATE clause for the collation, or an empty
+// string if the collation is empty.
+func collateSQL(collation string) string {
+	if collation == "" {
+		return ""
+	}
+	return " COLLATE " + pq.QuoteIdentifier(collation)
+}
+
 // due to sq not being able to pass args in OrderBy, we can't re-use funcToSQLOperand
 func funcOrderBySQL(alias string, fun skydb.Func) (string, error) {
 	switch f := fun.(type) {
@@ -782,10 +1048,15 @@ func (s FalseSqlizer) ToSql() (sql string, args []interface{}, err error) {
 
 // distancePredicateSqlizer generates SQL condition that calculates if a
 // location is within a certain distance.
+//
+// If the distance is a number, locations outside the bounding box of the
+// distance are excluded before the distance is calculated, such that the
+// distance of most far away locations is never calculated.
 type distancePredicateSqlizer struct {
 	alias    string
 	field    string
 	location skydb.Location
+	operator string
 	distance expressionSqlizer
 }
 
@@ -796,16 +1067,358 @@ func (s distancePredicateSqlizer) ToSql() (sql string, args []interface{}, err e
 		return
 	}
 
+	column := fullQuoteIdentifier(s.alias, s.field)
 	sql = fmt.Sprintf(
-		"ST_DWithin(%s, ST_MakePoint(?, ?), %s)",
-		fullQuoteIdentifier(s.alias, s.field),
+		"ST_Distance_Sphere(%s, ST_MakePoint(?, ?)) %s %s",
+		column,
+		s.operator,
 		distanceSQL,
 	)
 	args = []interface{}{s.location.Lng(), s.location.Lat()}
 	args = append(args, distanceArgs...)
+
+	var distance float64
+	switch v := s.distance.Value.(type) {
+	case float64:
+		distance = v
+	case int:
+		distance = float64(v)
+	case int64:
+		distance = float64(v)
+	default:
+		return
+	}
+	if s.distance.Type != skydb.Literal {
+		return
+	}
+	minLng, minLat, maxLng, maxLat, ok := distanceBoundingBox(s.location, distance)
+	if !ok {
+		return
+	}
+	sql = fmt.Sprintf("(%s && ST_MakeEnvelope(?, ?, ?, ?) AND %s)", column, sql)
+	args = append([]interface{}{minLng, minLat, maxLng, maxLat}, args...)
+	return
+}
+
+// earthRadius is the radius in meters of the sphere on which
+// ST_Distance_Sphere calculates distances.
+const earthRadius = 6370986.0
+
+// distanceBoundingBox returns the smallest box of longitudes and latitudes
+// containing all locations within distance meters of location, or false if
+// no such box exists because the locations include a pole or cross the
+// antimeridian.
+func distanceBoundingBox(location skydb.Location, distance float64) (minLng, minLat, maxLng, maxLat float64, ok bool) {
+	if distance < 0 {
+		return
+	}
+
+	// angular distance along the sphere
+	angle := distance / earthRadius
+	lat := location.Lat() * math.Pi / 180
+	minLat = lat - angle
+	maxLat = lat + angle
+	if minLat <= -math.Pi/2 || maxLat >= math.Pi/2 {
+		return
+	}
+
+	// the meridians tangent to the circle of the distance bound the
+	// longitudes, which are farther apart than at the latitude of location
+	deltaLng := math.Asin(math.Sin(angle) / math.Cos(lat))
+	lng := location.Lng() * math.Pi / 180
+	minLng = lng - deltaLng
+	maxLng = lng + deltaLng
+	if minLng < -math.Pi || maxLng > math.Pi {
+		return
+	}
+
+	// widen the box slightly against rounding errors
+	const margin = 1e-9
+	degrees := 180 / math.Pi
+	return minLng*degrees - margin, minLat*degrees - margin,
+		maxLng*degrees + margin, maxLat*degrees + margin, true
+}
+
+type withinPolygonPredicateSqlizer struct {
+	alias   string
+	field   string
+	polygon []skydb.Location
+}
+
+// ToSql generates SQL for withinPolygonPredicateSqlizer
+func (s withinPolygonPredicateSqlizer) ToSql() (sql string, args []interface{}, err error) {
+	vertices := s.polygon
+	if len(vertices) > 0 && vertices[0] != vertices[len(vertices)-1] {
+		// close the ring of the polygon
+		vertices = append(vertices[:len(vertices):len(vertices)], vertices[0])
+	}
+
+	points := make([]string, len(vertices))
+	args = make([]interface{}, 0, len(vertices)*2)
+	for i, vertex := range vertices {
+		points[i] = "ST_MakePoint(?, ?)"
+		args = append(args, vertex.Lng(), vertex.Lat())
+	}
+
+	sql = fmt.Sprintf(
+		"ST_Covers(ST_MakePolygon(ST_MakeLine(ARRAY[%s])), %s)",
+		strings.Join(points, ", "),
+		fullQuoteIdentifier(s.alias, s.field),
+	)
+	return
+}
+
+// anyMatchPredicateSqlizer generates SQL condition that checks whether
+// any element of a JSON array satisfies the element predicate. Values
+// that are not arrays are treated as empty arrays.
+type anyMatchPredicateSqlizer struct {
+	array   sq.Sqlizer
+	alias   string
+	element sq.Sqlizer
+}
+
+// newAnyMatchPredicateSqlizer creates an anyMatchPredicateSqlizer. The
+// depth is the number of AnyMatch predicates enclosing this one, which
+// gives each nested element a distinct alias.
+func newAnyMatchPredicateSqlizer(array sq.Sqlizer, p skydb.Predicate, depth int) (*anyMatchPredicateSqlizer, error) {
+	alias := fmt.Sprintf("_element%d", depth)
+	element, err := newElementPredicateSqlizer(alias, p, depth)
+	if err != nil {
+		return nil, err
+	}
+	return &anyMatchPredicateSqlizer{array, alias, element}, nil
+}
+
+// ToSql generates SQL for anyMatchPredicateSqlizer
+func (s *anyMatchPredicateSqlizer) ToSql() (sql string, args []interface{}, err error) {
+	arraySQL, arrayArgs, err := s.array.ToSql()
+	if err != nil {
+		return
+	}
+	elementSQL, elementArgs, err := s.element.ToSql()
+	if err != nil {
+		return
+	}
+
+	sql = fmt.Sprintf(
+		"EXISTS (SELECT 1 FROM jsonb_array_elements(CASE WHEN jsonb_typeof(to_jsonb(%[1]s)) = 'array' THEN to_jsonb(%[1]s) ELSE '[]'::jsonb END) AS %[2]s(value) WHERE %[3]s)",
+		arraySQL,
+		pq.QuoteIdentifier(s.alias),
+		elementSQL,
+	)
+	args = append(args, arrayArgs...)
+	args = append(args, arrayArgs...)
+	args = append(args, elementArgs...)
+	return
+}
+
+// newElementPredicateSqlizer creates a sqlizer for a predicate applied to
+// an array element aliased by alias. Key paths in the predicate refer to
+// fields of the element.
+func newElementPredicateSqlizer(alias string, p skydb.Predicate, depth int) (sq.Sqlizer, error) {
+	switch p.Operator {
+	case skydb.And, skydb.Or:
+		sqlizers := make([]sq.Sqlizer, len(p.Children))
+		for i, child := range p.GetSubPredicates() {
+			sqlizer, err := newElementPredicateSqlizer(alias, child, depth)
+			if err != nil {
+				return nil, err
+			}
+			sqlizers[i] = sqlizer
+		}
+		if p.Operator == skydb.And {
+			return sq.And(sqlizers), nil
+		}
+		return sq.Or(sqlizers), nil
+	case skydb.Not:
+		sqlizer, err := newElementPredicateSqlizer(alias, p.GetSubPredicates()[0], depth)
+		if err != nil {
+			return nil, err
+		}
+		return NotSqlizer{sqlizer}, nil
+	case skydb.AnyMatch:
+		keyPath, elementPredicate := p.GetAnyMatchOperands()
+		return newAnyMatchPredicateSqlizer(elementFieldSqlizer{alias, keyPath, false}, elementPredicate, depth+1)
+	}
+
+	if !p.Operator.IsBinary() {
+		return nil, skyerr.NewErrorf(skyerr.NotSupported,
+			"operator `%v` is not supported on array elements", p.Operator)
+	}
+
+	operator := p.Operator
+	lhs := p.Children[0].(skydb.Expression)
+	rhs := p.Children[1].(skydb.Expression)
+	if !lhs.IsKeyPath() && rhs.IsKeyPath() {
+		var ok bool
+		if operator, ok = swappedOperator(operator); !ok {
+			return nil, skyerr.NewErrorf(skyerr.NotSupported,
+				"operator `%v` on array elements must have key path on the left", p.Operator)
+		}
+		lhs, rhs = rhs, lhs
+	}
+	if !lhs.IsKeyPath() || rhs.Type != skydb.Literal {
+		return nil, skyerr.NewErrorf(skyerr.NotSupported,
+			"operator `%v` on array elements must compare a key path with a literal", p.Operator)
+	}
+
+	return &elementComparisonSqlizer{
+		alias:    alias,
+		key:      lhs.Value.(string),
+		operator: operator,
+		value:    rhs.Value,
+	}, nil
+}
+
+// swappedOperator returns the operator that gives the same result when
+// the operands are swapped.
+func swappedOperator(op skydb.Operator) (skydb.Operator, bool) {
+	switch op {
+	case skydb.Equal, skydb.NotEqual, skydb.EqualIgnoreCase:
+		return op, true
+	case skydb.GreaterThan:
+		return skydb.LessThan, true
+	case skydb.LessThan:
+		return skydb.GreaterThan, true
+	case skydb.GreaterThanOrEqual:
+		return skydb.LessThanOrEqual, true
+	case skydb.LessThanOrEqual:
+		return skydb.GreaterThanOrEqual, true
+	default:
+		return op, false
+	}
+}
+
+// elementFieldSqlizer generates SQL expression for a field of an array
+// element, as jsonb or, if asText is true, as text.
+type elementFieldSqlizer struct {
+	alias  string
+	key    string
+	asText bool
+}
+
+// ToSql generates SQL for elementFieldSqlizer
+func (s elementFieldSqlizer) ToSql() (sql string, args []interface{}, err error) {
+	op := "->"
+	if s.asText {
+		op = "->>"
+	}
+	sql = fmt.Sprintf("%s %s ?::text", fullQuoteIdentifier(s.alias, "value"), op)
+	args = []interface{}{s.key}
 	return
 }
 
+// elementComparisonSqlizer generates SQL condition comparing a field of
+// an array element with a literal. Values of different JSON types are
+// never ordered against each other.
+type elementComparisonSqlizer struct {
+	alias    string
+	key      string
+	operator skydb.Operator
+	value    interface{}
+}
+
+// ToSql generates SQL for elementComparisonSqlizer
+func (s *elementComparisonSqlizer) ToSql() (sql string, args []interface{}, err error) {
+	field, fieldArgs, _ := elementFieldSqlizer{s.alias, s.key, false}.ToSql()
+	text, textArgs, _ := elementFieldSqlizer{s.alias, s.key, true}.ToSql()
+
+	if s.operator == skydb.In {
+		values, ok := s.value.([]interface{})
+		if !ok {
+			return "", nil, fmt.Errorf("right operand of `In` on array elements must be an array")
+		}
+		if len(values) == 0 {
+			return FalseSqlizer{}.ToSql()
+		}
+
+		placeholders := make([]string, len(values))
+		args = append(args, fieldArgs...)
+		for i, value := range values {
+			literal, err := elementLiteralJSON(value)
+			if err != nil {
+				return "", nil, err
+			}
+			placeholders[i] = "?::jsonb"
+			args = append(args, literal)
+		}
+		sql = fmt.Sprintf("%s IN (%s)", field, strings.Join(placeholders, ", "))
+		return
+	}
+
+	literal, err := elementLiteralJSON(s.value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch s.operator {
+	case skydb.Equal, skydb.NotEqual:
+		op := "="
+		if s.operator == skydb.NotEqual {
+			op = "<>"
+		}
+		if s.value == nil {
+			sql = fmt.Sprintf("COALESCE(%s, 'null'::jsonb) %s 'null'::jsonb", field, op)
+			args = fieldArgs
+			return
+		}
+		sql = fmt.Sprintf("%s %s ?::jsonb", field, op)
+		args = append(fieldArgs, literal)
+	case skydb.GreaterThan, skydb.LessThan, skydb.GreaterThanOrEqual, skydb.LessThanOrEqual:
+		var buffer bytes.Buffer
+		if err := (&comparisonPredicateSqlizer{operator: s.operator}).writeOperator(&buffer); err != nil {
+			return "", nil, err
+		}
+		sql = fmt.Sprintf("(jsonb_typeof(%s) = jsonb_typeof(?::jsonb) AND %s %s ?::jsonb)",
+			field, field, buffer.String())
+		args = append(args, fieldArgs...)
+		args = append(args, literal)
+		args = append(args, fieldArgs...)
+		args = append(args, literal)
+	case skydb.Like, skydb.ILike, skydb.EqualIgnoreCase:
+		pattern, ok := s.value.(string)
+		if !ok {
+			if s.operator == skydb.EqualIgnoreCase {
+				// non-string operands are compared with normal equality
+				sql = fmt.Sprintf("%s = ?::jsonb", field)
+				args = append(fieldArgs, literal)
+				return
+			}
+			return "", nil, fmt.Errorf("right operand of `%v` must be a string", s.operator)
+		}
+
+		var condition string
+		switch s.operator {
+		case skydb.Like:
+			condition = "%s LIKE ?"
+		case skydb.ILike:
+			condition = "%s ILIKE ?"
+		case skydb.EqualIgnoreCase:
+			condition = "lower(%s) = lower(?)"
+		}
+		sql = fmt.Sprintf("(jsonb_typeof(%s) = 'string' AND "+condition+")", field, text)
+		args = append(args, fieldArgs...)
+		args = append(args, textArgs...)
+		args = append(args, pattern)
+	default:
+		err = fmt.Errorf("comparison operator `%v` is not supported", s.operator)
+	}
+	return
+}
+
+// elementLiteralJSON returns the JSON representation of a literal to be
+// compared with a field of an array element.
+func elementLiteralJSON(value interface{}) (string, error) {
+	switch value.(type) {
+	case nil, bool, string, float64, int, int64:
+		data, err := json.Marshal(value)
+		return string(data), err
+	default:
+		return "", skyerr.NewErrorf(skyerr.NotSupported,
+			"comparing array elements with %T is not supported", value)
+	}
+}
+
 // joinedTable represents a specification for table join
 type joinedTable struct {
 	secondaryTable  string
@@ -16,6 +16,7 @@ package pq
 
 import (
 	"fmt"
+	"math"
 	"testing"
 
 	"github.com/skygeario/skygear-server/pkg/server/skydb"
@@ -260,6 +261,7 @@ func TestPredicateSqlizerFactory(t *testing.T) {
 					"note",
 					"latlng",
 					skydb.NewLocation(22.25, 114.1667),
+					"<",
 					expressionSqlizer{
 						"note",
 						skydb.Expression{skydb.Literal, 500.0},
@@ -319,6 +321,7 @@ func TestAccessPredicateSqlizer(t *testing.T) {
 			sqlizer := &accessPredicateSqlizer{
 				&userinfo,
 				skydb.ReadLevel,
+				nil,
 			}
 			sql, args, err := sqlizer.ToSql()
 			So(err, ShouldBeNil)
@@ -334,6 +337,7 @@ func TestAccessPredicateSqlizer(t *testing.T) {
 			sqlizer := &accessPredicateSqlizer{
 				nil,
 				skydb.ReadLevel,
+				nil,
 			}
 			sql, args, err := sqlizer.ToSql()
 			So(err, ShouldBeNil)
@@ -347,6 +351,7 @@ func TestAccessPredicateSqlizer(t *testing.T) {
 			sqlizer := &accessPredicateSqlizer{
 				nil,
 				skydb.WriteLevel,
+				nil,
 			}
 			sql, args, err := sqlizer.ToSql()
 			So(err, ShouldBeNil)
@@ -356,6 +361,27 @@ func TestAccessPredicateSqlizer(t *testing.T) {
 			So(args, ShouldResemble, []interface{}{})
 		})
 
+		Convey("serialized for default ACL denying access", func() {
+			userinfo := skydb.UserInfo{
+				ID: "userid",
+			}
+			sqlizer := &accessPredicateSqlizer{
+				&userinfo,
+				skydb.WriteLevel,
+				skydb.RecordACL{
+					skydb.NewRecordACLEntryPublic(skydb.ReadLevel),
+				},
+			}
+			sql, args, err := sqlizer.ToSql()
+			So(err, ShouldBeNil)
+			So(sql, ShouldEqual,
+				`(_access @> '[{"user_id": "userid"}]' OR `+
+					`_owner_id = ? OR `+
+					`_access @> '[{"public": true, "level": "write"}]' OR `+
+					`FALSE)`)
+			So(args, ShouldResemble, []interface{}{"userid"})
+		})
+
 		Convey("serialized for role based ACE", func() {
 			userinfo := skydb.UserInfo{
 				ID:    "userid",
@@ -364,6 +390,7 @@ func TestAccessPredicateSqlizer(t *testing.T) {
 			sqlizer := &accessPredicateSqlizer{
 				&userinfo,
 				skydb.ReadLevel,
+				nil,
 			}
 			sql, args, err := sqlizer.ToSql()
 			So(err, ShouldBeNil)
@@ -385,7 +412,8 @@ func TestDistancePredicateSqlizer(t *testing.T) {
 			sqlizer := &distancePredicateSqlizer{
 				"note",
 				"latlng",
-				skydb.NewLocation(22.25, 114.1667),
+				skydb.NewLocation(114.1667, 22.25),
+				"<",
 				expressionSqlizer{
 					"note",
 					skydb.Expression{skydb.Literal, 500.0},
@@ -394,8 +422,124 @@ func TestDistancePredicateSqlizer(t *testing.T) {
 			sql, args, err := sqlizer.ToSql()
 			So(err, ShouldBeNil)
 			So(sql, ShouldEqual,
-				`ST_DWithin("note"."latlng", ST_MakePoint(?, ?), ?)`)
-			So(args, ShouldResemble, []interface{}{22.25, 114.1667, 500.0})
+				`("note"."latlng" && ST_MakeEnvelope(?, ?, ?, ?) AND `+
+					`ST_Distance_Sphere("note"."latlng", ST_MakePoint(?, ?)) < ?)`)
+			So(len(args), ShouldEqual, 7)
+			So(args[0], ShouldAlmostEqual, 114.1618, 0.0001)
+			So(args[1], ShouldAlmostEqual, 22.2455, 0.0001)
+			So(args[2], ShouldAlmostEqual, 114.1716, 0.0001)
+			So(args[3], ShouldAlmostEqual, 22.2545, 0.0001)
+			So(args[4:], ShouldResemble, []interface{}{114.1667, 22.25, 500.0})
+		})
+
+		Convey("serialized without bounding box for non-literal distance", func() {
+			sqlizer := &distancePredicateSqlizer{
+				"note",
+				"latlng",
+				skydb.NewLocation(114.1667, 22.25),
+				"<=",
+				expressionSqlizer{
+					"note",
+					skydb.Expression{Type: skydb.KeyPath, Value: "radius"},
+				},
+			}
+			sql, args, err := sqlizer.ToSql()
+			So(err, ShouldBeNil)
+			So(sql, ShouldEqual,
+				`ST_Distance_Sphere("note"."latlng", ST_MakePoint(?, ?)) <= "note"."radius"`)
+			So(args, ShouldResemble, []interface{}{114.1667, 22.25})
+		})
+	})
+}
+
+func TestDistanceBoundingBox(t *testing.T) {
+	// distance returns the great-circle distance between the locations
+	// by the haversine formula, as ST_Distance_Sphere does.
+	distance := func(a, b skydb.Location) float64 {
+		lat1, lat2 := a.Lat()*math.Pi/180, b.Lat()*math.Pi/180
+		dLat := lat2 - lat1
+		dLng := (b.Lng() - a.Lng()) * math.Pi / 180
+		h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+			math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+		return 2 * earthRadius * math.Asin(math.Sqrt(h))
+	}
+
+	// destination returns the location at the distance from the location
+	// along the bearing in radians.
+	destination := func(from skydb.Location, bearing, d float64) skydb.Location {
+		angle := d / earthRadius
+		lat1 := from.Lat() * math.Pi / 180
+		lng1 := from.Lng() * math.Pi / 180
+		lat2 := math.Asin(math.Sin(lat1)*math.Cos(angle) +
+			math.Cos(lat1)*math.Sin(angle)*math.Cos(bearing))
+		lng2 := lng1 + math.Atan2(math.Sin(bearing)*math.Sin(angle)*math.Cos(lat1),
+			math.Cos(angle)-math.Sin(lat1)*math.Sin(lat2))
+		return skydb.NewLocation(lng2*180/math.Pi, lat2*180/math.Pi)
+	}
+
+	Convey("distance bounding box", t, func() {
+		Convey("contains locations at the edge of the distance", func() {
+			for _, center := range []skydb.Location{
+				skydb.NewLocation(0, 0),
+				skydb.NewLocation(114.1667, 22.25),
+				skydb.NewLocation(-73.9857, 40.7484),
+				skydb.NewLocation(18.0686, 59.3293),
+				skydb.NewLocation(-20, -75),
+			} {
+				for _, d := range []float64{1, 500, 10000, 1000000} {
+					minLng, minLat, maxLng, maxLat, ok := distanceBoundingBox(center, d)
+					So(ok, ShouldBeTrue)
+
+					for i := 0; i < 360; i++ {
+						location := destination(center, float64(i)*math.Pi/180, d)
+						So(distance(center, location), ShouldAlmostEqual, d, d*1e-6)
+						So(location.Lng(), ShouldBeBetweenOrEqual, minLng, maxLng)
+						So(location.Lat(), ShouldBeBetweenOrEqual, minLat, maxLat)
+					}
+				}
+			}
+		})
+
+		Convey("excludes far away locations", func() {
+			minLng, minLat, maxLng, maxLat, ok := distanceBoundingBox(skydb.NewLocation(0, 0), 111195)
+			So(ok, ShouldBeTrue)
+			So(minLng, ShouldAlmostEqual, -1, 0.001)
+			So(maxLng, ShouldAlmostEqual, 1, 0.001)
+			So(minLat, ShouldAlmostEqual, -1, 0.001)
+			So(maxLat, ShouldAlmostEqual, 1, 0.001)
+		})
+
+		Convey("has no box covering a pole or crossing the antimeridian", func() {
+			_, _, _, _, ok := distanceBoundingBox(skydb.NewLocation(0, 89.9), 20000)
+			So(ok, ShouldBeFalse)
+			_, _, _, _, ok = distanceBoundingBox(skydb.NewLocation(179.9, 0), 20000)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestWithinPolygonPredicateSqlizer(t *testing.T) {
+	Convey("within polygon predicate", t, func() {
+		Convey("serialized with closed ring", func() {
+			sqlizer := &withinPolygonPredicateSqlizer{
+				"note",
+				"latlng",
+				[]skydb.Location{
+					skydb.NewLocation(0, 0),
+					skydb.NewLocation(10, 0),
+					skydb.NewLocation(10, 10),
+				},
+			}
+			sql, args, err := sqlizer.ToSql()
+			So(err, ShouldBeNil)
+			So(sql, ShouldEqual,
+				`ST_Covers(ST_MakePolygon(ST_MakeLine(ARRAY[ST_MakePoint(?, ?), ST_MakePoint(?, ?), ST_MakePoint(?, ?), ST_MakePoint(?, ?)])), "note"."latlng")`)
+			So(args, ShouldResemble, []interface{}{
+				0.0, 0.0,
+				10.0, 0.0,
+				10.0, 10.0,
+				0.0, 0.0,
+			})
 		})
 	})
 }
@@ -0,0 +1,651 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	"github.com/skygeario/skygear-server/pkg/server/skydb/skyconv"
+)
+
+// bundleVersion is the version of the bundle format written by
+// ExportBundle. ImportBundle rejects bundles of other versions.
+const bundleVersion = 1
+
+// A bundle is a stream of JSON values, each of which is an entry of a
+// kind followed by its data. Entries are written in the order they have
+// to be imported, such that ImportBundle reads the bundle in one pass:
+//
+//	header, roles, schema, record_access, default_acl, index,
+//	constraint, asset, record
+const (
+	bundleKindHeader       = "header"
+	bundleKindRoles        = "roles"
+	bundleKindSchema       = "schema"
+	bundleKindRecordAccess = "record_access"
+	bundleKindDefaultACL   = "default_acl"
+	bundleKindIndex        = "index"
+	bundleKindConstraint   = "constraint"
+	bundleKindAsset        = "asset"
+	bundleKindRecord       = "record"
+)
+
+type bundleEntry struct {
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+}
+
+type bundleHeader struct {
+	Version int `json:"version"`
+}
+
+type bundleRoles struct {
+	Admin   []string `json:"admin"`
+	Default []string `json:"default"`
+}
+
+// bundleSchema maps record types to their fields, whose types are written
+// as simple names, e.g. "string" or "ref(note)".
+type bundleSchema struct {
+	RecordTypes map[string]map[string]string `json:"record_types"`
+}
+
+type bundleRecordAccess struct {
+	RecordType string          `json:"record_type"`
+	Access     skydb.RecordACL `json:"access"`
+}
+
+type bundleDefaultACL struct {
+	DatabaseID string          `json:"database_id"`
+	Access     json.RawMessage `json:"access"`
+}
+
+// bundleIndex is an index of a record type. Definition is the part of the
+// index definition following the table name, e.g. "USING btree (title)",
+// which does not depend on the schema of the container.
+type bundleIndex struct {
+	RecordType string `json:"record_type"`
+	Name       string `json:"name"`
+	Unique     bool   `json:"unique,omitempty"`
+	Definition string `json:"definition"`
+}
+
+// bundleConstraint is a unique or check constraint of a record type, as
+// added by AddUniqueConstraint and AddEnumConstraint.
+type bundleConstraint struct {
+	RecordType string `json:"record_type"`
+	Name       string `json:"name"`
+	Definition string `json:"definition"`
+}
+
+type bundleAsset struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// bundleRecord is a record in the JSONRecord format of the database it is
+// in. DatabaseID is empty for the public database, and the user ID for a
+// private database.
+type bundleRecord struct {
+	DatabaseID string          `json:"database_id"`
+	Record     json.RawMessage `json:"record"`
+}
+
+type bundleWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *bundleWriter) write(kind string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return w.encoder.Encode(bundleEntry{Kind: kind, Data: raw})
+}
+
+// ExportBundle writes the roles, record types, indexes, constraints,
+// default access, assets and records of the container to w.
+//
+// The container is read at a snapshot, as by OpenSnapshot, so that the
+// bundle is consistent while writes continue. Records are written as
+// they are scanned, so the records of the container are never held in
+// memory at once.
+//
+// Subscriptions belong to devices, which are not exported, so a
+// container having subscriptions cannot be exported.
+func (c *conn) ExportBundle(w io.Writer) error {
+	snapshotConn, err := c.snapshotConn()
+	if err != nil {
+		return err
+	}
+	defer snapshotConn.Rollback()
+	return snapshotConn.exportBundle(w)
+}
+
+func (c *conn) exportBundle(w io.Writer) error {
+	var subscriptionCount int
+	if err := c.Get(&subscriptionCount, fmt.Sprintf(
+		"SELECT COUNT(*) FROM %s", c.tableName("_subscription"))); err != nil {
+		return err
+	}
+	if subscriptionCount > 0 {
+		return fmt.Errorf("cannot export container having %d subscriptions, which belong to devices not included in bundle", subscriptionCount)
+	}
+
+	bw := &bundleWriter{json.NewEncoder(w)}
+	if err := bw.write(bundleKindHeader, bundleHeader{bundleVersion}); err != nil {
+		return err
+	}
+
+	roles := bundleRoles{}
+	var err error
+	if roles.Admin, err = c.GetAdminRoles(); err != nil {
+		return err
+	}
+	if roles.Default, err = c.GetDefaultRoles(); err != nil {
+		return err
+	}
+	if err := bw.write(bundleKindRoles, roles); err != nil {
+		return err
+	}
+
+	db := c.PublicDB().(*database)
+	schemas, err := db.GetRecordSchemas()
+	if err != nil {
+		return err
+	}
+	recordTypes := make([]string, 0, len(schemas))
+	schema := bundleSchema{map[string]map[string]string{}}
+	for recordType, recordSchema := range schemas {
+		fields := map[string]string{}
+		for key, fieldType := range recordSchema {
+			if fieldType.Type == skydb.TypeUnknown {
+				return fmt.Errorf(`cannot export field "%s" of record type "%s" of unknown type`, key, recordType)
+			}
+			fields[key] = fieldType.ToSimpleName()
+		}
+		schema.RecordTypes[recordType] = fields
+		recordTypes = append(recordTypes, recordType)
+	}
+	sort.Strings(recordTypes)
+	if err := bw.write(bundleKindSchema, schema); err != nil {
+		return err
+	}
+
+	for _, recordType := range recordTypes {
+		acl, err := c.GetRecordAccess(recordType)
+		if err != nil {
+			return err
+		}
+		if len(acl) == 0 {
+			continue
+		}
+		if err := bw.write(bundleKindRecordAccess, bundleRecordAccess{recordType, acl}); err != nil {
+			return err
+		}
+	}
+
+	if err := c.exportDefaultACLs(bw); err != nil {
+		return err
+	}
+	if err := c.exportIndexes(bw); err != nil {
+		return err
+	}
+	if err := c.exportConstraints(bw); err != nil {
+		return err
+	}
+	if err := c.exportAssets(bw); err != nil {
+		return err
+	}
+
+	for _, recordType := range recordTypes {
+		if err := c.exportRecords(bw, recordType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) exportDefaultACLs(bw *bundleWriter) error {
+	rows, err := c.Queryx(fmt.Sprintf(
+		"SELECT database_id, access FROM %s ORDER BY database_id",
+		c.tableName("_default_acl")))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := bundleDefaultACL{}
+		var access []byte
+		if err := rows.Scan(&entry.DatabaseID, &access); err != nil {
+			return err
+		}
+		entry.Access = access
+		if err := bw.write(bundleKindDefaultACL, entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// exportIndexes writes the indexes of record types, except those backing
+// the primary key and constraints, which are created with them.
+func (c *conn) exportIndexes(bw *bundleWriter) error {
+	rows, err := c.Queryx(`
+	SELECT t.relname, i.relname, x.indisunique, pg_get_indexdef(i.oid)
+	FROM pg_index x
+	JOIN pg_class i ON i.oid = x.indexrelid
+	JOIN pg_class t ON t.oid = x.indrelid
+	JOIN pg_namespace ns ON ns.oid = t.relnamespace
+	WHERE ns.nspname = $1 AND t.relkind = 'r' AND (t.relname NOT LIKE '\_%')
+		AND NOT EXISTS (SELECT 1 FROM pg_constraint con WHERE con.conindid = x.indexrelid)
+	ORDER BY t.relname, i.relname
+	`, c.schemaName())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		index := bundleIndex{}
+		var definition string
+		if err := rows.Scan(&index.RecordType, &index.Name, &index.Unique, &definition); err != nil {
+			return err
+		}
+
+		// The definition names the table with the schema of the
+		// container, which is replaced on import.
+		i := strings.Index(definition, " USING ")
+		if i < 0 {
+			return fmt.Errorf(`unexpected definition of index "%s": %s`, index.Name, definition)
+		}
+		index.Definition = definition[i+1:]
+		if err := bw.write(bundleKindIndex, index); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (c *conn) exportConstraints(bw *bundleWriter) error {
+	rows, err := c.Queryx(`
+	SELECT t.relname, con.conname, pg_get_constraintdef(con.oid)
+	FROM pg_constraint con
+	JOIN pg_class t ON t.oid = con.conrelid
+	JOIN pg_namespace ns ON ns.oid = t.relnamespace
+	WHERE ns.nspname = $1 AND t.relkind = 'r' AND (t.relname NOT LIKE '\_%')
+		AND con.contype IN ('u', 'c')
+	ORDER BY t.relname, con.conname
+	`, c.schemaName())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		constraint := bundleConstraint{}
+		if err := rows.Scan(&constraint.RecordType, &constraint.Name, &constraint.Definition); err != nil {
+			return err
+		}
+		if err := bw.write(bundleKindConstraint, constraint); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (c *conn) exportAssets(bw *bundleWriter) error {
+	rows, err := c.Queryx(fmt.Sprintf(
+		"SELECT id, content_type, size FROM %s ORDER BY id",
+		c.tableName("_asset")))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		asset := bundleAsset{}
+		if err := rows.Scan(&asset.Name, &asset.ContentType, &asset.Size); err != nil {
+			return err
+		}
+		if err := bw.write(bundleKindAsset, asset); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// exportRecords writes the records of recordType in each database,
+// without the values of virtual fields, which are not stored.
+func (c *conn) exportRecords(bw *bundleWriter, recordType string) error {
+	rows, err := c.Queryx(fmt.Sprintf(
+		"SELECT DISTINCT _database_id FROM %s ORDER BY _database_id",
+		c.tableName(recordType)))
+	if err != nil {
+		return err
+	}
+	databaseIDs := []string{}
+	for rows.Next() {
+		var databaseID string
+		if err := rows.Scan(&databaseID); err != nil {
+			rows.Close()
+			return err
+		}
+		databaseIDs = append(databaseIDs, databaseID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, databaseID := range databaseIDs {
+		db := c.bundleDatabase(databaseID)
+		rows, err := db.Query(&skydb.Query{
+			Type:                recordType,
+			BypassAccessControl: true,
+		})
+		if err != nil {
+			return err
+		}
+
+		virtualFields := db.virtualFields(recordType)
+		for rows.Scan() {
+			record := rows.Record()
+			for key := range virtualFields {
+				delete(record.Data, key)
+			}
+
+			data, err := json.Marshal((*skyconv.JSONRecord)(&record))
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if err := bw.write(bundleKindRecord, bundleRecord{databaseID, data}); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bundleDatabase returns the database of records with the specified
+// _database_id, which is empty for the public database.
+func (c *conn) bundleDatabase(databaseID string) *database {
+	if databaseID == "" {
+		return c.PublicDB().(*database)
+	}
+	return c.PrivateDB(databaseID).(*database)
+}
+
+// ImportBundle imports the entries of the bundle in a transaction, which
+// is begun if none has begun. Record types are created by Extend, which
+// commits the schema changes on its own, so they remain if the import
+// fails afterwards.
+//
+// Records are saved without their reference fields first, which are
+// saved after all records are saved, so that records can reference
+// records that follow them in the bundle. The reference fields of
+// records are held in memory until then.
+func (c *conn) ImportBundle(r io.Reader) (err error) {
+	if c.tx == nil {
+		if err := c.Begin(); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				c.Rollback()
+			} else {
+				err = c.Commit()
+			}
+		}()
+	}
+
+	decoder := json.NewDecoder(r)
+	references := []bundleReferences{}
+	for n := 0; ; n++ {
+		entry := bundleEntry{}
+		if err := decoder.Decode(&entry); err == io.EOF {
+			if n == 0 {
+				return errors.New("bundle is empty")
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			if err := importBundleHeader(entry); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if entry.Kind == bundleKindRecord {
+			refs, err := c.importBundleRecord(entry.Data)
+			if err != nil {
+				return fmt.Errorf("bundle entry %d: %s", n, err)
+			}
+			if len(refs.record.Data) > 0 {
+				references = append(references, refs)
+			}
+			continue
+		}
+
+		if err := c.importBundleEntry(entry); err != nil {
+			return fmt.Errorf("bundle entry %d: %s", n, err)
+		}
+	}
+
+	for _, refs := range references {
+		if err := c.bundleDatabase(refs.databaseID).save(&refs.record); err != nil {
+			return fmt.Errorf(`failed to save references of record "%s": %s`, refs.record.ID, err)
+		}
+	}
+	return nil
+}
+
+// bundleReferences is a record holding only the reference fields of a
+// record imported from a bundle.
+type bundleReferences struct {
+	databaseID string
+	record     skydb.Record
+}
+
+func importBundleHeader(entry bundleEntry) error {
+	if entry.Kind != bundleKindHeader {
+		return fmt.Errorf(`bundle begins with entry of kind "%s" instead of header`, entry.Kind)
+	}
+	header := bundleHeader{}
+	if err := json.Unmarshal(entry.Data, &header); err != nil {
+		return err
+	}
+	if header.Version != bundleVersion {
+		return fmt.Errorf("unsupported bundle version %d", header.Version)
+	}
+	return nil
+}
+
+func (c *conn) importBundleEntry(entry bundleEntry) error {
+	switch entry.Kind {
+	case bundleKindRoles:
+		roles := bundleRoles{}
+		if err := json.Unmarshal(entry.Data, &roles); err != nil {
+			return err
+		}
+		if err := c.SetAdminRoles(roles.Admin); err != nil {
+			return err
+		}
+		return c.SetDefaultRoles(roles.Default)
+	case bundleKindSchema:
+		schema := bundleSchema{}
+		if err := json.Unmarshal(entry.Data, &schema); err != nil {
+			return err
+		}
+		return c.importBundleSchema(schema)
+	case bundleKindRecordAccess:
+		access := bundleRecordAccess{}
+		if err := json.Unmarshal(entry.Data, &access); err != nil {
+			return err
+		}
+		return c.SetRecordAccess(access.RecordType, access.Access)
+	case bundleKindDefaultACL:
+		defaultACL := bundleDefaultACL{}
+		if err := json.Unmarshal(entry.Data, &defaultACL); err != nil {
+			return err
+		}
+		acl := skydb.RecordACL{}
+		if err := json.Unmarshal(defaultACL.Access, &acl); err != nil {
+			return err
+		}
+		db := c.PublicDB()
+		if defaultACL.DatabaseID != skydb.PublicDatabaseIdentifier {
+			db = c.PrivateDB(defaultACL.DatabaseID)
+		}
+		return db.SetDefaultACL(acl)
+	case bundleKindIndex:
+		index := bundleIndex{}
+		if err := json.Unmarshal(entry.Data, &index); err != nil {
+			return err
+		}
+		unique := ""
+		if index.Unique {
+			unique = "UNIQUE "
+		}
+		// Indexes created with record types, such as those of
+		// reference fields, exist already.
+		_, err := c.Exec(fmt.Sprintf("CREATE %sINDEX IF NOT EXISTS %s ON %s %s",
+			unique,
+			pq.QuoteIdentifier(index.Name),
+			c.tableName(index.RecordType),
+			index.Definition))
+		return err
+	case bundleKindConstraint:
+		constraint := bundleConstraint{}
+		if err := json.Unmarshal(entry.Data, &constraint); err != nil {
+			return err
+		}
+		return c.importBundleConstraint(constraint)
+	case bundleKindAsset:
+		asset := bundleAsset{}
+		if err := json.Unmarshal(entry.Data, &asset); err != nil {
+			return err
+		}
+		return c.SaveAsset(&skydb.Asset{
+			Name:        asset.Name,
+			ContentType: asset.ContentType,
+			Size:        asset.Size,
+		})
+	}
+	return fmt.Errorf(`unexpected entry of kind "%s"`, entry.Kind)
+}
+
+// importBundleSchema extends the record types with their fields other
+// than references first, so that all referenced record types exist when
+// the references are added.
+func (c *conn) importBundleSchema(schema bundleSchema) error {
+	schemas := map[string]skydb.RecordSchema{}
+	refSchemas := map[string]skydb.RecordSchema{}
+	for recordType, fields := range schema.RecordTypes {
+		schemas[recordType] = skydb.RecordSchema{}
+		refSchemas[recordType] = skydb.RecordSchema{}
+		for key, typeName := range fields {
+			fieldType, err := skydb.SimpleNameToFieldType(typeName)
+			if err != nil {
+				return fmt.Errorf(`field "%s" of record type "%s": %s`, key, recordType, err)
+			}
+			if fieldType.Type == skydb.TypeReference {
+				refSchemas[recordType][key] = fieldType
+			} else {
+				schemas[recordType][key] = fieldType
+			}
+		}
+	}
+
+	db := c.PublicDB()
+	for _, s := range []map[string]skydb.RecordSchema{schemas, refSchemas} {
+		for recordType, recordSchema := range s {
+			if _, err := db.Extend(recordType, recordSchema); err != nil {
+				return fmt.Errorf(`failed to create record type "%s": %s`, recordType, err)
+			}
+		}
+	}
+	return nil
+}
+
+// importBundleConstraint adds the constraint unless a constraint of the
+// same name exists, such as the unique constraint of _id created with the
+// table.
+func (c *conn) importBundleConstraint(constraint bundleConstraint) error {
+	var exists bool
+	err := c.Get(&exists, `
+	SELECT EXISTS (
+		SELECT 1
+		FROM pg_constraint con
+		JOIN pg_class t ON t.oid = con.conrelid
+		JOIN pg_namespace ns ON ns.oid = t.relnamespace
+		WHERE ns.nspname = $1 AND t.relname = $2 AND con.conname = $3
+	)`, c.schemaName(), constraint.RecordType, constraint.Name)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = c.Exec(fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s %s",
+		c.tableName(constraint.RecordType),
+		pq.QuoteIdentifier(constraint.Name),
+		constraint.Definition))
+	return err
+}
+
+// importBundleRecord saves the record without its reference fields, and
+// returns a record holding the reference fields to be saved later.
+func (c *conn) importBundleRecord(data json.RawMessage) (bundleReferences, error) {
+	entry := bundleRecord{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return bundleReferences{}, err
+	}
+
+	record := skydb.Record{}
+	if err := skyconv.UnmarshalRecord(entry.Record, &record); err != nil {
+		return bundleReferences{}, err
+	}
+
+	refs := bundleReferences{entry.DatabaseID, record}
+	refs.record.Data = map[string]interface{}{}
+	for key, value := range record.Data {
+		if _, ok := value.(skydb.Reference); ok {
+			refs.record.Data[key] = value
+			delete(record.Data, key)
+		}
+	}
+
+	if err := c.bundleDatabase(entry.DatabaseID).save(&record); err != nil {
+		return bundleReferences{}, fmt.Errorf(`failed to save record "%s": %s`, record.ID, err)
+	}
+	return refs, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBundle(t *testing.T) {
+	Convey("Conn", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		So(c.SetAdminRoles([]string{"admin"}), ShouldBeNil)
+		So(c.SetDefaultRoles([]string{"user"}), ShouldBeNil)
+		So(c.SetRecordAccess("note", skydb.NewRecordACL([]skydb.RecordACLEntry{
+			skydb.NewRecordACLEntryRole("admin", skydb.CreateLevel),
+		})), ShouldBeNil)
+		So(db.SetDefaultACL(skydb.RecordACL{
+			skydb.NewRecordACLEntryPublic(skydb.ReadLevel),
+		}), ShouldBeNil)
+
+		_, err := db.Extend("category", skydb.RecordSchema{
+			"name": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+		_, err = db.Extend("note", skydb.RecordSchema{
+			"title":    skydb.FieldType{Type: skydb.TypeString},
+			"category": skydb.FieldType{Type: skydb.TypeReference, ReferenceType: "category"},
+		})
+		So(err, ShouldBeNil)
+		So(db.CreateIndex("note", skydb.Index{
+			Name:     "note_title",
+			KeyPaths: []string{"title"},
+		}), ShouldBeNil)
+		So(db.AddUniqueConstraint("category", "name"), ShouldBeNil)
+
+		createdAt := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+		category := skydb.Record{
+			ID:        skydb.NewRecordID("category", "work"),
+			OwnerID:   "ownerID",
+			CreatedAt: createdAt,
+			UpdatedAt: createdAt,
+			Data:      skydb.Data{"name": "Work"},
+		}
+		So(db.Save(&category), ShouldBeNil)
+		note := skydb.Record{
+			ID:        skydb.NewRecordID("note", "note1"),
+			OwnerID:   "ownerID",
+			CreatedAt: createdAt,
+			UpdatedAt: createdAt,
+			Data: skydb.Data{
+				"title":    "Meeting",
+				"category": skydb.NewReference("category", "work"),
+			},
+		}
+		So(db.Save(&note), ShouldBeNil)
+		privateNote := skydb.Record{
+			ID:        skydb.NewRecordID("note", "note2"),
+			OwnerID:   "ownerID",
+			CreatedAt: createdAt,
+			UpdatedAt: createdAt,
+			Data:      skydb.Data{"title": "Diary"},
+		}
+		So(c.PrivateDB("ownerID").Save(&privateNote), ShouldBeNil)
+
+		Convey("imports exported bundle into another container", func() {
+			buf := bytes.Buffer{}
+			So(c.ExportBundle(&buf), ShouldBeNil)
+
+			other := getTestConnOfApp(t, "io.skygear.test.bundle")
+			defer cleanupConn(t, other)
+			So(other.ImportBundle(&buf), ShouldBeNil)
+
+			roles, err := other.GetAdminRoles()
+			So(err, ShouldBeNil)
+			So(roles, ShouldResemble, []string{"admin"})
+			roles, err = other.GetDefaultRoles()
+			So(err, ShouldBeNil)
+			So(roles, ShouldResemble, []string{"user"})
+
+			access, err := other.GetRecordAccess("note")
+			So(err, ShouldBeNil)
+			So(access, ShouldResemble, skydb.NewRecordACL([]skydb.RecordACLEntry{
+				skydb.NewRecordACLEntryRole("admin", skydb.CreateLevel),
+			}))
+
+			otherDB := other.PublicDB()
+			defaultACL, err := otherDB.DefaultACL()
+			So(err, ShouldBeNil)
+			So(defaultACL, ShouldResemble, skydb.RecordACL{
+				skydb.NewRecordACLEntryPublic(skydb.ReadLevel),
+			})
+
+			schema, err := otherDB.GetSchema("note")
+			So(err, ShouldBeNil)
+			So(schema["title"].Type, ShouldEqual, skydb.TypeString)
+			So(schema["category"].Type, ShouldEqual, skydb.TypeReference)
+			So(schema["category"].ReferenceType, ShouldEqual, "category")
+
+			var indexCount int
+			So(other.Get(&indexCount, `
+			SELECT COUNT(*) FROM pg_indexes WHERE schemaname = $1 AND indexname = 'note_title'`,
+				other.schemaName()), ShouldBeNil)
+			So(indexCount, ShouldEqual, 1)
+
+			duplicated := skydb.Record{
+				ID:   skydb.NewRecordID("category", "duplicated"),
+				Data: skydb.Data{"name": "Work"},
+			}
+			So(otherDB.Save(&duplicated), ShouldNotBeNil)
+
+			imported := skydb.Record{}
+			So(otherDB.Get(note.ID, &imported), ShouldBeNil)
+			So(imported.OwnerID, ShouldEqual, "ownerID")
+			So(imported.CreatedAt, ShouldResemble, createdAt)
+			So(imported.Data["title"], ShouldEqual, "Meeting")
+			So(imported.Data["category"], ShouldResemble, skydb.NewReference("category", "work"))
+
+			So(other.PrivateDB("ownerID").Get(privateNote.ID, &imported), ShouldBeNil)
+			So(imported.Data["title"], ShouldEqual, "Diary")
+			So(otherDB.Get(privateNote.ID, &imported), ShouldEqual, skydb.ErrRecordNotFound)
+		})
+
+		Convey("exports records of snapshot in transaction", func() {
+			So(c.Begin(), ShouldBeNil)
+			defer c.Rollback()
+			uncommitted := skydb.Record{
+				ID:      skydb.NewRecordID("note", "uncommitted"),
+				OwnerID: "ownerID",
+				Data:    skydb.Data{"title": "Draft"},
+			}
+			So(db.Save(&uncommitted), ShouldBeNil)
+
+			buf := bytes.Buffer{}
+			So(c.ExportBundle(&buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "note1")
+			So(buf.String(), ShouldNotContainSubstring, "uncommitted")
+		})
+
+		Convey("rejects exporting container having subscriptions", func() {
+			addUser(t, c, "userid")
+			addDevice(t, c, "userid", "deviceid")
+			subscription := subscriptionForTest("deviceid", "subscriptionid", "note")
+			So(c.PrivateDB("userid").SaveSubscription(&subscription), ShouldBeNil)
+
+			buf := bytes.Buffer{}
+			So(c.ExportBundle(&buf), ShouldNotBeNil)
+		})
+
+		Convey("rejects bundle of unsupported version", func() {
+			other := getTestConnOfApp(t, "io.skygear.test.bundle")
+			defer cleanupConn(t, other)
+
+			err := other.ImportBundle(strings.NewReader(`{"kind":"header","data":{"version":0}}`))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,204 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	"golang.org/x/net/context"
+)
+
+// changelogPollInterval is the interval the changelog is polled for new
+// changes when no record change notification is received.
+const changelogPollInterval = 10 * time.Second
+
+// changelogFetchLimit is the maximum number of changes fetched from the
+// changelog at a time.
+const changelogFetchLimit = 100
+
+// changelogWatermark is the condition of changes that are final. Seq is
+// allocated when a change is made but not when it is committed, so a
+// change of a transaction in progress may be committed after changes of
+// larger seq are read. Changes are read only after every transaction
+// that began before them has ended, in the order of the ID of their
+// transaction and then seq, such that no change is read after changes
+// following it.
+const changelogWatermark = "txid < txid_snapshot_xmin(txid_current_snapshot())"
+
+// changelogCursor is the position of a change in the order changes are
+// read from the changelog.
+type changelogCursor struct {
+	txid uint64
+	seq  uint64
+}
+
+type rawChange struct {
+	Seq        uint64
+	TxID       uint64
+	Op         string
+	RecordType string
+	Record     []byte
+}
+
+func (db *database) Changes(ctx context.Context, sinceSeq uint64) (<-chan skydb.Change, error) {
+	recordEventChan := make(chan skydb.RecordEvent)
+	if err := db.c.Subscribe(recordEventChan); err != nil {
+		return nil, err
+	}
+
+	cursor, err := db.changelogCursor(sinceSeq)
+	if err != nil {
+		db.c.unsubscribe(recordEventChan)
+		return nil, err
+	}
+
+	changeChan := make(chan skydb.Change)
+	go func() {
+		defer close(changeChan)
+		defer db.c.unsubscribe(recordEventChan)
+
+		for {
+			changes, cursors, err := db.fetchChanges(cursor)
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					"seq": cursor.seq,
+					"err": err,
+				}).Errorln("pq/changelog: failed to fetch changes")
+			}
+
+			for i, change := range changes {
+				select {
+				case <-ctx.Done():
+					return
+				case changeChan <- change:
+				}
+				cursor = cursors[i]
+			}
+
+			if len(changes) == changelogFetchLimit {
+				// there may be more changes to fetch
+				continue
+			}
+
+			// wait until there is a record change, the record event
+			// itself is discarded as it does not carry a seq
+			select {
+			case <-ctx.Done():
+				return
+			case <-recordEventChan:
+			case <-time.After(changelogPollInterval):
+			}
+		}
+	}()
+
+	return changeChan, nil
+}
+
+// changelogCursor returns the cursor of the change of seq, or the cursor
+// before all changes if seq is 0 or the change is no longer kept.
+func (db *database) changelogCursor(seq uint64) (changelogCursor, error) {
+	if seq == 0 {
+		return changelogCursor{}, nil
+	}
+
+	q := psql.Select("txid").
+		From(db.tableName("_changelog")).
+		Where("seq = ?", seq)
+
+	var txid uint64
+	err := db.c.QueryRowWith(q).Scan(&txid)
+	if err == sql.ErrNoRows {
+		return changelogCursor{}, nil
+	} else if err != nil {
+		return changelogCursor{}, err
+	}
+	return changelogCursor{txid, seq}, nil
+}
+
+// fetchChanges fetches final changes on records of the Database after
+// the cursor, and returns them with their cursors.
+func (db *database) fetchChanges(cursor changelogCursor) ([]skydb.Change, []changelogCursor, error) {
+	q := psql.Select("seq", "txid", "op", "recordtype", "record").
+		From(db.tableName("_changelog")).
+		Where("(txid, seq) > (?, ?)", cursor.txid, cursor.seq).
+		Where(changelogWatermark).
+		OrderBy("txid", "seq").
+		Limit(changelogFetchLimit)
+	if db.DatabaseType() != skydb.UnionDatabase {
+		q = q.Where("record->>'_database_id' = ?", db.userID)
+	}
+
+	rows, err := db.c.QueryWith(q)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	changes := []skydb.Change{}
+	cursors := []changelogCursor{}
+	for rows.Next() {
+		var raw rawChange
+		if err := rows.Scan(&raw.Seq, &raw.TxID, &raw.Op, &raw.RecordType, &raw.Record); err != nil {
+			return nil, nil, err
+		}
+
+		change := skydb.Change{
+			Seq:    raw.Seq,
+			Record: &skydb.Record{},
+		}
+		if err := parseChangeEvent(raw.Op, &change.Event); err != nil {
+			return nil, nil, err
+		}
+		if err := parseRecordData(raw.Record, change.Record); err != nil {
+			return nil, nil, err
+		}
+		change.Record.ID.Type = raw.RecordType
+
+		changes = append(changes, change)
+		cursors = append(cursors, changelogCursor{raw.TxID, raw.Seq})
+	}
+
+	return changes, cursors, rows.Err()
+}
+
+func (db *database) HighWaterMark() (uint64, error) {
+	q := psql.Select("seq").
+		From(db.tableName("_changelog")).
+		Where(changelogWatermark).
+		OrderBy("txid DESC", "seq DESC").
+		Limit(1)
+	if db.DatabaseType() != skydb.UnionDatabase {
+		q = q.Where("record->>'_database_id' = ?", db.userID)
+	}
+
+	var seq uint64
+	err := db.c.QueryRowWith(q).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// purgeChangelog removes changes made before the specified time from
+// the changelog.
+func (db *database) purgeChangelog(before time.Time) error {
+	builder := psql.Delete(db.tableName("_changelog")).
+		Where("created_at < ?", before)
+	_, err := db.c.ExecWith(builder)
+	return err
+}
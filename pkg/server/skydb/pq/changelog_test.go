@@ -0,0 +1,283 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/context"
+)
+
+func TestChanges(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		changes, err := db.Changes(ctx, 0)
+		So(err, ShouldBeNil)
+
+		nextChange := func() *skydb.Change {
+			select {
+			case change, ok := <-changes:
+				if !ok {
+					return nil
+				}
+				return &change
+			case <-time.After(5 * time.Second):
+				return nil
+			}
+		}
+
+		Convey("emits changes on save and delete", func() {
+			record := skydb.Record{
+				ID:      skydb.NewRecordID("note", "id1"),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"content": "hello",
+				},
+			}
+			So(db.Save(&record), ShouldBeNil)
+
+			change := nextChange()
+			So(change, ShouldNotBeNil)
+			So(change.Event, ShouldEqual, skydb.RecordCreated)
+			So(change.Record.ID, ShouldResemble, skydb.NewRecordID("note", "id1"))
+			So(change.Record.Data["content"], ShouldEqual, "hello")
+
+			record.Data["content"] = "world"
+			So(db.Save(&record), ShouldBeNil)
+
+			change = nextChange()
+			So(change, ShouldNotBeNil)
+			So(change.Event, ShouldEqual, skydb.RecordUpdated)
+			So(change.Record.Data["content"], ShouldEqual, "world")
+
+			So(db.Delete(record.ID), ShouldBeNil)
+
+			change = nextChange()
+			So(change, ShouldNotBeNil)
+			So(change.Event, ShouldEqual, skydb.RecordDeleted)
+			So(change.Record.ID, ShouldResemble, skydb.NewRecordID("note", "id1"))
+		})
+
+		Convey("does not emit changes of other database", func() {
+			privateDB := c.PrivateDB("userid")
+			_, err := privateDB.Extend("note", skydb.RecordSchema{
+				"content": skydb.FieldType{Type: skydb.TypeString},
+			})
+			So(err, ShouldBeNil)
+
+			So(privateDB.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "private"),
+				OwnerID: "userid",
+			}), ShouldBeNil)
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "public"),
+				OwnerID: "userid",
+			}), ShouldBeNil)
+
+			change := nextChange()
+			So(change, ShouldNotBeNil)
+			So(change.Record.ID, ShouldResemble, skydb.NewRecordID("note", "public"))
+		})
+
+		Convey("resumes changes after a seq", func() {
+			for _, id := range []string{"id1", "id2", "id3", "id4"} {
+				So(db.Save(&skydb.Record{
+					ID:      skydb.NewRecordID("note", id),
+					OwnerID: "userid",
+				}), ShouldBeNil)
+			}
+
+			first := nextChange()
+			So(first, ShouldNotBeNil)
+			So(first.Record.ID.Key, ShouldEqual, "id1")
+			second := nextChange()
+			So(second, ShouldNotBeNil)
+			So(second.Record.ID.Key, ShouldEqual, "id2")
+			So(second.Seq, ShouldBeGreaterThan, first.Seq)
+			cancel()
+
+			resumeCtx, resumeCancel := context.WithCancel(context.Background())
+			defer resumeCancel()
+			changes, err = db.Changes(resumeCtx, second.Seq)
+			So(err, ShouldBeNil)
+
+			third := nextChange()
+			So(third, ShouldNotBeNil)
+			So(third.Record.ID.Key, ShouldEqual, "id3")
+			fourth := nextChange()
+			So(fourth, ShouldNotBeNil)
+			So(fourth.Record.ID.Key, ShouldEqual, "id4")
+			So(fourth.Seq, ShouldBeGreaterThan, third.Seq)
+		})
+
+		Convey("emits a change committed late before later changes", func() {
+			late := getTestConnOfApp(t, c.appName)
+			defer late.Close()
+			So(late.Begin(), ShouldBeNil)
+			So(late.PublicDB().Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "late"),
+				OwnerID: "userid",
+			}), ShouldBeNil)
+
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "early"),
+				OwnerID: "userid",
+			}), ShouldBeNil)
+
+			select {
+			case change := <-changes:
+				t.Fatalf("got change of %s before the late change is committed", change.Record.ID)
+			case <-time.After(500 * time.Millisecond):
+			}
+
+			So(late.Commit(), ShouldBeNil)
+
+			first := nextChange()
+			So(first, ShouldNotBeNil)
+			So(first.Record.ID.Key, ShouldEqual, "late")
+			second := nextChange()
+			So(second, ShouldNotBeNil)
+			So(second.Record.ID.Key, ShouldEqual, "early")
+			cancel()
+
+			Convey("resumes after the late change", func() {
+				resumeCtx, resumeCancel := context.WithCancel(context.Background())
+				defer resumeCancel()
+				changes, err = db.Changes(resumeCtx, first.Seq)
+				So(err, ShouldBeNil)
+
+				change := nextChange()
+				So(change, ShouldNotBeNil)
+				So(change.Record.ID.Key, ShouldEqual, "early")
+			})
+		})
+
+		Convey("purges changes older than retention on applying retention", func() {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "id1"),
+				OwnerID: "userid",
+			}), ShouldBeNil)
+			So(nextChange(), ShouldNotBeNil)
+			cancel()
+			time.Sleep(10 * time.Millisecond)
+
+			retaining := getTestConnWithConfig(t, c.appName, skydb.Config{
+				ChangelogRetention: time.Millisecond,
+			})
+			defer retaining.Close()
+			_, err := retaining.PublicDB().ApplyRetention()
+			So(err, ShouldBeNil)
+
+			fetched, _, err := db.(*database).fetchChanges(changelogCursor{})
+			So(err, ShouldBeNil)
+			So(fetched, ShouldBeEmpty)
+		})
+
+		Convey("keeps changes when reading them", func() {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "id1"),
+				OwnerID: "userid",
+			}), ShouldBeNil)
+			So(nextChange(), ShouldNotBeNil)
+
+			replayCtx, replayCancel := context.WithCancel(context.Background())
+			defer replayCancel()
+			changes, err = db.Changes(replayCtx, 0)
+			So(err, ShouldBeNil)
+
+			change := nextChange()
+			So(change, ShouldNotBeNil)
+			So(change.Record.ID.Key, ShouldEqual, "id1")
+		})
+
+		Convey("closes the channel when context is cancelled", func() {
+			cancel()
+			So(nextChange(), ShouldBeNil)
+
+			_, ok := <-changes
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestHighWaterMark(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("returns 0 without changes", func() {
+			seq, err := db.HighWaterMark()
+			So(err, ShouldBeNil)
+			So(seq, ShouldEqual, 0)
+		})
+
+		Convey("advances after each write", func() {
+			record := skydb.Record{
+				ID:      skydb.NewRecordID("note", "id1"),
+				OwnerID: "userid",
+			}
+			So(db.Save(&record), ShouldBeNil)
+			saved, err := db.HighWaterMark()
+			So(err, ShouldBeNil)
+			So(saved, ShouldBeGreaterThan, 0)
+
+			stable, err := db.HighWaterMark()
+			So(err, ShouldBeNil)
+			So(stable, ShouldEqual, saved)
+
+			So(db.Delete(record.ID), ShouldBeNil)
+			deleted, err := db.HighWaterMark()
+			So(err, ShouldBeNil)
+			So(deleted, ShouldBeGreaterThan, saved)
+		})
+
+		Convey("ignores changes of other database", func() {
+			privateDB := c.PrivateDB("userid")
+			_, err := privateDB.Extend("note", skydb.RecordSchema{
+				"content": skydb.FieldType{Type: skydb.TypeString},
+			})
+			So(err, ShouldBeNil)
+
+			So(privateDB.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "private"),
+				OwnerID: "userid",
+			}), ShouldBeNil)
+
+			seq, err := db.HighWaterMark()
+			So(err, ShouldBeNil)
+			So(seq, ShouldEqual, 0)
+		})
+	})
+}
@@ -20,6 +20,7 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	sq "github.com/lann/squirrel"
@@ -82,6 +83,18 @@ type conn struct {
 	statementCount uint64
 	accessModel    skydb.AccessModel
 	canMigrate     bool
+
+	// maxQueryDuration limits the duration of Database.Query, or is zero
+	// if queries are not limited.
+	maxQueryDuration time.Duration
+
+	// config is the configuration of the records of the app, copied at
+	// Open and never modified.
+	config skydb.Config
+
+	// takenWrites counts the writes of the transaction by record type,
+	// whose write rate limit tokens are refunded if it is rolled back.
+	takenWrites map[string]int
 }
 
 // Db returns the current database wrapper, or a transaction wrapper when
@@ -121,6 +134,7 @@ func (c *conn) Commit() error {
 		return err
 	}
 	c.tx = nil
+	c.takenWrites = nil
 	log.Debugf("%p: Committed transaction", c)
 	return nil
 }
@@ -131,6 +145,7 @@ func (c *conn) Rollback() error {
 		return skydb.ErrDatabaseTxDidNotBegin
 	}
 
+	c.refundTakenWrites()
 	if err := c.tx.Rollback(); err != nil {
 		log.Errorf("%p: Unable to rollback transaction %p: %v", c, c.tx, err)
 		return err
@@ -162,7 +177,70 @@ func (c *conn) UnionDB() skydb.Database {
 	}
 }
 
-func (c *conn) Close() error { return nil }
+func (c *conn) OpenSnapshot() (skydb.SnapshotDatabase, error) {
+	snapshotConn, err := c.snapshotConn()
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotDatabase{
+		database: &database{
+			c:            snapshotConn,
+			databaseType: skydb.PublicDatabase,
+			readOnly:     true,
+		},
+	}, nil
+}
+
+// snapshotConn returns a conn reading the snapshot of the current state
+// of the container in a read-only transaction, which is released by
+// Rollback.
+//
+// The snapshot is held by the transaction of a separate conn, so that c
+// continues to read and write the live database.
+func (c *conn) snapshotConn() (*conn, error) {
+	tx, err := c.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	// A repeatable read transaction takes its snapshot on the first
+	// query, which is issued right away instead of on the first read.
+	if _, err := tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY"); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err := tx.Exec("SELECT 1"); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return &conn{
+		db:               c.db,
+		tx:               tx,
+		RecordSchema:     map[string]skydb.RecordSchema{},
+		appName:          c.appName,
+		option:           c.option,
+		accessModel:      c.accessModel,
+		maxQueryDuration: c.maxQueryDuration,
+		config:           c.config,
+	}, nil
+}
+
+// Close rolls back the transaction in effect, if any, and discards the
+// cached record schemas. The connection pool is shared with other conns
+// and stays open, so a closed conn can be used again: its state is
+// initialized afresh on the next operation.
+func (c *conn) Close() error {
+	var err error
+	if c.tx != nil {
+		log.Debugf("%p: Rolling back transaction %p on close", c, c.tx)
+		c.refundTakenWrites()
+		err = c.tx.Rollback()
+		c.tx = nil
+	}
+	c.RecordSchema = map[string]skydb.RecordSchema{}
+	return err
+}
 
 // return the raw unquoted schema name of this app
 func (c *conn) schemaName() string {
@@ -179,6 +257,17 @@ type database struct {
 	c            *conn
 	userID       string
 	databaseType skydb.DatabaseType
+	readOnly     bool
+}
+
+// snapshotDatabase is a read-only database reading the snapshot of the
+// transaction of its conn.
+type snapshotDatabase struct {
+	*database
+}
+
+func (db *snapshotDatabase) Close() error {
+	return db.c.Rollback()
 }
 
 func (db *database) Conn() skydb.Conn       { return db.c }
@@ -198,7 +287,9 @@ func (db *database) ID() string {
 }
 
 func (db *database) DatabaseType() skydb.DatabaseType { return db.databaseType }
-func (db *database) IsReadOnly() bool                 { return db.DatabaseType() == skydb.UnionDatabase }
+func (db *database) IsReadOnly() bool {
+	return db.readOnly || db.DatabaseType() == skydb.UnionDatabase
+}
 
 // schemaName is a convenient method to access parent conn's schemaName
 func (db *database) schemaName() string {
@@ -212,8 +303,9 @@ func (db *database) tableName(table string) string {
 
 // this ensures that our structure conform to certain interfaces.
 var (
-	_ skydb.Conn     = &conn{}
-	_ skydb.Database = &database{}
+	_ skydb.Conn             = &conn{}
+	_ skydb.Database         = &database{}
+	_ skydb.SnapshotDatabase = &snapshotDatabase{}
 
 	_ driver.Valuer = authInfoValue{}
 )
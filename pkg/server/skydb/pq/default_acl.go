@@ -0,0 +1,62 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+)
+
+func (db *database) SetDefaultACL(acl skydb.RecordACL) error {
+	if acl == nil {
+		builder := psql.Delete(db.tableName("_default_acl")).
+			Where("database_id = ?", db.ID())
+		if _, err := db.c.ExecWith(builder); err != nil {
+			return fmt.Errorf("set default acl: failed to delete default acl: %s", err)
+		}
+		return nil
+	}
+
+	stmt := fmt.Sprintf(`INSERT INTO %s (database_id, access) VALUES ($1, $2)
+ON CONFLICT (database_id) DO UPDATE SET access = EXCLUDED.access`,
+		db.tableName("_default_acl"))
+	if _, err := db.c.Exec(stmt, db.ID(), aclValue(acl)); err != nil {
+		return fmt.Errorf("set default acl: failed to save default acl: %s", err)
+	}
+	return nil
+}
+
+func (db *database) DefaultACL() (skydb.RecordACL, error) {
+	builder := psql.Select("access").
+		From(db.tableName("_default_acl")).
+		Where("database_id = ?", db.ID())
+
+	var data []byte
+	err := db.c.QueryRowWith(builder).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("default acl: failed to fetch default acl: %s", err)
+	}
+
+	acl := skydb.RecordACL{}
+	if err := json.Unmarshal(data, &acl); err != nil {
+		return nil, fmt.Errorf("default acl: failed to parse default acl: %s", err)
+	}
+	return acl, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"testing"
+
+	sq "github.com/lann/squirrel"
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDefaultACL(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		defaultACL := skydb.RecordACL{
+			skydb.NewRecordACLEntryPublic(skydb.ReadLevel),
+		}
+
+		Convey("has no default ACL unless set", func() {
+			acl, err := db.DefaultACL()
+			So(err, ShouldBeNil)
+			So(acl, ShouldBeNil)
+		})
+
+		Convey("persists default ACL", func() {
+			So(db.SetDefaultACL(defaultACL), ShouldBeNil)
+
+			acl, err := c.PublicDB().DefaultACL()
+			So(err, ShouldBeNil)
+			So(acl, ShouldResemble, defaultACL)
+
+			acl, err = c.PrivateDB("alice").DefaultACL()
+			So(err, ShouldBeNil)
+			So(acl, ShouldBeNil)
+		})
+
+		Convey("removes default ACL", func() {
+			So(db.SetDefaultACL(defaultACL), ShouldBeNil)
+			So(db.SetDefaultACL(nil), ShouldBeNil)
+
+			acl, err := db.DefaultACL()
+			So(err, ShouldBeNil)
+			So(acl, ShouldBeNil)
+		})
+
+		Convey("queries records without ACL with default ACL", func() {
+			_, err := db.Extend("note", skydb.RecordSchema{})
+			So(err, ShouldBeNil)
+
+			for _, record := range []skydb.Record{
+				{
+					ID:      skydb.NewRecordID("note", "id1"),
+					OwnerID: "alice",
+				},
+				{
+					ID:      skydb.NewRecordID("note", "id2"),
+					OwnerID: "alice",
+					ACL: skydb.RecordACL{
+						skydb.NewRecordACLEntryDirect("bob", skydb.WriteLevel),
+					},
+				},
+			} {
+				So(db.Save(&record), ShouldBeNil)
+			}
+
+			queryKeys := func(user *skydb.UserInfo, level skydb.ACLLevel) []string {
+				query := &skydb.Query{
+					Type:       "note",
+					ViewAsUser: user,
+				}
+				sql, args, err := db.(*database).matchingIDsQuery(query, level)
+				So(err, ShouldBeNil)
+				sql, err = sq.Dollar.ReplacePlaceholders(sql + " ORDER BY _id")
+				So(err, ShouldBeNil)
+
+				rows, err := c.Queryx(sql, args...)
+				So(err, ShouldBeNil)
+				defer rows.Close()
+
+				keys := []string{}
+				for rows.Next() {
+					var key string
+					So(rows.Scan(&key), ShouldBeNil)
+					keys = append(keys, key)
+				}
+				return keys
+			}
+
+			bob := &skydb.UserInfo{ID: "bob"}
+			So(db.SetDefaultACL(defaultACL), ShouldBeNil)
+			So(queryKeys(bob, skydb.ReadLevel), ShouldResemble, []string{"id1", "id2"})
+			So(queryKeys(bob, skydb.WriteLevel), ShouldResemble, []string{"id2"})
+
+			So(db.SetDefaultACL(skydb.RecordACL{}), ShouldBeNil)
+			So(queryKeys(bob, skydb.WriteLevel), ShouldResemble, []string{"id1", "id2"})
+		})
+	})
+}
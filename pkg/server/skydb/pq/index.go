@@ -0,0 +1,771 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	"github.com/skygeario/skygear-server/pkg/server/skyerr"
+)
+
+func (db *database) CreateIndex(recordType string, index skydb.Index) error {
+	if !db.c.canMigrate {
+		return skyerr.NewError(skyerr.IncompatibleSchema, "Record schema requires migration but migration is disabled.")
+	}
+
+	if index.Name == "" {
+		return errors.New("got empty index name")
+	}
+
+	if len(index.KeyPaths) == 0 {
+		return errors.New("got empty index key paths")
+	}
+
+	typemap, err := db.remoteColumnTypes(recordType)
+	if err != nil {
+		return err
+	}
+
+	columns := make([]string, len(index.KeyPaths))
+	for i, keyPath := range index.KeyPaths {
+		if _, ok := typemap[keyPath]; !ok {
+			return fmt.Errorf(`unexpected key "%s"`, keyPath)
+		}
+		columns[i] = pq.QuoteIdentifier(keyPath)
+	}
+
+	stmt := fmt.Sprintf("CREATE INDEX %s ON %s (%s)",
+		pq.QuoteIdentifier(index.Name),
+		db.tableName(recordType),
+		strings.Join(columns, ", "))
+	if !index.Predicate.IsEmpty() {
+		predicateSQL, err := partialIndexPredicateSQL(typemap, index.Predicate)
+		if err != nil {
+			return fmt.Errorf("cannot create partial index: %s", err)
+		}
+		stmt += " WHERE " + predicateSQL
+	}
+	if _, err := db.c.Exec(stmt); err != nil {
+		return fmt.Errorf("failed to create index: %s", err)
+	}
+	return nil
+}
+
+func (db *database) DropIndex(recordType, indexName string) error {
+	if !db.c.canMigrate {
+		return skyerr.NewError(skyerr.IncompatibleSchema, "Record schema requires migration but migration is disabled.")
+	}
+
+	var exists bool
+	err := db.c.QueryRowx(`
+	SELECT EXISTS (
+		SELECT 1 FROM pg_indexes
+		WHERE schemaname = $1 AND tablename = $2 AND indexname = $3
+	)`, db.schemaName(), recordType, indexName).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf(`index "%s" does not exist on record type "%s"`, indexName, recordType)
+	}
+
+	stmt := fmt.Sprintf("DROP INDEX %s", db.tableName(indexName))
+	if _, err := db.c.Exec(stmt); err != nil {
+		return fmt.Errorf("failed to drop index: %s", err)
+	}
+	return nil
+}
+
+// rebuildIndexSuffix is the suffix of the name of the index built by
+// RebuildIndex before it replaces the existing index.
+const rebuildIndexSuffix = "_rebuild"
+
+func (db *database) RebuildIndex(recordType, indexName string) error {
+	if !db.c.canMigrate {
+		return skyerr.NewError(skyerr.IncompatibleSchema, "Record schema requires migration but migration is disabled.")
+	}
+
+	// Building an index concurrently cannot be done in a transaction.
+	if db.c.tx != nil {
+		return errors.New("cannot rebuild index in a transaction")
+	}
+
+	var indexDef string
+	err := db.c.QueryRowx(`
+	SELECT indexdef FROM pg_indexes
+	WHERE schemaname = $1 AND tablename = $2 AND indexname = $3
+	`, db.schemaName(), recordType, indexName).Scan(&indexDef)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf(`index "%s" does not exist on record type "%s"`, indexName, recordType)
+	} else if err != nil {
+		return err
+	}
+
+	// indexDef is of the form `CREATE [UNIQUE] INDEX name ON table ...`,
+	// which is reused for the new index with a different name.
+	createIndex := "CREATE INDEX "
+	if strings.HasPrefix(indexDef, "CREATE UNIQUE INDEX ") {
+		createIndex = "CREATE UNIQUE INDEX "
+	}
+	onPos := strings.Index(indexDef, " ON ")
+	if !strings.HasPrefix(indexDef, createIndex) || onPos == -1 {
+		return fmt.Errorf(`cannot rebuild index "%s" defined as "%s"`, indexName, indexDef)
+	}
+
+	// A concurrent build takes into account records modified while the
+	// index is being built, at the cost of scanning the table twice.
+	newIndexName := boundedIdentifier(indexName + rebuildIndexSuffix)
+	stmt := createIndex + "CONCURRENTLY " + pq.QuoteIdentifier(newIndexName) + indexDef[onPos:]
+	if _, err := db.c.Exec(stmt); err != nil {
+		// a failed concurrent build leaves behind an invalid index
+		db.c.Exec(fmt.Sprintf("DROP INDEX IF EXISTS %s", db.tableName(newIndexName)))
+		return fmt.Errorf("failed to build index: %s", err)
+	}
+
+	if err := db.c.Begin(); err != nil {
+		return err
+	}
+	err = db.swapIndex(indexName, newIndexName)
+	if err != nil {
+		db.c.Rollback()
+		db.c.Exec(fmt.Sprintf("DROP INDEX IF EXISTS %s", db.tableName(newIndexName)))
+		return fmt.Errorf("failed to replace index: %s", err)
+	}
+	return db.c.Commit()
+}
+
+func (db *database) swapIndex(indexName, newIndexName string) error {
+	stmt := fmt.Sprintf("DROP INDEX %s", db.tableName(indexName))
+	if _, err := db.c.Exec(stmt); err != nil {
+		return err
+	}
+
+	stmt = fmt.Sprintf("ALTER INDEX %s RENAME TO %s",
+		db.tableName(newIndexName),
+		pq.QuoteIdentifier(indexName))
+	_, err := db.c.Exec(stmt)
+	return err
+}
+
+// errIndexNotScanned is returned by verifyIndex if the planner does not
+// scan the index to be verified.
+var errIndexNotScanned = errors.New("index is not scanned")
+
+// verifiableIndex is an index on a record type that VerifyIndexes can
+// cross-check against the records.
+type verifiableIndex struct {
+	name       string
+	recordType string
+	columns    []string
+	// predicate is the SQL of the predicate of a partial index, or empty
+	// if the index is not partial.
+	predicate string
+}
+
+func (db *database) VerifyIndexes() ([]skydb.Inconsistency, error) {
+	// The planner settings changed to scan an index are local to a
+	// transaction, which is rolled back as nothing is modified.
+	if db.c.tx != nil {
+		return nil, errors.New("cannot verify indexes in a transaction")
+	}
+	if err := db.c.Begin(); err != nil {
+		return nil, err
+	}
+	defer db.c.Rollback()
+
+	// All scans see the same snapshot, so records saved meanwhile are
+	// not reported.
+	if _, err := db.c.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY"); err != nil {
+		return nil, err
+	}
+
+	indexes, err := db.verifiableIndexes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list indexes: %s", err)
+	}
+
+	inconsistencies := []skydb.Inconsistency{}
+	for _, index := range indexes {
+		found, err := db.verifyIndex(index)
+		if err == errIndexNotScanned {
+			log.Warnf(`Skipped verifying index "%s", which cannot be scanned in place of other indexes of the same key`, index.name)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf(`failed to verify index "%s": %s`, index.name, err)
+		}
+		inconsistencies = append(inconsistencies, found...)
+	}
+	return inconsistencies, nil
+}
+
+// verifiableIndexes returns the valid B-tree indexes over columns of
+// record types, which include the primary key and unique constraints.
+func (db *database) verifiableIndexes() ([]verifiableIndex, error) {
+	rows, err := db.c.Queryx(`
+	SELECT i.relname, t.relname, COALESCE(pg_get_expr(x.indpred, x.indrelid), ''),
+		array_to_json(ARRAY(
+			SELECT a.attname
+			FROM unnest(x.indkey::int2[]) WITH ORDINALITY AS k(attnum, n)
+			JOIN pg_attribute a ON a.attrelid = x.indrelid AND a.attnum = k.attnum
+			ORDER BY k.n
+		))::text
+	FROM pg_index x
+	JOIN pg_class i ON i.oid = x.indexrelid
+	JOIN pg_class t ON t.oid = x.indrelid
+	JOIN pg_namespace ns ON ns.oid = t.relnamespace
+	JOIN pg_am am ON am.oid = i.relam
+	WHERE ns.nspname = $1 AND t.relkind = 'r' AND (t.relname NOT LIKE '\_%')
+		AND am.amname = 'btree' AND x.indexprs IS NULL AND x.indisvalid
+	ORDER BY t.relname, i.relname
+	`, db.schemaName())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	indexes := []verifiableIndex{}
+	for rows.Next() {
+		index := verifiableIndex{}
+		var columns []byte
+		if err := rows.Scan(&index.name, &index.recordType, &index.predicate, &columns); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(columns, &index.columns); err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, rows.Err()
+}
+
+// verifyIndex compares the records reached by a full scan of the index
+// with the records covered by the index, as found by a sequential scan
+// of the table.
+//
+// A record covered by the index but not reached is reported missing. A
+// record reached more than once, reached out of the index order or not
+// covered by the index is reported stale.
+func (db *database) verifyIndex(index verifiableIndex) ([]skydb.Inconsistency, error) {
+	columns := make([]string, len(index.columns))
+	for i, column := range index.columns {
+		columns[i] = pq.QuoteIdentifier(column)
+	}
+	key := strings.Join(columns, ", ")
+
+	where := ""
+	covered := "TRUE"
+	if index.predicate != "" {
+		where = " WHERE " + index.predicate
+		covered = "(" + index.predicate + ") IS TRUE"
+	}
+
+	if _, err := db.c.Exec(`SET LOCAL enable_seqscan = on;
+SET LOCAL enable_indexscan = off;
+SET LOCAL enable_indexonlyscan = off;
+SET LOCAL enable_bitmapscan = off`); err != nil {
+		return nil, err
+	}
+
+	// Records are identified by their physical locations, as records
+	// of different databases may share the same ID.
+	coveredIDs := map[string]string{}
+	rows, err := db.c.Queryx(fmt.Sprintf("SELECT ctid::text, _id FROM %s%s",
+		db.tableName(index.recordType), where))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var ctid, id string
+		if err := rows.Scan(&ctid, &id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		coveredIDs[ctid] = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Disabling sequential scans and sorts leaves a full scan of an
+	// index in the order of the key as the only plan, which may still
+	// pick another index of the same key and so is checked.
+	if _, err := db.c.Exec(`SET LOCAL enable_seqscan = off;
+SET LOCAL enable_indexscan = on;
+SET LOCAL enable_sort = off`); err != nil {
+		return nil, err
+	}
+
+	stmt := fmt.Sprintf(`SELECT ctid::text, _id, %s,
+	ROW(%s) < lag(ROW(%s)) OVER (ORDER BY %s) IS TRUE
+FROM %s%s ORDER BY %s`,
+		covered, key, key, key, db.tableName(index.recordType), where, key)
+
+	var plan string
+	if err := db.c.QueryRowx("EXPLAIN (FORMAT JSON) " + stmt).Scan(&plan); err != nil {
+		return nil, err
+	}
+	if !strings.Contains(plan, fmt.Sprintf(`"Index Name": "%s"`, index.name)) {
+		return nil, errIndexNotScanned
+	}
+
+	inconsistency := func(id string, kind skydb.InconsistencyKind) skydb.Inconsistency {
+		return skydb.Inconsistency{
+			RecordType: index.recordType,
+			IndexName:  index.name,
+			RecordID:   skydb.NewRecordID(index.recordType, id),
+			Kind:       kind,
+		}
+	}
+
+	inconsistencies := []skydb.Inconsistency{}
+	reachedIDs := map[string]bool{}
+	rows, err = db.c.Queryx(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			ctid, id            string
+			isCovered, outOfKey bool
+		)
+		if err := rows.Scan(&ctid, &id, &isCovered, &outOfKey); err != nil {
+			return nil, err
+		}
+		if reachedIDs[ctid] || !isCovered || outOfKey {
+			inconsistencies = append(inconsistencies, inconsistency(id, skydb.StaleIndexEntry))
+		}
+		reachedIDs[ctid] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	missingIDs := []string{}
+	for ctid, id := range coveredIDs {
+		if !reachedIDs[ctid] {
+			missingIDs = append(missingIDs, id)
+		}
+	}
+	sort.Strings(missingIDs)
+	for _, id := range missingIDs {
+		inconsistencies = append(inconsistencies, inconsistency(id, skydb.MissingIndexEntry))
+	}
+
+	return inconsistencies, nil
+}
+
+// uniqueConstraintKind is the kind in the names of unique constraints
+// added by AddUniqueConstraint.
+const uniqueConstraintKind = "unique"
+
+// enumConstraintKind is the kind in the names of check constraints added
+// by AddEnumConstraint.
+const enumConstraintKind = "enum"
+
+// fieldConstraintName returns the name of the constraint of the kind added
+// on the field of the record type. The name ends with the kind and a hash
+// of the record type, field and kind, such that it is not mistaken for
+// constraints added otherwise. The record type and field before it are
+// truncated to fit the identifier length limit.
+//
+// Constraints named before are renamed by revision_8e5a1c7d3b2.
+func fieldConstraintName(recordType, keyPath, kind string) string {
+	sum := md5.Sum([]byte(recordType + "." + keyPath + "." + kind))
+	suffix := "_" + kind + "_" + hex.EncodeToString(sum[:])[:8]
+	prefix := recordType + "_" + keyPath
+	for len(prefix)+len(suffix) > maxIdentifierLength {
+		_, size := utf8.DecodeLastRuneInString(prefix)
+		prefix = prefix[:len(prefix)-size]
+	}
+	return prefix + suffix
+}
+
+// isFieldConstraint returns whether name is the name of the constraint of
+// the kind added on a field of typemap.
+func isFieldConstraint(name string, kind string, recordType string, typemap skydb.RecordSchema) bool {
+	for keyPath := range typemap {
+		if name == fieldConstraintName(recordType, keyPath, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *database) AddUniqueConstraint(recordType, keyPath string) error {
+	if !db.c.canMigrate {
+		return skyerr.NewError(skyerr.IncompatibleSchema, "Record schema requires migration but migration is disabled.")
+	}
+
+	typemap, err := db.remoteColumnTypes(recordType)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := typemap[keyPath]; !ok {
+		return fmt.Errorf(`unexpected key "%s"`, keyPath)
+	}
+
+	stmt := fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s UNIQUE (%s)",
+		db.tableName(recordType),
+		pq.QuoteIdentifier(fieldConstraintName(recordType, keyPath, uniqueConstraintKind)),
+		pq.QuoteIdentifier(keyPath))
+	if _, err := db.c.Exec(stmt); err != nil {
+		return fmt.Errorf("failed to add unique constraint: %s", err)
+	}
+	return nil
+}
+
+func (db *database) AddEnumConstraint(recordType, keyPath string, values []interface{}) error {
+	if !db.c.canMigrate {
+		return skyerr.NewError(skyerr.IncompatibleSchema, "Record schema requires migration but migration is disabled.")
+	}
+
+	if len(values) == 0 {
+		return errors.New("got empty enum values")
+	}
+
+	typemap, err := db.remoteColumnTypes(recordType)
+	if err != nil {
+		return err
+	}
+
+	fieldType, ok := typemap[keyPath]
+	if !ok {
+		return fmt.Errorf(`unexpected key "%s"`, keyPath)
+	}
+
+	literals := make([]string, len(values))
+	for i, value := range values {
+		literal, err := enumLiteral(fieldType.Type, value)
+		if err != nil {
+			return fmt.Errorf(`cannot add enum constraint on key "%s": %s`, keyPath, err)
+		}
+		literals[i] = literal
+	}
+
+	// DDL statements do not accept placeholders, so the values are
+	// written into the statement as literals.
+	stmt := fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s CHECK (%s IN (%s))",
+		db.tableName(recordType),
+		pq.QuoteIdentifier(fieldConstraintName(recordType, keyPath, enumConstraintKind)),
+		pq.QuoteIdentifier(keyPath),
+		strings.Join(literals, ", "))
+	if _, err := db.c.Exec(stmt); err != nil {
+		return fmt.Errorf("failed to add enum constraint: %s", err)
+	}
+	return nil
+}
+
+func enumLiteral(dataType skydb.DataType, value interface{}) (string, error) {
+	switch dataType {
+	case skydb.TypeString:
+		if _, ok := value.(string); ok {
+			return quoteLiteral(value)
+		}
+	case skydb.TypeNumber, skydb.TypeInteger:
+		switch value.(type) {
+		case int, int32, int64, float32, float64:
+			return quoteLiteral(value)
+		}
+	default:
+		return "", fmt.Errorf("unsupported type %v", dataType)
+	}
+	return "", fmt.Errorf("got value %v of type %T, want %v", value, value, dataType)
+}
+
+// partialIndexPredicateSQL returns the SQL of the predicate of a partial
+// index. The predicate is written with literals instead of placeholders
+// because DDL statements do not accept placeholders.
+func partialIndexPredicateSQL(typemap skydb.RecordSchema, p skydb.Predicate) (string, error) {
+	switch p.Operator {
+	case skydb.And, skydb.Or, skydb.Not:
+		sqls := make([]string, len(p.Children))
+		for i, child := range p.Children {
+			childPredicate, ok := child.(skydb.Predicate)
+			if !ok {
+				return "", fmt.Errorf("got %T in compound predicate, want skydb.Predicate", child)
+			}
+			sql, err := partialIndexPredicateSQL(typemap, childPredicate)
+			if err != nil {
+				return "", err
+			}
+			sqls[i] = "(" + sql + ")"
+		}
+
+		switch p.Operator {
+		case skydb.And:
+			return strings.Join(sqls, " AND "), nil
+		case skydb.Or:
+			return strings.Join(sqls, " OR "), nil
+		default:
+			if len(sqls) != 1 {
+				return "", errors.New("not predicate must have exactly one child")
+			}
+			return "NOT " + sqls[0], nil
+		}
+	}
+
+	if len(p.Children) != 2 {
+		return "", fmt.Errorf("comparison predicate must have exactly two children")
+	}
+	lhs, lok := p.Children[0].(skydb.Expression)
+	rhs, rok := p.Children[1].(skydb.Expression)
+	if !lok || !rok || !lhs.IsKeyPath() || rhs.Type != skydb.Literal {
+		return "", errors.New("comparison predicate must compare a key path with a literal")
+	}
+
+	keyPath := lhs.Value.(string)
+	if _, ok := typemap[keyPath]; !ok {
+		return "", fmt.Errorf(`unexpected key "%s"`, keyPath)
+	}
+	column := pq.QuoteIdentifier(keyPath)
+
+	if rhs.IsLiteralNull() {
+		switch p.Operator {
+		case skydb.Equal:
+			return column + " IS NULL", nil
+		case skydb.NotEqual:
+			return column + " IS NOT NULL", nil
+		default:
+			return "", fmt.Errorf("cannot compare with null using operator %v", p.Operator)
+		}
+	}
+
+	operator, err := comparisonOperatorSQL(p.Operator)
+	if err != nil {
+		return "", err
+	}
+	literal, err := quoteLiteral(rhs.Value)
+	if err != nil {
+		return "", err
+	}
+	return column + " " + operator + " " + literal, nil
+}
+
+// quoteLiteral returns value as an SQL literal.
+func quoteLiteral(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return "'" + strings.Replace(v, "'", "''", -1) + "'", nil
+	case bool:
+		if v {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case int, int32, int64, float32, float64:
+		return fmt.Sprintf("%v", v), nil
+	default:
+		return "", fmt.Errorf("unsupported literal %v of type %T", value, value)
+	}
+}
+
+// tableConstraint is a check, unique or foreign key constraint of the table
+// of a record type.
+type tableConstraint struct {
+	name       string
+	kind       string // 'c', 'u' or 'f' as pg_constraint.contype
+	definition string
+	columns    []string
+
+	// referencedTable and referencedColumns are the table and columns
+	// referenced by a foreign key constraint.
+	referencedTable   string
+	referencedColumns []string
+}
+
+// tableConstraints returns the check, unique and foreign key constraints
+// of the table of the record type, sorted by name.
+func (db *database) tableConstraints(recordType string) ([]tableConstraint, error) {
+	rows, err := db.c.Queryx(`
+	SELECT con.conname, con.contype, pg_get_constraintdef(con.oid),
+		COALESCE((
+			SELECT json_agg(a.attname ORDER BY k.i)
+			FROM unnest(con.conkey) WITH ORDINALITY AS k(attnum, i)
+			JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum
+		), '[]')::text,
+		COALESCE(quote_ident(rn.nspname) || '.' || quote_ident(ref.relname), ''),
+		COALESCE((
+			SELECT json_agg(a.attname ORDER BY k.i)
+			FROM unnest(con.confkey) WITH ORDINALITY AS k(attnum, i)
+			JOIN pg_attribute a ON a.attrelid = con.confrelid AND a.attnum = k.attnum
+		), '[]')::text
+	FROM pg_constraint con
+	JOIN pg_class t ON t.oid = con.conrelid
+	JOIN pg_namespace ns ON ns.oid = t.relnamespace
+	LEFT JOIN pg_class ref ON ref.oid = con.confrelid
+	LEFT JOIN pg_namespace rn ON rn.oid = ref.relnamespace
+	WHERE ns.nspname = $1 AND t.relname = $2 AND con.contype IN ('c', 'u', 'f')
+	ORDER BY con.conname
+	`, db.c.schemaName(), recordType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	constraints := []tableConstraint{}
+	for rows.Next() {
+		var c tableConstraint
+		var columnsJSON, referencedColumnsJSON string
+		if err := rows.Scan(&c.name, &c.kind, &c.definition, &columnsJSON, &c.referencedTable, &referencedColumnsJSON); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(columnsJSON), &c.columns); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(referencedColumnsJSON), &c.referencedColumns); err != nil {
+			return nil, err
+		}
+		constraints = append(constraints, c)
+	}
+	return constraints, rows.Err()
+}
+
+// conditionSQL returns the SQL condition which is true if the row of the
+// record, aliased as alias, satisfies the constraint.
+func (c tableConstraint) conditionSQL(db *database, recordType string, alias string) string {
+	switch c.kind {
+	case "c":
+		// Column references of the check expression are not qualified
+		// and resolve to the columns of the row.
+		expr := strings.TrimPrefix(c.definition, "CHECK ")
+		expr = strings.TrimSuffix(expr, " NOT VALID")
+		return fmt.Sprintf("(%s) IS NOT FALSE", expr)
+	case "u":
+		conds := []string{}
+		for _, column := range c.columns {
+			conds = append(conds, fmt.Sprintf("%s = %s",
+				fullQuoteIdentifier("_other", column), fullQuoteIdentifier(alias, column)))
+		}
+		return fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM %s AS "_other" WHERE %s AND NOT (%s = %s AND %s = %s))`,
+			db.tableName(recordType), strings.Join(conds, " AND "),
+			fullQuoteIdentifier("_other", "_id"), fullQuoteIdentifier(alias, "_id"),
+			fullQuoteIdentifier("_other", "_database_id"), fullQuoteIdentifier(alias, "_database_id"))
+	default:
+		nulls := []string{}
+		conds := []string{}
+		for i, column := range c.columns {
+			nulls = append(nulls, fullQuoteIdentifier(alias, column)+" IS NULL")
+			conds = append(conds, fmt.Sprintf("%s = %s",
+				fullQuoteIdentifier("_referenced", c.referencedColumns[i]), fullQuoteIdentifier(alias, column)))
+		}
+		return fmt.Sprintf(`(%s OR EXISTS (SELECT 1 FROM %s AS "_referenced" WHERE %s))`,
+			strings.Join(nulls, " OR "), c.referencedTable, strings.Join(conds, " AND "))
+	}
+}
+
+// violationError returns the error Save returns for violating the
+// constraint.
+func (c tableConstraint) violationError(id skydb.RecordID, typemap skydb.RecordSchema) error {
+	switch {
+	case c.kind == "u" && isFieldConstraint(c.name, uniqueConstraintKind, id.Type, typemap):
+		return skydb.ErrUniqueConstraintViolation
+	case c.kind == "c" && isFieldConstraint(c.name, enumConstraintKind, id.Type, typemap):
+		return skydb.ErrEnumConstraintViolation
+	default:
+		return fmt.Errorf(`db.save %s: violates constraint "%s"`, id, c.name)
+	}
+}
+
+// checkSave checks the data to be saved to the record against the types of
+// the columns and the constraints of the table of the record type, without
+// writing to the table.
+//
+// The row Save would write is computed from data and the current row of
+// the record by a read-only statement, in which the values of data are
+// converted to the types of their columns and the constraints are
+// evaluated against the row.
+func (db *database) checkSave(id skydb.RecordID, typemap skydb.RecordSchema, data map[string]interface{}) error {
+	for column := range data {
+		if _, ok := typemap[column]; !ok {
+			return fmt.Errorf(`db.save %s: unexpected key "%s"`, id, column)
+		}
+	}
+
+	constraints, err := db.tableConstraints(id.Type)
+	if err != nil {
+		return err
+	}
+
+	columns := []string{}
+	for column := range typemap {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	args := []interface{}{id.Key, db.userID}
+	selects := []string{
+		`CAST($1 AS text) AS "_id"`,
+		`CAST($2 AS text) AS "_database_id"`,
+	}
+	for _, column := range columns {
+		if column == "_id" || column == "_database_id" {
+			continue
+		}
+		value, ok := data[column]
+		if !ok {
+			selects = append(selects, fullQuoteIdentifier("_previous", column))
+			continue
+		}
+
+		columnType := typemap[column].UnderlyingType
+		if columnType == "" {
+			columnType = pqDataType(typemap[column].Type)
+		}
+		args = append(args, value)
+		selects = append(selects, fmt.Sprintf("CAST($%d AS %s) AS %s",
+			len(args), columnType, pq.QuoteIdentifier(column)))
+	}
+
+	conditions := []string{"TRUE"}
+	for _, c := range constraints {
+		conditions = append(conditions, c.conditionSQL(db, id.Type, id.Type))
+	}
+
+	stmt := fmt.Sprintf(`SELECT %s FROM (
+		SELECT %s
+		FROM (SELECT 1) AS "_row"
+		LEFT JOIN %s AS "_previous" ON "_previous"."_id" = $1 AND "_previous"."_database_id" = $2
+	) AS %s`,
+		strings.Join(conditions, ", "), strings.Join(selects, ", "),
+		db.tableName(id.Type), pq.QuoteIdentifier(id.Type))
+
+	satisfied := make([]bool, len(conditions))
+	dest := make([]interface{}, len(conditions))
+	for i := range satisfied {
+		dest[i] = &satisfied[i]
+	}
+	if err := db.c.QueryRowx(stmt, args...).Scan(dest...); err != nil {
+		return err
+	}
+
+	for i, c := range constraints {
+		if !satisfied[i+1] {
+			return c.violationError(id, typemap)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,609 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCreateIndex(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB().(*database)
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"status":   skydb.FieldType{Type: skydb.TypeString},
+			"priority": skydb.FieldType{Type: skydb.TypeNumber},
+		})
+		So(err, ShouldBeNil)
+
+		indexColumns := func(indexName string) []string {
+			rows, err := c.Queryx(`
+			SELECT a.attname
+			FROM pg_index i
+			JOIN pg_class ic ON ic.oid = i.indexrelid
+			JOIN pg_namespace n ON n.oid = ic.relnamespace
+			JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+			WHERE n.nspname = $1 AND ic.relname = $2
+			ORDER BY array_position(i.indkey, a.attnum)
+			`, db.schemaName(), indexName)
+			So(err, ShouldBeNil)
+			defer rows.Close()
+
+			columns := []string{}
+			for rows.Next() {
+				var column string
+				So(rows.Scan(&column), ShouldBeNil)
+				columns = append(columns, column)
+			}
+			return columns
+		}
+
+		Convey("creates composite index", func() {
+			err := db.CreateIndex("note", skydb.Index{
+				Name:     "note_owner_status",
+				KeyPaths: []string{"_owner_id", "status"},
+			})
+			So(err, ShouldBeNil)
+			So(indexColumns("note_owner_status"), ShouldResemble, []string{"_owner_id", "status"})
+		})
+
+		Convey("creates partial index used only by queries implying its predicate", func() {
+			err := db.CreateIndex("note", skydb.Index{
+				Name:     "note_priority_open",
+				KeyPaths: []string{"priority"},
+				Predicate: skydb.Predicate{
+					Operator: skydb.Equal,
+					Children: []interface{}{
+						skydb.Expression{Type: skydb.KeyPath, Value: "status"},
+						skydb.Expression{Type: skydb.Literal, Value: "open"},
+					},
+				},
+			})
+			So(err, ShouldBeNil)
+			So(indexColumns("note_priority_open"), ShouldResemble, []string{"priority"})
+
+			queryPlan := func(status string) string {
+				tx, err := c.db.Beginx()
+				So(err, ShouldBeNil)
+				defer tx.Rollback()
+
+				_, err = tx.Exec("SET LOCAL enable_seqscan = off")
+				So(err, ShouldBeNil)
+
+				rows, err := tx.Query(fmt.Sprintf(
+					"EXPLAIN SELECT _id FROM %s WHERE priority = 1 AND status = '%s'",
+					db.tableName("note"), status))
+				So(err, ShouldBeNil)
+				defer rows.Close()
+
+				lines := []string{}
+				for rows.Next() {
+					var line string
+					So(rows.Scan(&line), ShouldBeNil)
+					lines = append(lines, line)
+				}
+				return strings.Join(lines, "\n")
+			}
+
+			So(queryPlan("open"), ShouldContainSubstring, "note_priority_open")
+			So(queryPlan("closed"), ShouldNotContainSubstring, "note_priority_open")
+		})
+
+		Convey("errors on partial index predicate with unknown key path", func() {
+			err := db.CreateIndex("note", skydb.Index{
+				Name:     "note_priority_notexist",
+				KeyPaths: []string{"priority"},
+				Predicate: skydb.Predicate{
+					Operator: skydb.Equal,
+					Children: []interface{}{
+						skydb.Expression{Type: skydb.KeyPath, Value: "notexist"},
+						skydb.Expression{Type: skydb.Literal, Value: "open"},
+					},
+				},
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("drops index", func() {
+			err := db.CreateIndex("note", skydb.Index{
+				Name:     "note_priority",
+				KeyPaths: []string{"priority"},
+			})
+			So(err, ShouldBeNil)
+
+			err = db.DropIndex("note", "note_priority")
+			So(err, ShouldBeNil)
+			So(indexColumns("note_priority"), ShouldBeEmpty)
+		})
+
+		Convey("rebuilds index while records are saved", func() {
+			err := db.CreateIndex("note", skydb.Index{
+				Name:     "note_priority",
+				KeyPaths: []string{"priority"},
+			})
+			So(err, ShouldBeNil)
+
+			// writes go through another connection, as a connection is
+			// not shared by concurrent requests
+			writerConn, err := Open(c.appName, skydb.RoleBasedAccess, "", true, skydb.Config{})
+			So(err, ShouldBeNil)
+			defer writerConn.Close()
+			writerDB := writerConn.PublicDB()
+
+			const n = 50
+			saveNote := func(i int) error {
+				return writerDB.Save(&skydb.Record{
+					ID:      skydb.NewRecordID("note", fmt.Sprintf("id%d", i)),
+					OwnerID: "userid",
+					Data: map[string]interface{}{
+						"priority": float64(i),
+					},
+				})
+			}
+			for i := 0; i < n; i++ {
+				So(saveNote(i), ShouldBeNil)
+			}
+
+			errs := make(chan error, n)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := n; i < 2*n; i++ {
+					if err := saveNote(i); err != nil {
+						errs <- err
+					}
+				}
+			}()
+
+			err = db.RebuildIndex("note", "note_priority")
+			wg.Wait()
+			close(errs)
+
+			So(err, ShouldBeNil)
+			So(errs, ShouldBeEmpty)
+			So(indexColumns("note_priority"), ShouldResemble, []string{"priority"})
+			So(indexColumns("note_priority"+rebuildIndexSuffix), ShouldBeEmpty)
+
+			tx, err := c.db.Beginx()
+			So(err, ShouldBeNil)
+			defer tx.Rollback()
+			_, err = tx.Exec("SET LOCAL enable_seqscan = off")
+			So(err, ShouldBeNil)
+
+			var count int
+			err = tx.QueryRowx(fmt.Sprintf(
+				"SELECT COUNT(*) FROM %s WHERE priority >= 0",
+				db.tableName("note"))).Scan(&count)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 2*n)
+		})
+
+		Convey("rebuilds index of long name", func() {
+			name := "note_priority_" + strings.Repeat("x", 49)
+			err := db.CreateIndex("note", skydb.Index{
+				Name:     name,
+				KeyPaths: []string{"priority"},
+			})
+			So(err, ShouldBeNil)
+
+			So(db.RebuildIndex("note", name), ShouldBeNil)
+			So(indexColumns(name), ShouldResemble, []string{"priority"})
+		})
+
+		Convey("errors on rebuilding non-existent index", func() {
+			err := db.RebuildIndex("note", "note_notexist")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("errors on rebuilding index in a transaction", func() {
+			err := db.CreateIndex("note", skydb.Index{
+				Name:     "note_priority",
+				KeyPaths: []string{"priority"},
+			})
+			So(err, ShouldBeNil)
+
+			So(db.Begin(), ShouldBeNil)
+			defer db.Rollback()
+			So(db.RebuildIndex("note", "note_priority"), ShouldNotBeNil)
+		})
+
+		Convey("verifies index against records", func() {
+			err := db.CreateIndex("note", skydb.Index{
+				Name:     "note_priority",
+				KeyPaths: []string{"priority"},
+			})
+			So(err, ShouldBeNil)
+
+			saveNote := func(i int) {
+				So(db.Save(&skydb.Record{
+					ID:      skydb.NewRecordID("note", fmt.Sprintf("id%d", i)),
+					OwnerID: "userid",
+					Data: map[string]interface{}{
+						"priority": float64(i),
+					},
+				}), ShouldBeNil)
+			}
+			saveNote(0)
+			saveNote(1)
+
+			inconsistencies, err := db.VerifyIndexes()
+			So(err, ShouldBeNil)
+			So(inconsistencies, ShouldBeEmpty)
+
+			Convey("reports records missing from desynced index", func() {
+				// an index not ready is not maintained on writes
+				setIndexReady := func(ready bool) {
+					_, err := c.Exec(fmt.Sprintf(
+						"UPDATE pg_index SET indisready = %t WHERE indexrelid = '%s'::regclass",
+						ready, db.tableName("note_priority")))
+					So(err, ShouldBeNil)
+				}
+				setIndexReady(false)
+				saveNote(2)
+				setIndexReady(true)
+
+				inconsistencies, err := db.VerifyIndexes()
+				So(err, ShouldBeNil)
+				So(inconsistencies, ShouldResemble, []skydb.Inconsistency{
+					{
+						RecordType: "note",
+						IndexName:  "note_priority",
+						RecordID:   skydb.NewRecordID("note", "id2"),
+						Kind:       skydb.MissingIndexEntry,
+					},
+				})
+
+				So(db.RebuildIndex("note", "note_priority"), ShouldBeNil)
+				inconsistencies, err = db.VerifyIndexes()
+				So(err, ShouldBeNil)
+				So(inconsistencies, ShouldBeEmpty)
+			})
+		})
+
+		Convey("errors on verifying indexes in a transaction", func() {
+			So(db.Begin(), ShouldBeNil)
+			defer db.Rollback()
+			_, err := db.VerifyIndexes()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("errors on dropping non-existent index", func() {
+			err := db.DropIndex("note", "note_notexist")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("errors on unknown key path", func() {
+			err := db.CreateIndex("note", skydb.Index{
+				Name:     "note_notexist",
+				KeyPaths: []string{"status", "notexist"},
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("errors on empty key paths", func() {
+			err := db.CreateIndex("note", skydb.Index{
+				Name: "note_empty",
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("errors if migration is disabled", func() {
+			c.canMigrate = false
+			err := db.CreateIndex("note", skydb.Index{
+				Name:     "note_status",
+				KeyPaths: []string{"status"},
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestPartialIndexPredicateSQL(t *testing.T) {
+	Convey("partialIndexPredicateSQL", t, func() {
+		typemap := skydb.RecordSchema{
+			"status":   skydb.FieldType{Type: skydb.TypeString},
+			"priority": skydb.FieldType{Type: skydb.TypeNumber},
+		}
+		comparison := func(op skydb.Operator, keyPath string, value interface{}) skydb.Predicate {
+			return skydb.Predicate{
+				Operator: op,
+				Children: []interface{}{
+					skydb.Expression{Type: skydb.KeyPath, Value: keyPath},
+					skydb.Expression{Type: skydb.Literal, Value: value},
+				},
+			}
+		}
+
+		Convey("writes compound predicate with literals", func() {
+			sql, err := partialIndexPredicateSQL(typemap, skydb.Predicate{
+				Operator: skydb.And,
+				Children: []interface{}{
+					comparison(skydb.Equal, "status", "won't fix"),
+					comparison(skydb.GreaterThan, "priority", 2),
+					skydb.Predicate{
+						Operator: skydb.Not,
+						Children: []interface{}{
+							comparison(skydb.Equal, "status", nil),
+						},
+					},
+				},
+			})
+			So(err, ShouldBeNil)
+			So(sql, ShouldEqual, `("status" = 'won''t fix') AND ("priority" > 2) AND (NOT ("status" IS NULL))`)
+		})
+
+		Convey("errors on unsupported operator", func() {
+			_, err := partialIndexPredicateSQL(typemap, comparison(skydb.Like, "status", "open%"))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("errors on unknown key path", func() {
+			_, err := partialIndexPredicateSQL(typemap, comparison(skydb.Equal, "notexist", "open"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestAddUniqueConstraint(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"slug": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		newNote := func(id, slug string) *skydb.Record {
+			return &skydb.Record{
+				ID:      skydb.NewRecordID("note", id),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"slug": slug,
+				},
+			}
+		}
+
+		So(db.AddUniqueConstraint("note", "slug"), ShouldBeNil)
+		So(db.Save(newNote("id1", "hello")), ShouldBeNil)
+
+		Convey("rejects save with duplicated value", func() {
+			So(db.Save(newNote("id2", "hello")), ShouldEqual, skydb.ErrUniqueConstraintViolation)
+			So(db.Save(newNote("id2", "world")), ShouldBeNil)
+		})
+
+		Convey("rejects create with duplicated value", func() {
+			So(db.Create(newNote("id2", "hello"), skydb.SuffixOnCollision), ShouldEqual, skydb.ErrUniqueConstraintViolation)
+		})
+
+		Convey("allows updating the same record", func() {
+			So(db.Save(newNote("id1", "hello")), ShouldBeNil)
+		})
+
+		Convey("accepts only one of concurrent conflicting saves", func() {
+			errs := make(chan error, 2)
+			var wg sync.WaitGroup
+			for _, id := range []string{"id2", "id3"} {
+				wg.Add(1)
+				go func(id string) {
+					defer wg.Done()
+					errs <- db.Save(newNote(id, "world"))
+				}(id)
+			}
+			wg.Wait()
+			close(errs)
+
+			succeeded, violated := 0, 0
+			for err := range errs {
+				switch err {
+				case nil:
+					succeeded++
+				case skydb.ErrUniqueConstraintViolation:
+					violated++
+				}
+			}
+			So(succeeded, ShouldEqual, 1)
+			So(violated, ShouldEqual, 1)
+		})
+
+		Convey("errors on existing duplicated values", func() {
+			So(db.Save(newNote("id2", "world")), ShouldBeNil)
+
+			So(db.AddUniqueConstraint("note", "_owner_id"), ShouldNotBeNil)
+		})
+
+		Convey("errors on unknown key", func() {
+			So(db.AddUniqueConstraint("note", "notexist"), ShouldNotBeNil)
+		})
+
+		Convey("rejects save with duplicated value of long key", func() {
+			key := strings.Repeat("k", 60)
+			_, err := db.Extend("note", skydb.RecordSchema{
+				key: skydb.FieldType{Type: skydb.TypeString},
+			})
+			So(err, ShouldBeNil)
+			So(db.AddUniqueConstraint("note", key), ShouldBeNil)
+
+			saveNote := func(id string) error {
+				return db.Save(&skydb.Record{
+					ID:      skydb.NewRecordID("note", id),
+					OwnerID: "userid",
+					Data: map[string]interface{}{
+						key: "value",
+					},
+				})
+			}
+			So(saveNote("id2"), ShouldBeNil)
+			So(saveNote("id3"), ShouldEqual, skydb.ErrUniqueConstraintViolation)
+		})
+
+		Convey("does not report violation of other unique constraint", func() {
+			_, err := db.Extend("note", skydb.RecordSchema{
+				"code": skydb.FieldType{Type: skydb.TypeString},
+			})
+			So(err, ShouldBeNil)
+			_, err = c.Exec(fmt.Sprintf(`ALTER TABLE %s ADD CONSTRAINT "note_code_unique" UNIQUE ("code")`,
+				c.tableName("note")))
+			So(err, ShouldBeNil)
+
+			saveNote := func(id string) error {
+				return db.Save(&skydb.Record{
+					ID:      skydb.NewRecordID("note", id),
+					OwnerID: "userid",
+					Data: map[string]interface{}{
+						"code": "value",
+					},
+				})
+			}
+			So(saveNote("id2"), ShouldBeNil)
+			err = saveNote("id3")
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotEqual, skydb.ErrUniqueConstraintViolation)
+		})
+	})
+}
+
+func TestAddEnumConstraint(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"status":   skydb.FieldType{Type: skydb.TypeString},
+			"priority": skydb.FieldType{Type: skydb.TypeInteger},
+		})
+		So(err, ShouldBeNil)
+
+		newNote := func(id string, data map[string]interface{}) *skydb.Record {
+			return &skydb.Record{
+				ID:      skydb.NewRecordID("note", id),
+				OwnerID: "userid",
+				Data:    data,
+			}
+		}
+
+		Convey("restricts string field", func() {
+			So(db.AddEnumConstraint("note", "status", []interface{}{"open", "closed", "won't fix"}), ShouldBeNil)
+
+			So(db.Save(newNote("id1", map[string]interface{}{"status": "open"})), ShouldBeNil)
+			So(db.Save(newNote("id2", map[string]interface{}{"status": "won't fix"})), ShouldBeNil)
+			So(db.Save(newNote("id3", map[string]interface{}{})), ShouldBeNil)
+			So(db.Save(newNote("id4", map[string]interface{}{"status": "pending"})), ShouldEqual, skydb.ErrEnumConstraintViolation)
+			So(db.Create(newNote("id5", map[string]interface{}{"status": "pending"}), skydb.FailOnCollision), ShouldEqual, skydb.ErrEnumConstraintViolation)
+		})
+
+		Convey("restricts integer field", func() {
+			So(db.AddEnumConstraint("note", "priority", []interface{}{1, 2, 3}), ShouldBeNil)
+
+			So(db.Save(newNote("id1", map[string]interface{}{"priority": 2})), ShouldBeNil)
+			So(db.Save(newNote("id2", map[string]interface{}{"priority": 4})), ShouldEqual, skydb.ErrEnumConstraintViolation)
+		})
+
+		Convey("errors on existing values not allowed", func() {
+			So(db.Save(newNote("id1", map[string]interface{}{"status": "pending"})), ShouldBeNil)
+
+			So(db.AddEnumConstraint("note", "status", []interface{}{"open", "closed"}), ShouldNotBeNil)
+		})
+
+		Convey("errors on values of wrong type", func() {
+			So(db.AddEnumConstraint("note", "status", []interface{}{"open", 1}), ShouldNotBeNil)
+		})
+
+		Convey("errors on unknown key", func() {
+			So(db.AddEnumConstraint("note", "notexist", []interface{}{"open"}), ShouldNotBeNil)
+		})
+	})
+}
+
+func BenchmarkCompositeIndexQuery(b *testing.B) {
+	c := getTestConn(b)
+	defer cleanupConn(b, c)
+
+	db := c.PublicDB().(*database)
+	_, err := db.Extend("note", skydb.RecordSchema{
+		"status": skydb.FieldType{Type: skydb.TypeString},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	_, err = c.Exec(fmt.Sprintf(`
+	INSERT INTO %s (_id, _database_id, _owner_id, _created_at, _created_by, _updated_at, _updated_by, status)
+	SELECT 'id' || i, '_public', 'owner' || (i %% 100), now(), 'owner', now(), 'owner',
+		CASE WHEN i %% 10 = 0 THEN 'open' ELSE 'closed' END
+	FROM generate_series(1, 100000) AS i
+	`, db.tableName("note")))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	query := skydb.Query{
+		Type: "note",
+		Predicate: skydb.Predicate{
+			Operator: skydb.And,
+			Children: []interface{}{
+				skydb.Predicate{
+					Operator: skydb.Equal,
+					Children: []interface{}{
+						skydb.Expression{Type: skydb.KeyPath, Value: "_owner_id"},
+						skydb.Expression{Type: skydb.Literal, Value: "owner10"},
+					},
+				},
+				skydb.Predicate{
+					Operator: skydb.Equal,
+					Children: []interface{}{
+						skydb.Expression{Type: skydb.KeyPath, Value: "status"},
+						skydb.Expression{Type: skydb.Literal, Value: "open"},
+					},
+				},
+			},
+		},
+		BypassAccessControl: true,
+	}
+
+	runQuery := func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.QueryCount(&query); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("full scan", runQuery)
+
+	err = db.CreateIndex("note", skydb.Index{
+		Name:     "note_owner_status",
+		KeyPaths: []string{"_owner_id", "status"},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := c.Exec(fmt.Sprintf("ANALYZE %s", db.tableName("note"))); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("composite index", runQuery)
+}
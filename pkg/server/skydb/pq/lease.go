@@ -0,0 +1,75 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	"github.com/skygeario/skygear-server/pkg/server/uuid"
+)
+
+func (db *database) AcquireLease(id skydb.RecordID, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", fmt.Errorf("acquire lease %s: got non-positive ttl %v", id, ttl)
+	}
+
+	// Expiry is computed with the clock of the database, such that
+	// servers with skewed clocks agree on whether a lease has expired.
+	token := uuid.New()
+	stmt := fmt.Sprintf(`INSERT INTO %s AS lease (recordtype, record_id, token, expire_at)
+VALUES ($1, $2, $3, (now() AT TIME ZONE 'UTC') + $4 * interval '1 microsecond')
+ON CONFLICT (recordtype, record_id) DO UPDATE
+SET token = EXCLUDED.token, expire_at = EXCLUDED.expire_at
+WHERE lease.expire_at <= (now() AT TIME ZONE 'UTC')`,
+		db.tableName("_lease"))
+	result, err := db.c.Exec(stmt, id.Type, id.Key, token, int64(ttl/time.Microsecond))
+	if err != nil {
+		return "", fmt.Errorf("acquire lease %s: failed to insert lease: %s", id, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return "", fmt.Errorf("acquire lease %s: failed to retrieve insertion status", id)
+	}
+
+	if rowsAffected == 0 {
+		return "", skydb.ErrLeaseHeld
+	}
+
+	return token, nil
+}
+
+func (db *database) ReleaseLease(id skydb.RecordID, token string) error {
+	builder := psql.Delete(db.tableName("_lease")).
+		Where("recordtype = ? AND record_id = ? AND token = ?", id.Type, id.Key, token)
+
+	result, err := db.c.ExecWith(builder)
+	if err != nil {
+		return fmt.Errorf("release lease %s: failed to delete lease: %s", id, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("release lease %s: failed to retrieve deletion status", id)
+	}
+
+	if rowsAffected == 0 {
+		return skydb.ErrLeaseNotHeld
+	}
+
+	return nil
+}
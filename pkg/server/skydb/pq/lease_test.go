@@ -0,0 +1,82 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLease(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		id := skydb.NewRecordID("note", "id1")
+
+		Convey("acquires and releases lease", func() {
+			token, err := db.AcquireLease(id, time.Minute)
+			So(err, ShouldBeNil)
+			So(token, ShouldNotBeEmpty)
+
+			So(db.ReleaseLease(id, token), ShouldBeNil)
+
+			token, err = db.AcquireLease(id, time.Minute)
+			So(err, ShouldBeNil)
+			So(token, ShouldNotBeEmpty)
+		})
+
+		Convey("fails to acquire lease held by another holder", func() {
+			_, err := db.AcquireLease(id, time.Minute)
+			So(err, ShouldBeNil)
+
+			_, err = db.AcquireLease(id, time.Minute)
+			So(err, ShouldEqual, skydb.ErrLeaseHeld)
+		})
+
+		Convey("acquires leases of different records", func() {
+			_, err := db.AcquireLease(id, time.Minute)
+			So(err, ShouldBeNil)
+
+			_, err = db.AcquireLease(skydb.NewRecordID("note", "id2"), time.Minute)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("reclaims expired lease", func() {
+			oldToken, err := db.AcquireLease(id, 10*time.Millisecond)
+			So(err, ShouldBeNil)
+
+			time.Sleep(50 * time.Millisecond)
+
+			token, err := db.AcquireLease(id, time.Minute)
+			So(err, ShouldBeNil)
+			So(token, ShouldNotEqual, oldToken)
+
+			So(db.ReleaseLease(id, oldToken), ShouldEqual, skydb.ErrLeaseNotHeld)
+			So(db.ReleaseLease(id, token), ShouldBeNil)
+		})
+
+		Convey("fails to release lease with wrong token", func() {
+			_, err := db.AcquireLease(id, time.Minute)
+			So(err, ShouldBeNil)
+
+			So(db.ReleaseLease(id, "wrongtoken"), ShouldEqual, skydb.ErrLeaseNotHeld)
+		})
+	})
+}
@@ -31,12 +31,15 @@ import (
 
 var subscribeListenOnce sync.Once
 var appEventChannelsMap map[string][]chan skydb.RecordEvent
+var appEventChannelsMutex sync.RWMutex
 
 // Assume all app resist on one Database
 func (c *conn) Subscribe(recordEventChan chan skydb.RecordEvent) error {
 	appName := toLowerAndUnderscore(c.appName)
+	appEventChannelsMutex.Lock()
 	channels := appEventChannelsMap[appName]
 	appEventChannelsMap[appName] = append(channels, recordEventChan)
+	appEventChannelsMutex.Unlock()
 
 	// TODO(limouren): Seems a start-up time config would be better?
 	subscribeListenOnce.Do(func() {
@@ -46,8 +49,36 @@ func (c *conn) Subscribe(recordEventChan chan skydb.RecordEvent) error {
 	return nil
 }
 
+// unsubscribe stops recordEventChan from receiving RecordEvent.
+func (c *conn) unsubscribe(recordEventChan chan skydb.RecordEvent) {
+	appName := toLowerAndUnderscore(c.appName)
+	appEventChannelsMutex.Lock()
+	channels := appEventChannelsMap[appName]
+	for i, ch := range channels {
+		if ch == recordEventChan {
+			appEventChannelsMap[appName] = append(channels[:i:i], channels[i+1:]...)
+			break
+		}
+	}
+	appEventChannelsMutex.Unlock()
+
+	// events emitted before the channel is removed are sent in their own
+	// goroutines, drain them so that those goroutines can exit
+	go func() {
+		for {
+			select {
+			case <-recordEventChan:
+			case <-time.After(time.Minute):
+				return
+			}
+		}
+	}()
+}
+
 func emit(n *notification) {
+	appEventChannelsMutex.RLock()
 	channels := appEventChannelsMap[n.AppName]
+	appEventChannelsMutex.RUnlock()
 	for _, channel := range channels {
 		go func(ch chan skydb.RecordEvent) {
 			ch <- skydb.RecordEvent{
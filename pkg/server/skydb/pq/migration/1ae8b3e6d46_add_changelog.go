@@ -0,0 +1,99 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migration
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+type revision_1ae8b3e6d46 struct {
+}
+
+func (r *revision_1ae8b3e6d46) Version() string { return "1ae8b3e6d46" }
+
+func (r *revision_1ae8b3e6d46) Up(tx *sqlx.Tx) error {
+	stmts := []string{
+		`CREATE TABLE _changelog (
+			seq bigserial PRIMARY KEY,
+			op text NOT NULL,
+			recordtype text NOT NULL,
+			record jsonb NOT NULL,
+			created_at timestamp without time zone NOT NULL DEFAULT (now() AT TIME ZONE 'UTC')
+		);`,
+		`CREATE INDEX ON _changelog (created_at);`,
+		`CREATE OR REPLACE FUNCTION public.log_record_change() RETURNS TRIGGER AS $$
+			DECLARE
+				affected_record RECORD;
+			BEGIN
+				IF (TG_OP = 'DELETE') THEN
+					affected_record := OLD;
+				ELSE
+					affected_record := NEW;
+				END IF;
+				EXECUTE format('INSERT INTO %I._changelog (op, recordtype, record) VALUES ($1, $2, $3)', TG_TABLE_SCHEMA)
+					USING TG_OP, TG_TABLE_NAME, row_to_json(affected_record)::jsonb;
+				RETURN affected_record;
+			END;
+		$$ LANGUAGE plpgsql;`,
+		`DO $$
+			DECLARE
+				record_table text;
+			BEGIN
+				FOR record_table IN
+					SELECT table_name FROM information_schema.tables
+					WHERE table_schema = current_schema()
+						AND table_type = 'BASE TABLE'
+						AND table_name NOT LIKE '\_%'
+				LOOP
+					EXECUTE format('CREATE TRIGGER trigger_log_record_change
+						AFTER INSERT OR UPDATE OR DELETE ON %I FOR EACH ROW
+						EXECUTE PROCEDURE public.log_record_change();', record_table);
+				END LOOP;
+			END;
+		$$;`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *revision_1ae8b3e6d46) Down(tx *sqlx.Tx) error {
+	stmts := []string{
+		`DO $$
+			DECLARE
+				record_table text;
+			BEGIN
+				FOR record_table IN
+					SELECT table_name FROM information_schema.tables
+					WHERE table_schema = current_schema()
+						AND table_type = 'BASE TABLE'
+						AND table_name NOT LIKE '\_%'
+				LOOP
+					EXECUTE format('DROP TRIGGER IF EXISTS trigger_log_record_change ON %I;', record_table);
+				END LOOP;
+			END;
+		$$;`,
+		`DROP TABLE _changelog;`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migration
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+type revision_2c7e4b9d1f6 struct {
+}
+
+func (r *revision_2c7e4b9d1f6) Version() string { return "2c7e4b9d1f6" }
+
+func (r *revision_2c7e4b9d1f6) Up(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`
+		CREATE OR REPLACE FUNCTION public.set_null_reference() RETURNS TRIGGER AS $$
+			BEGIN
+				NEW._updated_at := timezone('UTC', now());
+				IF NOT COALESCE(NEW._null_fields, '[]'::jsonb) ? TG_ARGV[0] THEN
+					NEW._null_fields := COALESCE(NEW._null_fields, '[]'::jsonb) || to_jsonb(TG_ARGV[0]);
+				END IF;
+				RETURN NEW;
+			END;
+		$$ LANGUAGE plpgsql;
+	`)
+	return err
+}
+
+func (r *revision_2c7e4b9d1f6) Down(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`DROP FUNCTION IF EXISTS public.set_null_reference();`)
+	return err
+}
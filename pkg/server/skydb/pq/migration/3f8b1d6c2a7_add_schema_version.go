@@ -0,0 +1,54 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migration
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type revision_3f8b1d6c2a7 struct {
+}
+
+func (r *revision_3f8b1d6c2a7) Version() string { return "3f8b1d6c2a7" }
+
+func (r *revision_3f8b1d6c2a7) Up(tx *sqlx.Tx) error {
+	tables, err := getAllRecordTables(tx)
+	if err != nil {
+		return err
+	}
+	for _, name := range tables {
+		_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN _schema_version integer;`, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *revision_3f8b1d6c2a7) Down(tx *sqlx.Tx) error {
+	tables, err := getAllRecordTables(tx)
+	if err != nil {
+		return err
+	}
+	for _, name := range tables {
+		_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s DROP COLUMN _schema_version;`, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
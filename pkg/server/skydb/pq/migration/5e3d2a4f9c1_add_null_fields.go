@@ -0,0 +1,54 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migration
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type revision_5e3d2a4f9c1 struct {
+}
+
+func (r *revision_5e3d2a4f9c1) Version() string { return "5e3d2a4f9c1" }
+
+func (r *revision_5e3d2a4f9c1) Up(tx *sqlx.Tx) error {
+	tables, err := getAllRecordTables(tx)
+	if err != nil {
+		return err
+	}
+	for _, name := range tables {
+		_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN _null_fields jsonb;`, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *revision_5e3d2a4f9c1) Down(tx *sqlx.Tx) error {
+	tables, err := getAllRecordTables(tx)
+	if err != nil {
+		return err
+	}
+	for _, name := range tables {
+		_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s DROP COLUMN _null_fields;`, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migration
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+type revision_6d2f8a3c1e5 struct {
+}
+
+func (r *revision_6d2f8a3c1e5) Version() string { return "6d2f8a3c1e5" }
+
+func (r *revision_6d2f8a3c1e5) Up(tx *sqlx.Tx) error {
+	stmts := []string{
+		`ALTER TABLE _changelog ADD COLUMN txid bigint NOT NULL DEFAULT txid_current();`,
+		`CREATE INDEX ON _changelog (txid, seq);`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *revision_6d2f8a3c1e5) Down(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE _changelog DROP COLUMN txid;`)
+	return err
+}
@@ -0,0 +1,43 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migration
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+type revision_7c3e9a51f24 struct {
+}
+
+func (r *revision_7c3e9a51f24) Version() string { return "7c3e9a51f24" }
+
+func (r *revision_7c3e9a51f24) Up(tx *sqlx.Tx) error {
+	const stmt = `
+CREATE TABLE _lease (
+	recordtype text NOT NULL,
+	record_id text NOT NULL,
+	token text NOT NULL,
+	expire_at timestamp without time zone NOT NULL,
+	PRIMARY KEY (recordtype, record_id)
+);
+`
+	_, err := tx.Exec(stmt)
+	return err
+}
+
+func (r *revision_7c3e9a51f24) Down(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`DROP TABLE _lease;`)
+	return err
+}
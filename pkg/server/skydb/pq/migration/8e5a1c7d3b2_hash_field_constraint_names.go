@@ -0,0 +1,80 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migration
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type revision_8e5a1c7d3b2 struct {
+}
+
+func (r *revision_8e5a1c7d3b2) Version() string { return "8e5a1c7d3b2" }
+
+// renameFieldConstraintsSQL renames the unique and enum constraints on a
+// field of a record type between the names <type>_<field>_<kind> and
+// <type>_<field>_<kind>_<hash>, where hash is the first 8 hex digits of
+// the MD5 of "<type>.<field>.<kind>" and <type>_<field> is truncated to
+// fit the identifier length limit. Names longer than the limit were
+// truncated by PostgreSQL when the constraints were added.
+const renameFieldConstraintsSQL = `
+DO $$
+DECLARE
+	con record;
+	prefix text;
+	hashed text;
+	legacy text;
+BEGIN
+	FOR con IN
+		SELECT c.conname, t.relname, a.attname,
+			CASE c.contype WHEN 'u' THEN 'unique' ELSE 'enum' END AS kind
+		FROM pg_constraint c
+		JOIN pg_class t ON t.oid = c.conrelid
+		JOIN pg_namespace ns ON ns.oid = t.relnamespace
+		JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = c.conkey[1]
+		WHERE ns.nspname = current_schema() AND array_length(c.conkey, 1) = 1
+			AND c.contype IN ('u', 'c')
+	LOOP
+		prefix := con.relname || '_' || con.attname;
+		legacy := prefix || '_' || con.kind;
+		WHILE octet_length(legacy) > 63 LOOP
+			legacy := left(legacy, -1);
+		END LOOP;
+		hashed := '_' || con.kind || '_' || left(md5(con.relname || '.' || con.attname || '.' || con.kind), 8);
+		WHILE octet_length(prefix || hashed) > 63 LOOP
+			prefix := left(prefix, -1);
+		END LOOP;
+		hashed := prefix || hashed;
+
+		IF con.conname = %[1]s THEN
+			EXECUTE format('ALTER TABLE %%I.%%I RENAME CONSTRAINT %%I TO %%I',
+				current_schema(), con.relname, con.conname, %[2]s);
+		END IF;
+	END LOOP;
+END
+$$;
+`
+
+func (r *revision_8e5a1c7d3b2) Up(tx *sqlx.Tx) error {
+	_, err := tx.Exec(fmt.Sprintf(renameFieldConstraintsSQL, "legacy", "hashed"))
+	return err
+}
+
+func (r *revision_8e5a1c7d3b2) Down(tx *sqlx.Tx) error {
+	_, err := tx.Exec(fmt.Sprintf(renameFieldConstraintsSQL, "hashed", "legacy"))
+	return err
+}
@@ -25,7 +25,7 @@ import (
 type fullMigration struct {
 }
 
-func (r *fullMigration) Version() string { return "db76e79e987" }
+func (r *fullMigration) Version() string { return "8e5a1c7d3b2" }
 
 func (r *fullMigration) createTable(tx *sqlx.Tx) error {
 	const stmt = `
@@ -56,6 +56,31 @@ CREATE OR REPLACE FUNCTION public.notify_record_change() RETURNS TRIGGER AS $$
 	END;
 $$ LANGUAGE plpgsql;
 
+CREATE OR REPLACE FUNCTION public.log_record_change() RETURNS TRIGGER AS $$
+	DECLARE
+		affected_record RECORD;
+	BEGIN
+		IF (TG_OP = 'DELETE') THEN
+			affected_record := OLD;
+		ELSE
+			affected_record := NEW;
+		END IF;
+		EXECUTE format('INSERT INTO %I._changelog (op, recordtype, record) VALUES ($1, $2, $3)', TG_TABLE_SCHEMA)
+			USING TG_OP, TG_TABLE_NAME, row_to_json(affected_record)::jsonb;
+		RETURN affected_record;
+	END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION public.set_null_reference() RETURNS TRIGGER AS $$
+	BEGIN
+		NEW._updated_at := timezone('UTC', now());
+		IF NOT COALESCE(NEW._null_fields, '[]'::jsonb) ? TG_ARGV[0] THEN
+			NEW._null_fields := COALESCE(NEW._null_fields, '[]'::jsonb) || to_jsonb(TG_ARGV[0]);
+		END IF;
+		RETURN NEW;
+	END;
+$$ LANGUAGE plpgsql;
+
 CREATE TABLE _user (
 	id text PRIMARY KEY,
 	username citext,
@@ -121,6 +146,27 @@ CREATE TABLE _record_creation (
     FOREIGN KEY (role_id) REFERENCES _role(id)
 );
 CREATE INDEX _record_creation_unique_record_type ON _record_creation (record_type);
+CREATE TABLE _changelog (
+	seq bigserial PRIMARY KEY,
+	op text NOT NULL,
+	recordtype text NOT NULL,
+	record jsonb NOT NULL,
+	created_at timestamp without time zone NOT NULL DEFAULT (now() AT TIME ZONE 'UTC'),
+	txid bigint NOT NULL DEFAULT txid_current()
+);
+CREATE INDEX ON _changelog (created_at);
+CREATE INDEX ON _changelog (txid, seq);
+CREATE TABLE _lease (
+	recordtype text NOT NULL,
+	record_id text NOT NULL,
+	token text NOT NULL,
+	expire_at timestamp without time zone NOT NULL,
+	PRIMARY KEY (recordtype, record_id)
+);
+CREATE TABLE _default_acl (
+	database_id text PRIMARY KEY,
+	access jsonb NOT NULL
+);
 `
 	_, err := tx.Exec(stmt)
 	return err
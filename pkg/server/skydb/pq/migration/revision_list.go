@@ -27,4 +27,12 @@ var revisions = []Revision{
 	&revision_c0397f15027{},
 	&revision_88a550bf579{},
 	&revision_db76e79e987{},
+	&revision_1ae8b3e6d46{},
+	&revision_7c3e9a51f24{},
+	&revision_5e3d2a4f9c1{},
+	&revision_9a4c7e2b815{},
+	&revision_3f8b1d6c2a7{},
+	&revision_6d2f8a3c1e5{},
+	&revision_2c7e4b9d1f6{},
+	&revision_8e5a1c7d3b2{},
 }
@@ -18,8 +18,11 @@ import (
 	"database/sql"
 	"fmt"
 	"net"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -53,6 +56,26 @@ func isUniqueViolated(err error) bool {
 	return false
 }
 
+// isUniqueConstraintViolated returns whether err is caused by violating
+// a unique constraint added by AddUniqueConstraint on a field of typemap.
+func isUniqueConstraintViolated(err error, recordType string, typemap skydb.RecordSchema) bool {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return isFieldConstraint(pqErr.Constraint, uniqueConstraintKind, recordType, typemap)
+	}
+
+	return false
+}
+
+// isEnumConstraintViolated returns whether err is caused by violating
+// an enum constraint added by AddEnumConstraint on a field of typemap.
+func isEnumConstraintViolated(err error, recordType string, typemap skydb.RecordSchema) bool {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23514" {
+		return isFieldConstraint(pqErr.Constraint, enumConstraintKind, recordType, typemap)
+	}
+
+	return false
+}
+
 func isUndefinedTable(err error) bool {
 	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "42P01" {
 		return true
@@ -61,6 +84,15 @@ func isUndefinedTable(err error) bool {
 	return false
 }
 
+// isQueryCanceled returns whether err is caused by a statement canceled
+// by PostgreSQL, such as on exceeding the statement timeout.
+func isQueryCanceled(err error) bool {
+	if pqErr, ok := err.(*pq.Error); ok {
+		return pqErr.Code == "57014"
+	}
+	return false
+}
+
 func isNetworkError(err error) bool {
 	_, ok := err.(*net.OpError)
 	return ok
@@ -73,8 +105,31 @@ type queryxRunner interface {
 }
 
 // Open returns a new connection to postgresql implementation
-func Open(appName string, accessModel skydb.AccessModel, connString string, migrate bool) (skydb.Conn, error) {
-	db, err := getDB(appName, connString, migrate)
+//
+// Besides the parameters of PostgreSQL, connString accepts the parameter
+// max_query_duration, such as "5s", which limits the duration of
+// Database.Query. A query exceeding it is canceled and returns
+// skydb.ErrQueryTimeout.
+//
+// connString also accepts the parameter max_open_conns, which limits the
+// number of connections to PostgreSQL open at once by the Conns of the
+// same connection string, 10 by default. Operations beyond the limit wait
+// for a connection to be released instead of failing.
+//
+// config is copied, such that modifying it afterwards does not affect the
+// returned Conn.
+func Open(appName string, accessModel skydb.AccessModel, connString string, migrate bool, config skydb.Config) (skydb.Conn, error) {
+	connString, maxQueryDuration, err := extractMaxQueryDuration(connString)
+	if err != nil {
+		return nil, err
+	}
+
+	connString, maxOpenConns, err := extractMaxOpenConns(connString)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := getDB(appName, connString, maxOpenConns, migrate)
 	if err != nil {
 		return nil, err
 	}
@@ -82,21 +137,105 @@ func Open(appName string, accessModel skydb.AccessModel, connString string, migr
 		return nil, fmt.Errorf("Unsupported AccessModel: RelationBasedAccess")
 	}
 
+	if len(config.ReadHooks) > 0 {
+		startReadHookWorkersOnce.Do(startReadHookWorkers)
+	}
+
 	return &conn{
-		db:           db,
-		RecordSchema: map[string]skydb.RecordSchema{},
-		appName:      appName,
-		option:       connString,
-		accessModel:  accessModel,
-		canMigrate:   migrate,
+		db:               db,
+		RecordSchema:     map[string]skydb.RecordSchema{},
+		appName:          appName,
+		option:           connString,
+		accessModel:      accessModel,
+		canMigrate:       migrate,
+		maxQueryDuration: maxQueryDuration,
+		config:           config.Copy(),
 	}, nil
 }
 
+const (
+	maxQueryDurationParam = "max_query_duration"
+	maxOpenConnsParam     = "max_open_conns"
+)
+
+// defaultMaxOpenConns is the maximum number of open connections to the
+// database of a connection string without the max_open_conns parameter.
+const defaultMaxOpenConns = 10
+
+// extractMaxQueryDuration removes the max_query_duration parameter from
+// connString and returns the parsed duration.
+func extractMaxQueryDuration(connString string) (string, time.Duration, error) {
+	connString, value, found, err := extractConnParam(connString, maxQueryDurationParam)
+	if err != nil || !found {
+		return connString, 0, err
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return "", 0, fmt.Errorf("invalid %s = %q", maxQueryDurationParam, value)
+	}
+	return connString, duration, nil
+}
+
+// extractMaxOpenConns removes the max_open_conns parameter from connString
+// and returns the parsed number, or defaultMaxOpenConns if connString does
+// not have the parameter.
+func extractMaxOpenConns(connString string) (string, int, error) {
+	connString, value, found, err := extractConnParam(connString, maxOpenConnsParam)
+	if err != nil || !found {
+		return connString, defaultMaxOpenConns, err
+	}
+
+	maxOpenConns, err := strconv.Atoi(value)
+	if err != nil || maxOpenConns <= 0 {
+		return "", 0, fmt.Errorf("invalid %s = %q", maxOpenConnsParam, value)
+	}
+	return connString, maxOpenConns, nil
+}
+
+// extractConnParam removes the parameter of name from connString, which
+// is either a URL or space-separated key=value pairs, and returns its
+// value. PostgreSQL would reject the connection on the unknown parameter
+// otherwise.
+func extractConnParam(connString, name string) (string, string, bool, error) {
+	var value string
+	if strings.HasPrefix(connString, "postgres://") || strings.HasPrefix(connString, "postgresql://") {
+		u, err := url.Parse(connString)
+		if err != nil {
+			return "", "", false, fmt.Errorf("failed to parse connection string: %s", err)
+		}
+		query := u.Query()
+		if _, ok := query[name]; !ok {
+			return connString, "", false, nil
+		}
+		value = query.Get(name)
+		query.Del(name)
+		u.RawQuery = query.Encode()
+		return u.String(), value, true, nil
+	}
+
+	pairs := []string{}
+	found := false
+	for _, pair := range strings.Fields(connString) {
+		if strings.HasPrefix(pair, name+"=") {
+			value = strings.TrimPrefix(pair, name+"=")
+			found = true
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	if !found {
+		return connString, "", false, nil
+	}
+	return strings.Join(pairs, " "), value, true, nil
+}
+
 type getDBReq struct {
-	appName    string
-	connString string
-	migrate    bool
-	done       chan getDBResp
+	appName      string
+	connString   string
+	maxOpenConns int
+	migrate      bool
+	done         chan getDBResp
 }
 
 type getDBResp struct {
@@ -104,12 +243,15 @@ type getDBResp struct {
 	err error
 }
 
+// dbs stores databases by connection string and maximum number of open
+// connections, such that connections of different limits do not share
+// a connection pool.
 var dbs = map[string]*sqlx.DB{}
 var getDBChan = make(chan getDBReq)
 
-func getDB(appName, connString string, migrate bool) (*sqlx.DB, error) {
+func getDB(appName, connString string, maxOpenConns int, migrate bool) (*sqlx.DB, error) {
 	ch := make(chan getDBResp)
-	getDBChan <- getDBReq{appName, connString, migrate, ch}
+	getDBChan <- getDBReq{appName, connString, maxOpenConns, migrate, ch}
 	resp := <-ch
 	return resp.db, resp.err
 }
@@ -118,7 +260,8 @@ func getDB(appName, connString string, migrate bool) (*sqlx.DB, error) {
 func dbInitializer() {
 	for {
 		req := <-getDBChan
-		db, ok := dbs[req.connString]
+		key := fmt.Sprintf("%s\x00%d", req.connString, req.maxOpenConns)
+		db, ok := dbs[key]
 		if !ok {
 			var err error
 			db, err = sqlx.Open("postgres", req.connString)
@@ -127,7 +270,7 @@ func dbInitializer() {
 				continue
 			}
 
-			db.SetMaxOpenConns(10)
+			db.SetMaxOpenConns(req.maxOpenConns)
 
 			if err := mustInitDB(db, req.appName, req.migrate); err != nil {
 				db.Close()
@@ -135,7 +278,7 @@ func dbInitializer() {
 				continue
 			}
 
-			dbs[req.connString] = db
+			dbs[key] = db
 		}
 
 		req.done <- getDBResp{db, nil}
@@ -19,11 +19,14 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	. "github.com/smartystreets/goconvey/convey"
 )
 
 // NOTE(limouren): postgresql uses this error to signify a non-exist
@@ -40,7 +43,15 @@ func testAppName() string {
 	return "io.skygear.test"
 }
 
-func getTestConn(t *testing.T) *conn {
+func getTestConn(t testing.TB) *conn {
+	return getTestConnOfApp(t, testAppName())
+}
+
+func getTestConnOfApp(t testing.TB, appName string) *conn {
+	return getTestConnWithConfig(t, appName, skydb.Config{})
+}
+
+func getTestConnWithConfig(t testing.TB, appName string, config skydb.Config) *conn {
 	if runtime.GOMAXPROCS(0) > 1 {
 		t.Skip("skipping zmq test in GOMAXPROCS>1")
 	}
@@ -51,8 +62,7 @@ func getTestConn(t *testing.T) *conn {
 	}
 	defaultTo("PGDATABASE", "skygear_test")
 	defaultTo("PGSSLMODE", "disable")
-	appName := testAppName()
-	c, err := Open(appName, skydb.RoleBasedAccess, "", true)
+	c, err := Open(appName, skydb.RoleBasedAccess, "", true, config)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -65,7 +75,7 @@ func getTestConn(t *testing.T) *conn {
 	return c.(*conn)
 }
 
-func dropAllRecordTables(t *testing.T, c *conn) {
+func dropAllRecordTables(t testing.TB, c *conn) {
 	tx, err := c.db.Beginx()
 	if err != nil {
 		t.Fatal(err)
@@ -83,7 +93,7 @@ func dropAllRecordTables(t *testing.T, c *conn) {
 	}
 }
 
-func cleanupConn(t *testing.T, c *conn) {
+func cleanupConn(t testing.TB, c *conn) {
 	if len(c.RecordSchema) > 0 {
 		dropAllRecordTables(t, c)
 	}
@@ -149,3 +159,133 @@ func exhaustRows(rows *skydb.Rows, errin error) (records []skydb.Record, err err
 	err = rows.Err()
 	return
 }
+
+func TestExtractMaxOpenConns(t *testing.T) {
+	Convey("extractMaxOpenConns", t, func() {
+		Convey("extracts from URL", func() {
+			connString, maxOpenConns, err := extractMaxOpenConns(
+				"postgres://postgres:@localhost/postgres?max_open_conns=4&sslmode=disable")
+			So(err, ShouldBeNil)
+			So(connString, ShouldEqual, "postgres://postgres:@localhost/postgres?sslmode=disable")
+			So(maxOpenConns, ShouldEqual, 4)
+		})
+
+		Convey("extracts from key-value pairs", func() {
+			connString, maxOpenConns, err := extractMaxOpenConns(
+				"dbname=skygear max_open_conns=20 sslmode=disable")
+			So(err, ShouldBeNil)
+			So(connString, ShouldEqual, "dbname=skygear sslmode=disable")
+			So(maxOpenConns, ShouldEqual, 20)
+		})
+
+		Convey("defaults without the parameter", func() {
+			connString, maxOpenConns, err := extractMaxOpenConns("dbname=skygear sslmode=disable")
+			So(err, ShouldBeNil)
+			So(connString, ShouldEqual, "dbname=skygear sslmode=disable")
+			So(maxOpenConns, ShouldEqual, defaultMaxOpenConns)
+		})
+
+		Convey("returns error on non-positive number", func() {
+			_, _, err := extractMaxOpenConns("dbname=skygear max_open_conns=0")
+			So(err, ShouldNotBeNil)
+			_, _, err = extractMaxOpenConns("dbname=skygear max_open_conns=many")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestMaxOpenConns(t *testing.T) {
+	Convey("Conn opened with max_open_conns", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		limited, err := Open(c.appName, skydb.RoleBasedAccess, "max_open_conns=2", false, skydb.Config{})
+		So(err, ShouldBeNil)
+		db := limited.(*conn).Db().(*sqlx.DB)
+
+		Convey("queues operations beyond the limit", func() {
+			done := make(chan struct{})
+			peak := make(chan int)
+			go func() {
+				max := 0
+				for {
+					select {
+					case <-done:
+						peak <- max
+						return
+					default:
+					}
+					if n := db.Stats().OpenConnections; n > max {
+						max = n
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}()
+
+			errs := make(chan error, 8)
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := limited.(*conn).Exec("SELECT pg_sleep(0.05)")
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(done)
+			close(errs)
+
+			for err := range errs {
+				So(err, ShouldBeNil)
+			}
+			So(<-peak, ShouldBeBetweenOrEqual, 1, 2)
+		})
+	})
+}
+
+func TestCloseAndReuse(t *testing.T) {
+	Convey("Conn", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("rolls back the transaction in effect on close", func() {
+			So(c.Begin(), ShouldBeNil)
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "1"),
+				OwnerID: "user",
+				Data:    skydb.Data{"content": "uncommitted"},
+			}), ShouldBeNil)
+
+			So(c.Close(), ShouldBeNil)
+			So(c.tx, ShouldBeNil)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "1"), &record), ShouldEqual, skydb.ErrRecordNotFound)
+		})
+
+		Convey("works again after close", func() {
+			So(c.Close(), ShouldBeNil)
+			So(c.RecordSchema, ShouldBeEmpty)
+
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "1"),
+				OwnerID: "user",
+				Data:    skydb.Data{"content": "hello"},
+			}), ShouldBeNil)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "1"), &record), ShouldBeNil)
+			So(record.Data["content"], ShouldEqual, "hello")
+
+			So(c.Begin(), ShouldBeNil)
+			So(c.Commit(), ShouldBeNil)
+		})
+	})
+}
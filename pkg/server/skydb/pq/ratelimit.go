@@ -0,0 +1,159 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+)
+
+// tokenBucket enforces a skydb.WriteRateLimit. A write takes a token,
+// and tokens are refilled continuously at the rate of the limit.
+type tokenBucket struct {
+	limit  skydb.WriteRateLimit
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+func newTokenBucket(limit skydb.WriteRateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		last:   now,
+	}
+}
+
+// refill adds the tokens refilled since the last refill until now.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.limit.Rate
+		if burst := float64(b.limit.Burst); b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	}
+}
+
+// take takes a token from the bucket at the time now, and returns false
+// without taking one if the bucket is empty. Checking and taking the
+// token under the same lock, concurrent writes cannot overdraw the bucket.
+func (b *tokenBucket) take(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refund returns n tokens taken by writes not made to the bucket.
+func (b *tokenBucket) refund(n int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.tokens += float64(n)
+	if burst := float64(b.limit.Burst); b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// writeBucketKey identifies the token bucket enforcing the write rate
+// limit of a record type of an app. The limit is part of the key, such
+// that Conns opened with different limits do not share a bucket.
+type writeBucketKey struct {
+	appName    string
+	recordType string
+	limit      skydb.WriteRateLimit
+}
+
+// writeBuckets stores token buckets by writeBucketKey, such that writes of
+// connections of the same app share the same limit.
+var writeBuckets = map[writeBucketKey]*tokenBucket{}
+var writeBucketsMutex sync.Mutex
+
+// writeBucket returns the token bucket of the write rate limit of the
+// record type, or nil if the record type is not limited.
+func (c *conn) writeBucket(recordType string, now time.Time) *tokenBucket {
+	limit, ok := c.config.WriteRateLimits[recordType]
+	if !ok {
+		return nil
+	}
+
+	key := writeBucketKey{toLowerAndUnderscore(c.appName), recordType, limit}
+	writeBucketsMutex.Lock()
+	defer writeBucketsMutex.Unlock()
+	bucket, ok := writeBuckets[key]
+	if !ok {
+		bucket = newTokenBucket(limit, now)
+		writeBuckets[key] = bucket
+	}
+	return bucket
+}
+
+// takeWriteToken returns skydb.ErrRateLimited if writing a record of the
+// record type exceeds its write rate limit, or takes the token of the
+// write otherwise. The token is refunded by refundWriteToken if the write
+// fails, or when the transaction of the write is rolled back.
+func (db *database) takeWriteToken(recordType string) error {
+	now := time.Now()
+	bucket := db.c.writeBucket(recordType, now)
+	if bucket == nil {
+		return nil
+	}
+
+	if !bucket.take(now) {
+		return skydb.ErrRateLimited
+	}
+	if db.c.tx != nil {
+		if db.c.takenWrites == nil {
+			db.c.takenWrites = map[string]int{}
+		}
+		db.c.takenWrites[recordType]++
+	}
+	return nil
+}
+
+// refundWriteToken refunds the token taken by takeWriteToken for a write
+// of a record of the record type which failed.
+func (db *database) refundWriteToken(recordType string) {
+	now := time.Now()
+	bucket := db.c.writeBucket(recordType, now)
+	if bucket == nil {
+		return
+	}
+
+	bucket.refund(1)
+	if db.c.tx != nil && db.c.takenWrites[recordType] > 0 {
+		db.c.takenWrites[recordType]--
+	}
+}
+
+// refundTakenWrites refunds the tokens taken by the writes of the rolled
+// back transaction.
+func (c *conn) refundTakenWrites() {
+	now := time.Now()
+	for recordType, n := range c.takenWrites {
+		if bucket := c.writeBucket(recordType, now); bucket != nil {
+			bucket.refund(n)
+		}
+	}
+	c.takenWrites = nil
+}
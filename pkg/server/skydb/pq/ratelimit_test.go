@@ -0,0 +1,182 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTokenBucket(t *testing.T) {
+	Convey("tokenBucket", t, func() {
+		now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+		bucket := newTokenBucket(skydb.WriteRateLimit{Rate: 2, Burst: 3}, now)
+
+		take := bucket.take
+
+		Convey("takes up to burst tokens at once", func() {
+			So(take(now), ShouldBeTrue)
+			So(take(now), ShouldBeTrue)
+			So(take(now), ShouldBeTrue)
+			So(take(now), ShouldBeFalse)
+		})
+
+		Convey("refills at the rate", func() {
+			for i := 0; i < 3; i++ {
+				So(take(now), ShouldBeTrue)
+			}
+			So(take(now.Add(250*time.Millisecond)), ShouldBeFalse)
+			So(take(now.Add(500*time.Millisecond)), ShouldBeTrue)
+			So(take(now.Add(500*time.Millisecond)), ShouldBeFalse)
+		})
+
+		Convey("refills no more than burst", func() {
+			later := now.Add(time.Hour)
+			for i := 0; i < 3; i++ {
+				So(take(later), ShouldBeTrue)
+			}
+			So(take(later), ShouldBeFalse)
+		})
+
+		Convey("refunds tokens up to burst", func() {
+			for i := 0; i < 3; i++ {
+				So(take(now), ShouldBeTrue)
+			}
+			bucket.refund(1)
+			So(take(now), ShouldBeTrue)
+			So(take(now), ShouldBeFalse)
+
+			bucket.refund(5)
+			for i := 0; i < 3; i++ {
+				So(take(now), ShouldBeTrue)
+			}
+			So(take(now), ShouldBeFalse)
+		})
+	})
+}
+
+// resetWriteBuckets discards the token buckets of all apps, such that
+// tests do not share tokens.
+func resetWriteBuckets() {
+	writeBucketsMutex.Lock()
+	defer writeBucketsMutex.Unlock()
+	writeBuckets = map[writeBucketKey]*tokenBucket{}
+}
+
+func TestWriteRateLimit(t *testing.T) {
+	Convey("Database", t, func() {
+		resetWriteBuckets()
+		c := getTestConnWithConfig(t, testAppName(), skydb.Config{
+			WriteRateLimits: map[string]skydb.WriteRateLimit{
+				"note": {Rate: 10, Burst: 2},
+			},
+		})
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		note := func(key string) *skydb.Record {
+			return &skydb.Record{
+				ID:      skydb.NewRecordID("note", key),
+				OwnerID: "userid",
+			}
+		}
+
+		Convey("rejects writes beyond the rate until the bucket refills", func() {
+			So(db.Save(note("1")), ShouldBeNil)
+			So(db.Create(note("2"), skydb.FailOnCollision), ShouldBeNil)
+			So(db.Save(note("3")), ShouldEqual, skydb.ErrRateLimited)
+			So(db.Create(note("3"), skydb.FailOnCollision), ShouldEqual, skydb.ErrRateLimited)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "1"), &record), ShouldBeNil)
+			So(db.Get(skydb.NewRecordID("note", "3"), &record), ShouldEqual, skydb.ErrRecordNotFound)
+
+			time.Sleep(150 * time.Millisecond)
+			So(db.Save(note("3")), ShouldBeNil)
+		})
+
+		Convey("does not consume tokens to validate saves", func() {
+			for _, key := range []string{"1", "2", "3"} {
+				_, err := db.ValidateSave(note(key))
+				So(err, ShouldBeNil)
+			}
+
+			So(db.Save(note("1")), ShouldBeNil)
+			So(db.Save(note("2")), ShouldBeNil)
+		})
+
+		Convey("does not count failed writes", func() {
+			So(db.Save(note("1")), ShouldBeNil)
+			So(db.Create(note("1"), skydb.FailOnCollision), ShouldNotBeNil)
+			So(db.Save(note("2")), ShouldBeNil)
+			So(db.Save(note("3")), ShouldEqual, skydb.ErrRateLimited)
+		})
+
+		Convey("does not count writes of rolled back transaction", func() {
+			So(c.Begin(), ShouldBeNil)
+			So(db.Save(note("1")), ShouldBeNil)
+			So(db.Save(note("2")), ShouldBeNil)
+			So(db.Save(note("3")), ShouldEqual, skydb.ErrRateLimited)
+			So(c.Rollback(), ShouldBeNil)
+
+			So(db.Save(note("1")), ShouldBeNil)
+			So(db.Save(note("2")), ShouldBeNil)
+		})
+
+		Convey("counts writes of committed transaction", func() {
+			So(c.Begin(), ShouldBeNil)
+			So(db.Save(note("1")), ShouldBeNil)
+			So(db.Save(note("2")), ShouldBeNil)
+			So(c.Commit(), ShouldBeNil)
+
+			So(db.Save(note("3")), ShouldEqual, skydb.ErrRateLimited)
+		})
+
+		Convey("does not count writes of imported bundle", func() {
+			So(db.Save(note("1")), ShouldBeNil)
+			So(db.Save(note("2")), ShouldBeNil)
+			bundle := bytes.Buffer{}
+			So(c.ExportBundle(&bundle), ShouldBeNil)
+			time.Sleep(250 * time.Millisecond)
+
+			So(c.ImportBundle(&bundle), ShouldBeNil)
+			So(db.Save(note("1")), ShouldBeNil)
+			So(db.Save(note("2")), ShouldBeNil)
+		})
+
+		Convey("does not limit other record types", func() {
+			_, err := db.Extend("event", skydb.RecordSchema{
+				"content": skydb.FieldType{Type: skydb.TypeString},
+			})
+			So(err, ShouldBeNil)
+
+			for _, key := range []string{"1", "2", "3", "4", "5"} {
+				So(db.Save(&skydb.Record{
+					ID:      skydb.NewRecordID("event", key),
+					OwnerID: "userid",
+				}), ShouldBeNil)
+			}
+		})
+	})
+}
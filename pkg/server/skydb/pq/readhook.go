@@ -0,0 +1,109 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"io"
+	"sync"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+)
+
+// readHookWorkers is the number of workers calling read hooks, and
+// readHookQueueSize is the number of reads queued up for the workers.
+const (
+	readHookWorkers   = 4
+	readHookQueueSize = 1024
+)
+
+type readHookJob struct {
+	hooks  []skydb.ReadHookFunc
+	record skydb.Record
+}
+
+var readHookQueue = make(chan readHookJob, readHookQueueSize)
+var startReadHookWorkersOnce sync.Once
+
+// startReadHookWorkers starts the workers calling read hooks. They are
+// started when the first Conn with read hooks is opened, so they do not
+// run for apps without read hooks.
+func startReadHookWorkers() {
+	for i := 0; i < readHookWorkers; i++ {
+		go func() {
+			for job := range readHookQueue {
+				for _, hook := range job.hooks {
+					hook(&job.record)
+				}
+			}
+		}()
+	}
+}
+
+// notifyRead queues a copy of record to be passed to hooks. The record
+// is dropped if the queue is full, so that reads are never blocked by
+// hooks.
+func notifyRead(hooks []skydb.ReadHookFunc, record *skydb.Record) {
+	copied := *record
+	copied.Data = make(skydb.Data, len(record.Data))
+	for key, value := range record.Data {
+		copied.Data[key] = value
+	}
+
+	select {
+	case readHookQueue <- readHookJob{hooks, copied}:
+	default:
+		log.WithField("id", record.ID).Warnln("Dropped record read for read hooks with full queue")
+	}
+}
+
+// withReadHooks returns rows which pass each record scanned to the read
+// hooks, or rows itself if there are no read hooks.
+func (db *database) withReadHooks(rows *skydb.Rows, err error) (*skydb.Rows, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := db.c.config.ReadHooks
+	if len(hooks) == 0 {
+		return rows, nil
+	}
+	return skydb.NewRows(readHookRowsIter{rows, hooks}), nil
+}
+
+type readHookRowsIter struct {
+	rows  *skydb.Rows
+	hooks []skydb.ReadHookFunc
+}
+
+func (it readHookRowsIter) Close() error {
+	return it.rows.Close()
+}
+
+func (it readHookRowsIter) Next(record *skydb.Record) error {
+	if !it.rows.Scan() {
+		if err := it.rows.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+
+	*record = it.rows.Record()
+	notifyRead(it.hooks, record)
+	return nil
+}
+
+func (it readHookRowsIter) OverallRecordCount() *uint64 {
+	return it.rows.OverallRecordCount()
+}
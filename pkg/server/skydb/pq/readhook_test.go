@@ -0,0 +1,113 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReadHook(t *testing.T) {
+	Convey("Conn", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"title": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+		for _, id := range []string{"id1", "id2", "id3"} {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", id),
+				OwnerID: "ownerID",
+				Data:    skydb.Data{"title": id},
+			}), ShouldBeNil)
+		}
+
+		var mutex sync.Mutex
+		wg := sync.WaitGroup{}
+		read := map[string]int{}
+		hooked := getTestConnWithConfig(t, c.appName, skydb.Config{
+			ReadHooks: []skydb.ReadHookFunc{
+				func(record *skydb.Record) {
+					mutex.Lock()
+					read[record.ID.Key]++
+					mutex.Unlock()
+					wg.Done()
+				},
+			},
+		})
+		defer hooked.Close()
+		db = hooked.PublicDB()
+
+		waitRead := func() map[string]int {
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			return read
+		}
+
+		Convey("calls hook once per record returned from Query", func() {
+			wg.Add(2)
+			rows, err := db.Query(&skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.NotEqual,
+					Children: []interface{}{
+						skydb.Expression{Type: skydb.KeyPath, Value: "title"},
+						skydb.Expression{Type: skydb.Literal, Value: "id2"},
+					},
+				},
+				BypassAccessControl: true,
+			})
+			So(err, ShouldBeNil)
+			count := 0
+			for rows.Scan() {
+				count++
+			}
+			So(rows.Err(), ShouldBeNil)
+			So(count, ShouldEqual, 2)
+
+			So(waitRead(), ShouldResemble, map[string]int{
+				"id1": 1,
+				"id3": 1,
+			})
+		})
+
+		Convey("calls hook with record returned from Get", func() {
+			wg.Add(1)
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id2"), &record), ShouldBeNil)
+
+			So(waitRead(), ShouldResemble, map[string]int{
+				"id2": 1,
+			})
+		})
+	})
+}
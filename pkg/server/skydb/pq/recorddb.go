@@ -15,11 +15,14 @@
 package pq
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -28,6 +31,7 @@ import (
 	sq "github.com/lann/squirrel"
 	"github.com/lib/pq"
 	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	"github.com/skygeario/skygear-server/pkg/server/uuid"
 )
 
 func (db *database) Get(id skydb.RecordID, record *skydb.Record) error {
@@ -42,11 +46,15 @@ func (db *database) Get(id skydb.RecordID, record *skydb.Record) error {
 
 	builder := db.selectQuery(psql.Select(), id.Type, typemap).Where("_id = ?", id.Key)
 	row := db.c.QueryRowWith(builder)
-	if err := newRecordScanner(id.Type, typemap, row).Scan(record); err == sql.ErrNoRows {
+	if err := newRecordScanner(id.Type, typemap, db.scanConfig(id.Type), row).Scan(record); err == sql.ErrNoRows {
 		return skydb.ErrRecordNotFound
 	} else if err != nil {
 		return err
 	}
+
+	if hooks := db.c.config.ReadHooks; len(hooks) > 0 {
+		notifyRead(hooks, record)
+	}
 	return nil
 }
 
@@ -87,25 +95,69 @@ func (db *database) GetByIDs(ids []skydb.RecordID) (*skydb.Rows, error) {
 		log.Debugf("Getting records by ID failed %v", err)
 		return nil, err
 	}
-	return newRows(recordType, typemap, rows, err)
+	return db.withReadHooks(newRows(recordType, typemap, db.scanConfig(recordType), rows, err))
+}
+
+// GetMap fetches records of recordType by keys with GetByIDs and indexes
+// them by key.
+func (db *database) GetMap(recordType string, keys []string) (map[string]*skydb.Record, []string, error) {
+	records := map[string]*skydb.Record{}
+	if len(keys) == 0 {
+		return records, []string{}, nil
+	}
+
+	ids := make([]skydb.RecordID, len(keys))
+	for i, key := range keys {
+		ids[i] = skydb.NewRecordID(recordType, key)
+	}
+
+	rows, err := db.GetByIDs(ids)
+	if err == skydb.ErrRecordNotFound {
+		// record type has not been created, so all keys are missing
+		return records, keys, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Scan() {
+		record := rows.Record()
+		records[record.ID.Key] = &record
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	missingKeys := []string{}
+	for _, key := range keys {
+		if _, ok := records[key]; !ok {
+			missingKeys = append(missingKeys, key)
+		}
+	}
+	return records, missingKeys, nil
 }
 
 // Save attempts to do a upsert
 func (db *database) Save(record *skydb.Record) error {
-	if record.ID.Key == "" {
-		return errors.New("db.save: got empty record id")
+	if err := db.takeWriteToken(record.ID.Type); err != nil {
+		return err
 	}
-	if record.ID.Type == "" {
-		return fmt.Errorf("db.save %s: got empty record type", record.ID.Key)
+	if err := db.save(record); err != nil {
+		db.refundWriteToken(record.ID.Type)
+		return err
 	}
-	if record.OwnerID == "" {
-		return fmt.Errorf("db.save %s: got empty OwnerID", record.ID.Key)
+	return nil
+}
+
+// save upserts the record as Save does, without being limited by or
+// charged to the write rate limit, for records written internally.
+func (db *database) save(record *skydb.Record) error {
+	if err := db.checkRecordToSave(record); err != nil {
+		return err
 	}
 
 	var pkData map[string]interface{}
 	switch db.DatabaseType() {
-	case skydb.UnionDatabase:
-		return skydb.ErrDatabaseIsReadOnly
 	case skydb.PublicDatabase:
 		fallthrough
 	case skydb.PrivateDatabase:
@@ -114,137 +166,1918 @@ func (db *database) Save(record *skydb.Record) error {
 			"_database_id": db.userID,
 		}
 	}
-	upsert := upsertQuery(db.tableName(record.ID.Type), pkData, convert(record)).
+	data := convert(record)
+	for name := range db.virtualFields(record.ID.Type) {
+		delete(data, name)
+	}
+	if err := db.applySpecialFloatPolicy(record.ID.Type, data); err != nil {
+		return err
+	}
+
+	typemap, err := db.remoteColumnTypes(record.ID.Type)
+	if err != nil {
+		return err
+	}
+
+	if err := db.preSave(typemap, record); err != nil {
+		return err
+	}
+
+	db.stampSchemaVersion(typemap, record.ID.Type, data)
+
+	// Fields saved as null are remembered, such that they are returned
+	// as null rather than omitted like fields never saved. A new record
+	// has the fields saved as null, while the null fields of an existing
+	// record are updated from its current ones.
+	_, hasNullFields := typemap[nullFieldsColumn]
+	nullKeys, valuedKeys := savedNullKeys(data)
+	if hasNullFields {
+		data[nullFieldsColumn] = nullKeys
+	}
+
+	upsert := upsertQuery(db.tableName(record.ID.Type), pkData, data).
 		IgnoreKeyOnUpdate("_owner_id").
 		IgnoreKeyOnUpdate("_created_at").
 		IgnoreKeyOnUpdate("_created_by")
+	if hasNullFields {
+		upsert.SetOnUpdate(nullFieldsColumn, sq.Expr(nullFieldsSQL("?", "?"), nullKeys, valuedKeys))
+	}
+
+	row := db.c.QueryRowWith(upsert)
+	scanner := newRecordScanner(record.ID.Type, typemap, db.scanConfig(record.ID.Type), row)
+	if err = scanner.Scan(record); isUniqueConstraintViolated(err, record.ID.Type, typemap) {
+		return skydb.ErrUniqueConstraintViolation
+	} else if isEnumConstraintViolated(err, record.ID.Type, typemap) {
+		return skydb.ErrEnumConstraintViolation
+	} else if err != nil {
+		return err
+	}
+
+	record.DatabaseID = db.userID
+	return nil
+}
+
+// nullFieldsColumn is the column storing the names of the fields of
+// a record saved as null, as a JSON array. Without it, a null field
+// cannot be told apart from a field never saved since both are NULL.
+const nullFieldsColumn = "_null_fields"
+
+// schemaVersionColumn is the column storing the schema version under
+// which a record is written.
+const schemaVersionColumn = "_schema_version"
+
+// stampSchemaVersion sets the current schema version of the record type
+// to the data to be saved, unless the record type is not versioned or
+// its table predates the schema version column.
+func (db *database) stampSchemaVersion(typemap skydb.RecordSchema, recordType string, data map[string]interface{}) {
+	version := db.schemaVersioning(recordType).currentVersion()
+	if version == 0 {
+		return
+	}
+	if _, ok := typemap[schemaVersionColumn]; ok {
+		data[schemaVersionColumn] = version
+	}
+}
+
+// savedNullKeys returns the names of the fields of data saved as null and
+// of the other fields saved, as JSON arrays. Reserved keys are excluded.
+func savedNullKeys(data map[string]interface{}) (nullKeys string, valuedKeys string) {
+	nulls := []string{}
+	valued := []string{}
+	for key, value := range data {
+		if strings.HasPrefix(key, "_") {
+			continue
+		}
+		if value == nil {
+			nulls = append(nulls, key)
+		} else {
+			valued = append(valued, key)
+		}
+	}
+	sort.Strings(nulls)
+	sort.Strings(valued)
+
+	nullsJSON, _ := json.Marshal(nulls)
+	valuedJSON, _ := json.Marshal(valued)
+	return string(nullsJSON), string(valuedJSON)
+}
+
+// nullFieldsSQL returns the SQL of the null fields of a record after
+// saving fields, where nullKeysSQL and valuedKeysSQL are the JSON arrays
+// of the names of the fields saved as null and with values. Fields saved
+// with values are no longer null, while other null fields are kept.
+//
+// The null fields are computed from the current ones by the statement
+// saving the fields, such that concurrent saves to the record serialized
+// by its row lock do not lose null fields.
+func nullFieldsSQL(nullKeysSQL, valuedKeysSQL string) string {
+	return fmt.Sprintf(`(SELECT COALESCE(jsonb_agg(name ORDER BY name), '[]'::jsonb)
+	FROM (
+		SELECT jsonb_array_elements_text(COALESCE(%s, '[]'::jsonb))
+		UNION SELECT jsonb_array_elements_text(%s::jsonb)
+	) AS null_fields(name)
+	WHERE name NOT IN (SELECT jsonb_array_elements_text(%s::jsonb)))`,
+		pq.QuoteIdentifier(nullFieldsColumn), nullKeysSQL, valuedKeysSQL)
+}
+
+func (db *database) SaveWithResult(record *skydb.Record) (result skydb.SaveResult, err error) {
+	if db.IsReadOnly() {
+		return skydb.SaveResult{}, skydb.ErrDatabaseIsReadOnly
+	}
+
+	// The previous record is locked until the transaction ends, so that
+	// it is not updated between the read and the save.
+	if db.c.tx == nil {
+		if err := db.c.Begin(); err != nil {
+			return skydb.SaveResult{}, err
+		}
+		defer func() {
+			if err != nil {
+				db.c.Rollback()
+			} else {
+				err = db.c.Commit()
+			}
+		}()
+	}
+
+	var previous *skydb.Record
+	typemap, err := db.remoteColumnTypes(record.ID.Type)
+	if err != nil {
+		return skydb.SaveResult{}, err
+	}
+	if len(typemap) > 0 {
+		_, err = db.lockRecord(record.ID)
+		if err == nil {
+			previousRecord := skydb.Record{}
+			if err = db.Get(record.ID, &previousRecord); err != nil {
+				return skydb.SaveResult{}, err
+			}
+			previous = &previousRecord
+		} else if err != skydb.ErrRecordNotFound {
+			return skydb.SaveResult{}, err
+		}
+	}
+
+	if err = db.Save(record); err != nil {
+		return skydb.SaveResult{}, err
+	}
+
+	return skydb.SaveResult{
+		Record:   record,
+		Previous: previous,
+	}, nil
+}
+
+// checkRecordToSave returns the error Save returns for the record
+// regardless of the stored records.
+func (db *database) checkRecordToSave(record *skydb.Record) error {
+	if record.ID.Key == "" {
+		return errors.New("db.save: got empty record id")
+	}
+	if record.ID.Type == "" {
+		return fmt.Errorf("db.save %s: got empty record type", record.ID.Key)
+	}
+	if record.OwnerID == "" {
+		return fmt.Errorf("db.save %s: got empty OwnerID", record.ID.Key)
+	}
+
+	if db.IsReadOnly() {
+		return skydb.ErrDatabaseIsReadOnly
+	}
+	return nil
+}
+
+// ValidateSave checks the record as Save does and computes the record as
+// it would be saved from the stored record, without executing the save.
+// The values and constraints are checked by a read-only statement, so
+// that no sequence is advanced and no trigger is fired.
+func (db *database) ValidateSave(record *skydb.Record) (skydb.SavePreview, error) {
+	if err := db.checkRecordToSave(record); err != nil {
+		return skydb.SavePreview{}, err
+	}
+
+	data := convert(record)
+	virtualFields := db.virtualFields(record.ID.Type)
+	for name := range virtualFields {
+		delete(data, name)
+	}
+	if err := db.applySpecialFloatPolicy(record.ID.Type, data); err != nil {
+		return skydb.SavePreview{}, err
+	}
+
+	typemap, err := db.remoteColumnTypes(record.ID.Type)
+	if err != nil {
+		return skydb.SavePreview{}, err
+	}
+
+	var previous *skydb.Record
+	previousRecord := skydb.Record{}
+	if err := db.Get(record.ID, &previousRecord); err == nil {
+		previous = &previousRecord
+	} else if err != skydb.ErrRecordNotFound {
+		return skydb.SavePreview{}, err
+	}
+
+	if err := db.checkSave(record.ID, typemap, data); err != nil {
+		return skydb.SavePreview{}, err
+	}
+
+	// Save keeps the owner and creation of an existing record, and
+	// updates only the fields of the supplied record.
+	preview := skydb.Record{
+		ID:         record.ID,
+		DatabaseID: db.userID,
+		OwnerID:    record.OwnerID,
+		CreatedAt:  record.CreatedAt,
+		CreatorID:  record.CreatorID,
+		UpdatedAt:  record.UpdatedAt,
+		UpdaterID:  record.UpdaterID,
+		ACL:        record.ACL,
+		Data:       skydb.Data{},
+	}
+	if previous != nil {
+		preview.OwnerID = previous.OwnerID
+		preview.CreatedAt = previous.CreatedAt
+		preview.CreatorID = previous.CreatorID
+		for key, value := range previous.Data {
+			preview.Data[key] = value
+		}
+	}
+	for key, value := range record.Data {
+		if _, ok := virtualFields[key]; !ok {
+			preview.Data[key] = value
+		}
+	}
+	for name, fn := range virtualFields {
+		preview.Data[name] = fn(&preview)
+	}
+
+	return skydb.SavePreview{
+		Record:      &preview,
+		Previous:    previous,
+		ChangedKeys: changedKeys(previous, &preview),
+	}, nil
+}
+
+// changedKeys returns the sorted keys of the fields of record whose values
+// differ from those of previous, or all keys if previous is nil.
+func changedKeys(previous *skydb.Record, record *skydb.Record) []string {
+	keys := []string{}
+	previousData := map[string]interface{}{}
+	if previous != nil {
+		previousData = previous.Data
+	}
+	for key, value := range record.Data {
+		if previousValue, ok := previousData[key]; !ok || !reflect.DeepEqual(previousValue, value) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range previousData {
+		if _, ok := record.Data[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// UpsertAll upserts each record in a savepoint, such that a failed
+// record is rolled back without aborting the transaction of the batch.
+func (db *database) UpsertAll(records []*skydb.Record, matchKeyPath string) (result skydb.BatchUpsertResult, err error) {
+	if db.IsReadOnly() {
+		return result, skydb.ErrDatabaseIsReadOnly
+	}
+	if db.DatabaseType() == skydb.UnionDatabase {
+		return result, errors.New("db.UpsertAll: cannot upsert records in union database")
+	}
+
+	if db.c.tx == nil {
+		if err := db.c.Begin(); err != nil {
+			return result, err
+		}
+		defer func() {
+			if err != nil {
+				db.c.Rollback()
+			} else {
+				err = db.c.Commit()
+			}
+		}()
+	}
+
+	constrained := map[string]bool{}
+	results := make([]skydb.UpsertResult, len(records))
+	for i, record := range records {
+		if _, ok := constrained[record.ID.Type]; !ok {
+			ok, err := db.hasUniqueConstraint(record.ID.Type, matchKeyPath)
+			if err != nil {
+				return result, err
+			}
+			constrained[record.ID.Type] = ok
+		}
+		if !constrained[record.ID.Type] {
+			return result, fmt.Errorf(`db.UpsertAll: no unique constraint on "%s" of record type "%s"`, matchKeyPath, record.ID.Type)
+		}
+
+		if _, err := db.c.Exec("SAVEPOINT upsert_all"); err != nil {
+			return result, err
+		}
+		status, upsertErr := db.upsertMatched(record, matchKeyPath)
+		if upsertErr != nil {
+			status = skydb.UpsertFailed
+			if _, err := db.c.Exec("ROLLBACK TO SAVEPOINT upsert_all"); err != nil {
+				return result, err
+			}
+		}
+		if _, err := db.c.Exec("RELEASE SAVEPOINT upsert_all"); err != nil {
+			return result, err
+		}
+
+		results[i] = skydb.UpsertResult{
+			Record: record,
+			Status: status,
+			Err:    upsertErr,
+		}
+	}
+
+	result.Results = results
+	return result, nil
+}
+
+// upsertMatched saves record with the key of the record having the same
+// value at matchKeyPath, or creates it if there is no such record.
+func (db *database) upsertMatched(record *skydb.Record, matchKeyPath string) (skydb.UpsertStatus, error) {
+	value, ok := record.Data[matchKeyPath]
+	if !ok || value == nil {
+		return skydb.UpsertFailed, fmt.Errorf(`db.UpsertAll: got no value of "%s"`, matchKeyPath)
+	}
+
+	// the lookup is served by the index backing the unique constraint
+	builder := psql.Select("_id").
+		From(db.tableName(record.ID.Type)).
+		Where(pq.QuoteIdentifier(matchKeyPath)+" = ? AND _database_id = ?", value, db.userID)
+	var key string
+	err := db.c.GetWith(&key, builder)
+	switch {
+	case err == sql.ErrNoRows:
+		if record.ID.Key == "" {
+			record.ID.Key = uuid.New()
+		}
+		if err := db.Create(record, skydb.FailOnCollision); err != nil {
+			return skydb.UpsertFailed, err
+		}
+		return skydb.UpsertCreated, nil
+	case err != nil:
+		return skydb.UpsertFailed, err
+	}
+
+	record.ID.Key = key
+	if err := db.Save(record); err != nil {
+		return skydb.UpsertFailed, err
+	}
+	return skydb.UpsertUpdated, nil
+}
+
+// hasUniqueConstraint returns whether the unique constraint added by
+// AddUniqueConstraint exists on the field at keyPath of recordType.
+func (db *database) hasUniqueConstraint(recordType, keyPath string) (bool, error) {
+	var exists bool
+	err := db.c.Get(&exists, `
+	SELECT EXISTS (
+		SELECT 1
+		FROM pg_constraint con
+		JOIN pg_class t ON t.oid = con.conrelid
+		JOIN pg_namespace ns ON ns.oid = t.relnamespace
+		WHERE ns.nspname = $1 AND t.relname = $2 AND con.conname = $3
+			AND con.contype = 'u'
+	)
+	`, db.c.schemaName(), recordType, fieldConstraintName(recordType, keyPath, uniqueConstraintKind))
+	return exists, err
+}
+
+func (db *database) Create(record *skydb.Record, policy skydb.CollisionPolicy) error {
+	if err := db.takeWriteToken(record.ID.Type); err != nil {
+		return err
+	}
+	if err := db.create(record, policy); err != nil {
+		db.refundWriteToken(record.ID.Type)
+		return err
+	}
+	return nil
+}
+
+func (db *database) create(record *skydb.Record, policy skydb.CollisionPolicy) error {
+	if record.ID.Key == "" {
+		return errors.New("db.create: got empty record id")
+	}
+	if record.ID.Type == "" {
+		return fmt.Errorf("db.create %s: got empty record type", record.ID.Key)
+	}
+	if record.OwnerID == "" {
+		return fmt.Errorf("db.create %s: got empty OwnerID", record.ID.Key)
+	}
+
+	if db.IsReadOnly() {
+		return skydb.ErrDatabaseIsReadOnly
+	}
+
+	data := convert(record)
+	for name := range db.virtualFields(record.ID.Type) {
+		delete(data, name)
+	}
+	if err := db.applySpecialFloatPolicy(record.ID.Type, data); err != nil {
+		return err
+	}
+	data["_database_id"] = db.userID
 
 	typemap, err := db.remoteColumnTypes(record.ID.Type)
 	if err != nil {
 		return err
 	}
 
-	if err := db.preSave(typemap, record); err != nil {
-		return err
+	if err := db.preSave(typemap, record); err != nil {
+		return err
+	}
+
+	db.stampSchemaVersion(typemap, record.ID.Type, data)
+
+	if _, ok := typemap[nullFieldsColumn]; ok {
+		data[nullFieldsColumn], _ = savedNullKeys(data)
+	}
+
+	// ON CONFLICT DO NOTHING returns no rows on key collision without
+	// aborting the enclosing transaction, which makes retrying with another
+	// key possible.
+	baseKey := record.ID.Key
+	for suffix := 1; ; suffix++ {
+		key := baseKey
+		if suffix > 1 {
+			key = fmt.Sprintf("%s-%d", baseKey, suffix)
+		}
+		data["_id"] = key
+
+		columns, values := extractKeyAndValue(data)
+		for i, column := range columns {
+			columns[i] = pq.QuoteIdentifier(column)
+		}
+		builder := psql.Insert(db.tableName(record.ID.Type)).
+			Columns(columns...).
+			Values(values...).
+			Suffix(`ON CONFLICT ("_id") DO NOTHING RETURNING *`)
+		row := db.c.QueryRowWith(builder)
+		err := newRecordScanner(record.ID.Type, typemap, db.scanConfig(record.ID.Type), row).Scan(record)
+		if err == sql.ErrNoRows {
+			if policy == skydb.SuffixOnCollision {
+				continue
+			}
+			return skydb.ErrRecordDuplicated
+		} else if isUniqueConstraintViolated(err, record.ID.Type, typemap) {
+			return skydb.ErrUniqueConstraintViolation
+		} else if isEnumConstraintViolated(err, record.ID.Type, typemap) {
+			return skydb.ErrEnumConstraintViolation
+		} else if err != nil {
+			return err
+		}
+
+		record.DatabaseID = db.userID
+		return nil
+	}
+}
+
+func (db *database) preSave(schema skydb.RecordSchema, record *skydb.Record) error {
+	const SetSequenceMaxValue = `SELECT setval($1, GREATEST(max(%v), $2)) FROM %v;`
+
+	for key, value := range record.Data {
+		// we are setting a sequence field
+		if schema[key].Type == skydb.TypeSequence {
+			selectSQL := fmt.Sprintf(SetSequenceMaxValue, pq.QuoteIdentifier(key), db.tableName(record.ID.Type))
+			seqName := db.tableName(fmt.Sprintf(`%v_%v_seq`, record.ID.Type, key))
+			if _, err := db.c.Exec(selectSQL, seqName, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func convert(r *skydb.Record) map[string]interface{} {
+	m := map[string]interface{}{}
+	for key, rawValue := range r.Data {
+		switch value := rawValue.(type) {
+		case []interface{}:
+			m[key] = jsonSliceValue(value)
+		case map[string]interface{}:
+			m[key] = jsonMapValue(value)
+		case *skydb.Asset:
+			m[key] = assetValue(*value)
+		case skydb.Reference:
+			m[key] = referenceValue(value)
+		case skydb.Location:
+			m[key] = locationValue(value)
+		case skydb.Unknown:
+			// Do not modify columns with unknown type because they are
+			// managed by the developer.
+		default:
+			m[key] = rawValue
+		}
+	}
+	m["_owner_id"] = r.OwnerID
+	m["_access"] = aclValue(r.ACL)
+	m["_created_at"] = r.CreatedAt
+	m["_created_by"] = r.CreatorID
+	m["_updated_at"] = r.UpdatedAt
+	m["_updated_by"] = r.UpdaterID
+	return m
+}
+
+func (db *database) Delete(id skydb.RecordID) error {
+	builder := psql.Delete(db.tableName(id.Type)).
+		Where("_id = ?", id.Key)
+
+	if db.IsReadOnly() {
+		return skydb.ErrDatabaseIsReadOnly
+	}
+
+	switch db.DatabaseType() {
+	case skydb.PublicDatabase:
+		fallthrough
+	case skydb.PrivateDatabase:
+		builder = builder.Where("_database_id = ?", db.userID)
+	}
+
+	result, err := db.c.ExecWith(builder)
+	if isUndefinedTable(err) {
+		return skydb.ErrRecordNotFound
+	} else if isForienKeyViolated(err) {
+		return skydb.ErrRecordReferenced
+	} else if err != nil {
+		return fmt.Errorf("delete %s: failed to delete record", id)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("delete %s: failed to retrieve deletion status", id)
+	}
+
+	if rowsAffected == 0 {
+		return skydb.ErrRecordNotFound
+	} else if rowsAffected > 1 {
+		log.WithFields(logrus.Fields{
+			"id":           id,
+			"rowsAffected": rowsAffected,
+			"err":          err,
+		}).Errorln("Unexpected rows deleted")
+		return fmt.Errorf("delete %s: got %v rows deleted, want 1", id, rowsAffected)
+	}
+
+	return err
+}
+
+func (db *database) SaveIfMatch(record *skydb.Record, updatedAt time.Time) (err error) {
+	if db.IsReadOnly() {
+		return skydb.ErrDatabaseIsReadOnly
+	}
+
+	// The record is locked until the transaction ends, so that it is not
+	// updated between the comparison and the save.
+	if db.c.tx == nil {
+		if err := db.c.Begin(); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				db.c.Rollback()
+			} else {
+				err = db.c.Commit()
+			}
+		}()
+	}
+
+	if err = db.lockIfMatch(record.ID, updatedAt); err != nil {
+		return err
+	}
+
+	return db.Save(record)
+}
+
+func (db *database) DeleteIfMatch(id skydb.RecordID, updatedAt time.Time) (err error) {
+	if db.IsReadOnly() {
+		return skydb.ErrDatabaseIsReadOnly
+	}
+
+	// The record is locked until the transaction ends, so that it is not
+	// updated between the comparison and the deletion.
+	if db.c.tx == nil {
+		if err := db.c.Begin(); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				db.c.Rollback()
+			} else {
+				err = db.c.Commit()
+			}
+		}()
+	}
+
+	if err = db.lockIfMatch(id, updatedAt); err != nil {
+		return err
+	}
+
+	return db.Delete(id)
+}
+
+// lockIfMatch locks the record of the transaction and returns
+// ErrRecordConflict if it was not last updated at updatedAt.
+func (db *database) lockIfMatch(id skydb.RecordID, updatedAt time.Time) error {
+	currentUpdatedAt, err := db.lockRecord(id)
+	if err != nil {
+		return err
+	}
+
+	if !currentUpdatedAt.Equal(updatedAt) {
+		return skydb.ErrRecordConflict
+	}
+	return nil
+}
+
+// lockRecord locks the record until the transaction ends and returns
+// the time it was last updated.
+func (db *database) lockRecord(id skydb.RecordID) (time.Time, error) {
+	builder := psql.Select("_updated_at").
+		From(db.tableName(id.Type)).
+		Where("_id = ? AND _database_id = ?", id.Key, db.userID).
+		Suffix("FOR UPDATE")
+
+	var updatedAt time.Time
+	err := db.c.QueryRowWith(builder).Scan(&updatedAt)
+	if err == sql.ErrNoRows || isUndefinedTable(err) {
+		return time.Time{}, skydb.ErrRecordNotFound
+	} else if err != nil {
+		return time.Time{}, fmt.Errorf("%s: failed to lock record: %s", id, err)
+	}
+	return updatedAt, nil
+}
+
+func (db *database) DeleteByQuery(query *skydb.Query) (int, error) {
+	if query.Type == "" {
+		return 0, errors.New("got empty query type")
+	}
+
+	if db.IsReadOnly() {
+		return 0, skydb.ErrDatabaseIsReadOnly
+	}
+
+	typemap, err := db.remoteColumnTypes(query.Type)
+	if err != nil || len(typemap) == 0 { // error or record type has not been created
+		return 0, err
+	}
+
+	matchSQL, matchArgs, err := db.matchingIDsQuery(query, skydb.WriteLevel)
+	if err != nil {
+		return 0, err
+	}
+
+	builder := psql.Delete(db.tableName(query.Type)).
+		Where("_id IN ("+matchSQL+")", matchArgs...)
+	result, err := db.c.ExecWith(builder)
+	if isForienKeyViolated(err) {
+		return 0, skydb.ErrRecordReferenced
+	} else if err != nil {
+		return 0, fmt.Errorf("delete by query %s: failed to delete records: %s", query.Type, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete by query %s: failed to retrieve deletion status", query.Type)
+	}
+
+	return int(rowsAffected), nil
+}
+
+func (db *database) UpdateByQuery(query *skydb.Query, patch map[string]interface{}) (int, error) {
+	if query.Type == "" {
+		return 0, errors.New("got empty query type")
+	}
+
+	if db.IsReadOnly() {
+		return 0, skydb.ErrDatabaseIsReadOnly
+	}
+
+	typemap, err := db.remoteColumnTypes(query.Type)
+	if err != nil || len(typemap) == 0 { // error or record type has not been created
+		return 0, err
+	}
+
+	virtualFields := db.virtualFields(query.Type)
+	for key := range patch {
+		if strings.HasPrefix(key, "_") {
+			return 0, fmt.Errorf("update by query %s: cannot patch reserved key %s", query.Type, key)
+		}
+		if _, ok := virtualFields[key]; ok {
+			return 0, fmt.Errorf("update by query %s: cannot patch virtual field %s", query.Type, key)
+		}
+		if _, ok := typemap[key]; !ok {
+			return 0, fmt.Errorf("update by query %s: field %s does not exist", query.Type, key)
+		}
+	}
+
+	matchSQL, matchArgs, err := db.matchingIDsQuery(query, skydb.WriteLevel)
+	if err != nil {
+		return 0, err
+	}
+
+	converted := convert(&skydb.Record{Data: patch})
+	data := map[string]interface{}{}
+	for key := range patch {
+		if value, ok := converted[key]; ok {
+			data[key] = value
+		}
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if _, ok := typemap[nullFieldsColumn]; ok {
+		nullKeys, valuedKeys := savedNullKeys(data)
+		data[nullFieldsColumn] = sq.Expr(nullFieldsSQL("?", "?"), nullKeys, valuedKeys)
+	}
+	data["_updated_at"] = time.Now().UTC()
+
+	// The records are updated by a single statement, so that the update
+	// is atomic.
+	builder := psql.Update(db.tableName(query.Type)).
+		SetMap(data).
+		Where("_id IN ("+matchSQL+")", matchArgs...)
+	result, err := db.c.ExecWith(builder)
+	if err != nil {
+		return 0, fmt.Errorf("update by query %s: failed to update records: %s", query.Type, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("update by query %s: failed to retrieve update status", query.Type)
+	}
+
+	return int(rowsAffected), nil
+}
+
+// matchingIDsQuery returns the SQL selecting _id of records matching the
+// query which can be accessed at the specified ACL level.
+//
+// The SQL is in question placeholder format such that it can be used as
+// a subquery of other statements.
+func (db *database) matchingIDsQuery(query *skydb.Query, aclLevel skydb.ACLLevel) (string, []interface{}, error) {
+	typemap := skydb.RecordSchema{
+		"_id": skydb.FieldType{Type: skydb.TypeString},
+	}
+
+	q := db.selectQuery(sq.Select(), query.Type, typemap)
+	factory := newPredicateSqlizerFactory(db, query.Type)
+	q, err := db.applyQueryPredicateWithACLLevel(q, factory, query, aclLevel)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return q.ToSql()
+}
+
+func (db *database) RenameField(recordType, oldKey, newKey string) (int, error) {
+	if db.IsReadOnly() {
+		return 0, skydb.ErrDatabaseIsReadOnly
+	}
+
+	if strings.HasPrefix(oldKey, "_") || strings.HasPrefix(newKey, "_") {
+		return 0, errors.New("cannot rename reserved key")
+	}
+
+	typemap, err := db.remoteColumnTypes(recordType)
+	if err != nil || len(typemap) == 0 { // error or record type has not been created
+		return 0, err
+	}
+
+	oldType, ok := typemap[oldKey]
+	if !ok {
+		return 0, fmt.Errorf(`unexpected key "%s"`, oldKey)
+	}
+
+	if newType, ok := typemap[newKey]; !ok {
+		if _, err := db.Extend(recordType, skydb.RecordSchema{newKey: oldType}); err != nil {
+			return 0, err
+		}
+	} else if isConflict(oldType, newType) {
+		return 0, fmt.Errorf("conflicting schema %v => %v", oldType, newType)
+	}
+
+	stmt := fmt.Sprintf("UPDATE %s SET %s = %s, %s = NULL, _updated_at = $2 WHERE %s IS NOT NULL AND _database_id = $1",
+		db.tableName(recordType),
+		pq.QuoteIdentifier(newKey),
+		pq.QuoteIdentifier(oldKey),
+		pq.QuoteIdentifier(oldKey),
+		pq.QuoteIdentifier(oldKey))
+	result, err := db.c.Exec(stmt, db.userID, time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("rename field %s: failed to update records: %s", oldKey, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("rename field %s: failed to retrieve update status", oldKey)
+	}
+
+	return int(rowsAffected), nil
+}
+
+func (db *database) SwapRecords(idA, idB skydb.RecordID) error {
+	if idA.Type != idB.Type {
+		return fmt.Errorf("swap records %s, %s: got different record types", idA, idB)
+	}
+
+	if db.IsReadOnly() {
+		return skydb.ErrDatabaseIsReadOnly
+	}
+
+	typemap, err := db.remoteColumnTypes(idA.Type)
+	if err != nil {
+		return err
+	} else if len(typemap) == 0 { // record type has not been created
+		return skydb.ErrRecordNotFound
+	}
+
+	// The owner and ACL are swapped along with the data, so that data
+	// is never exposed to readers denied access to it before the swap.
+	columns := []string{"_access", "_owner_id"}
+	for key := range typemap {
+		if !strings.HasPrefix(key, "_") || key == nullFieldsColumn || key == schemaVersionColumn {
+			columns = append(columns, key)
+		}
+	}
+	sort.Strings(columns)
+
+	assignments := []string{"_updated_at = $3"}
+	for _, column := range columns {
+		assignments = append(assignments, fmt.Sprintf("%s = other.%s",
+			pq.QuoteIdentifier(column),
+			pq.QuoteIdentifier(column)))
+	}
+
+	// Both records are updated by a single statement, joining each record
+	// with the other one. If either record is missing, the join yields no
+	// rows and neither record is modified.
+	stmt := fmt.Sprintf(`UPDATE %s AS record SET %s FROM %s AS other
+WHERE ((record._id = $1 AND other._id = $2) OR (record._id = $2 AND other._id = $1))
+  AND record._database_id = $4 AND other._database_id = $4`,
+		db.tableName(idA.Type),
+		strings.Join(assignments, ", "),
+		db.tableName(idA.Type))
+	result, err := db.c.Exec(stmt, idA.Key, idB.Key, time.Now().UTC(), db.userID)
+	if err != nil {
+		return fmt.Errorf("swap records %s, %s: failed to update records: %s", idA, idB, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("swap records %s, %s: failed to retrieve update status", idA, idB)
+	}
+
+	if rowsAffected == 0 {
+		return skydb.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (db *database) RenameRecord(id skydb.RecordID, newKey string) error {
+	if newKey == "" {
+		return fmt.Errorf("rename record %s: got empty key", id)
+	}
+
+	if db.IsReadOnly() {
+		return skydb.ErrDatabaseIsReadOnly
+	}
+
+	typemap, err := db.remoteColumnTypes(id.Type)
+	if err != nil {
+		return err
+	} else if len(typemap) == 0 { // record type has not been created
+		return skydb.ErrRecordNotFound
+	}
+
+	var exists, duplicated bool
+	err = db.c.QueryRowx(fmt.Sprintf(`SELECT
+  EXISTS (SELECT 1 FROM %[1]s WHERE _id = $1 AND _database_id = $2),
+  EXISTS (SELECT 1 FROM %[1]s WHERE _id = $3)`, db.tableName(id.Type)),
+		id.Key, db.userID, newKey).Scan(&exists, &duplicated)
+	if err != nil {
+		return fmt.Errorf("rename record %s: failed to query records: %s", id, err)
+	} else if !exists {
+		return skydb.ErrRecordNotFound
+	} else if duplicated {
+		return skydb.ErrRecordDuplicated
+	}
+
+	schemas, err := db.GetRecordSchemas()
+	if err != nil {
+		return err
+	}
+
+	recordTypes := []string{}
+	for recordType := range schemas {
+		recordTypes = append(recordTypes, recordType)
+	}
+	sort.Strings(recordTypes)
+
+	// The record and its referencing records are updated by a single
+	// statement, such that foreign keys are checked only after all of
+	// them are updated. Referencing records of the record type itself
+	// are updated along with the record, since a row cannot be updated
+	// twice by a statement.
+	assignments := []string{"_id = CASE WHEN _id = $1 AND _database_id = $3 THEN $2 ELSE _id END"}
+	conditions := []string{"(_id = $1 AND _database_id = $3)"}
+	updates := []string{}
+	for _, recordType := range recordTypes {
+		keys := []string{}
+		for key, fieldType := range schemas[recordType] {
+			if fieldType.Type == skydb.TypeReference && fieldType.ReferenceType == id.Type {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		sort.Strings(keys)
+
+		refAssignments := []string{}
+		refConditions := []string{}
+		for _, key := range keys {
+			column := pq.QuoteIdentifier(key)
+			refAssignments = append(refAssignments,
+				fmt.Sprintf("%[1]s = CASE WHEN %[1]s = $1 THEN $2 ELSE %[1]s END", column))
+			refConditions = append(refConditions, column+" = $1")
+		}
+
+		if recordType == id.Type {
+			assignments = append(assignments, refAssignments...)
+			conditions = append(conditions, refConditions...)
+			continue
+		}
+		updates = append(updates, fmt.Sprintf("%s AS (UPDATE %s SET %s WHERE %s)",
+			pq.QuoteIdentifier(fmt.Sprintf("referencing_%d", len(updates))),
+			db.tableName(recordType),
+			strings.Join(refAssignments, ", "),
+			strings.Join(refConditions, " OR ")))
+	}
+
+	stmt := fmt.Sprintf("UPDATE %s SET %s WHERE %s",
+		db.tableName(id.Type),
+		strings.Join(assignments, ", "),
+		strings.Join(conditions, " OR "))
+	if len(updates) > 0 {
+		stmt = "WITH " + strings.Join(updates, ", ") + " " + stmt
+	}
+
+	if _, err := db.c.Exec(stmt, id.Key, newKey, db.userID); err != nil {
+		return fmt.Errorf("rename record %s: failed to update records: %s", id, err)
+	}
+	return nil
+}
+
+func (db *database) ArrayAppend(id skydb.RecordID, field string, unique bool, values ...interface{}) error {
+	column := pq.QuoteIdentifier(field)
+	valueSQL := fmt.Sprintf("COALESCE(%s, '[]') || $1::jsonb", column)
+	if unique {
+		valueSQL = fmt.Sprintf(`COALESCE(%[1]s, '[]') || (
+	SELECT COALESCE(jsonb_agg(value ORDER BY position), '[]')
+	FROM jsonb_array_elements($1::jsonb) WITH ORDINALITY AS appended(value, position)
+	WHERE NOT EXISTS (
+		SELECT 1 FROM jsonb_array_elements(COALESCE(%[1]s, '[]')) AS existing(value)
+		WHERE existing.value = appended.value))`, column)
+	}
+
+	return db.updateArrayField(id, field, valueSQL, true, values)
+}
+
+func (db *database) ArrayRemove(id skydb.RecordID, field string, values ...interface{}) error {
+	column := pq.QuoteIdentifier(field)
+	valueSQL := fmt.Sprintf(`CASE WHEN %[1]s IS NULL THEN NULL ELSE (
+	SELECT COALESCE(jsonb_agg(value ORDER BY position), '[]')
+	FROM jsonb_array_elements(%[1]s) WITH ORDINALITY AS element(value, position)
+	WHERE element.value NOT IN (SELECT jsonb_array_elements($1::jsonb))) END`, column)
+
+	return db.updateArrayField(id, field, valueSQL, false, values)
+}
+
+// updateArrayField sets the array field of the record to the value
+// computed by valueSQL in a single statement. Since the value is computed
+// from the field value of the row being updated, concurrent updates to the
+// same field are serialized by the row lock and none of them is lost.
+//
+// In valueSQL, $1 refers to values encoded as a JSON array. If valueSQL
+// is never null, the field is no longer saved as null.
+func (db *database) updateArrayField(id skydb.RecordID, field, valueSQL string, nonNull bool, values []interface{}) error {
+	if strings.HasPrefix(field, "_") {
+		return fmt.Errorf("update array %s: cannot update reserved key %s", id, field)
+	}
+
+	if db.IsReadOnly() {
+		return skydb.ErrDatabaseIsReadOnly
+	}
+
+	typemap, err := db.remoteColumnTypes(id.Type)
+	if err != nil {
+		return err
+	} else if len(typemap) == 0 { // record type has not been created
+		return skydb.ErrRecordNotFound
+	}
+
+	if fieldType, ok := typemap[field]; !ok {
+		if _, err := db.Extend(id.Type, skydb.RecordSchema{
+			field: skydb.FieldType{Type: skydb.TypeJSON},
+		}); err != nil {
+			return err
+		}
+	} else if fieldType.Type != skydb.TypeJSON {
+		return skydb.ErrFieldNotArray
+	}
+
+	column := pq.QuoteIdentifier(field)
+	assignments := fmt.Sprintf("%s = %s, _updated_at = $2", column, valueSQL)
+	if _, ok := typemap[nullFieldsColumn]; ok && nonNull {
+		valuedKeys, _ := json.Marshal([]string{field})
+		literal, _ := quoteLiteral(string(valuedKeys))
+		assignments += fmt.Sprintf(", %s = %s",
+			pq.QuoteIdentifier(nullFieldsColumn), nullFieldsSQL("'[]'", literal))
+	}
+	stmt := fmt.Sprintf(`UPDATE %s SET %s
+WHERE _id = $3 AND _database_id = $4 AND (%s IS NULL OR jsonb_typeof(%s) = 'array')`,
+		db.tableName(id.Type),
+		assignments,
+		column,
+		column)
+	result, err := db.c.Exec(stmt,
+		jsonSliceValue(append([]interface{}{}, values...)),
+		time.Now().UTC(),
+		id.Key,
+		db.userID)
+	if err != nil {
+		return fmt.Errorf("update array %s: failed to update record: %s", id, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("update array %s: failed to retrieve update status", id)
+	}
+
+	if rowsAffected == 0 {
+		// Either the record does not exist or the field is not an array
+		record := skydb.Record{}
+		if err := db.Get(id, &record); err != nil {
+			return err
+		}
+		return skydb.ErrFieldNotArray
+	}
+
+	return nil
+}
+
+func (db *database) applyQueryPredicate(q sq.SelectBuilder, factory *predicateSqlizerFactory, query *skydb.Query) (sq.SelectBuilder, error) {
+	return db.applyQueryPredicateWithACLLevel(q, factory, query, skydb.ReadLevel)
+}
+
+func (db *database) applyQueryPredicateWithACLLevel(q sq.SelectBuilder, factory *predicateSqlizerFactory, query *skydb.Query, aclLevel skydb.ACLLevel) (sq.SelectBuilder, error) {
+	if p := query.Predicate; !p.IsEmpty() {
+		sqlizer, err := factory.newPredicateSqlizer(p)
+		if err != nil {
+			return q, err
+		}
+		q = q.Where(sqlizer)
+	}
+	q = factory.addJoinsToSelectBuilder(q)
+
+	if db.DatabaseType() == skydb.PublicDatabase && !query.BypassAccessControl {
+		aclSqlizer, err := factory.newAccessControlSqlizer(query.ViewAsUser, aclLevel)
+		if err != nil {
+			return q, err
+		}
+		q = q.Where(aclSqlizer)
+	}
+
+	return q, nil
+}
+
+// sortColumnPrefix is the prefix of columns selected for sorting by key path
+// in a referenced record. They are not scanned into the resulting record.
+const sortColumnPrefix = "_sort_"
+
+func (db *database) applySorts(q sq.SelectBuilder, factory *predicateSqlizerFactory, sorts []skydb.Sort) (sq.SelectBuilder, error) {
+	for i, sort := range sorts {
+		if values := db.fieldOrder(factory.primaryTable, sort.KeyPath); values != nil {
+			if sort.Collation != "" {
+				return q, errors.New("invalid Sort: Collation does not apply to field with order")
+			}
+			order, err := sortOrderOrderBySQL(sort.Order)
+			if err != nil {
+				return q, err
+			}
+			column, err := missingAsSQL(fullQuoteIdentifier(factory.primaryTable, sort.KeyPath), sort)
+			if err != nil {
+				return q, err
+			}
+			q = q.OrderBy(fieldOrderRankSQL(column, values) + " " + order)
+			continue
+		}
+
+		if !strings.Contains(sort.KeyPath, ".") {
+			orderBy, err := sortOrderBySQL(factory.primaryTable, sort)
+			if err != nil {
+				return q, err
+			}
+			q = q.OrderBy(orderBy)
+			continue
+		}
+
+		expr, err := factory.newExpressionSqlizerForKeyPath(skydb.Expression{
+			Type:  skydb.KeyPath,
+			Value: sort.KeyPath,
+		})
+		if err != nil {
+			return q, err
+		}
+		exprSQL, _, err := expr.ToSql()
+		if err != nil {
+			return q, err
+		}
+		exprSQL, err = missingAsSQL(exprSQL, sort)
+		if err != nil {
+			return q, err
+		}
+		exprSQL += collateSQL(sort.Collation)
+
+		order, err := sortOrderOrderBySQL(sort.Order)
+		if err != nil {
+			return q, err
+		}
+
+		// A query with joined tables selects distinct rows, which requires
+		// the ORDER BY expression to appear in the select list.
+		column := fmt.Sprintf("%s%d", sortColumnPrefix, i)
+		q = q.Column(exprSQL + " AS " + pq.QuoteIdentifier(column)).
+			OrderBy(exprSQL + " " + order)
+	}
+
+	return q, nil
+}
+
+func (db *database) defaultSorts(recordType string) []skydb.Sort {
+	return db.c.config.DefaultSorts[recordType]
+}
+
+// querySorts returns the sorts of query, or the default sorts of its
+// record type if it has none, followed by a sort on _id such that records
+// are ordered totally and the query can be resumed after a record.
+// A query without any sorts is not sorted unless it is resumed.
+func (db *database) querySorts(query *skydb.Query) []skydb.Sort {
+	sorts := query.Sorts
+	if len(sorts) == 0 {
+		sorts = db.defaultSorts(query.Type)
+	}
+	if len(sorts) == 0 && query.After == nil {
+		return sorts
+	}
+
+	for _, sort := range sorts {
+		if sort.KeyPath == "_id" {
+			return sorts
+		}
+	}
+	return append(sorts[:len(sorts):len(sorts)], skydb.Sort{
+		KeyPath: "_id",
+		Order:   skydb.Ascending,
+	})
+}
+
+// applyAfter limits q to records ordered after the record by sorts, which
+// must end with a sort on _id. A record is ordered after another if they
+// have equal values of some leading sorts and the value of the next sort
+// is after that of the other record.
+//
+// Null values are ordered after other values in ascending sorts and
+// before them in descending sorts, as PostgreSQL orders them.
+func (db *database) applyAfter(q sq.SelectBuilder, alias string, sorts []skydb.Sort, record *skydb.Record) (sq.SelectBuilder, error) {
+	after := sq.Or{}
+	equal := sq.And{}
+	for _, sort := range sorts {
+		if sort.KeyPath == "" || strings.Contains(sort.KeyPath, ".") {
+			return q, fmt.Errorf("cannot resume query sorted by other than a field of %s", alias)
+		}
+
+		column, err := missingAsSQL(fullQuoteIdentifier(alias, sort.KeyPath), sort)
+		if err != nil {
+			return q, err
+		}
+		value := literalToSQLValue(record.Get(sort.KeyPath))
+		if value == nil {
+			value = sort.MissingAs
+		}
+
+		placeholder := "?"
+		if values := db.fieldOrder(alias, sort.KeyPath); values != nil {
+			column = fieldOrderRankSQL(column, values)
+			if str, ok := value.(string); ok {
+				value = fieldOrderRank(values, str)
+			} else {
+				value = len(values)
+			}
+		} else if sort.Collation != "" {
+			column += collateSQL(sort.Collation)
+			placeholder = "CAST(? AS text)" + collateSQL(sort.Collation)
+		}
+
+		var next, same sq.Sqlizer
+		switch {
+		case value == nil && sort.Order == skydb.Descending:
+			next = sq.Expr(column + " IS NOT NULL")
+			same = sq.Expr(column + " IS NULL")
+		case value == nil:
+			next = sq.Expr("FALSE")
+			same = sq.Expr(column + " IS NULL")
+		case sort.Order == skydb.Descending:
+			next = sq.Expr(column+" < "+placeholder, value)
+			same = sq.Expr(column+" = "+placeholder, value)
+		default:
+			next = sq.Or{
+				sq.Expr(column+" > "+placeholder, value),
+				sq.Expr(column + " IS NULL"),
+			}
+			same = sq.Expr(column+" = "+placeholder, value)
+		}
+
+		after = append(after, append(equal[:len(equal):len(equal)], next))
+		equal = append(equal, same)
+	}
+
+	return q.Where(after), nil
+}
+
+// fieldOrder returns the order of values of the field, or nil if the
+// field is ordered by its value.
+func (db *database) fieldOrder(recordType, fieldName string) []string {
+	return db.c.config.FieldOrders[recordType][fieldName]
+}
+
+// fieldOrderRank returns the position of value in values, or the number
+// of values if value is not one of them.
+func fieldOrderRank(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return len(values)
+}
+
+// fieldOrderRankSQL returns the SQL expression evaluating to the
+// position of the value of column in values, as fieldOrderRank does.
+func fieldOrderRankSQL(column string, values []string) string {
+	var buffer bytes.Buffer
+	buffer.WriteString("CASE " + column)
+	for i, value := range values {
+		literal, _ := quoteLiteral(value)
+		fmt.Fprintf(&buffer, " WHEN %s THEN %d", literal, i)
+	}
+	fmt.Fprintf(&buffer, " ELSE %d END", len(values))
+	return buffer.String()
+}
+
+func (db *database) ApplyRetention() (int, error) {
+	if db.IsReadOnly() {
+		return 0, skydb.ErrDatabaseIsReadOnly
+	}
+
+	purged := 0
+	for recordType, policy := range db.c.config.RetentionPolicies {
+		typemap, err := db.remoteColumnTypes(recordType)
+		if err != nil {
+			return purged, err
+		}
+		if len(typemap) == 0 { // record type has not been created
+			continue
+		}
+
+		if policy.MaxAge > 0 {
+			stmt := fmt.Sprintf("DELETE FROM %s WHERE _created_at < $1",
+				db.tableName(recordType))
+			n, err := db.execRowsAffected(stmt, time.Now().UTC().Add(-policy.MaxAge))
+			if err != nil {
+				return purged, fmt.Errorf("apply retention %s: failed to delete records: %s", recordType, err)
+			}
+			purged += n
+		}
+
+		if policy.MaxCount > 0 {
+			stmt := fmt.Sprintf(`DELETE FROM %[1]s WHERE (_database_id, _id) IN (
+				SELECT _database_id, _id FROM %[1]s
+				ORDER BY _created_at DESC, _id DESC
+				OFFSET $1
+			)`, db.tableName(recordType))
+			n, err := db.execRowsAffected(stmt, policy.MaxCount)
+			if err != nil {
+				return purged, fmt.Errorf("apply retention %s: failed to delete records: %s", recordType, err)
+			}
+			purged += n
+		}
+	}
+
+	if retention := db.c.config.ChangelogRetention; retention > 0 {
+		if err := db.purgeChangelog(time.Now().UTC().Add(-retention)); err != nil {
+			return purged, fmt.Errorf("apply retention: failed to purge changelog: %s", err)
+		}
+	}
+
+	return purged, nil
+}
+
+func (db *database) execRowsAffected(query string, args ...interface{}) (int, error) {
+	result, err := db.c.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(rowsAffected), nil
+}
+
+func (db *database) virtualFields(recordType string) map[string]skydb.VirtualFieldFunc {
+	return db.c.config.VirtualFields[recordType]
+}
+
+func (db *database) FieldMasks(recordType string) map[string]skydb.FieldMask {
+	return db.c.config.FieldMasks[recordType]
+}
+
+// schemaVersioning holds the current schema version of a record type
+// and the migrators up-converting records from older versions.
+type schemaVersioning struct {
+	version   int
+	migrators map[int]skydb.SchemaMigratorFunc
+}
+
+func (v *schemaVersioning) currentVersion() int {
+	if v == nil {
+		return 0
+	}
+	return v.version
+}
+
+// migrate up-converts the record one version after another until it
+// reaches the current version, or no migrator is registered for the
+// version it is at.
+func (v *schemaVersioning) migrate(record *skydb.Record) error {
+	if v == nil {
+		return nil
+	}
+	for record.SchemaVersion < v.version {
+		fn, ok := v.migrators[record.SchemaVersion]
+		if !ok {
+			return nil
+		}
+		if err := fn(record); err != nil {
+			return fmt.Errorf("failed to migrate %s from schema version %d: %s",
+				record.ID, record.SchemaVersion, err)
+		}
+		record.SchemaVersion++
+	}
+	return nil
+}
+
+// schemaVersioning returns the schema versioning of the record type, or
+// nil if the record type is not versioned.
+func (db *database) schemaVersioning(recordType string) *schemaVersioning {
+	version := db.c.config.SchemaVersions[recordType]
+	if version == 0 {
+		return nil
+	}
+	return &schemaVersioning{
+		version:   version,
+		migrators: db.c.config.SchemaMigrators[recordType],
+	}
+}
+
+func (db *database) lenientDecoding(recordType string) bool {
+	return db.c.config.LenientDecoding[recordType]
+}
+
+func isDroppedField(record *skydb.Record, name string) bool {
+	for _, dropped := range record.DroppedFields {
+		if dropped == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *database) queryEngine(recordType string) skydb.QueryEngine {
+	return db.c.config.QueryEngines[recordType]
+}
+
+func (db *database) Query(query *skydb.Query) (*skydb.Rows, error) {
+	return db.withReadHooks(db.query(query))
+}
+
+func (db *database) query(query *skydb.Query) (*skydb.Rows, error) {
+	if query.Type == "" {
+		return nil, errors.New("got empty query type")
+	}
+
+	if engine := db.queryEngine(query.Type); engine != nil && engine.Match(query) {
+		return engine.Query(db, query)
+	}
+
+	typemap, err := db.remoteColumnTypes(query.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(typemap) == 0 { // record type has not been created
+		return skydb.EmptyRows, nil
+	}
+
+	query = withDistance(query)
+	sorts := db.querySorts(query)
+
+	// Sorts are applied before predicate such that tables joined for
+	// sorting are added to the query with those joined for predicate.
+	q := psql.Select()
+	factory := newPredicateSqlizerFactory(db, query.Type)
+	q, err = db.applySorts(q, factory, sorts)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err = db.applyQueryPredicate(q, factory, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.After != nil {
+		q, err = db.applyAfter(q, query.Type, sorts, query.After)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if query.Limit != nil {
+		q = q.Limit(*query.Limit)
+	}
+
+	if query.Offset > 0 {
+		q = q.Offset(query.Offset)
+	}
+
+	// Select columns to return, this is the last step so that predicate
+	// have a chance to change typemap, and the generated sql
+	// depends on the alias name used in table joins.
+	typemap, err = updateTypemapForQuery(query, typemap)
+	if err != nil {
+		return nil, err
+	}
+	typemap = factory.updateTypemap(typemap)
+	q = db.selectQuery(q, query.Type, typemap)
+
+	if db.c.maxQueryDuration > 0 {
+		return db.queryWithTimeout(query.Type, typemap, q)
+	}
+
+	rows, err := db.c.QueryWith(q)
+	return newRows(query.Type, typemap, db.scanConfig(query.Type), rows, err)
+}
+
+// queryWithTimeout executes the query with the statement timeout of
+// PostgreSQL set to the maximum query duration, and reads all records
+// before the timeout is reset.
+//
+// The timeout is set locally to a transaction, which is begun for the
+// query if none has begun. Otherwise a savepoint resets the timeout and
+// recovers the enclosing transaction from a timed out query.
+func (db *database) queryWithTimeout(recordType string, typemap skydb.RecordSchema, q sq.SelectBuilder) (*skydb.Rows, error) {
+	if db.c.tx == nil {
+		if err := db.c.Begin(); err != nil {
+			return nil, err
+		}
+		defer db.c.Rollback()
+	} else {
+		if _, err := db.c.Exec("SAVEPOINT query_timeout"); err != nil {
+			return nil, err
+		}
+		defer func() {
+			db.c.Exec("ROLLBACK TO SAVEPOINT query_timeout")
+			db.c.Exec("RELEASE SAVEPOINT query_timeout")
+		}()
+	}
+
+	timeout := int64(db.c.maxQueryDuration / time.Millisecond)
+	if timeout == 0 {
+		timeout = 1
+	}
+	if _, err := db.c.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d", timeout)); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.c.QueryWith(q)
+	if isQueryCanceled(err) {
+		return nil, skydb.ErrQueryTimeout
+	} else if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rs := newRecordScanner(recordType, typemap, db.scanConfig(recordType), rows)
+	records := []skydb.Record{}
+	for rows.Next() {
+		record := skydb.Record{}
+		if err := rs.Scan(&record); isQueryCanceled(err) {
+			return nil, skydb.ErrQueryTimeout
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); isQueryCanceled(err) {
+		return nil, skydb.ErrQueryTimeout
+	} else if err != nil {
+		return nil, err
+	}
+
+	return skydb.NewRows(&bufferedRowsIter{records, rs.recordCount}), nil
+}
+
+// bufferedRowsIter iterates records read in advance, along with the
+// overall record count of the query.
+type bufferedRowsIter struct {
+	records     []skydb.Record
+	recordCount *uint64
+}
+
+func (rowsi *bufferedRowsIter) Close() error {
+	return nil
+}
+
+func (rowsi *bufferedRowsIter) Next(record *skydb.Record) error {
+	if len(rowsi.records) == 0 {
+		return io.EOF
+	}
+	*record = rowsi.records[0]
+	rowsi.records = rowsi.records[1:]
+	return nil
+}
+
+func (rowsi *bufferedRowsIter) OverallRecordCount() *uint64 {
+	return rowsi.recordCount
+}
+
+func (db *database) QueryCount(query *skydb.Query) (uint64, error) {
+	if query.Type == "" {
+		return 0, errors.New("got empty query type")
+	}
+
+	typemap, err := db.remoteColumnTypes(query.Type)
+	if err != nil || len(typemap) == 0 { // error or record type has not been created
+		return 0, err
+	}
+
+	typemap = skydb.RecordSchema{
+		"_record_count": skydb.FieldType{
+			Type: skydb.TypeNumber,
+			Expression: skydb.Expression{
+				Type: skydb.Function,
+				Value: skydb.CountFunc{
+					OverallRecords: false,
+				},
+			},
+		},
+	}
+
+	q := db.selectQuery(psql.Select(), query.Type, typemap)
+	factory := newPredicateSqlizerFactory(db, query.Type)
+	q, err = db.applyQueryPredicate(q, factory, query)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.c.QueryWith(q)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		panic("Unexpected zero rows returned for aggregate count function.")
+	}
+
+	var recordCount uint64
+	err = rows.Scan(&recordCount)
+	if err != nil {
+		return 0, err
+	}
+
+	return recordCount, nil
+}
+
+func (db *database) QueryKeys(query *skydb.Query) ([]skydb.RecordKey, error) {
+	if query.Type == "" {
+		return nil, errors.New("got empty query type")
+	}
+
+	typemap, err := db.remoteColumnTypes(query.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []skydb.RecordKey{}
+	if len(typemap) == 0 { // record type has not been created
+		return keys, nil
+	}
+
+	sorts := db.querySorts(query)
+
+	typemap = skydb.RecordSchema{
+		"_id":         skydb.FieldType{Type: skydb.TypeString},
+		"_updated_at": skydb.FieldType{Type: skydb.TypeDateTime},
+	}
+	q := db.selectQuery(psql.Select(), query.Type, typemap)
+	factory := newPredicateSqlizerFactory(db, query.Type)
+	q, err = db.applySorts(q, factory, sorts)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err = db.applyQueryPredicate(q, factory, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.After != nil {
+		q, err = db.applyAfter(q, query.Type, sorts, query.After)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if query.Limit != nil {
+		q = q.Limit(*query.Limit)
+	}
+
+	if query.Offset > 0 {
+		q = q.Offset(query.Offset)
+	}
+
+	sqlRows, err := db.c.QueryWith(q)
+	rows, err := newRows(query.Type, typemap, scanConfig{}, sqlRows, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Scan() {
+		record := rows.Record()
+		keys = append(keys, skydb.RecordKey{
+			ID:        record.ID,
+			UpdatedAt: record.UpdatedAt,
+		})
+	}
+
+	return keys, rows.Err()
+}
+
+// emptyQueryETag is the ETag of a query matching no records, which is the
+// MD5 hash of an empty string.
+const emptyQueryETag = "d41d8cd98f00b204e9800998ecf8427e"
+
+func (db *database) FindReferencing(targetID skydb.RecordID) (*skydb.Rows, error) {
+	schemas, err := db.GetRecordSchemas()
+	if err != nil {
+		return nil, err
+	}
+
+	recordTypes := []string{}
+	for recordType := range schemas {
+		recordTypes = append(recordTypes, recordType)
+	}
+	sort.Strings(recordTypes)
+
+	queries := []*skydb.Query{}
+	for _, recordType := range recordTypes {
+		keys := []string{}
+		for key, fieldType := range schemas[recordType] {
+			if fieldType.Type == skydb.TypeReference && fieldType.ReferenceType == targetID.Type {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		sort.Strings(keys)
+
+		predicates := []interface{}{}
+		for _, key := range keys {
+			predicates = append(predicates, skydb.Predicate{
+				Operator: skydb.Equal,
+				Children: []interface{}{
+					skydb.Expression{
+						Type:  skydb.KeyPath,
+						Value: key,
+					},
+					skydb.Expression{
+						Type:  skydb.Literal,
+						Value: skydb.NewReference(targetID.Type, targetID.Key),
+					},
+				},
+			})
+		}
+
+		predicate := predicates[0].(skydb.Predicate)
+		if len(predicates) > 1 {
+			predicate = skydb.Predicate{
+				Operator: skydb.Or,
+				Children: predicates,
+			}
+		}
+
+		queries = append(queries, &skydb.Query{
+			Type:      recordType,
+			Predicate: predicate,
+		})
 	}
 
-	row := db.c.QueryRowWith(upsert)
-	if err = newRecordScanner(record.ID.Type, typemap, row).Scan(record); err != nil {
-		return err
-	}
+	return skydb.NewRows(&queriesRowsIter{db: db, queries: queries}), nil
+}
 
-	record.DatabaseID = db.userID
+// queriesRowsIter iterates the results of queries one after another.
+// Each query is executed only after the results of the previous query
+// are exhausted, so that at most one result set is open at a time.
+type queriesRowsIter struct {
+	db      *database
+	queries []*skydb.Query
+	rows    *skydb.Rows
+}
+
+func (iter *queriesRowsIter) Close() error {
+	if iter.rows != nil {
+		return iter.rows.Close()
+	}
 	return nil
 }
 
-func (db *database) preSave(schema skydb.RecordSchema, record *skydb.Record) error {
-	const SetSequenceMaxValue = `SELECT setval($1, GREATEST(max(%v), $2)) FROM %v;`
+func (iter *queriesRowsIter) Next(record *skydb.Record) error {
+	for {
+		if iter.rows == nil {
+			if len(iter.queries) == 0 {
+				return io.EOF
+			}
 
-	for key, value := range record.Data {
-		// we are setting a sequence field
-		if schema[key].Type == skydb.TypeSequence {
-			selectSQL := fmt.Sprintf(SetSequenceMaxValue, pq.QuoteIdentifier(key), db.tableName(record.ID.Type))
-			seqName := db.tableName(fmt.Sprintf(`%v_%v_seq`, record.ID.Type, key))
-			if _, err := db.c.Exec(selectSQL, seqName, value); err != nil {
+			rows, err := iter.db.Query(iter.queries[0])
+			if err != nil {
 				return err
 			}
+			iter.queries = iter.queries[1:]
+			iter.rows = rows
 		}
-	}
 
-	return nil
-}
+		if iter.rows.Scan() {
+			*record = iter.rows.Record()
+			return nil
+		}
 
-func convert(r *skydb.Record) map[string]interface{} {
-	m := map[string]interface{}{}
-	for key, rawValue := range r.Data {
-		switch value := rawValue.(type) {
-		case []interface{}:
-			m[key] = jsonSliceValue(value)
-		case map[string]interface{}:
-			m[key] = jsonMapValue(value)
-		case *skydb.Asset:
-			m[key] = assetValue(*value)
-		case skydb.Reference:
-			m[key] = referenceValue(value)
-		case skydb.Location:
-			m[key] = locationValue(value)
-		case skydb.Unknown:
-			// Do not modify columns with unknown type because they are
-			// managed by the developer.
-		default:
-			m[key] = rawValue
+		if err := iter.rows.Err(); err != nil {
+			return err
+		}
+		if err := iter.rows.Close(); err != nil {
+			return err
 		}
+		iter.rows = nil
 	}
-	m["_owner_id"] = r.OwnerID
-	m["_access"] = aclValue(r.ACL)
-	m["_created_at"] = r.CreatedAt
-	m["_created_by"] = r.CreatorID
-	m["_updated_at"] = r.UpdatedAt
-	m["_updated_by"] = r.UpdaterID
-	return m
 }
 
-func (db *database) Delete(id skydb.RecordID) error {
-	builder := psql.Delete(db.tableName(id.Type)).
-		Where("_id = ?", id.Key)
+func (iter *queriesRowsIter) OverallRecordCount() *uint64 {
+	return nil
+}
 
-	switch db.DatabaseType() {
-	case skydb.UnionDatabase:
-		return skydb.ErrDatabaseIsReadOnly
-	case skydb.PublicDatabase:
-		fallthrough
-	case skydb.PrivateDatabase:
-		builder = builder.Where("_database_id = ?", db.userID)
+func (db *database) QueryETag(query *skydb.Query) (string, error) {
+	if query.Type == "" {
+		return "", errors.New("got empty query type")
 	}
 
-	result, err := db.c.ExecWith(builder)
-	if isUndefinedTable(err) {
-		return skydb.ErrRecordNotFound
-	} else if err != nil {
-		return fmt.Errorf("delete %s: failed to delete record", id)
+	typemap, err := db.remoteColumnTypes(query.Type)
+	if err != nil {
+		return "", err
+	}
+	if len(typemap) == 0 { // record type has not been created
+		return emptyQueryETag, nil
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	// The whole row is hashed rather than _id and _updated_at, so that the
+	// ETag changes even if a write leaves _updated_at unchanged.
+	idColumn := fullQuoteIdentifier(query.Type, "_id")
+	q := db.selectQuery(psql.Select(), query.Type, skydb.RecordSchema{}).
+		Column(fmt.Sprintf(
+			"md5(COALESCE(string_agg(md5(CAST(%s AS text)), ',' ORDER BY %s), ''))",
+			pq.QuoteIdentifier(query.Type), idColumn,
+		))
+	factory := newPredicateSqlizerFactory(db, query.Type)
+	q, err = db.applyQueryPredicate(q, factory, query)
 	if err != nil {
-		return fmt.Errorf("delete %s: failed to retrieve deletion status", id)
+		return "", err
 	}
 
-	if rowsAffected == 0 {
-		return skydb.ErrRecordNotFound
-	} else if rowsAffected > 1 {
-		log.WithFields(logrus.Fields{
-			"id":           id,
-			"rowsAffected": rowsAffected,
-			"err":          err,
-		}).Errorln("Unexpected rows deleted")
-		return fmt.Errorf("delete %s: got %v rows deleted, want 1", id, rowsAffected)
+	var etag string
+	if err := db.c.QueryRowWith(q).Scan(&etag); err != nil {
+		return "", err
 	}
 
-	return err
+	return etag, nil
 }
 
-func (db *database) applyQueryPredicate(q sq.SelectBuilder, factory *predicateSqlizerFactory, query *skydb.Query) (sq.SelectBuilder, error) {
-	if p := query.Predicate; !p.IsEmpty() {
-		sqlizer, err := factory.newPredicateSqlizer(p)
+func (db *database) GroupCount(query *skydb.Query, keyPath string, missing skydb.MissingGroupPolicy, having *skydb.HavingCount) (map[interface{}]uint64, error) {
+	if query.Type == "" {
+		return nil, errors.New("got empty query type")
+	}
+
+	typemap, err := db.remoteColumnTypes(query.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[interface{}]uint64{}
+	if len(typemap) == 0 { // record type has not been created
+		return counts, nil
+	}
+
+	fieldType, ok := typemap[keyPath]
+	if !ok {
+		return nil, fmt.Errorf(`unexpected key "%s"`, keyPath)
+	}
+
+	switch fieldType.Type {
+	case skydb.TypeJSON, skydb.TypeACL, skydb.TypeAsset, skydb.TypeLocation, skydb.TypeUnknown:
+		return nil, fmt.Errorf(`cannot group records by key "%s" of type %v`, keyPath, fieldType.Type)
+	}
+
+	typemap = skydb.RecordSchema{
+		keyPath: fieldType,
+		"_record_count": skydb.FieldType{
+			Type: skydb.TypeNumber,
+			Expression: skydb.Expression{
+				Type: skydb.Function,
+				Value: skydb.CountFunc{
+					OverallRecords: false,
+				},
+			},
+		},
+	}
+
+	q := db.selectQuery(psql.Select(), query.Type, typemap)
+	factory := newPredicateSqlizerFactory(db, query.Type)
+	q, err = db.applyQueryPredicate(q, factory, query)
+	if err != nil {
+		return nil, err
+	}
+	if missing == skydb.ExcludeMissing {
+		q = q.Where(fullQuoteIdentifier(query.Type, keyPath) + " IS NOT NULL")
+	}
+	q = q.GroupBy(fullQuoteIdentifier(query.Type, keyPath))
+	if having != nil {
+		operator, err := comparisonOperatorSQL(having.Operator)
 		if err != nil {
-			return q, err
+			return nil, err
 		}
-		q = q.Where(sqlizer)
-		q = factory.addJoinsToSelectBuilder(q)
+		q = q.Having("COUNT(*) "+operator+" ?", having.Count)
 	}
 
-	if db.DatabaseType() == skydb.PublicDatabase && !query.BypassAccessControl {
-		aclSqlizer, err := factory.newAccessControlSqlizer(query.ViewAsUser, skydb.ReadLevel)
-		if err != nil {
-			return q, err
+	rows, err := db.c.QueryWith(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rs := newRecordScanner(query.Type, typemap, scanConfig{}, rows)
+	for rows.Next() {
+		record := skydb.Record{}
+		if err := rs.Scan(&record); err != nil {
+			return nil, err
 		}
-		q = q.Where(aclSqlizer)
+		counts[record.Get(keyPath)] = *rs.recordCount
 	}
 
-	return q, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
 }
 
-func (db *database) Query(query *skydb.Query) (*skydb.Rows, error) {
+func (db *database) QueryGrouped(query *skydb.Query, groupKey string) (map[interface{}][]skydb.Record, error) {
 	if query.Type == "" {
 		return nil, errors.New("got empty query type")
 	}
@@ -254,93 +2087,119 @@ func (db *database) Query(query *skydb.Query) (*skydb.Rows, error) {
 		return nil, err
 	}
 
+	groups := map[interface{}][]skydb.Record{}
 	if len(typemap) == 0 { // record type has not been created
-		return skydb.EmptyRows, nil
+		return groups, nil
 	}
 
-	q := psql.Select()
-	factory := newPredicateSqlizerFactory(db, query.Type)
-	q, err = db.applyQueryPredicate(q, factory, query)
-	if err != nil {
-		return nil, err
+	fieldType, ok := typemap[groupKey]
+	if !ok {
+		return nil, fmt.Errorf(`unexpected key "%s"`, groupKey)
 	}
 
-	for _, sort := range query.Sorts {
-		orderBy, err := sortOrderBySQL(query.Type, sort)
-		if err != nil {
-			return nil, err
-		}
-		q = q.OrderBy(orderBy)
+	switch fieldType.Type {
+	case skydb.TypeJSON, skydb.TypeACL, skydb.TypeAsset, skydb.TypeLocation, skydb.TypeUnknown:
+		return nil, fmt.Errorf(`cannot group records by key "%s" of type %v`, groupKey, fieldType.Type)
 	}
 
-	if query.Limit != nil {
-		q = q.Limit(*query.Limit)
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	if query.Offset > 0 {
-		q = q.Offset(query.Offset)
+	for rows.Scan() {
+		record := rows.Record()
+		value := record.Get(groupKey)
+		groups[value] = append(groups[value], record)
 	}
 
-	// Select columns to return, this is the last step so that predicate
-	// have a chance to change typemap, and the generated sql
-	// depends on the alias name used in table joins.
-	typemap, err = updateTypemapForQuery(query, typemap)
-	if err != nil {
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-	typemap = factory.updateTypemap(typemap)
-	q = db.selectQuery(q, query.Type, typemap)
 
-	rows, err := db.c.QueryWith(q)
-	return newRows(query.Type, typemap, rows, err)
+	return groups, nil
 }
 
-func (db *database) QueryCount(query *skydb.Query) (uint64, error) {
+func (db *database) Aggregate(query *skydb.Query, keyPath string, fn skydb.AggFunc) (float64, uint64, error) {
 	if query.Type == "" {
-		return 0, errors.New("got empty query type")
+		return 0, 0, errors.New("got empty query type")
 	}
 
 	typemap, err := db.remoteColumnTypes(query.Type)
 	if err != nil || len(typemap) == 0 { // error or record type has not been created
-		return 0, err
+		return 0, 0, err
 	}
 
-	typemap = skydb.RecordSchema{
-		"_record_count": skydb.FieldType{
-			Type: skydb.TypeNumber,
-			Expression: skydb.Expression{
-				Type: skydb.Function,
-				Value: skydb.CountFunc{
-					OverallRecords: false,
-				},
-			},
-		},
+	fieldType, ok := typemap[keyPath]
+	if !ok {
+		return 0, 0, fmt.Errorf(`unexpected key "%s"`, keyPath)
 	}
 
-	q := db.selectQuery(psql.Select(), query.Type, typemap)
-	factory := newPredicateSqlizerFactory(db, query.Type)
-	q, err = db.applyQueryPredicate(q, factory, query)
+	switch fieldType.Type {
+	case skydb.TypeNumber, skydb.TypeInteger, skydb.TypeSequence:
+	default:
+		return 0, 0, fmt.Errorf(`cannot aggregate key "%s" of type %v`, keyPath, fieldType.Type)
+	}
+
+	aggSQL, err := aggFuncSQL(fn)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
-	rows, err := db.c.QueryWith(q)
+	column := fullQuoteIdentifier(query.Type, keyPath)
+	q := db.selectQuery(psql.Select(), query.Type, skydb.RecordSchema{}).
+		Column(fmt.Sprintf("%s(%s)", aggSQL, column)).
+		Column(fmt.Sprintf("COUNT(*) - COUNT(%s)", column))
+	factory := newPredicateSqlizerFactory(db, query.Type)
+	q, err = db.applyQueryPredicate(q, factory, query)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
-	defer rows.Close()
 
-	if !rows.Next() {
-		panic("Unexpected zero rows returned for aggregate count function.")
+	var (
+		result  sql.NullFloat64
+		skipped int64
+	)
+	if err := db.c.QueryRowWith(q).Scan(&result, &skipped); err != nil {
+		return 0, 0, err
 	}
 
-	var recordCount uint64
-	err = rows.Scan(&recordCount)
-	if err != nil {
-		return 0, err
+	return result.Float64, uint64(skipped), nil
+}
+
+func aggFuncSQL(fn skydb.AggFunc) (string, error) {
+	switch fn {
+	case skydb.SumAgg:
+		return "SUM", nil
+	case skydb.AvgAgg:
+		return "AVG", nil
+	case skydb.MinAgg:
+		return "MIN", nil
+	case skydb.MaxAgg:
+		return "MAX", nil
+	default:
+		return "", fmt.Errorf("got unrecognized skydb.AggFunc = %v", fn)
 	}
+}
 
-	return recordCount, nil
+func comparisonOperatorSQL(op skydb.Operator) (string, error) {
+	switch op {
+	case skydb.Equal:
+		return "=", nil
+	case skydb.NotEqual:
+		return "<>", nil
+	case skydb.GreaterThan:
+		return ">", nil
+	case skydb.LessThan:
+		return "<", nil
+	case skydb.GreaterThanOrEqual:
+		return ">=", nil
+	case skydb.LessThanOrEqual:
+		return "<=", nil
+	default:
+		return "", fmt.Errorf("got unsupported comparison operator = %v", op)
+	}
 }
 
 // columnsScanner wraps over sqlx.Rows and sqlx.Row to provide
@@ -350,18 +2209,44 @@ type columnsScanner interface {
 	Scan(dest ...interface{}) error
 }
 
+// scanConfig is the configuration of a record type applied to its records
+// when they are scanned.
+type scanConfig struct {
+	virtualFields map[string]skydb.VirtualFieldFunc
+	versioning    *schemaVersioning
+	lenient       bool
+
+	// decodeSpecialFloats is whether special floats encoded in JSON fields
+	// are decoded, which is only done for record types encoding them, such
+	// that user data of the same form is returned intact otherwise.
+	decodeSpecialFloats bool
+}
+
+func (db *database) scanConfig(recordType string) scanConfig {
+	return scanConfig{
+		virtualFields:       db.virtualFields(recordType),
+		versioning:          db.schemaVersioning(recordType),
+		lenient:             db.lenientDecoding(recordType),
+		decodeSpecialFloats: db.specialFloatPolicy(recordType) == skydb.EncodeSpecialFloats,
+	}
+}
+
 type recordScanner struct {
 	recordType  string
 	typemap     skydb.RecordSchema
+	config      scanConfig
 	cs          columnsScanner
 	columns     []string
 	err         error
 	recordCount *uint64
+
+	// nullFields is the null fields of the last scanned record.
+	nullFields []string
 }
 
-func newRecordScanner(recordType string, typemap skydb.RecordSchema, cs columnsScanner) *recordScanner {
+func newRecordScanner(recordType string, typemap skydb.RecordSchema, config scanConfig, cs columnsScanner) *recordScanner {
 	columns, err := cs.Columns()
-	return &recordScanner{recordType, typemap, cs, columns, err, nil}
+	return &recordScanner{recordType, typemap, config, cs, columns, err, nil, nil}
 }
 
 func (rs *recordScanner) Scan(record *skydb.Record) error {
@@ -371,6 +2256,12 @@ func (rs *recordScanner) Scan(record *skydb.Record) error {
 
 	values := make([]interface{}, 0, len(rs.columns))
 	for _, column := range rs.columns {
+		if strings.HasPrefix(column, sortColumnPrefix) {
+			var ignored interface{}
+			values = append(values, &ignored)
+			continue
+		}
+
 		schema, ok := rs.typemap[column]
 		if !ok {
 			return fmt.Errorf("received unknown column = %s", column)
@@ -410,6 +2301,16 @@ func (rs *recordScanner) Scan(record *skydb.Record) error {
 		}
 	}
 
+	// Reserved columns are always decoded strictly, as a record is not
+	// usable without them.
+	if rs.config.lenient {
+		for i, column := range rs.columns {
+			if scanner, ok := values[i].(sql.Scanner); ok && !strings.HasPrefix(column, "_") {
+				values[i] = &lenientScanner{Scanner: scanner}
+			}
+		}
+	}
+
 	if err := rs.cs.Scan(values...); err != nil {
 		rs.err = err
 		return err
@@ -417,10 +2318,49 @@ func (rs *recordScanner) Scan(record *skydb.Record) error {
 
 	record.ID.Type = rs.recordType
 	record.Data = map[string]interface{}{}
+	record.SchemaVersion = 0
+	record.DroppedFields = nil
+	rs.nullFields = nil
 
 	for i, column := range rs.columns {
 		value := values[i]
 
+		if strings.HasPrefix(column, sortColumnPrefix) || strings.HasPrefix(column, rollupColumnPrefix) {
+			continue
+		}
+
+		if lenient, ok := value.(*lenientScanner); ok {
+			if lenient.err != nil {
+				log.WithFields(logrus.Fields{
+					"recordType": rs.recordType,
+					"field":      column,
+					"err":        lenient.err,
+				}).Warnln("pq: failed to decode field, dropping it from the record")
+				record.DroppedFields = append(record.DroppedFields, column)
+				continue
+			}
+			value = lenient.Scanner
+		}
+
+		if column == nullFieldsColumn {
+			if svalue, ok := value.(*nullJSON); ok && svalue.Valid {
+				fields, _ := svalue.JSON.([]interface{})
+				for _, field := range fields {
+					if name, ok := field.(string); ok {
+						rs.nullFields = append(rs.nullFields, name)
+					}
+				}
+			}
+			continue
+		}
+
+		if column == schemaVersionColumn {
+			if svalue, ok := value.(*sql.NullInt64); ok && svalue.Valid {
+				record.SchemaVersion = int(svalue.Int64)
+			}
+			continue
+		}
+
 		if column == "_record_count" {
 			svalue, ok := value.(*sql.NullFloat64)
 			if !ok || !svalue.Valid {
@@ -471,7 +2411,9 @@ func (rs *recordScanner) Scan(record *skydb.Record) error {
 				record.Set(column, svalue.Asset)
 			}
 		case *nullJSON:
-			if svalue.Valid {
+			if svalue.Valid && rs.config.decodeSpecialFloats {
+				record.Set(column, decodeSpecialFloats(svalue.JSON))
+			} else if svalue.Valid {
 				record.Set(column, svalue.JSON)
 			}
 		case *nullLocation:
@@ -494,6 +2436,28 @@ func (rs *recordScanner) Scan(record *skydb.Record) error {
 
 	}
 
+	// A null field has no value in its column, which is only told apart
+	// from a field never saved by its presence in the null fields.
+	for _, name := range rs.nullFields {
+		if _, ok := rs.typemap[name]; !ok {
+			continue
+		}
+		if isDroppedField(record, name) {
+			continue
+		}
+		if _, ok := record.Data[name]; !ok {
+			record.Data[name] = nil
+		}
+	}
+
+	if err := rs.config.versioning.migrate(record); err != nil {
+		return err
+	}
+
+	for name, fn := range rs.config.virtualFields {
+		record.Data[name] = fn(record)
+	}
+
 	return nil
 }
 
@@ -520,11 +2484,11 @@ func (rowsi rowsIter) OverallRecordCount() *uint64 {
 	return rowsi.rs.recordCount
 }
 
-func newRows(recordType string, typemap skydb.RecordSchema, rows *sqlx.Rows, err error) (*skydb.Rows, error) {
+func newRows(recordType string, typemap skydb.RecordSchema, config scanConfig, rows *sqlx.Rows, err error) (*skydb.Rows, error) {
 	if err != nil {
 		return nil, err
 	}
-	rs := newRecordScanner(recordType, typemap, rows)
+	rs := newRecordScanner(recordType, typemap, config, rows)
 	return skydb.NewRows(rowsIter{rows, rs}), nil
 }
 
@@ -556,6 +2520,43 @@ func (db *database) selectQuery(q sq.SelectBuilder, recordType string, typemap s
 	return q
 }
 
+// distanceKey is the transient field holding the distance of a record
+// from the location of a geo query with IncludeDistance.
+const distanceKey = "_distance"
+
+// withDistance returns a copy of a geo query with IncludeDistance, in
+// which the distance is computed as distanceKey, and sorts by distanceKey
+// are replaced by sorts by the distance. Other queries are returned as is.
+func withDistance(query *skydb.Query) *skydb.Query {
+	if !query.IncludeDistance {
+		return query
+	}
+	distanceFunc, ok := query.Predicate.GeoDistanceFunc()
+	if !ok {
+		return query
+	}
+
+	q := *query
+	q.ComputedKeys = map[string]skydb.Expression{}
+	for key, value := range query.ComputedKeys {
+		q.ComputedKeys[key] = value
+	}
+	q.ComputedKeys[distanceKey] = skydb.Expression{
+		Type:  skydb.Function,
+		Value: distanceFunc,
+	}
+
+	q.Sorts = make([]skydb.Sort, len(query.Sorts))
+	for i, sort := range query.Sorts {
+		if sort.KeyPath == distanceKey {
+			sort.KeyPath = ""
+			sort.Func = distanceFunc
+		}
+		q.Sorts[i] = sort
+	}
+	return &q
+}
+
 func updateTypemapForQuery(query *skydb.Query, typemap skydb.RecordSchema) (skydb.RecordSchema, error) {
 	if query.DesiredKeys != nil {
 		newtypemap, err := whitelistedRecordSchema(typemap, query.DesiredKeys)
@@ -17,6 +17,9 @@ package pq
 import (
 	"database/sql"
 	"fmt"
+	"math"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -73,6 +76,50 @@ func TestGet(t *testing.T) {
 	})
 }
 
+func TestGetLenientDecoding(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"title":   skydb.FieldType{Type: skydb.TypeString},
+			"content": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		So(db.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("note", "id"),
+			OwnerID: "userid",
+			Data:    skydb.Data{"title": "Title", "content": "not a number"},
+		}), ShouldBeNil)
+
+		// make the content field undecodable by declaring it as a number
+		// in the cached schema
+		c.RecordSchema["note"]["content"] = skydb.FieldType{Type: skydb.TypeNumber}
+
+		Convey("fails to get a record with an undecodable field", func() {
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id"), &record), ShouldNotBeNil)
+		})
+
+		Convey("gets a partial record when decoded leniently", func() {
+			// the cached schema is of c, so c is configured instead of
+			// opening another Conn
+			c.config = skydb.Config{
+				LenientDecoding: map[string]bool{"note": true},
+			}
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id"), &record), ShouldBeNil)
+			So(record.ID, ShouldResemble, skydb.NewRecordID("note", "id"))
+			So(record.OwnerID, ShouldEqual, "userid")
+			So(record.Data, ShouldResemble, skydb.Data{"title": "Title"})
+			So(record.DroppedFields, ShouldResemble, []string{"content"})
+		})
+	})
+}
+
 func TestGetByIDs(t *testing.T) {
 	Convey("Database", t, func() {
 		c := getTestConn(t)
@@ -186,6 +233,52 @@ func TestGetByIDs(t *testing.T) {
 	})
 }
 
+func TestGetMap(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("getuser")
+		_, err := db.Extend("record", skydb.RecordSchema{
+			"string": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		for _, key := range []string{"id0", "id1"} {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("record", key),
+				OwnerID: "getuser",
+				Data:    map[string]interface{}{"string": key},
+			}), ShouldBeNil)
+		}
+
+		Convey("get present and absent records", func() {
+			records, missingKeys, err := db.GetMap("record", []string{"id2", "id1", "id3", "id0"})
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 2)
+			So(records["id0"].ID, ShouldResemble, skydb.NewRecordID("record", "id0"))
+			So(records["id0"].Data["string"], ShouldEqual, "id0")
+			So(records["id1"].ID, ShouldResemble, skydb.NewRecordID("record", "id1"))
+			So(records["id1"].Data["string"], ShouldEqual, "id1")
+			So(missingKeys, ShouldResemble, []string{"id2", "id3"})
+		})
+
+		Convey("get records of type not yet created", func() {
+			records, missingKeys, err := db.GetMap("notexist", []string{"id0"})
+			So(err, ShouldBeNil)
+			So(records, ShouldBeEmpty)
+			So(missingKeys, ShouldResemble, []string{"id0"})
+		})
+
+		Convey("get no records", func() {
+			records, missingKeys, err := db.GetMap("record", []string{})
+			So(err, ShouldBeNil)
+			So(records, ShouldBeEmpty)
+			So(missingKeys, ShouldBeEmpty)
+		})
+	})
+}
+
 func TestSave(t *testing.T) {
 	var c *conn
 	Convey("Database", t, func() {
@@ -252,6 +345,106 @@ func TestSave(t *testing.T) {
 			So(content, ShouldEqual, "more content")
 		})
 
+		Convey("distinguishes null fields from absent fields", func() {
+			record.Data = map[string]interface{}{
+				"content": nil,
+			}
+			So(db.Save(&record), ShouldBeNil)
+			So(record.Data, ShouldResemble, skydb.Data{
+				"content": nil,
+			})
+
+			fetched := skydb.Record{}
+			So(db.Get(record.ID, &fetched), ShouldBeNil)
+			So(fetched.Data, ShouldResemble, skydb.Data{
+				"content": nil,
+			})
+
+			records, err := exhaustRows(db.Query(&skydb.Query{Type: "note"}))
+			So(err, ShouldBeNil)
+			So(records, ShouldHaveLength, 1)
+			So(records[0].Data, ShouldResemble, skydb.Data{
+				"content": nil,
+			})
+
+			Convey("keeping null fields not saved again", func() {
+				record.Data = map[string]interface{}{
+					"number": float64(1),
+				}
+				So(db.Save(&record), ShouldBeNil)
+
+				fetched := skydb.Record{}
+				So(db.Get(record.ID, &fetched), ShouldBeNil)
+				So(fetched.Data, ShouldResemble, skydb.Data{
+					"content": nil,
+					"number":  float64(1),
+				})
+			})
+
+			Convey("forgetting null fields saved with values", func() {
+				record.Data = map[string]interface{}{
+					"content": "some content",
+				}
+				So(db.Save(&record), ShouldBeNil)
+
+				fetched := skydb.Record{}
+				So(db.Get(record.ID, &fetched), ShouldBeNil)
+				So(fetched.Data, ShouldResemble, skydb.Data{
+					"content": "some content",
+				})
+			})
+
+			Convey("remembering null fields updated by query", func() {
+				n, err := db.UpdateByQuery(&skydb.Query{
+					Type:                "note",
+					BypassAccessControl: true,
+				}, map[string]interface{}{
+					"number": nil,
+				})
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 1)
+
+				fetched := skydb.Record{}
+				So(db.Get(record.ID, &fetched), ShouldBeNil)
+				So(fetched.Data, ShouldResemble, skydb.Data{
+					"content": nil,
+					"number":  nil,
+				})
+			})
+
+			Convey("forgetting null fields appended to", func() {
+				_, err := db.Extend("note", skydb.RecordSchema{
+					"tags": skydb.FieldType{Type: skydb.TypeJSON},
+				})
+				So(err, ShouldBeNil)
+				record.Data = map[string]interface{}{
+					"tags": nil,
+				}
+				So(db.Save(&record), ShouldBeNil)
+				So(db.ArrayAppend(record.ID, "tags", false, "tag"), ShouldBeNil)
+
+				fetched := skydb.Record{}
+				So(db.Get(record.ID, &fetched), ShouldBeNil)
+				So(fetched.Data, ShouldResemble, skydb.Data{
+					"content": nil,
+					"tags":    []interface{}{"tag"},
+				})
+			})
+		})
+
+		Convey("distinguishes null fields from absent fields of created records", func() {
+			record.Data = map[string]interface{}{
+				"content": nil,
+			}
+			So(db.Create(&record, skydb.FailOnCollision), ShouldBeNil)
+
+			fetched := skydb.Record{}
+			So(db.Get(record.ID, &fetched), ShouldBeNil)
+			So(fetched.Data, ShouldResemble, skydb.Data{
+				"content": nil,
+			})
+		})
+
 		Convey("error if saving with recordid already taken by other user", func() {
 			ownerDB := c.PrivateDB("ownerid")
 			err := ownerDB.Save(&record)
@@ -322,14 +515,12 @@ func TestSave(t *testing.T) {
 	})
 }
 
-func TestDelete(t *testing.T) {
-	var c *conn
+func TestSaveWithResult(t *testing.T) {
 	Convey("Database", t, func() {
-		c = getTestConn(t)
+		c := getTestConn(t)
 		defer cleanupConn(t, c)
 
 		db := c.PrivateDB("userid")
-
 		_, err := db.Extend("note", skydb.RecordSchema{
 			"content": skydb.FieldType{Type: skydb.TypeString},
 		})
@@ -337,177 +528,3302 @@ func TestDelete(t *testing.T) {
 
 		record := skydb.Record{
 			ID:      skydb.NewRecordID("note", "someid"),
-			OwnerID: "user_id",
+			OwnerID: "userid",
 			Data: map[string]interface{}{
-				"content": "some content",
+				"content": "old",
 			},
 		}
 
-		Convey("deletes existing record", func() {
-			err := db.Save(&record)
+		Convey("returns nil previous record on create", func() {
+			result, err := db.SaveWithResult(&record)
 			So(err, ShouldBeNil)
+			So(result.Record, ShouldEqual, &record)
+			So(result.Previous, ShouldBeNil)
+		})
 
-			err = db.Delete(skydb.NewRecordID("note", "someid"))
-			So(err, ShouldBeNil)
+		Convey("returns previous record on update", func() {
+			So(db.Save(&record), ShouldBeNil)
 
-			err = db.(*database).c.QueryRowx("SELECT * FROM note WHERE _id = 'someid' AND _database_id = 'userid'").Scan((*string)(nil))
-			So(err, ShouldEqual, sql.ErrNoRows)
+			updated := skydb.Record{
+				ID:      skydb.NewRecordID("note", "someid"),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"content": "new",
+				},
+			}
+			result, err := db.SaveWithResult(&updated)
+			So(err, ShouldBeNil)
+			So(result.Record.Data["content"], ShouldEqual, "new")
+			So(result.Previous, ShouldNotBeNil)
+			So(result.Previous.Data["content"], ShouldEqual, "old")
 		})
 
-		Convey("returns ErrRecordNotFound when record to delete doesn't exist", func() {
-			err := db.Delete(skydb.NewRecordID("note", "notexistid"))
-			So(err, ShouldEqual, skydb.ErrRecordNotFound)
+		Convey("commits the implicit transaction", func() {
+			_, err := db.SaveWithResult(&record)
+			So(err, ShouldBeNil)
+			So(c.tx, ShouldBeNil)
+
+			fetched := skydb.Record{}
+			So(db.Get(record.ID, &fetched), ShouldBeNil)
+			So(fetched.Data["content"], ShouldEqual, "old")
 		})
 
-		Convey("return ErrRecordNotFound when deleting other user record", func() {
-			err := db.Save(&record)
+		Convey("reads and saves within the transaction of the Database", func() {
+			So(db.Save(&record), ShouldBeNil)
+
+			txDB := db.(skydb.TxDatabase)
+			So(txDB.Begin(), ShouldBeNil)
+			updated := skydb.Record{
+				ID:      skydb.NewRecordID("note", "someid"),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"content": "new",
+				},
+			}
+			result, err := db.SaveWithResult(&updated)
 			So(err, ShouldBeNil)
-			otherDB := c.PrivateDB("otheruserid")
-			err = otherDB.Delete(skydb.NewRecordID("note", "someid"))
-			So(err, ShouldEqual, skydb.ErrRecordNotFound)
+			So(result.Previous.Data["content"], ShouldEqual, "old")
+			So(c.tx, ShouldNotBeNil)
+			So(txDB.Rollback(), ShouldBeNil)
+
+			fetched := skydb.Record{}
+			So(db.Get(record.ID, &fetched), ShouldBeNil)
+			So(fetched.Data["content"], ShouldEqual, "old")
 		})
 	})
 }
 
-func TestQuery(t *testing.T) {
+func TestValidateSave(t *testing.T) {
 	Convey("Database", t, func() {
 		c := getTestConn(t)
 		defer cleanupConn(t, c)
 
-		// fixture
-		record1 := skydb.Record{
-			ID:      skydb.NewRecordID("note", "id1"),
-			OwnerID: "user_id",
-			Data: map[string]interface{}{
-				"noteOrder": float64(1),
-				"content":   "Hello World",
-				"emotion":   nil,
-			},
-		}
-		record2 := skydb.Record{
-			ID:      skydb.NewRecordID("note", "id2"),
-			OwnerID: "user_id",
-			Data: map[string]interface{}{
-				"noteOrder": float64(2),
-				"content":   "Bye World",
-				"emotion":   nil,
-			},
-		}
-		record3 := skydb.Record{
-			ID:      skydb.NewRecordID("note", "id3"),
-			OwnerID: "user_id",
-			Data: map[string]interface{}{
-				"noteOrder": float64(3),
-				"content":   "Good Hello",
-				"emotion":   "happy",
-			},
-		}
-
 		db := c.PrivateDB("userid")
 		_, err := db.Extend("note", skydb.RecordSchema{
-			"noteOrder": skydb.FieldType{Type: skydb.TypeNumber},
-			"content":   skydb.FieldType{Type: skydb.TypeString},
-			"emotion":   skydb.FieldType{Type: skydb.TypeString},
+			"content": skydb.FieldType{Type: skydb.TypeString},
+			"number":  skydb.FieldType{Type: skydb.TypeNumber},
 		})
 		So(err, ShouldBeNil)
 
-		err = db.Save(&record2)
-		So(err, ShouldBeNil)
-		err = db.Save(&record1)
-		So(err, ShouldBeNil)
-		err = db.Save(&record3)
-		So(err, ShouldBeNil)
-
-		Convey("queries records", func() {
-			query := skydb.Query{
-				Type: "note",
-			}
-			records, err := exhaustRows(db.Query(&query))
+		record := skydb.Record{
+			ID:      skydb.NewRecordID("note", "someid"),
+			OwnerID: "userid",
+			Data: map[string]interface{}{
+				"content": "old",
+				"number":  float64(1),
+			},
+		}
 
+		Convey("previews create without saving", func() {
+			preview, err := db.ValidateSave(&record)
 			So(err, ShouldBeNil)
-			So(records[0], ShouldResemble, record2)
-			So(records[1], ShouldResemble, record1)
-			So(records[2], ShouldResemble, record3)
-			So(len(records), ShouldEqual, 3)
+			So(preview.Previous, ShouldBeNil)
+			So(preview.Record.ID, ShouldResemble, record.ID)
+			So(preview.Record.Data, ShouldResemble, skydb.Data{
+				"content": "old",
+				"number":  float64(1),
+			})
+			So(preview.ChangedKeys, ShouldResemble, []string{"content", "number"})
+
+			So(db.Get(record.ID, &skydb.Record{}), ShouldEqual, skydb.ErrRecordNotFound)
 		})
 
-		Convey("sorts queried records ascendingly", func() {
-			query := skydb.Query{
-				Type: "note",
-				Sorts: []skydb.Sort{
-					skydb.Sort{
-						KeyPath: "noteOrder",
-						Order:   skydb.Ascending,
-					},
+		Convey("previews update without saving", func() {
+			So(db.Save(&record), ShouldBeNil)
+
+			updated := skydb.Record{
+				ID:      skydb.NewRecordID("note", "someid"),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"content": "new",
 				},
 			}
-			records, err := exhaustRows(db.Query(&query))
-
+			preview, err := db.ValidateSave(&updated)
 			So(err, ShouldBeNil)
-			So(records, ShouldResemble, []skydb.Record{
-				record1,
-				record2,
-				record3,
+			So(preview.Previous, ShouldNotBeNil)
+			So(preview.Previous.Data["content"], ShouldEqual, "old")
+			So(preview.Record.Data, ShouldResemble, skydb.Data{
+				"content": "new",
+				"number":  float64(1),
 			})
+			So(preview.ChangedKeys, ShouldResemble, []string{"content"})
+			So(updated.Data, ShouldResemble, map[string]interface{}{
+				"content": "new",
+			})
+
+			fetched := skydb.Record{}
+			So(db.Get(record.ID, &fetched), ShouldBeNil)
+			So(fetched.Data["content"], ShouldEqual, "old")
 		})
 
-		Convey("sorts queried records descendingly", func() {
-			query := skydb.Query{
-				Type: "note",
-				Sorts: []skydb.Sort{
-					skydb.Sort{
-						KeyPath: "noteOrder",
-						Order:   skydb.Descending,
-					},
+		Convey("returns error Save would return", func() {
+			_, err := db.ValidateSave(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "someid"),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"unknown": "value",
 				},
-			}
-			records, err := exhaustRows(db.Query(&query))
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("rolls back within transaction", func() {
+			So(c.Begin(), ShouldBeNil)
+			defer c.Rollback()
+
+			_, err := db.ValidateSave(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "someid"),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"unknown": "value",
+				},
+			})
+			So(err, ShouldNotBeNil)
 
+			_, err = db.ValidateSave(&record)
 			So(err, ShouldBeNil)
-			So(records, ShouldResemble, []skydb.Record{
-				record3,
-				record2,
-				record1,
+			So(db.Get(record.ID, &skydb.Record{}), ShouldEqual, skydb.ErrRecordNotFound)
+		})
+
+		Convey("returns error for value of another type", func() {
+			_, err := db.ValidateSave(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "someid"),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"number": "not a number",
+				},
 			})
+			So(err, ShouldNotBeNil)
 		})
 
-		Convey("query records by note order", func() {
-			query := skydb.Query{
-				Type: "note",
-				Predicate: skydb.Predicate{
-					Operator: skydb.Equal,
-					Children: []interface{}{
-						skydb.Expression{
-							Type:  skydb.KeyPath,
-							Value: "noteOrder",
-						},
-						skydb.Expression{
-							Type:  skydb.Literal,
-							Value: 1,
-						},
-					},
+		Convey("returns ErrUniqueConstraintViolation for duplicated value", func() {
+			So(db.AddUniqueConstraint("note", "content"), ShouldBeNil)
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "otherid"),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"content": "old",
 				},
-			}
-			records, err := exhaustRows(db.Query(&query))
+			}), ShouldBeNil)
+
+			_, err := db.ValidateSave(&record)
+			So(err, ShouldEqual, skydb.ErrUniqueConstraintViolation)
 
+			other := skydb.Record{
+				ID:      skydb.NewRecordID("note", "otherid"),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"content": "old",
+				},
+			}
+			_, err = db.ValidateSave(&other)
 			So(err, ShouldBeNil)
-			So(records[0], ShouldResemble, record1)
-			So(len(records), ShouldEqual, 1)
 		})
 
-		Convey("query records by content matching", func() {
-			query := skydb.Query{
+		Convey("returns ErrEnumConstraintViolation for value not in enum", func() {
+			So(db.AddEnumConstraint("note", "content", []interface{}{"old", "new"}), ShouldBeNil)
+
+			_, err := db.ValidateSave(&record)
+			So(err, ShouldBeNil)
+
+			_, err = db.ValidateSave(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "someid"),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"content": "unknown",
+				},
+			})
+			So(err, ShouldEqual, skydb.ErrEnumConstraintViolation)
+		})
+
+		Convey("does not advance sequence", func() {
+			_, err := db.Extend("note", skydb.RecordSchema{
+				"seq": skydb.FieldType{Type: skydb.TypeSequence},
+			})
+			So(err, ShouldBeNil)
+
+			_, err = db.ValidateSave(&record)
+			So(err, ShouldBeNil)
+
+			So(db.Save(&record), ShouldBeNil)
+			So(record.Data["seq"], ShouldEqual, int64(1))
+		})
+	})
+}
+
+func TestUpsertAll(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		_, err := db.Extend("contact", skydb.RecordSchema{
+			"externalId": skydb.FieldType{Type: skydb.TypeString},
+			"name":       skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+		So(db.AddUniqueConstraint("contact", "externalId"), ShouldBeNil)
+
+		So(db.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("contact", "existing"),
+			OwnerID: "userid",
+			Data:    skydb.Data{"externalId": "ext-1", "name": "Old"},
+		}), ShouldBeNil)
+
+		newContact := func(externalID, name string) *skydb.Record {
+			return &skydb.Record{
+				ID:      skydb.NewRecordID("contact", ""),
+				OwnerID: "userid",
+				Data:    skydb.Data{"externalId": externalID, "name": name},
+			}
+		}
+
+		Convey("creates and updates records by the match key", func() {
+			result, err := db.UpsertAll([]*skydb.Record{
+				newContact("ext-1", "Updated"),
+				newContact("ext-2", "Created"),
+			}, "externalId")
+			So(err, ShouldBeNil)
+			So(len(result.Results), ShouldEqual, 2)
+
+			So(result.Results[0].Status, ShouldEqual, skydb.UpsertUpdated)
+			So(result.Results[0].Record.ID.Key, ShouldEqual, "existing")
+			So(result.Results[1].Status, ShouldEqual, skydb.UpsertCreated)
+			So(result.Results[1].Record.ID.Key, ShouldNotBeEmpty)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("contact", "existing"), &record), ShouldBeNil)
+			So(record.Data["name"], ShouldEqual, "Updated")
+
+			So(db.Get(result.Results[1].Record.ID, &record), ShouldBeNil)
+			So(record.Data["name"], ShouldEqual, "Created")
+		})
+
+		Convey("updates a record created earlier in the batch", func() {
+			result, err := db.UpsertAll([]*skydb.Record{
+				newContact("ext-2", "First"),
+				newContact("ext-2", "Second"),
+			}, "externalId")
+			So(err, ShouldBeNil)
+			So(result.Results[0].Status, ShouldEqual, skydb.UpsertCreated)
+			So(result.Results[1].Status, ShouldEqual, skydb.UpsertUpdated)
+			So(result.Results[1].Record.ID, ShouldResemble, result.Results[0].Record.ID)
+		})
+
+		Convey("reports failed records without affecting others", func() {
+			result, err := db.UpsertAll([]*skydb.Record{
+				{
+					ID:      skydb.NewRecordID("contact", ""),
+					OwnerID: "userid",
+					Data:    skydb.Data{"name": "No external ID"},
+				},
+				newContact("ext-3", "Created"),
+			}, "externalId")
+			So(err, ShouldBeNil)
+			So(result.Results[0].Status, ShouldEqual, skydb.UpsertFailed)
+			So(result.Results[0].Err, ShouldNotBeNil)
+			So(result.Results[1].Status, ShouldEqual, skydb.UpsertCreated)
+
+			record := skydb.Record{}
+			So(db.Get(result.Results[1].Record.ID, &record), ShouldBeNil)
+		})
+
+		Convey("returns error without unique constraint", func() {
+			_, err := db.UpsertAll([]*skydb.Record{
+				newContact("ext-2", "Created"),
+			}, "name")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCreate(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		newNote := func(content string) *skydb.Record {
+			return &skydb.Record{
+				ID:      skydb.NewRecordID("note", "hello-world"),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"content": content,
+				},
+			}
+		}
+
+		So(db.Create(newNote("first"), skydb.FailOnCollision), ShouldBeNil)
+
+		Convey("fails on collision by default", func() {
+			record := newNote("second")
+			So(db.Create(record, skydb.FailOnCollision), ShouldEqual, skydb.ErrRecordDuplicated)
+
+			existing := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "hello-world"), &existing), ShouldBeNil)
+			So(existing.Data["content"], ShouldEqual, "first")
+		})
+
+		Convey("appends suffix on collision", func() {
+			record := newNote("second")
+			So(db.Create(record, skydb.SuffixOnCollision), ShouldBeNil)
+			So(record.ID.Key, ShouldEqual, "hello-world-2")
+
+			record = newNote("third")
+			So(db.Create(record, skydb.SuffixOnCollision), ShouldBeNil)
+			So(record.ID.Key, ShouldEqual, "hello-world-3")
+		})
+
+		Convey("creates unique keys concurrently", func() {
+			const n = 10
+			keys := make(chan string, n)
+			errs := make(chan error, n)
+
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					record := newNote(fmt.Sprintf("concurrent %d", i))
+					if err := db.Create(record, skydb.SuffixOnCollision); err != nil {
+						errs <- err
+						return
+					}
+					keys <- record.ID.Key
+				}(i)
+			}
+			wg.Wait()
+			close(keys)
+			close(errs)
+
+			So(errs, ShouldBeEmpty)
+			uniqueKeys := map[string]bool{}
+			for key := range keys {
+				So(uniqueKeys[key], ShouldBeFalse)
+				uniqueKeys[key] = true
+			}
+			So(len(uniqueKeys), ShouldEqual, n)
+			So(uniqueKeys["hello-world"], ShouldBeFalse)
+		})
+
+		Convey("errors on union database", func() {
+			So(c.UnionDB().Create(newNote("second"), skydb.FailOnCollision), ShouldEqual, skydb.ErrDatabaseIsReadOnly)
+		})
+	})
+}
+
+func TestDelete(t *testing.T) {
+	var c *conn
+	Convey("Database", t, func() {
+		c = getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		record := skydb.Record{
+			ID:      skydb.NewRecordID("note", "someid"),
+			OwnerID: "user_id",
+			Data: map[string]interface{}{
+				"content": "some content",
+			},
+		}
+
+		Convey("deletes existing record", func() {
+			err := db.Save(&record)
+			So(err, ShouldBeNil)
+
+			err = db.Delete(skydb.NewRecordID("note", "someid"))
+			So(err, ShouldBeNil)
+
+			err = db.(*database).c.QueryRowx("SELECT * FROM note WHERE _id = 'someid' AND _database_id = 'userid'").Scan((*string)(nil))
+			So(err, ShouldEqual, sql.ErrNoRows)
+		})
+
+		Convey("returns ErrRecordNotFound when record to delete doesn't exist", func() {
+			err := db.Delete(skydb.NewRecordID("note", "notexistid"))
+			So(err, ShouldEqual, skydb.ErrRecordNotFound)
+		})
+
+		Convey("return ErrRecordNotFound when deleting other user record", func() {
+			err := db.Save(&record)
+			So(err, ShouldBeNil)
+			otherDB := c.PrivateDB("otheruserid")
+			err = otherDB.Delete(skydb.NewRecordID("note", "someid"))
+			So(err, ShouldEqual, skydb.ErrRecordNotFound)
+		})
+	})
+}
+
+func TestSaveIfMatch(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		updatedAt := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+		record := skydb.Record{
+			ID:        skydb.NewRecordID("note", "someid"),
+			OwnerID:   "userid",
+			CreatedAt: updatedAt,
+			UpdatedAt: updatedAt,
+			Data: map[string]interface{}{
+				"content": "some content",
+			},
+		}
+		So(db.Save(&record), ShouldBeNil)
+
+		record.UpdatedAt = updatedAt.Add(time.Second)
+		record.Data["content"] = "new content"
+
+		Convey("saves record updated at the expected time", func() {
+			err := db.SaveIfMatch(&record, updatedAt)
+			So(err, ShouldBeNil)
+
+			saved := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "someid"), &saved), ShouldBeNil)
+			So(saved.Data["content"], ShouldEqual, "new content")
+		})
+
+		Convey("returns ErrRecordConflict for record updated at another time", func() {
+			err := db.SaveIfMatch(&record, updatedAt.Add(-time.Second))
+			So(err, ShouldEqual, skydb.ErrRecordConflict)
+
+			saved := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "someid"), &saved), ShouldBeNil)
+			So(saved.Data["content"], ShouldEqual, "some content")
+		})
+
+		Convey("returns ErrRecordNotFound when record to save doesn't exist", func() {
+			record.ID = skydb.NewRecordID("note", "notexistid")
+			err := db.SaveIfMatch(&record, updatedAt)
+			So(err, ShouldEqual, skydb.ErrRecordNotFound)
+		})
+	})
+}
+
+func TestDeleteIfMatch(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		updatedAt := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+		So(db.Save(&skydb.Record{
+			ID:        skydb.NewRecordID("note", "someid"),
+			OwnerID:   "userid",
+			CreatedAt: updatedAt,
+			UpdatedAt: updatedAt,
+			Data: map[string]interface{}{
+				"content": "some content",
+			},
+		}), ShouldBeNil)
+
+		Convey("deletes record updated at the expected time", func() {
+			err := db.DeleteIfMatch(skydb.NewRecordID("note", "someid"), updatedAt)
+			So(err, ShouldBeNil)
+
+			record := skydb.Record{}
+			err = db.Get(skydb.NewRecordID("note", "someid"), &record)
+			So(err, ShouldEqual, skydb.ErrRecordNotFound)
+		})
+
+		Convey("returns ErrRecordConflict for record updated at another time", func() {
+			err := db.DeleteIfMatch(skydb.NewRecordID("note", "someid"), updatedAt.Add(-time.Second))
+			So(err, ShouldEqual, skydb.ErrRecordConflict)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "someid"), &record), ShouldBeNil)
+			So(record.Data["content"], ShouldEqual, "some content")
+		})
+
+		Convey("returns ErrRecordNotFound when record to delete doesn't exist", func() {
+			err := db.DeleteIfMatch(skydb.NewRecordID("note", "notexistid"), updatedAt)
+			So(err, ShouldEqual, skydb.ErrRecordNotFound)
+		})
+
+		Convey("returns ErrRecordNotFound when record type doesn't exist", func() {
+			err := db.DeleteIfMatch(skydb.NewRecordID("unknown", "someid"), updatedAt)
+			So(err, ShouldEqual, skydb.ErrRecordNotFound)
+		})
+	})
+}
+
+func TestRenameField(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"title":   skydb.FieldType{Type: skydb.TypeString},
+			"content": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		So(db.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("note", "id1"),
+			OwnerID: "userid",
+			Data: map[string]interface{}{
+				"title":   "Hello",
+				"content": "Hello World",
+			},
+		}), ShouldBeNil)
+		So(db.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("note", "id2"),
+			OwnerID: "userid",
+			Data: map[string]interface{}{
+				"content": "Bye World",
+			},
+		}), ShouldBeNil)
+
+		otherDB := c.PrivateDB("otheruserid")
+		So(otherDB.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("note", "id3"),
+			OwnerID: "otheruserid",
+			Data: map[string]interface{}{
+				"title": "Other",
+			},
+		}), ShouldBeNil)
+
+		Convey("moves field to a new key", func() {
+			saved := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id1"), &saved), ShouldBeNil)
+			unmigrated := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id2"), &unmigrated), ShouldBeNil)
+
+			migrated, err := db.RenameField("note", "title", "subject")
+			So(err, ShouldBeNil)
+			So(migrated, ShouldEqual, 1)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id1"), &record), ShouldBeNil)
+			So(record.UpdatedAt.After(saved.UpdatedAt), ShouldBeTrue)
+			So(record.Data, ShouldResemble, map[string]interface{}{
+				"subject": "Hello",
+				"content": "Hello World",
+			})
+
+			So(db.Get(skydb.NewRecordID("note", "id2"), &record), ShouldBeNil)
+			So(record.Data, ShouldResemble, map[string]interface{}{
+				"content": "Bye World",
+			})
+			So(record.UpdatedAt, ShouldResemble, unmigrated.UpdatedAt)
+
+			So(otherDB.Get(skydb.NewRecordID("note", "id3"), &record), ShouldBeNil)
+			So(record.Data, ShouldResemble, map[string]interface{}{
+				"title": "Other",
+			})
+		})
+
+		Convey("moves field to an existing key", func() {
+			migrated, err := db.RenameField("note", "content", "title")
+			So(err, ShouldBeNil)
+			So(migrated, ShouldEqual, 2)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id2"), &record), ShouldBeNil)
+			So(record.Data, ShouldResemble, map[string]interface{}{
+				"title": "Bye World",
+			})
+		})
+
+		Convey("errors on unknown key", func() {
+			_, err := db.RenameField("note", "notexist", "subject")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("errors on reserved key", func() {
+			_, err := db.RenameField("note", "title", "_owner_id")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSwapRecords(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"title":   skydb.FieldType{Type: skydb.TypeString},
+			"content": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		So(db.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("note", "id1"),
+			OwnerID: "userid",
+			Data: map[string]interface{}{
+				"title":   "Hello",
+				"content": "Hello World",
+			},
+		}), ShouldBeNil)
+		So(db.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("note", "id2"),
+			OwnerID: "userid",
+			Data: map[string]interface{}{
+				"content": "Bye World",
+			},
+		}), ShouldBeNil)
+
+		Convey("swaps data of two records", func() {
+			err := db.SwapRecords(
+				skydb.NewRecordID("note", "id1"),
+				skydb.NewRecordID("note", "id2"))
+			So(err, ShouldBeNil)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id1"), &record), ShouldBeNil)
+			So(record.Data, ShouldResemble, map[string]interface{}{
+				"content": "Bye World",
+			})
+
+			record = skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id2"), &record), ShouldBeNil)
+			So(record.Data, ShouldResemble, map[string]interface{}{
+				"title":   "Hello",
+				"content": "Hello World",
+			})
+		})
+
+		Convey("swaps owners and ACLs of two records with their data", func() {
+			secretACL := skydb.RecordACL{
+				skydb.NewRecordACLEntryRole("admin", skydb.ReadLevel),
+			}
+			publicACL := skydb.RecordACL{
+				skydb.NewRecordACLEntryPublic(skydb.ReadLevel),
+			}
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "secret"),
+				OwnerID: "adminid",
+				ACL:     secretACL,
+				Data: map[string]interface{}{
+					"content": "Secret",
+				},
+			}), ShouldBeNil)
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "public"),
+				OwnerID: "userid",
+				ACL:     publicACL,
+				Data: map[string]interface{}{
+					"content": "Public",
+				},
+			}), ShouldBeNil)
+
+			err := db.SwapRecords(
+				skydb.NewRecordID("note", "secret"),
+				skydb.NewRecordID("note", "public"))
+			So(err, ShouldBeNil)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "public"), &record), ShouldBeNil)
+			So(record.Data, ShouldResemble, map[string]interface{}{
+				"content": "Secret",
+			})
+			So(record.OwnerID, ShouldEqual, "adminid")
+			So(record.ACL, ShouldResemble, secretACL)
+
+			record = skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "secret"), &record), ShouldBeNil)
+			So(record.Data, ShouldResemble, map[string]interface{}{
+				"content": "Public",
+			})
+			So(record.OwnerID, ShouldEqual, "userid")
+			So(record.ACL, ShouldResemble, publicACL)
+		})
+
+		Convey("returns ErrRecordNotFound and modifies nothing if a record is missing", func() {
+			err := db.SwapRecords(
+				skydb.NewRecordID("note", "id1"),
+				skydb.NewRecordID("note", "notexist"))
+			So(err, ShouldEqual, skydb.ErrRecordNotFound)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id1"), &record), ShouldBeNil)
+			So(record.Data, ShouldResemble, map[string]interface{}{
+				"title":   "Hello",
+				"content": "Hello World",
+			})
+		})
+
+		Convey("does not swap records of another user", func() {
+			otherDB := c.PrivateDB("otheruserid")
+			err := otherDB.SwapRecords(
+				skydb.NewRecordID("note", "id1"),
+				skydb.NewRecordID("note", "id2"))
+			So(err, ShouldEqual, skydb.ErrRecordNotFound)
+		})
+
+		Convey("returns error on different record types", func() {
+			err := db.SwapRecords(
+				skydb.NewRecordID("note", "id1"),
+				skydb.NewRecordID("comment", "id2"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestRenameRecord(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("post", skydb.RecordSchema{
+			"title": skydb.FieldType{Type: skydb.TypeString},
+			"previous": skydb.FieldType{
+				Type:          skydb.TypeReference,
+				ReferenceType: "post",
+			},
+		})
+		So(err, ShouldBeNil)
+		_, err = db.Extend("comment", skydb.RecordSchema{
+			"post": skydb.FieldType{
+				Type:          skydb.TypeReference,
+				ReferenceType: "post",
+			},
+		})
+		So(err, ShouldBeNil)
+
+		save := func(db skydb.Database, id skydb.RecordID, ownerID string, data map[string]interface{}) {
+			So(db.Save(&skydb.Record{
+				ID:      id,
+				OwnerID: ownerID,
+				Data:    data,
+			}), ShouldBeNil)
+		}
+		save(db, skydb.NewRecordID("post", "tmp-1"), "userid", map[string]interface{}{
+			"title": "Hello World",
+		})
+		save(db, skydb.NewRecordID("post", "bye-world"), "userid", map[string]interface{}{
+			"title":    "Bye World",
+			"previous": skydb.NewReference("post", "tmp-1"),
+		})
+		save(db, skydb.NewRecordID("comment", "comment1"), "userid", map[string]interface{}{
+			"post": skydb.NewReference("post", "tmp-1"),
+		})
+		otherDB := c.PrivateDB("otheruserid")
+		save(otherDB, skydb.NewRecordID("comment", "comment2"), "otheruserid", map[string]interface{}{
+			"post": skydb.NewReference("post", "tmp-1"),
+		})
+
+		Convey("renames record and its referencing records", func() {
+			err := db.RenameRecord(skydb.NewRecordID("post", "tmp-1"), "hello-world")
+			So(err, ShouldBeNil)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("post", "tmp-1"), &record), ShouldEqual, skydb.ErrRecordNotFound)
+			So(db.Get(skydb.NewRecordID("post", "hello-world"), &record), ShouldBeNil)
+			So(record.Data["title"], ShouldEqual, "Hello World")
+
+			So(db.Get(skydb.NewRecordID("post", "bye-world"), &record), ShouldBeNil)
+			So(record.Data["previous"], ShouldResemble, skydb.NewReference("post", "hello-world"))
+
+			So(db.Get(skydb.NewRecordID("comment", "comment1"), &record), ShouldBeNil)
+			So(record.Data["post"], ShouldResemble, skydb.NewReference("post", "hello-world"))
+
+			So(otherDB.Get(skydb.NewRecordID("comment", "comment2"), &record), ShouldBeNil)
+			So(record.Data["post"], ShouldResemble, skydb.NewReference("post", "hello-world"))
+		})
+
+		Convey("returns ErrRecordDuplicated if new key exists", func() {
+			err := db.RenameRecord(skydb.NewRecordID("post", "tmp-1"), "bye-world")
+			So(err, ShouldEqual, skydb.ErrRecordDuplicated)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("comment", "comment1"), &record), ShouldBeNil)
+			So(record.Data["post"], ShouldResemble, skydb.NewReference("post", "tmp-1"))
+		})
+
+		Convey("returns ErrRecordNotFound if record is missing", func() {
+			err := db.RenameRecord(skydb.NewRecordID("post", "notexist"), "hello-world")
+			So(err, ShouldEqual, skydb.ErrRecordNotFound)
+		})
+
+		Convey("does not rename record of another user", func() {
+			err := otherDB.RenameRecord(skydb.NewRecordID("post", "tmp-1"), "hello-world")
+			So(err, ShouldEqual, skydb.ErrRecordNotFound)
+		})
+	})
+}
+
+func TestArrayAppendAndRemove(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"title": skydb.FieldType{Type: skydb.TypeString},
+			"tags":  skydb.FieldType{Type: skydb.TypeJSON},
+		})
+		So(err, ShouldBeNil)
+
+		id := skydb.NewRecordID("note", "id1")
+		So(db.Save(&skydb.Record{
+			ID:      id,
+			OwnerID: "userid",
+			Data: map[string]interface{}{
+				"title": "Hello",
+				"tags":  []interface{}{"a", "b"},
+			},
+		}), ShouldBeNil)
+
+		getField := func(field string) interface{} {
+			record := skydb.Record{}
+			So(db.Get(id, &record), ShouldBeNil)
+			return record.Data[field]
+		}
+
+		Convey("appends values to array", func() {
+			So(db.ArrayAppend(id, "tags", false, "b", "c"), ShouldBeNil)
+			So(getField("tags"), ShouldResemble, []interface{}{"a", "b", "b", "c"})
+		})
+
+		Convey("appends unique values to array", func() {
+			So(db.ArrayAppend(id, "tags", true, "b", "c"), ShouldBeNil)
+			So(getField("tags"), ShouldResemble, []interface{}{"a", "b", "c"})
+		})
+
+		Convey("appends to a new field", func() {
+			So(db.ArrayAppend(id, "comments", false, "comment1"), ShouldBeNil)
+			So(getField("comments"), ShouldResemble, []interface{}{"comment1"})
+		})
+
+		Convey("removes values from array", func() {
+			So(db.ArrayAppend(id, "tags", false, "a"), ShouldBeNil)
+			So(db.ArrayRemove(id, "tags", "a", "c"), ShouldBeNil)
+			So(getField("tags"), ShouldResemble, []interface{}{"b"})
+		})
+
+		Convey("returns ErrFieldNotArray on non-array field", func() {
+			So(db.ArrayAppend(id, "title", false, "a"), ShouldEqual, skydb.ErrFieldNotArray)
+			So(db.ArrayRemove(id, "title", "a"), ShouldEqual, skydb.ErrFieldNotArray)
+		})
+
+		Convey("returns ErrFieldNotArray on non-array value", func() {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "id2"),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"tags": map[string]interface{}{"a": "b"},
+				},
+			}), ShouldBeNil)
+			err := db.ArrayAppend(skydb.NewRecordID("note", "id2"), "tags", false, "a")
+			So(err, ShouldEqual, skydb.ErrFieldNotArray)
+		})
+
+		Convey("returns ErrRecordNotFound on missing record", func() {
+			err := db.ArrayAppend(skydb.NewRecordID("note", "notexist"), "tags", false, "a")
+			So(err, ShouldEqual, skydb.ErrRecordNotFound)
+		})
+
+		Convey("does not lose concurrent appends", func() {
+			const n = 10
+			errs := make(chan error, n)
+
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if err := db.ArrayAppend(id, "tags", false, fmt.Sprintf("tag%d", i)); err != nil {
+						errs <- err
+					}
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+
+			So(errs, ShouldBeEmpty)
+			So(len(getField("tags").([]interface{})), ShouldEqual, n+2)
+		})
+	})
+}
+
+func TestOperationObserver(t *testing.T) {
+	Convey("Conn opened with an Observer", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		operations := []string{}
+		errOperations := []string{}
+		observedConn, err := skydb.Open("pq", c.appName, "role", "", false, skydb.Config{
+			Observer: skydb.OperationObserverFunc(func(operation string, duration time.Duration, err error) {
+				operations = append(operations, operation)
+				if err != nil {
+					errOperations = append(errOperations, operation)
+				}
+			}),
+		})
+		So(err, ShouldBeNil)
+		defer observedConn.Close()
+
+		db := observedConn.PrivateDB("userid")
+		_, err = db.Extend("note", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+			"slug":    skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+		So(db.AddUniqueConstraint("note", "slug"), ShouldBeNil)
+
+		id := skydb.NewRecordID("note", "id1")
+		So(db.Save(&skydb.Record{
+			ID:      id,
+			OwnerID: "userid",
+			Data: map[string]interface{}{
+				"content": "Hello World",
+			},
+		}), ShouldBeNil)
+		So(db.Get(id, &skydb.Record{}), ShouldBeNil)
+		_, err = db.Query(&skydb.Query{Type: "note"})
+		So(err, ShouldBeNil)
+		_, err = db.UpsertAll([]*skydb.Record{{
+			ID:      skydb.NewRecordID("note", ""),
+			OwnerID: "userid",
+			Data:    skydb.Data{"slug": "hello-world"},
+		}}, "slug")
+		So(err, ShouldBeNil)
+		So(db.Delete(id), ShouldBeNil)
+		So(db.Get(id, &skydb.Record{}), ShouldEqual, skydb.ErrRecordNotFound)
+
+		So(operations, ShouldResemble, []string{"Extend", "AddUniqueConstraint", "Save", "Get", "Query", "UpsertAll", "Delete", "Get"})
+		So(errOperations, ShouldResemble, []string{"Get"})
+	})
+}
+
+func TestDeleteByQuery(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"category": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		for id, category := range map[string]string{
+			"id1": "spam",
+			"id2": "spam",
+			"id3": "important",
+		} {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", id),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"category": category,
+				},
+			}), ShouldBeNil)
+		}
+
+		otherDB := c.PrivateDB("otheruserid")
+		So(otherDB.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("note", "id4"),
+			OwnerID: "otheruserid",
+			Data: map[string]interface{}{
+				"category": "spam",
+			},
+		}), ShouldBeNil)
+
+		spamQuery := skydb.Query{
+			Type: "note",
+			Predicate: skydb.Predicate{
+				Operator: skydb.Equal,
+				Children: []interface{}{
+					skydb.Expression{Type: skydb.KeyPath, Value: "category"},
+					skydb.Expression{Type: skydb.Literal, Value: "spam"},
+				},
+			},
+		}
+
+		Convey("deletes matching records only", func() {
+			deleted, err := db.DeleteByQuery(&spamQuery)
+			So(err, ShouldBeNil)
+			So(deleted, ShouldEqual, 2)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id1"), &record), ShouldEqual, skydb.ErrRecordNotFound)
+			So(db.Get(skydb.NewRecordID("note", "id2"), &record), ShouldEqual, skydb.ErrRecordNotFound)
+			So(db.Get(skydb.NewRecordID("note", "id3"), &record), ShouldBeNil)
+			So(otherDB.Get(skydb.NewRecordID("note", "id4"), &record), ShouldBeNil)
+		})
+
+		Convey("deletes nothing when nothing matches", func() {
+			query := skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.Equal,
+					Children: []interface{}{
+						skydb.Expression{Type: skydb.KeyPath, Value: "category"},
+						skydb.Expression{Type: skydb.Literal, Value: "notexist"},
+					},
+				},
+			}
+			deleted, err := db.DeleteByQuery(&query)
+			So(err, ShouldBeNil)
+			So(deleted, ShouldEqual, 0)
+		})
+
+		Convey("returns zero for record type not yet created", func() {
+			deleted, err := db.DeleteByQuery(&skydb.Query{Type: "notexist"})
+			So(err, ShouldBeNil)
+			So(deleted, ShouldEqual, 0)
+		})
+
+		Convey("errors on union database", func() {
+			_, err := c.UnionDB().DeleteByQuery(&spamQuery)
+			So(err, ShouldEqual, skydb.ErrDatabaseIsReadOnly)
+		})
+	})
+}
+
+func TestApplyRetention(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		for _, recordType := range []string{"log", "event", "note"} {
+			_, err := db.Extend(recordType, skydb.RecordSchema{
+				"message": skydb.FieldType{Type: skydb.TypeString},
+			})
+			So(err, ShouldBeNil)
+		}
+
+		now := time.Now().UTC()
+		for _, recordType := range []string{"log", "event", "note"} {
+			for i := 0; i < 5; i++ {
+				So(db.Save(&skydb.Record{
+					ID:        skydb.NewRecordID(recordType, fmt.Sprintf("id%d", i)),
+					OwnerID:   "userid",
+					CreatedAt: now.Add(-time.Duration(i) * 24 * time.Hour),
+					Data: map[string]interface{}{
+						"message": "hello",
+					},
+				}), ShouldBeNil)
+			}
+		}
+
+		applyRetention := func(policies map[string]skydb.RetentionPolicy) (int, error) {
+			retaining := getTestConnWithConfig(t, c.appName, skydb.Config{
+				RetentionPolicies: policies,
+			})
+			defer retaining.Close()
+			return retaining.PublicDB().ApplyRetention()
+		}
+
+		remainingKeys := func(recordType string) []string {
+			keys, err := db.QueryKeys(&skydb.Query{
+				Type: recordType,
+				Sorts: []skydb.Sort{
+					{KeyPath: "_id", Order: skydb.Ascending},
+				},
+			})
+			So(err, ShouldBeNil)
+
+			remaining := []string{}
+			for _, key := range keys {
+				remaining = append(remaining, key.ID.Key)
+			}
+			return remaining
+		}
+
+		Convey("purges records by age", func() {
+			purged, err := applyRetention(map[string]skydb.RetentionPolicy{
+				"log": {MaxAge: 36 * time.Hour},
+			})
+			So(err, ShouldBeNil)
+			So(purged, ShouldEqual, 3)
+			So(remainingKeys("log"), ShouldResemble, []string{"id0", "id1"})
+			So(remainingKeys("note"), ShouldHaveLength, 5)
+		})
+
+		Convey("purges oldest records by count", func() {
+			purged, err := applyRetention(map[string]skydb.RetentionPolicy{
+				"event": {MaxCount: 3},
+			})
+			So(err, ShouldBeNil)
+			So(purged, ShouldEqual, 2)
+			So(remainingKeys("event"), ShouldResemble, []string{"id0", "id1", "id2"})
+			So(remainingKeys("note"), ShouldHaveLength, 5)
+		})
+
+		Convey("purges records by both age and count", func() {
+			purged, err := applyRetention(map[string]skydb.RetentionPolicy{
+				"log": {MaxAge: 84 * time.Hour, MaxCount: 2},
+			})
+			So(err, ShouldBeNil)
+			So(purged, ShouldEqual, 3)
+			So(remainingKeys("log"), ShouldResemble, []string{"id0", "id1"})
+		})
+
+		Convey("purges nothing without policies", func() {
+			purged, err := db.ApplyRetention()
+			So(err, ShouldBeNil)
+			So(purged, ShouldEqual, 0)
+		})
+
+		Convey("errors on union database", func() {
+			_, err := c.UnionDB().ApplyRetention()
+			So(err, ShouldEqual, skydb.ErrDatabaseIsReadOnly)
+		})
+	})
+}
+
+func TestUpdateByQuery(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"featured": skydb.FieldType{Type: skydb.TypeBoolean},
+			"expired":  skydb.FieldType{Type: skydb.TypeBoolean},
+			"slug":     skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+		So(db.AddUniqueConstraint("note", "slug"), ShouldBeNil)
+
+		for id, expired := range map[string]bool{
+			"id1": true,
+			"id2": true,
+			"id3": false,
+		} {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", id),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"featured": true,
+					"expired":  expired,
+				},
+			}), ShouldBeNil)
+		}
+
+		otherDB := c.PrivateDB("otheruserid")
+		So(otherDB.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("note", "id4"),
+			OwnerID: "otheruserid",
+			Data: map[string]interface{}{
+				"featured": true,
+				"expired":  true,
+			},
+		}), ShouldBeNil)
+
+		expiredQuery := skydb.Query{
+			Type: "note",
+			Predicate: skydb.Predicate{
+				Operator: skydb.Equal,
+				Children: []interface{}{
+					skydb.Expression{Type: skydb.KeyPath, Value: "expired"},
+					skydb.Expression{Type: skydb.Literal, Value: true},
+				},
+			},
+		}
+
+		Convey("patches matching records only", func() {
+			updated, err := db.UpdateByQuery(&expiredQuery, map[string]interface{}{
+				"featured": false,
+			})
+			So(err, ShouldBeNil)
+			So(updated, ShouldEqual, 2)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id1"), &record), ShouldBeNil)
+			So(record.Data["featured"], ShouldEqual, false)
+			So(db.Get(skydb.NewRecordID("note", "id2"), &record), ShouldBeNil)
+			So(record.Data["featured"], ShouldEqual, false)
+			So(db.Get(skydb.NewRecordID("note", "id3"), &record), ShouldBeNil)
+			So(record.Data["featured"], ShouldEqual, true)
+			So(otherDB.Get(skydb.NewRecordID("note", "id4"), &record), ShouldBeNil)
+			So(record.Data["featured"], ShouldEqual, true)
+		})
+
+		Convey("updates no records if any of them fails", func() {
+			_, err := db.UpdateByQuery(&expiredQuery, map[string]interface{}{
+				"featured": false,
+				"slug":     "expired",
+			})
+			So(err, ShouldNotBeNil)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id1"), &record), ShouldBeNil)
+			So(record.Data["featured"], ShouldEqual, true)
+			So(db.Get(skydb.NewRecordID("note", "id2"), &record), ShouldBeNil)
+			So(record.Data["featured"], ShouldEqual, true)
+		})
+
+		Convey("errors on unknown field", func() {
+			_, err := db.UpdateByQuery(&expiredQuery, map[string]interface{}{
+				"notexist": false,
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("errors on reserved key", func() {
+			_, err := db.UpdateByQuery(&expiredQuery, map[string]interface{}{
+				"_owner_id": "otheruserid",
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("errors on union database", func() {
+			_, err := c.UnionDB().UpdateByQuery(&expiredQuery, map[string]interface{}{
+				"featured": false,
+			})
+			So(err, ShouldEqual, skydb.ErrDatabaseIsReadOnly)
+		})
+	})
+}
+
+func TestQuerySortCollation(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"name":     skydb.FieldType{Type: skydb.TypeString},
+			"priority": skydb.FieldType{Type: skydb.TypeNumber},
+		})
+		So(err, ShouldBeNil)
+
+		for id, data := range map[string]map[string]interface{}{
+			"id1": {"name": "alpha", "priority": float64(1)},
+			"id2": {"name": "Beta", "priority": float64(1)},
+			"id3": {"name": "Beta", "priority": float64(2)},
+		} {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", id),
+				OwnerID: "userid",
+				Data:    data,
+			}), ShouldBeNil)
+		}
+
+		Convey("sorts by collated string key and numeric key", func() {
+			query := skydb.Query{
+				Type: "note",
+				Sorts: []skydb.Sort{
+					{
+						KeyPath:   "name",
+						Order:     skydb.Ascending,
+						Collation: "C",
+					},
+					{
+						KeyPath: "priority",
+						Order:   skydb.Descending,
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+			So(err, ShouldBeNil)
+
+			ids := []string{}
+			for _, record := range records {
+				ids = append(ids, record.ID.Key)
+			}
+			// Byte-wise order places uppercase letters before lowercase ones
+			So(ids, ShouldResemble, []string{"id3", "id2", "id1"})
+		})
+
+		Convey("errors on unknown collation", func() {
+			query := skydb.Query{
+				Type: "note",
+				Sorts: []skydb.Sort{
+					{
+						KeyPath:   "name",
+						Order:     skydb.Ascending,
+						Collation: "notexist",
+					},
+				},
+			}
+			_, err := exhaustRows(db.Query(&query))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestQuerySortMissingAs(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"priority": skydb.FieldType{Type: skydb.TypeNumber},
+		})
+		So(err, ShouldBeNil)
+
+		for id, data := range map[string]map[string]interface{}{
+			"id1": {"priority": float64(-1)},
+			"id2": {},
+			"id3": {"priority": float64(1)},
+			"id4": {"priority": nil},
+		} {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", id),
+				OwnerID: "userid",
+				Data:    data,
+			}), ShouldBeNil)
+		}
+
+		Convey("sorts records missing key as the substitute value", func() {
+			query := skydb.Query{
+				Type: "note",
+				Sorts: []skydb.Sort{
+					{
+						KeyPath:   "priority",
+						Order:     skydb.Descending,
+						MissingAs: 0,
+					},
+					{
+						KeyPath: "_id",
+						Order:   skydb.Ascending,
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+			So(err, ShouldBeNil)
+
+			ids := []string{}
+			for _, record := range records {
+				ids = append(ids, record.ID.Key)
+			}
+			So(ids, ShouldResemble, []string{"id3", "id2", "id4", "id1"})
+		})
+
+		Convey("errors on substitute value of unsupported type", func() {
+			query := skydb.Query{
+				Type: "note",
+				Sorts: []skydb.Sort{
+					{
+						KeyPath:   "priority",
+						Order:     skydb.Ascending,
+						MissingAs: []interface{}{},
+					},
+				},
+			}
+			_, err := exhaustRows(db.Query(&query))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestQueryArrayLength(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"items": skydb.FieldType{Type: skydb.TypeJSON},
+		})
+		So(err, ShouldBeNil)
+
+		for id, items := range map[string]interface{}{
+			"id1": []interface{}{},
+			"id2": []interface{}{"a", "b"},
+			"id3": []interface{}{"a", "b", "c", "d"},
+			"id4": map[string]interface{}{"a": "b"},
+		} {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", id),
+				OwnerID: "userid",
+				Data:    map[string]interface{}{"items": items},
+			}), ShouldBeNil)
+		}
+
+		queryIDs := func(predicate skydb.Predicate) []string {
+			records, err := exhaustRows(db.Query(&skydb.Query{
+				Type:      "note",
+				Predicate: predicate,
+				Sorts: []skydb.Sort{
+					{KeyPath: "_id", Order: skydb.Ascending},
+				},
+			}))
+			So(err, ShouldBeNil)
+
+			ids := []string{}
+			for _, record := range records {
+				ids = append(ids, record.ID.Key)
+			}
+			return ids
+		}
+
+		Convey("compares array length", func() {
+			ids := queryIDs(skydb.Predicate{
+				Operator: skydb.GreaterThan,
+				Children: []interface{}{
+					skydb.Expression{
+						Type:  skydb.Function,
+						Value: skydb.ArrayLengthFunc{Field: "items"},
+					},
+					skydb.Expression{Type: skydb.Literal, Value: 1},
+				},
+			})
+			So(ids, ShouldResemble, []string{"id2", "id3"})
+		})
+
+		Convey("does not match non-array field", func() {
+			ids := queryIDs(skydb.Predicate{
+				Operator: skydb.LessThan,
+				Children: []interface{}{
+					skydb.Expression{
+						Type:  skydb.Function,
+						Value: skydb.ArrayLengthFunc{Field: "items"},
+					},
+					skydb.Expression{Type: skydb.Literal, Value: 1},
+				},
+			})
+			So(ids, ShouldResemble, []string{"id1"})
+		})
+
+		Convey("treats non-array field as empty", func() {
+			ids := queryIDs(skydb.Predicate{
+				Operator: skydb.LessThan,
+				Children: []interface{}{
+					skydb.Expression{
+						Type: skydb.Function,
+						Value: skydb.ArrayLengthFunc{
+							Field:           "items",
+							NonArrayAsEmpty: true,
+						},
+					},
+					skydb.Expression{Type: skydb.Literal, Value: 1},
+				},
+			})
+			So(ids, ShouldResemble, []string{"id1", "id4"})
+		})
+	})
+}
+
+func TestQueryKeys(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"noteOrder": skydb.FieldType{Type: skydb.TypeNumber},
+		})
+		So(err, ShouldBeNil)
+
+		for i, id := range []string{"id2", "id1", "id3"} {
+			So(db.Save(&skydb.Record{
+				ID:        skydb.NewRecordID("note", id),
+				OwnerID:   "userid",
+				UpdatedAt: time.Date(2006, 1, 2, 15, 4, i, 0, time.UTC),
+				Data: map[string]interface{}{
+					"noteOrder": float64(i),
+				},
+			}), ShouldBeNil)
+		}
+
+		Convey("returns keys of matching records", func() {
+			keys, err := db.QueryKeys(&skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.GreaterThan,
+					Children: []interface{}{
+						skydb.Expression{Type: skydb.KeyPath, Value: "noteOrder"},
+						skydb.Expression{Type: skydb.Literal, Value: float64(0)},
+					},
+				},
+				Sorts: []skydb.Sort{
+					{KeyPath: "noteOrder", Order: skydb.Desc},
+				},
+			})
+			So(err, ShouldBeNil)
+			So(keys, ShouldHaveLength, 2)
+			So(keys[0].ID, ShouldResemble, skydb.NewRecordID("note", "id3"))
+			So(keys[1].ID, ShouldResemble, skydb.NewRecordID("note", "id1"))
+		})
+
+		Convey("returns update times of records", func() {
+			keys, err := db.QueryKeys(&skydb.Query{
+				Type: "note",
+				Sorts: []skydb.Sort{
+					{KeyPath: "noteOrder", Order: skydb.Asc},
+				},
+			})
+			So(err, ShouldBeNil)
+			So(keys, ShouldResemble, []skydb.RecordKey{
+				{
+					ID:        skydb.NewRecordID("note", "id2"),
+					UpdatedAt: time.Date(2006, 1, 2, 15, 4, 0, 0, time.UTC),
+				},
+				{
+					ID:        skydb.NewRecordID("note", "id1"),
+					UpdatedAt: time.Date(2006, 1, 2, 15, 4, 1, 0, time.UTC),
+				},
+				{
+					ID:        skydb.NewRecordID("note", "id3"),
+					UpdatedAt: time.Date(2006, 1, 2, 15, 4, 2, 0, time.UTC),
+				},
+			})
+		})
+
+		Convey("returns no keys for record type not yet created", func() {
+			keys, err := db.QueryKeys(&skydb.Query{Type: "notexist"})
+			So(err, ShouldBeNil)
+			So(keys, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestQueryEqualIgnoreCase(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("user", skydb.RecordSchema{
+			"username": skydb.FieldType{Type: skydb.TypeString},
+			"age":      skydb.FieldType{Type: skydb.TypeNumber},
+		})
+		So(err, ShouldBeNil)
+
+		for id, data := range map[string]map[string]interface{}{
+			"id1": {"username": "alice", "age": float64(20)},
+			"id2": {"username": "ALICE", "age": float64(30)},
+			"id3": {"username": "Émile", "age": float64(20)},
+			"id4": {"username": "bob", "age": float64(40)},
+		} {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("user", id),
+				OwnerID: "userid",
+				Data:    data,
+			}), ShouldBeNil)
+		}
+
+		queryKeys := func(keyPath string, value interface{}) []string {
+			records, err := exhaustRows(db.Query(&skydb.Query{
+				Type: "user",
+				Predicate: skydb.Predicate{
+					Operator: skydb.EqualIgnoreCase,
+					Children: []interface{}{
+						skydb.Expression{Type: skydb.KeyPath, Value: keyPath},
+						skydb.Expression{Type: skydb.Literal, Value: value},
+					},
+				},
+				Sorts: []skydb.Sort{
+					{KeyPath: "_id", Order: skydb.Ascending},
+				},
+			}))
+			So(err, ShouldBeNil)
+
+			keys := []string{}
+			for _, record := range records {
+				keys = append(keys, record.ID.Key)
+			}
+			return keys
+		}
+
+		Convey("matches string field across case variants", func() {
+			So(queryKeys("username", "Alice"), ShouldResemble, []string{"id1", "id2"})
+			So(queryKeys("username", "émile"), ShouldResemble, []string{"id3"})
+		})
+
+		Convey("compares non-string field with normal equality", func() {
+			So(queryKeys("age", 20), ShouldResemble, []string{"id1", "id3"})
+		})
+	})
+}
+
+func TestQueryAnyMatch(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("order", skydb.RecordSchema{
+			"items": skydb.FieldType{Type: skydb.TypeJSON},
+		})
+		So(err, ShouldBeNil)
+
+		for id, items := range map[string]interface{}{
+			"id1": []interface{}{
+				map[string]interface{}{"name": "apple", "quantity": float64(1)},
+				map[string]interface{}{"name": "pear", "quantity": float64(5)},
+			},
+			"id2": []interface{}{
+				map[string]interface{}{"name": "apple", "quantity": float64(3)},
+			},
+			"id3": []interface{}{},
+			"id4": map[string]interface{}{"name": "apple", "quantity": float64(3)},
+			"id5": nil,
+		} {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("order", id),
+				OwnerID: "userid",
+				Data:    map[string]interface{}{"items": items},
+			}), ShouldBeNil)
+		}
+
+		binaryPred := func(op skydb.Operator, keyPath string, value interface{}) skydb.Predicate {
+			return skydb.Predicate{
+				Operator: op,
+				Children: []interface{}{
+					skydb.Expression{Type: skydb.KeyPath, Value: keyPath},
+					skydb.Expression{Type: skydb.Literal, Value: value},
+				},
+			}
+		}
+
+		queryKeys := func(elementPredicate skydb.Predicate) []string {
+			records, err := exhaustRows(db.Query(&skydb.Query{
+				Type: "order",
+				Predicate: skydb.Predicate{
+					Operator: skydb.AnyMatch,
+					Children: []interface{}{
+						skydb.Expression{Type: skydb.KeyPath, Value: "items"},
+						elementPredicate,
+					},
+				},
+				Sorts: []skydb.Sort{
+					{KeyPath: "_id", Order: skydb.Ascending},
+				},
+			}))
+			So(err, ShouldBeNil)
+
+			keys := []string{}
+			for _, record := range records {
+				keys = append(keys, record.ID.Key)
+			}
+			return keys
+		}
+
+		Convey("matches records with an element satisfying the predicate", func() {
+			So(queryKeys(binaryPred(skydb.Equal, "name", "apple")), ShouldResemble, []string{"id1", "id2"})
+			So(queryKeys(binaryPred(skydb.GreaterThan, "quantity", 4)), ShouldResemble, []string{"id1"})
+		})
+
+		Convey("requires a single element to satisfy all conditions", func() {
+			So(queryKeys(skydb.Predicate{
+				Operator: skydb.And,
+				Children: []interface{}{
+					binaryPred(skydb.Equal, "name", "apple"),
+					binaryPred(skydb.GreaterThan, "quantity", 2),
+				},
+			}), ShouldResemble, []string{"id2"})
+		})
+
+		Convey("does not match elements of other types", func() {
+			So(queryKeys(binaryPred(skydb.GreaterThan, "name", 0)), ShouldBeEmpty)
+			So(queryKeys(binaryPred(skydb.Equal, "name", "banana")), ShouldBeEmpty)
+		})
+	})
+}
+
+func TestQueryNullAndAbsent(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+			"number":  skydb.FieldType{Type: skydb.TypeNumber},
+		})
+		So(err, ShouldBeNil)
+
+		for id, data := range map[string]map[string]interface{}{
+			"null":   {"content": nil, "number": float64(1)},
+			"absent": {"number": float64(2)},
+			"value":  {"content": "some content", "number": float64(3)},
+		} {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", id),
+				OwnerID: "userid",
+				Data:    data,
+			}), ShouldBeNil)
+		}
+
+		queryKeys := func(op skydb.Operator) []string {
+			records, err := exhaustRows(db.Query(&skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: op,
+					Children: []interface{}{
+						skydb.Expression{Type: skydb.KeyPath, Value: "content"},
+					},
+				},
+				Sorts: []skydb.Sort{
+					{KeyPath: "_id", Order: skydb.Ascending},
+				},
+			}))
+			So(err, ShouldBeNil)
+
+			keys := []string{}
+			for _, record := range records {
+				keys = append(keys, record.ID.Key)
+			}
+			return keys
+		}
+
+		Convey("matches records with fields saved as null", func() {
+			So(queryKeys(skydb.IsNull), ShouldResemble, []string{"null"})
+		})
+
+		Convey("matches records with fields never saved", func() {
+			So(queryKeys(skydb.IsAbsent), ShouldResemble, []string{"absent"})
+		})
+
+		Convey("matches records with fields saved as null later", func() {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "value"),
+				OwnerID: "userid",
+				Data:    map[string]interface{}{"content": nil},
+			}), ShouldBeNil)
+			So(queryKeys(skydb.IsNull), ShouldResemble, []string{"null", "value"})
+			So(queryKeys(skydb.IsAbsent), ShouldResemble, []string{"absent"})
+		})
+
+		Convey("does not match records with fields saved with values later", func() {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "null"),
+				OwnerID: "userid",
+				Data:    map[string]interface{}{"content": "some content"},
+			}), ShouldBeNil)
+			So(queryKeys(skydb.IsNull), ShouldBeEmpty)
+			So(queryKeys(skydb.IsAbsent), ShouldResemble, []string{"absent"})
+		})
+	})
+}
+
+func TestQueryReferenceType(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		for _, recordType := range []string{"project", "milestone"} {
+			_, err := db.Extend(recordType, skydb.RecordSchema{
+				"name": skydb.FieldType{Type: skydb.TypeString},
+			})
+			So(err, ShouldBeNil)
+		}
+		_, err := db.Extend("task", skydb.RecordSchema{
+			"project": skydb.FieldType{
+				Type:          skydb.TypeReference,
+				ReferenceType: "project",
+			},
+			"milestone": skydb.FieldType{
+				Type:          skydb.TypeReference,
+				ReferenceType: "milestone",
+			},
+		})
+		So(err, ShouldBeNil)
+
+		save := func(id skydb.RecordID, data map[string]interface{}) {
+			So(db.Save(&skydb.Record{
+				ID:      id,
+				OwnerID: "userid",
+				Data:    data,
+			}), ShouldBeNil)
+		}
+		save(skydb.NewRecordID("project", "project1"), map[string]interface{}{})
+		save(skydb.NewRecordID("project", "project2"), map[string]interface{}{})
+		save(skydb.NewRecordID("milestone", "milestone1"), map[string]interface{}{})
+		save(skydb.NewRecordID("task", "task1"), map[string]interface{}{
+			"project": skydb.NewReference("project", "project1"),
+		})
+		save(skydb.NewRecordID("task", "task2"), map[string]interface{}{
+			"project": skydb.NewReference("project", "project2"),
+		})
+		save(skydb.NewRecordID("task", "task3"), map[string]interface{}{
+			"milestone": skydb.NewReference("milestone", "milestone1"),
+		})
+
+		queryKeys := func(field string, recordType string) []string {
+			records, err := exhaustRows(db.Query(&skydb.Query{
+				Type: "task",
+				Predicate: skydb.Predicate{
+					Operator: skydb.Functional,
+					Children: []interface{}{
+						skydb.Expression{
+							Type: skydb.Function,
+							Value: skydb.ReferenceTypeFunc{
+								Field: field,
+								Type:  recordType,
+							},
+						},
+					},
+				},
+				Sorts: []skydb.Sort{
+					{KeyPath: "_id", Order: skydb.Ascending},
+				},
+			}))
+			So(err, ShouldBeNil)
+
+			keys := []string{}
+			for _, record := range records {
+				keys = append(keys, record.ID.Key)
+			}
+			return keys
+		}
+
+		Convey("matches records referencing any record of the type", func() {
+			So(queryKeys("project", "project"), ShouldResemble, []string{"task1", "task2"})
+			So(queryKeys("milestone", "milestone"), ShouldResemble, []string{"task3"})
+		})
+
+		Convey("matches no records if the field references another type", func() {
+			So(queryKeys("project", "milestone"), ShouldBeEmpty)
+		})
+
+		Convey("matches no records if the field does not exist", func() {
+			So(queryKeys("notexist", "project"), ShouldBeEmpty)
+		})
+	})
+}
+
+func TestQueryOwnerPredicate(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		save := func(key string, ownerID string, acl skydb.RecordACL) {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", key),
+				OwnerID: ownerID,
+				ACL:     acl,
+			}), ShouldBeNil)
+		}
+		private := func(ownerID string) skydb.RecordACL {
+			return skydb.NewRecordACL([]skydb.RecordACLEntry{
+				skydb.NewRecordACLEntryDirect(ownerID, skydb.WriteLevel),
+			})
+		}
+		save("alice1", "alice", private("alice"))
+		save("alice2", "alice", private("alice"))
+		save("bob1", "bob", private("bob"))
+		save("carol1", "carol", private("carol"))
+		save("dave1", "dave", skydb.NewRecordACL([]skydb.RecordACLEntry{
+			skydb.NewRecordACLEntryPublic(skydb.ReadLevel),
+		}))
+		save("erin1", "erin", nil)
+
+		queryKeys := func(ownerIDs []string, includePublic bool) []string {
+			records, err := exhaustRows(db.Query(&skydb.Query{
+				Type:      "note",
+				Predicate: skydb.NewOwnerPredicate(ownerIDs, includePublic),
+				Sorts: []skydb.Sort{
+					{KeyPath: "_id", Order: skydb.Ascending},
+				},
+			}))
+			So(err, ShouldBeNil)
+
+			keys := []string{}
+			for _, record := range records {
+				keys = append(keys, record.ID.Key)
+			}
+			return keys
+		}
+
+		Convey("matches records owned by any of the owners", func() {
+			So(queryKeys([]string{"alice", "bob"}, false), ShouldResemble,
+				[]string{"alice1", "alice2", "bob1"})
+		})
+
+		Convey("matches records owned by any of the owners or public", func() {
+			So(queryKeys([]string{"alice", "carol"}, true), ShouldResemble,
+				[]string{"alice1", "alice2", "carol1", "dave1", "erin1"})
+		})
+
+		Convey("matches public records only without owners", func() {
+			So(queryKeys(nil, true), ShouldResemble, []string{"dave1", "erin1"})
+		})
+
+		Convey("does not treat records without ACL as public under default ACL", func() {
+			So(db.SetDefaultACL(skydb.NewRecordACL([]skydb.RecordACLEntry{
+				skydb.NewRecordACLEntryRole("admin", skydb.ReadLevel),
+			})), ShouldBeNil)
+			defer db.SetDefaultACL(nil)
+
+			So(queryKeys([]string{"bob"}, true), ShouldResemble, []string{"bob1", "dave1"})
+		})
+	})
+}
+
+func TestFindReferencing(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("post", skydb.RecordSchema{
+			"title": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+		_, err = db.Extend("comment", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+			"post": skydb.FieldType{
+				Type:          skydb.TypeReference,
+				ReferenceType: "post",
+			},
+		})
+		So(err, ShouldBeNil)
+		_, err = db.Extend("like", skydb.RecordSchema{
+			"post": skydb.FieldType{
+				Type:          skydb.TypeReference,
+				ReferenceType: "post",
+			},
+		})
+		So(err, ShouldBeNil)
+
+		save := func(id skydb.RecordID, data map[string]interface{}) {
+			So(db.Save(&skydb.Record{
+				ID:      id,
+				OwnerID: "userid",
+				Data:    data,
+			}), ShouldBeNil)
+		}
+		save(skydb.NewRecordID("post", "post1"), map[string]interface{}{"title": "Post 1"})
+		save(skydb.NewRecordID("post", "post2"), map[string]interface{}{"title": "Post 2"})
+		save(skydb.NewRecordID("comment", "comment1"), map[string]interface{}{
+			"post": skydb.NewReference("post", "post1"),
+		})
+		save(skydb.NewRecordID("comment", "comment2"), map[string]interface{}{
+			"post": skydb.NewReference("post", "post1"),
+		})
+		save(skydb.NewRecordID("comment", "comment3"), map[string]interface{}{
+			"post": skydb.NewReference("post", "post2"),
+		})
+		save(skydb.NewRecordID("like", "like1"), map[string]interface{}{
+			"post": skydb.NewReference("post", "post1"),
+		})
+
+		findReferencing := func(targetID skydb.RecordID) []string {
+			rows, err := db.FindReferencing(targetID)
+			So(err, ShouldBeNil)
+			defer rows.Close()
+
+			ids := []string{}
+			for rows.Scan() {
+				ids = append(ids, rows.Record().ID.String())
+			}
+			So(rows.Err(), ShouldBeNil)
+			sort.Strings(ids)
+			return ids
+		}
+
+		Convey("finds records referencing the target", func() {
+			So(findReferencing(skydb.NewRecordID("post", "post1")), ShouldResemble, []string{
+				"comment/comment1",
+				"comment/comment2",
+				"like/like1",
+			})
+			So(findReferencing(skydb.NewRecordID("post", "post2")), ShouldResemble, []string{
+				"comment/comment3",
+			})
+		})
+
+		Convey("does not find deleted referencing records", func() {
+			So(db.Delete(skydb.NewRecordID("comment", "comment1")), ShouldBeNil)
+			So(findReferencing(skydb.NewRecordID("post", "post1")), ShouldResemble, []string{
+				"comment/comment2",
+				"like/like1",
+			})
+		})
+
+		Convey("finds nothing for unreferenced record", func() {
+			So(findReferencing(skydb.NewRecordID("comment", "comment1")), ShouldResemble, []string{})
+		})
+
+		Convey("indexes reference columns", func() {
+			var exists bool
+			err := c.QueryRowx(`
+			SELECT EXISTS (
+				SELECT 1 FROM pg_indexes
+				WHERE schemaname = $1 AND tablename = 'comment' AND indexname = 'comment_post_ref'
+			)`, c.schemaName()).Scan(&exists)
+			So(err, ShouldBeNil)
+			So(exists, ShouldBeTrue)
+		})
+	})
+}
+
+func TestDeletePolicy(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("post", skydb.RecordSchema{
+			"title": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+		_, err = db.Extend("comment", skydb.RecordSchema{
+			"post": skydb.FieldType{
+				Type:          skydb.TypeReference,
+				ReferenceType: "post",
+			},
+		})
+		So(err, ShouldBeNil)
+		_, err = db.Extend("reply", skydb.RecordSchema{
+			"comment": skydb.FieldType{
+				Type:          skydb.TypeReference,
+				ReferenceType: "comment",
+			},
+		})
+		So(err, ShouldBeNil)
+
+		save := func(id skydb.RecordID, data map[string]interface{}) {
+			So(db.Save(&skydb.Record{
+				ID:      id,
+				OwnerID: "userid",
+				Data:    data,
+			}), ShouldBeNil)
+		}
+		postID := skydb.NewRecordID("post", "post1")
+		commentID := skydb.NewRecordID("comment", "comment1")
+		replyID := skydb.NewRecordID("reply", "reply1")
+		save(postID, map[string]interface{}{"title": "Post 1"})
+		save(commentID, map[string]interface{}{
+			"post": skydb.NewReference("post", "post1"),
+		})
+		save(replyID, map[string]interface{}{
+			"comment": skydb.NewReference("comment", "comment1"),
+		})
+
+		exists := func(id skydb.RecordID) bool {
+			err := db.Get(id, &skydb.Record{})
+			if err == skydb.ErrRecordNotFound {
+				return false
+			}
+			So(err, ShouldBeNil)
+			return true
+		}
+
+		// configure extends the record types with the delete policies,
+		// such that their foreign keys enforce the policies.
+		configure := func(policies map[string]map[string]skydb.DeletePolicy) {
+			configured := getTestConnWithConfig(t, c.appName, skydb.Config{
+				DeletePolicies: policies,
+			})
+			defer configured.Close()
+			for _, recordType := range []string{"post", "comment", "reply"} {
+				_, err := configured.PrivateDB("userid").Extend(recordType, skydb.RecordSchema{})
+				So(err, ShouldBeNil)
+			}
+		}
+
+		deleteWith := func(policies map[string]map[string]skydb.DeletePolicy, id skydb.RecordID) error {
+			configure(policies)
+			return db.Delete(id)
+		}
+
+		Convey("restricts deleting referenced record by default", func() {
+			So(db.Delete(postID), ShouldEqual, skydb.ErrRecordReferenced)
+			So(exists(postID), ShouldBeTrue)
+			So(exists(commentID), ShouldBeTrue)
+		})
+
+		Convey("cascades deletion to referencing records", func() {
+			So(deleteWith(map[string]map[string]skydb.DeletePolicy{
+				"comment": {"post": skydb.DeleteCascade},
+				"reply":   {"comment": skydb.DeleteCascade},
+			}, postID), ShouldBeNil)
+			So(exists(postID), ShouldBeFalse)
+			So(exists(commentID), ShouldBeFalse)
+			So(exists(replyID), ShouldBeFalse)
+		})
+
+		Convey("restricts cascading deletion to referenced records", func() {
+			So(deleteWith(map[string]map[string]skydb.DeletePolicy{
+				"comment": {"post": skydb.DeleteCascade},
+			}, postID), ShouldEqual, skydb.ErrRecordReferenced)
+			So(exists(postID), ShouldBeTrue)
+			So(exists(commentID), ShouldBeTrue)
+			So(exists(replyID), ShouldBeTrue)
+		})
+
+		Convey("sets referencing field to null", func() {
+			before := skydb.Record{}
+			So(db.Get(commentID, &before), ShouldBeNil)
+
+			So(deleteWith(map[string]map[string]skydb.DeletePolicy{
+				"comment": {"post": skydb.DeleteSetNull},
+			}, postID), ShouldBeNil)
+			So(exists(postID), ShouldBeFalse)
+
+			comment := skydb.Record{}
+			So(db.Get(commentID, &comment), ShouldBeNil)
+			So(comment.Data, ShouldResemble, skydb.Data{
+				"post": nil,
+			})
+			So(comment.UpdatedAt, ShouldHappenAfter, before.UpdatedAt)
+		})
+
+		Convey("cascades deletion by query", func() {
+			configure(map[string]map[string]skydb.DeletePolicy{
+				"comment": {"post": skydb.DeleteCascade},
+				"reply":   {"comment": skydb.DeleteCascade},
+			})
+			n, err := db.DeleteByQuery(&skydb.Query{
+				Type:                "post",
+				BypassAccessControl: true,
+			})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			So(exists(commentID), ShouldBeFalse)
+			So(exists(replyID), ShouldBeFalse)
+		})
+
+		Convey("restricts deleting referenced record once policy is removed", func() {
+			configure(map[string]map[string]skydb.DeletePolicy{
+				"comment": {"post": skydb.DeleteCascade},
+			})
+			So(deleteWith(map[string]map[string]skydb.DeletePolicy{}, postID), ShouldEqual, skydb.ErrRecordReferenced)
+			So(exists(commentID), ShouldBeTrue)
+		})
+	})
+}
+
+func BenchmarkDistanceQuery(b *testing.B) {
+	c := getTestConn(b)
+	defer cleanupConn(b, c)
+
+	db := c.PublicDB().(*database)
+	_, err := db.Extend("restaurant", skydb.RecordSchema{
+		"location": skydb.FieldType{Type: skydb.TypeLocation},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	_, err = c.Exec(fmt.Sprintf(`
+	INSERT INTO %s (_id, _database_id, _owner_id, _created_at, _created_by, _updated_at, _updated_by, location)
+	SELECT 'id' || i, '_public', 'owner', now(), 'owner', now(), 'owner',
+		ST_MakePoint(random() * 360 - 180, random() * 170 - 85)
+	FROM generate_series(1, 100000) AS i
+	`, db.tableName("restaurant")))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	location := skydb.NewLocation(114.1667, 22.25)
+	b.Run("distance only", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var count int
+			err := c.Get(&count, fmt.Sprintf(
+				"SELECT count(*) FROM %s WHERE ST_Distance_Sphere(location, ST_MakePoint($1, $2)) < $3",
+				db.tableName("restaurant")), location.Lng(), location.Lat(), 500000.0)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	query := skydb.Query{
+		Type: "restaurant",
+		Predicate: skydb.Predicate{
+			Operator: skydb.LessThan,
+			Children: []interface{}{
+				skydb.Expression{
+					Type: skydb.Function,
+					Value: skydb.DistanceFunc{
+						Field:    "location",
+						Location: location,
+					},
+				},
+				skydb.Expression{Type: skydb.Literal, Value: 500000.0},
+			},
+		},
+		BypassAccessControl: true,
+	}
+	b.Run("bounding box", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.QueryCount(&query); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestQueryETag(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		saveNote := func(id, category string, updatedAt time.Time) {
+			So(db.Save(&skydb.Record{
+				ID:        skydb.NewRecordID("note", id),
+				OwnerID:   "userid",
+				UpdatedAt: updatedAt,
+				Data: map[string]interface{}{
+					"category": category,
+				},
+			}), ShouldBeNil)
+		}
+
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"category": skydb.FieldType{Type: skydb.TypeString},
+			"content":  skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+		saveNote("id1", "spam", time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC))
+		saveNote("id2", "spam", time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC))
+		saveNote("id3", "important", time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC))
+
+		query := skydb.Query{
+			Type: "note",
+			Predicate: skydb.Predicate{
+				Operator: skydb.Equal,
+				Children: []interface{}{
+					skydb.Expression{Type: skydb.KeyPath, Value: "category"},
+					skydb.Expression{Type: skydb.Literal, Value: "spam"},
+				},
+			},
+		}
+		etag, err := db.QueryETag(&query)
+		So(err, ShouldBeNil)
+		So(etag, ShouldNotBeEmpty)
+
+		Convey("is stable without relevant writes", func() {
+			saveNote("id3", "important", time.Date(2006, 1, 2, 15, 4, 6, 0, time.UTC))
+
+			newETag, err := db.QueryETag(&query)
+			So(err, ShouldBeNil)
+			So(newETag, ShouldEqual, etag)
+		})
+
+		Convey("changes when a matching record is updated", func() {
+			saveNote("id1", "spam", time.Date(2006, 1, 2, 15, 4, 6, 0, time.UTC))
+
+			newETag, err := db.QueryETag(&query)
+			So(err, ShouldBeNil)
+			So(newETag, ShouldNotEqual, etag)
+		})
+
+		Convey("changes when a matching record is modified at the same update time", func() {
+			So(db.Save(&skydb.Record{
+				ID:        skydb.NewRecordID("note", "id1"),
+				OwnerID:   "userid",
+				UpdatedAt: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+				Data: map[string]interface{}{
+					"category": "spam",
+					"content":  "modified",
+				},
+			}), ShouldBeNil)
+
+			newETag, err := db.QueryETag(&query)
+			So(err, ShouldBeNil)
+			So(newETag, ShouldNotEqual, etag)
+		})
+
+		Convey("changes when a matching record is added", func() {
+			saveNote("id3", "spam", time.Date(2006, 1, 2, 15, 4, 6, 0, time.UTC))
+
+			newETag, err := db.QueryETag(&query)
+			So(err, ShouldBeNil)
+			So(newETag, ShouldNotEqual, etag)
+		})
+
+		Convey("changes when a matching record is removed", func() {
+			So(db.Delete(skydb.NewRecordID("note", "id2")), ShouldBeNil)
+
+			newETag, err := db.QueryETag(&query)
+			So(err, ShouldBeNil)
+			So(newETag, ShouldNotEqual, etag)
+		})
+
+		Convey("returns the same ETag for no matching records", func() {
+			emptyETag, err := db.QueryETag(&skydb.Query{Type: "notexist"})
+			So(err, ShouldBeNil)
+
+			So(db.Delete(skydb.NewRecordID("note", "id1")), ShouldBeNil)
+			So(db.Delete(skydb.NewRecordID("note", "id2")), ShouldBeNil)
+			newETag, err := db.QueryETag(&query)
+			So(err, ShouldBeNil)
+			So(newETag, ShouldEqual, emptyETag)
+		})
+	})
+}
+
+func TestQuery(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		// fixture
+		record1 := skydb.Record{
+			ID:      skydb.NewRecordID("note", "id1"),
+			OwnerID: "user_id",
+			Data: map[string]interface{}{
+				"noteOrder": float64(1),
+				"content":   "Hello World",
+				"emotion":   nil,
+			},
+		}
+		record2 := skydb.Record{
+			ID:      skydb.NewRecordID("note", "id2"),
+			OwnerID: "user_id",
+			Data: map[string]interface{}{
+				"noteOrder": float64(2),
+				"content":   "Bye World",
+				"emotion":   nil,
+			},
+		}
+		record3 := skydb.Record{
+			ID:      skydb.NewRecordID("note", "id3"),
+			OwnerID: "user_id",
+			Data: map[string]interface{}{
+				"noteOrder": float64(3),
+				"content":   "Good Hello",
+				"emotion":   "happy",
+			},
+		}
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"noteOrder": skydb.FieldType{Type: skydb.TypeNumber},
+			"content":   skydb.FieldType{Type: skydb.TypeString},
+			"emotion":   skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		err = db.Save(&record2)
+		So(err, ShouldBeNil)
+		err = db.Save(&record1)
+		So(err, ShouldBeNil)
+		err = db.Save(&record3)
+		So(err, ShouldBeNil)
+
+		Convey("queries records", func() {
+			query := skydb.Query{
+				Type: "note",
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records[0], ShouldResemble, record2)
+			So(records[1], ShouldResemble, record1)
+			So(records[2], ShouldResemble, record3)
+			So(len(records), ShouldEqual, 3)
+		})
+
+		Convey("sorts queried records ascendingly", func() {
+			query := skydb.Query{
+				Type: "note",
+				Sorts: []skydb.Sort{
+					skydb.Sort{
+						KeyPath: "noteOrder",
+						Order:   skydb.Ascending,
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records, ShouldResemble, []skydb.Record{
+				record1,
+				record2,
+				record3,
+			})
+		})
+
+		Convey("sorts queried records descendingly", func() {
+			query := skydb.Query{
+				Type: "note",
+				Sorts: []skydb.Sort{
+					skydb.Sort{
+						KeyPath: "noteOrder",
+						Order:   skydb.Descending,
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records, ShouldResemble, []skydb.Record{
+				record3,
+				record2,
+				record1,
+			})
+		})
+
+		Convey("query records by note order", func() {
+			query := skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.Equal,
+					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.KeyPath,
+							Value: "noteOrder",
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: 1,
+						},
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records[0], ShouldResemble, record1)
+			So(len(records), ShouldEqual, 1)
+		})
+
+		Convey("query records by content matching", func() {
+			query := skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.Like,
+					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.KeyPath,
+							Value: "content",
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: "Hello%",
+						},
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records[0], ShouldResemble, record1)
+			So(len(records), ShouldEqual, 1)
+		})
+
+		Convey("query records by case insensitive content matching", func() {
+			query := skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.ILike,
+					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.KeyPath,
+							Value: "content",
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: "hello%",
+						},
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records[0], ShouldResemble, record1)
+			So(len(records), ShouldEqual, 1)
+		})
+
+		Convey("query records by check array members", func() {
+			query := skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.In,
+					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.KeyPath,
+							Value: "content",
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: []interface{}{"Bye World", "Good Hello", "Anything"},
+						},
+					},
+				},
+				Sorts: []skydb.Sort{
+					skydb.Sort{
+						KeyPath: "noteOrder",
+						Order:   skydb.Descending,
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records[0], ShouldResemble, record3)
+			So(records[1], ShouldResemble, record2)
+			So(len(records), ShouldEqual, 2)
+		})
+
+		Convey("query records by checking empty array", func() {
+			query := skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.In,
+					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.KeyPath,
+							Value: "content",
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: []interface{}{},
+						},
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 0)
+		})
+
+		Convey("query records by note order using or predicate", func() {
+			keyPathExpr := skydb.Expression{
+				Type:  skydb.KeyPath,
+				Value: "noteOrder",
+			}
+			value1 := skydb.Expression{
+				Type:  skydb.Literal,
+				Value: 2,
+			}
+			value2 := skydb.Expression{
+				Type:  skydb.Literal,
+				Value: 3,
+			}
+			query := skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.Or,
+					Children: []interface{}{
+						skydb.Predicate{
+							Operator: skydb.Equal,
+							Children: []interface{}{keyPathExpr, value1},
+						},
+						skydb.Predicate{
+							Operator: skydb.Equal,
+							Children: []interface{}{keyPathExpr, value2},
+						},
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records[0], ShouldResemble, record2)
+			So(records[1], ShouldResemble, record3)
+			So(len(records), ShouldEqual, 2)
+		})
+
+		Convey("query records by offset and paging", func() {
+			query := skydb.Query{
+				Type:   "note",
+				Limit:  new(uint64),
+				Offset: 1,
+				Sorts: []skydb.Sort{
+					skydb.Sort{
+						KeyPath: "noteOrder",
+						Order:   skydb.Descending,
+					},
+				},
+			}
+			*query.Limit = 2
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records[0], ShouldResemble, record2)
+			So(records[1], ShouldResemble, record1)
+			So(len(records), ShouldEqual, 2)
+		})
+
+		Convey("resumes query records from the position of rows", func() {
+			query := skydb.Query{
+				Type: "note",
+				Sorts: []skydb.Sort{
+					skydb.Sort{
+						KeyPath: "noteOrder",
+						Order:   skydb.Ascending,
+					},
+				},
+			}
+			rows, err := db.Query(&query)
+			So(err, ShouldBeNil)
+			So(rows.Scan(), ShouldBeTrue)
+			So(rows.Record(), ShouldResemble, record1)
+			cursor := rows.Position()
+			rows.Close()
+			So(cursor.Count, ShouldEqual, 1)
+
+			records, err := exhaustRows(db.Query(skydb.ResumeQuery(&query, cursor)))
+			So(err, ShouldBeNil)
+			So(records, ShouldResemble, []skydb.Record{record2, record3})
+		})
+
+		Convey("resumes query records after a preceding record is removed", func() {
+			query := skydb.Query{
+				Type: "note",
+				Sorts: []skydb.Sort{
+					skydb.Sort{
+						KeyPath: "noteOrder",
+						Order:   skydb.Ascending,
+					},
+				},
+			}
+			rows, err := db.Query(&query)
+			So(err, ShouldBeNil)
+			So(rows.Scan(), ShouldBeTrue)
+			So(rows.Scan(), ShouldBeTrue)
+			So(rows.Record(), ShouldResemble, record2)
+			cursor := rows.Position()
+			rows.Close()
+
+			So(db.Delete(record1.ID), ShouldBeNil)
+			records, err := exhaustRows(db.Query(skydb.ResumeQuery(&query, cursor)))
+			So(err, ShouldBeNil)
+			So(records, ShouldResemble, []skydb.Record{record3})
+		})
+
+		Convey("resumes query records sorted by null values", func() {
+			resume := func(order skydb.SortOrder) []skydb.Record {
+				query := skydb.Query{
+					Type: "note",
+					Sorts: []skydb.Sort{
+						skydb.Sort{
+							KeyPath: "emotion",
+							Order:   order,
+						},
+					},
+				}
+				rows, err := db.Query(&query)
+				So(err, ShouldBeNil)
+				So(rows.Scan(), ShouldBeTrue)
+				So(rows.Scan(), ShouldBeTrue)
+				cursor := rows.Position()
+				rows.Close()
+
+				records, err := exhaustRows(db.Query(skydb.ResumeQuery(&query, cursor)))
+				So(err, ShouldBeNil)
+				return records
+			}
+
+			So(resume(skydb.Ascending), ShouldResemble, []skydb.Record{record2})
+			So(resume(skydb.Descending), ShouldResemble, []skydb.Record{record3})
+		})
+
+		Convey("does not resume query records sorted by a function", func() {
+			query := skydb.Query{
+				Type: "note",
+				Sorts: []skydb.Sort{
+					skydb.Sort{
+						Func: skydb.DistanceFunc{
+							Field:    "location",
+							Location: skydb.NewLocation(1, 2),
+						},
+						Order: skydb.Ascending,
+					},
+				},
+				After: &record1,
+			}
+			_, err := db.Query(&query)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "cannot resume query")
+		})
+
+		Convey("query records for nil item", func() {
+			query := skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.Equal,
+					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.KeyPath,
+							Value: "emotion",
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: nil,
+						},
+					},
+				},
+				Sorts: []skydb.Sort{
+					skydb.Sort{
+						KeyPath: "noteOrder",
+						Order:   skydb.Ascending,
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records[0], ShouldResemble, record1)
+			So(records[1], ShouldResemble, record2)
+			So(len(records), ShouldEqual, 2)
+		})
+
+		Convey("query records for not nil item", func() {
+			query := skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.NotEqual,
+					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.KeyPath,
+							Value: "emotion",
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: nil,
+						},
+					},
+				},
+				Sorts: []skydb.Sort{
+					skydb.Sort{
+						KeyPath: "noteOrder",
+						Order:   skydb.Ascending,
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records[0], ShouldResemble, record3)
+			So(len(records), ShouldEqual, 1)
+		})
+	})
+
+	Convey("Database with reference", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		// fixture
+		record1 := skydb.Record{
+			ID:      skydb.NewRecordID("note", "id1"),
+			OwnerID: "user_id",
+			Data: map[string]interface{}{
+				"noteOrder": float64(1),
+			},
+		}
+		record2 := skydb.Record{
+			ID:      skydb.NewRecordID("note", "id2"),
+			OwnerID: "user_id",
+			Data: map[string]interface{}{
+				"noteOrder": float64(2),
+				"category":  skydb.NewReference("category", "important"),
+			},
+		}
+		record3 := skydb.Record{
+			ID:      skydb.NewRecordID("note", "id3"),
+			OwnerID: "user_id",
+			Data: map[string]interface{}{
+				"noteOrder": float64(3),
+				"category":  skydb.NewReference("category", "funny"),
+			},
+		}
+		category1 := skydb.Record{
+			ID:      skydb.NewRecordID("category", "important"),
+			OwnerID: "user_id",
+			Data: map[string]interface{}{
+				"hidden": false,
+			},
+		}
+		category2 := skydb.Record{
+			ID:      skydb.NewRecordID("category", "funny"),
+			OwnerID: "user_id",
+			Data: map[string]interface{}{
+				"hidden": true,
+			},
+		}
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("category", skydb.RecordSchema{
+			"hidden": skydb.FieldType{Type: skydb.TypeBoolean},
+		})
+		So(err, ShouldBeNil)
+
+		_, err = db.Extend("note", skydb.RecordSchema{
+			"noteOrder": skydb.FieldType{Type: skydb.TypeNumber},
+			"category": skydb.FieldType{
+				Type:          skydb.TypeReference,
+				ReferenceType: "category",
+			},
+		})
+		So(err, ShouldBeNil)
+
+		err = db.Save(&category1)
+		So(err, ShouldBeNil)
+		err = db.Save(&category2)
+		So(err, ShouldBeNil)
+		err = db.Save(&record2)
+		So(err, ShouldBeNil)
+		err = db.Save(&record1)
+		So(err, ShouldBeNil)
+		err = db.Save(&record3)
+		So(err, ShouldBeNil)
+
+		Convey("query records by reference", func() {
+			query := skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.Equal,
+					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.KeyPath,
+							Value: "category",
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: skydb.NewReference("category", "important"),
+						},
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 1)
+			So(records[0], ShouldResemble, record2)
+		})
+
+		Convey("query records by comparing field in a referenced record", func() {
+			query := skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.Equal,
+					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.KeyPath,
+							Value: "category.hidden",
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: true,
+						},
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 1)
+			So(records[0], ShouldResemble, record3)
+		})
+
+		Convey("query records sorted by fields in a referenced record and the record", func() {
+			record4 := skydb.Record{
+				ID:      skydb.NewRecordID("note", "id4"),
+				OwnerID: "user_id",
+				Data: map[string]interface{}{
+					"noteOrder": float64(4),
+					"category":  skydb.NewReference("category", "important"),
+				},
+			}
+			So(db.Save(&record4), ShouldBeNil)
+
+			query := skydb.Query{
+				Type: "note",
+				Sorts: []skydb.Sort{
+					{
+						KeyPath: "category.hidden",
+						Order:   skydb.Asc,
+					},
+					{
+						KeyPath: "noteOrder",
+						Order:   skydb.Desc,
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records, ShouldResemble, []skydb.Record{
+				record4,
+				record2,
+				record3,
+				record1,
+			})
+		})
+	})
+
+	Convey("Database with location", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		record0 := skydb.Record{
+			ID:      skydb.NewRecordID("restaurant", "0"),
+			OwnerID: "someuserid",
+			Data: map[string]interface{}{
+				"location": skydb.NewLocation(0, 0),
+			},
+		}
+		record1 := skydb.Record{
+			ID:      skydb.NewRecordID("restaurant", "1"),
+			OwnerID: "someuserid",
+			Data: map[string]interface{}{
+				"location": skydb.NewLocation(1, 0),
+			},
+		}
+		record2 := skydb.Record{
+			ID:      skydb.NewRecordID("restaurant", "2"),
+			OwnerID: "someuserid",
+			Data: map[string]interface{}{
+				"location": skydb.NewLocation(0, 1),
+			},
+		}
+
+		db := c.PublicDB()
+		_, err := db.Extend("restaurant", skydb.RecordSchema{
+			"location": skydb.FieldType{Type: skydb.TypeLocation},
+		})
+		So(err, ShouldBeNil)
+		So(db.Save(&record0), ShouldBeNil)
+		So(db.Save(&record1), ShouldBeNil)
+		So(db.Save(&record2), ShouldBeNil)
+
+		Convey("query within distance", func() {
+			query := skydb.Query{
+				Type: "restaurant",
+				Predicate: skydb.Predicate{
+					Operator: skydb.LessThanOrEqual,
+					Children: []interface{}{
+						skydb.Expression{
+							Type: skydb.Function,
+							Value: skydb.DistanceFunc{
+								Field:    "location",
+								Location: skydb.NewLocation(1, 1),
+							},
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: 157260,
+						},
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records, ShouldResemble, []skydb.Record{record0, record1, record2})
+		})
+
+		Convey("query within distance with func on R.H.S.", func() {
+			query := skydb.Query{
+				Type: "restaurant",
+				Predicate: skydb.Predicate{
+					Operator: skydb.GreaterThan,
+					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: 157260,
+						},
+						skydb.Expression{
+							Type: skydb.Function,
+							Value: skydb.DistanceFunc{
+								Field:    "location",
+								Location: skydb.NewLocation(1, 1),
+							},
+						},
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records, ShouldResemble, []skydb.Record{record0, record1, record2})
+		})
+
+		Convey("query within distance near the edge", func() {
+			queryWithin := func(distance float64) []skydb.Record {
+				records, err := exhaustRows(db.Query(&skydb.Query{
+					Type: "restaurant",
+					Predicate: skydb.Predicate{
+						Operator: skydb.LessThan,
+						Children: []interface{}{
+							skydb.Expression{
+								Type: skydb.Function,
+								Value: skydb.DistanceFunc{
+									Field:    "location",
+									Location: skydb.NewLocation(0, 0),
+								},
+							},
+							skydb.Expression{
+								Type:  skydb.Literal,
+								Value: distance,
+							},
+						},
+					},
+				}))
+				So(err, ShouldBeNil)
+				return records
+			}
+
+			// record1 and record2 are 111194.93 meters away
+			So(queryWithin(111195), ShouldResemble, []skydb.Record{record0, record1, record2})
+			So(queryWithin(111194), ShouldResemble, []skydb.Record{record0})
+		})
+
+		Convey("query with computed distance", func() {
+			query := skydb.Query{
+				Type: "restaurant",
+				ComputedKeys: map[string]skydb.Expression{
+					"distance": skydb.Expression{
+						Type: skydb.Function,
+						Value: skydb.DistanceFunc{
+							Field:    "location",
+							Location: skydb.NewLocation(1, 1),
+						},
+					},
+				},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 3)
+			So(records[0].Transient["distance"], ShouldAlmostEqual, 157249, 1)
+		})
+
+		Convey("query records ordered by distance", func() {
+			query := skydb.Query{
+				Type: "restaurant",
+				Sorts: []skydb.Sort{
+					{
+						Func: skydb.DistanceFunc{
+							Field:    "location",
+							Location: skydb.NewLocation(0, 0),
+						},
+						Order: skydb.Desc,
+					},
+				},
+			}
+
+			records, err := exhaustRows(db.Query(&query))
+			So(err, ShouldBeNil)
+			So(records, ShouldResemble, []skydb.Record{record1, record2, record0})
+		})
+
+		Convey("query within distance including distance", func() {
+			origin := skydb.NewLocation(1, 1)
+			query := skydb.Query{
+				Type: "restaurant",
+				Predicate: skydb.Predicate{
+					Operator: skydb.LessThanOrEqual,
+					Children: []interface{}{
+						skydb.Expression{
+							Type: skydb.Function,
+							Value: skydb.DistanceFunc{
+								Field:    "location",
+								Location: origin,
+							},
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: 157260,
+						},
+					},
+				},
+				Sorts: []skydb.Sort{
+					{KeyPath: "_distance", Order: skydb.Desc},
+				},
+				IncludeDistance: true,
+			}
+
+			records, err := exhaustRows(db.Query(&query))
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 3)
+			So(records[0].ID, ShouldResemble, record0.ID)
+			for _, record := range records {
+				location := record.Data["location"].(skydb.Location)
+				So(record.Transient["_distance"], ShouldAlmostEqual, haversineDistance(origin, location), 1)
+			}
+			So(query.ComputedKeys, ShouldBeNil)
+		})
+
+		Convey("query not within distance excluding distance", func() {
+			query := skydb.Query{
+				Type:            "restaurant",
+				IncludeDistance: true,
+			}
+
+			records, err := exhaustRows(db.Query(&query))
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 3)
+			So(records[0].Transient, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Database with multiple fields", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		record0 := skydb.Record{
+			ID:      skydb.NewRecordID("restaurant", "0"),
+			OwnerID: "someuserid",
+			Data: map[string]interface{}{
+				"cuisine": "american",
+				"title":   "American Restaurant",
+			},
+		}
+		record1 := skydb.Record{
+			ID:      skydb.NewRecordID("restaurant", "1"),
+			OwnerID: "someuserid",
+			Data: map[string]interface{}{
+				"cuisine": "chinese",
+				"title":   "Chinese Restaurant",
+			},
+		}
+		record2 := skydb.Record{
+			ID:      skydb.NewRecordID("restaurant", "2"),
+			OwnerID: "someuserid",
+			Data: map[string]interface{}{
+				"cuisine": "italian",
+				"title":   "Italian Restaurant",
+			},
+		}
+
+		recordsInDB := []skydb.Record{record0, record1, record2}
+
+		db := c.PublicDB()
+		_, err := db.Extend("restaurant", skydb.RecordSchema{
+			"title":   skydb.FieldType{Type: skydb.TypeString},
+			"cuisine": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+		So(db.Save(&record0), ShouldBeNil)
+		So(db.Save(&record1), ShouldBeNil)
+		So(db.Save(&record2), ShouldBeNil)
+
+		Convey("query with desired keys", func() {
+			query := skydb.Query{
+				Type:        "restaurant",
+				DesiredKeys: []string{"cuisine"},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 3)
+			for i, record := range records {
+				So(record.Data["title"], ShouldBeNil)
+				So(record.Data["cuisine"], ShouldEqual, recordsInDB[i].Data["cuisine"])
+			}
+		})
+
+		Convey("query with empty desired keys", func() {
+			query := skydb.Query{
+				Type:        "restaurant",
+				DesiredKeys: []string{},
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 3)
+			for _, record := range records {
+				So(record.Data["title"], ShouldBeNil)
+				So(record.Data["cuisine"], ShouldBeNil)
+			}
+		})
+
+		Convey("query with nil desired keys", func() {
+			query := skydb.Query{
+				Type:        "restaurant",
+				DesiredKeys: nil,
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 3)
+			for i, record := range records {
+				So(record.Data["title"], ShouldEqual, recordsInDB[i].Data["title"])
+				So(record.Data["cuisine"], ShouldEqual, recordsInDB[i].Data["cuisine"])
+			}
+		})
+
+		Convey("query with non-recognized desired keys", func() {
+			query := skydb.Query{
+				Type:        "restaurant",
+				DesiredKeys: []string{"pricing"},
+			}
+			_, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Database with JSON", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		// fixture
+		record1 := skydb.Record{
+			ID:      skydb.NewRecordID("note", "id1"),
+			OwnerID: "user_id",
+			Data: map[string]interface{}{
+				"primaryTag": "red",
+				"tags":       []interface{}{"red", "green"},
+			},
+		}
+		record2 := skydb.Record{
+			ID:      skydb.NewRecordID("note", "id2"),
+			OwnerID: "user_id",
+			Data: map[string]interface{}{
+				"primaryTag": "yellow",
+				"tags":       []interface{}{"red", "green"},
+			},
+		}
+		record3 := skydb.Record{
+			ID:      skydb.NewRecordID("note", "id3"),
+			OwnerID: "user_id",
+			Data: map[string]interface{}{
+				"primaryTag": "green",
+				"tags":       []interface{}{"red", "yellow"},
+			},
+		}
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"primaryTag": skydb.FieldType{Type: skydb.TypeString},
+			"tags":       skydb.FieldType{Type: skydb.TypeJSON},
+		})
+		So(err, ShouldBeNil)
+
+		err = db.Save(&record2)
+		So(err, ShouldBeNil)
+		err = db.Save(&record1)
+		So(err, ShouldBeNil)
+		err = db.Save(&record3)
+		So(err, ShouldBeNil)
+
+		Convey("query records by literal string in JSON", func() {
+			query := skydb.Query{
 				Type: "note",
 				Predicate: skydb.Predicate{
-					Operator: skydb.Like,
+					Operator: skydb.In,
 					Children: []interface{}{
 						skydb.Expression{
-							Type:  skydb.KeyPath,
-							Value: "content",
+							Type:  skydb.Literal,
+							Value: "yellow",
 						},
 						skydb.Expression{
-							Type:  skydb.Literal,
-							Value: "Hello%",
+							Type:  skydb.KeyPath,
+							Value: "tags",
 						},
 					},
 				},
@@ -515,551 +3831,720 @@ func TestQuery(t *testing.T) {
 			records, err := exhaustRows(db.Query(&query))
 
 			So(err, ShouldBeNil)
-			So(records[0], ShouldResemble, record1)
-			So(len(records), ShouldEqual, 1)
+			So(records, ShouldResemble, []skydb.Record{record3})
 		})
+	})
 
-		Convey("query records by case insensitive content matching", func() {
+	Convey("Database with ACL", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		// fixture
+		record1 := skydb.Record{
+			ID:      skydb.NewRecordID("note", "id1"),
+			OwnerID: "alice",
+			ACL:     skydb.RecordACL{},
+		}
+		record2 := skydb.Record{
+			ID:      skydb.NewRecordID("note", "id2"),
+			OwnerID: "alice",
+			ACL: skydb.RecordACL{
+				skydb.NewRecordACLEntryPublic(skydb.ReadLevel),
+			},
+		}
+		record3 := skydb.Record{
+			ID:      skydb.NewRecordID("note", "id3"),
+			OwnerID: "alice",
+			ACL: skydb.RecordACL{
+				skydb.NewRecordACLEntryDirect("bob", skydb.ReadLevel),
+			},
+		}
+		record4 := skydb.Record{
+			ID:      skydb.NewRecordID("note", "id4"),
+			OwnerID: "alice",
+			ACL: skydb.RecordACL{
+				skydb.NewRecordACLEntryRole("marketing", skydb.ReadLevel),
+			},
+		}
+		record5 := skydb.Record{
+			ID:      skydb.NewRecordID("note", "id5"),
+			OwnerID: "alice",
+			ACL: skydb.RecordACL{
+				skydb.NewRecordACLEntryDirect("bob", skydb.ReadLevel),
+				skydb.NewRecordACLEntryRole("marketing", skydb.ReadLevel),
+			},
+		}
+
+		db := c.PublicDB()
+		_, err := db.Extend("note", skydb.RecordSchema{})
+		So(err, ShouldBeNil)
+
+		err = db.Save(&record1)
+		So(err, ShouldBeNil)
+		err = db.Save(&record2)
+		So(err, ShouldBeNil)
+		err = db.Save(&record3)
+		So(err, ShouldBeNil)
+		err = db.Save(&record4)
+		So(err, ShouldBeNil)
+		err = db.Save(&record5)
+		So(err, ShouldBeNil)
+
+		sortsByID := []skydb.Sort{
+			skydb.Sort{
+				KeyPath: "_id",
+				Order:   skydb.Ascending,
+			},
+		}
+
+		Convey("can be queried by owner", func() {
 			query := skydb.Query{
-				Type: "note",
-				Predicate: skydb.Predicate{
-					Operator: skydb.ILike,
-					Children: []interface{}{
-						skydb.Expression{
-							Type:  skydb.KeyPath,
-							Value: "content",
-						},
-						skydb.Expression{
-							Type:  skydb.Literal,
-							Value: "hello%",
-						},
-					},
-				},
+				Type:       "note",
+				ViewAsUser: &skydb.UserInfo{ID: "alice"},
+				Sorts:      sortsByID,
 			}
 			records, err := exhaustRows(db.Query(&query))
 
 			So(err, ShouldBeNil)
-			So(records[0], ShouldResemble, record1)
-			So(len(records), ShouldEqual, 1)
+			So(records, ShouldResemble, []skydb.Record{record1, record2, record3, record4, record5})
 		})
 
-		Convey("query records by check array members", func() {
+		Convey("can be queried by public", func() {
+			query := skydb.Query{
+				Type:       "note",
+				ViewAsUser: nil,
+				Sorts:      sortsByID,
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records, ShouldResemble, []skydb.Record{record2})
+		})
+
+		Convey("can be queried by explicit user", func() {
+			query := skydb.Query{
+				Type:       "note",
+				ViewAsUser: &skydb.UserInfo{ID: "bob"},
+				Sorts:      sortsByID,
+			}
+			records, err := exhaustRows(db.Query(&query))
+
+			So(err, ShouldBeNil)
+			So(records, ShouldResemble, []skydb.Record{record2, record3, record5})
+		})
+
+		Convey("can be queried by explicit role", func() {
 			query := skydb.Query{
 				Type: "note",
-				Predicate: skydb.Predicate{
-					Operator: skydb.In,
-					Children: []interface{}{
-						skydb.Expression{
-							Type:  skydb.KeyPath,
-							Value: "content",
-						},
-						skydb.Expression{
-							Type:  skydb.Literal,
-							Value: []interface{}{"Bye World", "Good Hello", "Anything"},
-						},
-					},
-				},
-				Sorts: []skydb.Sort{
-					skydb.Sort{
-						KeyPath: "noteOrder",
-						Order:   skydb.Descending,
-					},
+				ViewAsUser: &skydb.UserInfo{
+					ID:    "carol",
+					Roles: []string{"marketing"},
 				},
+				Sorts: sortsByID,
 			}
 			records, err := exhaustRows(db.Query(&query))
 
 			So(err, ShouldBeNil)
-			So(records[0], ShouldResemble, record3)
-			So(records[1], ShouldResemble, record2)
-			So(len(records), ShouldEqual, 2)
+			So(records, ShouldResemble, []skydb.Record{record2, record4, record5})
 		})
 
-		Convey("query records by checking empty array", func() {
+		Convey("can be queried by explicit user and role", func() {
 			query := skydb.Query{
 				Type: "note",
-				Predicate: skydb.Predicate{
-					Operator: skydb.In,
-					Children: []interface{}{
-						skydb.Expression{
-							Type:  skydb.KeyPath,
-							Value: "content",
-						},
-						skydb.Expression{
-							Type:  skydb.Literal,
-							Value: []interface{}{},
-						},
-					},
+				ViewAsUser: &skydb.UserInfo{
+					ID:    "bob",
+					Roles: []string{"marketing"},
 				},
+				Sorts: sortsByID,
 			}
 			records, err := exhaustRows(db.Query(&query))
 
 			So(err, ShouldBeNil)
-			So(len(records), ShouldEqual, 0)
+			So(records, ShouldResemble, []skydb.Record{record2, record3, record4, record5})
 		})
 
-		Convey("query records by note order using or predicate", func() {
-			keyPathExpr := skydb.Expression{
-				Type:  skydb.KeyPath,
-				Value: "noteOrder",
-			}
-			value1 := skydb.Expression{
-				Type:  skydb.Literal,
-				Value: 2,
-			}
-			value2 := skydb.Expression{
-				Type:  skydb.Literal,
-				Value: 3,
-			}
+		Convey("can be queried with bypass access control", func() {
 			query := skydb.Query{
 				Type: "note",
-				Predicate: skydb.Predicate{
-					Operator: skydb.Or,
-					Children: []interface{}{
-						skydb.Predicate{
-							Operator: skydb.Equal,
-							Children: []interface{}{keyPathExpr, value1},
-						},
-						skydb.Predicate{
-							Operator: skydb.Equal,
-							Children: []interface{}{keyPathExpr, value2},
-						},
-					},
+				ViewAsUser: &skydb.UserInfo{
+					ID: "dave",
 				},
+				Sorts:               sortsByID,
+				BypassAccessControl: true,
 			}
 			records, err := exhaustRows(db.Query(&query))
 
-			So(err, ShouldBeNil)
-			So(records[0], ShouldResemble, record2)
-			So(records[1], ShouldResemble, record3)
-			So(len(records), ShouldEqual, 2)
+			So(err, ShouldBeNil)
+			So(records, ShouldResemble, []skydb.Record{record1, record2, record3, record4, record5})
+		})
+	})
+
+	Convey("Empty Conn", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		Convey("gets no users", func() {
+			userinfo := skydb.UserInfo{}
+			err := c.GetUser("notexistuserid", &userinfo)
+			So(err, ShouldEqual, skydb.ErrUserNotFound)
+		})
+
+		Convey("gets no users with principal", func() {
+			userinfo := skydb.UserInfo{}
+			err := c.GetUserByPrincipalID("com.example:johndoe", &userinfo)
+			So(err, ShouldEqual, skydb.ErrUserNotFound)
+		})
+
+		Convey("query no users", func() {
+			emails := []string{"user@example.com"}
+			result, err := c.QueryUser(emails, []string{})
+			So(err, ShouldBeNil)
+			So(len(result), ShouldEqual, 0)
+		})
+
+		Convey("updates no users", func() {
+			userinfo := skydb.UserInfo{
+				ID: "notexistuserid",
+			}
+			err := c.UpdateUser(&userinfo)
+			So(err, ShouldEqual, skydb.ErrUserNotFound)
+		})
+
+		Convey("deletes no users", func() {
+			err := c.DeleteUser("notexistuserid")
+			So(err, ShouldEqual, skydb.ErrUserNotFound)
+		})
+
+		Convey("gets no devices", func() {
+			device := skydb.Device{}
+			err := c.GetDevice("notexistdeviceid", &device)
+			So(err, ShouldEqual, skydb.ErrDeviceNotFound)
+		})
+
+		Convey("deletes no devices", func() {
+			err := c.DeleteDevice("notexistdeviceid")
+			So(err, ShouldEqual, skydb.ErrDeviceNotFound)
+		})
+
+		Convey("Empty Database", func() {
+			db := c.PublicDB()
+
+			Convey("gets nothing", func() {
+				record := skydb.Record{}
+
+				err := db.Get(skydb.NewRecordID("type", "notexistid"), &record)
+
+				So(err, ShouldEqual, skydb.ErrRecordNotFound)
+			})
+
+			Convey("deletes nothing", func() {
+				err := db.Delete(skydb.NewRecordID("type", "notexistid"))
+				So(err, ShouldEqual, skydb.ErrRecordNotFound)
+			})
+
+			Convey("queries nothing", func() {
+				query := skydb.Query{
+					Type: "notexisttype",
+				}
+
+				records, err := exhaustRows(db.Query(&query))
+
+				So(err, ShouldBeNil)
+				So(records, ShouldBeEmpty)
+			})
 		})
+	})
+}
 
-		Convey("query records by offset and paging", func() {
-			query := skydb.Query{
-				Type:   "note",
-				Limit:  new(uint64),
-				Offset: 1,
-				Sorts: []skydb.Sort{
-					skydb.Sort{
+func TestQueryDefaultSorts(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConnWithConfig(t, testAppName(), skydb.Config{
+			DefaultSorts: map[string][]skydb.Sort{
+				"note": {
+					{
 						KeyPath: "noteOrder",
-						Order:   skydb.Descending,
+						Order:   skydb.Desc,
 					},
 				},
-			}
-			*query.Limit = 2
-			records, err := exhaustRows(db.Query(&query))
+			},
+		})
+		defer cleanupConn(t, c)
 
-			So(err, ShouldBeNil)
-			So(records[0], ShouldResemble, record2)
-			So(records[1], ShouldResemble, record1)
-			So(len(records), ShouldEqual, 2)
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"noteOrder": skydb.FieldType{Type: skydb.TypeNumber},
 		})
+		So(err, ShouldBeNil)
 
-		Convey("query records for nil item", func() {
-			query := skydb.Query{
-				Type: "note",
-				Predicate: skydb.Predicate{
-					Operator: skydb.Equal,
-					Children: []interface{}{
-						skydb.Expression{
-							Type:  skydb.KeyPath,
-							Value: "emotion",
-						},
-						skydb.Expression{
-							Type:  skydb.Literal,
-							Value: nil,
-						},
-					},
-				},
-				Sorts: []skydb.Sort{
-					skydb.Sort{
-						KeyPath: "noteOrder",
-						Order:   skydb.Ascending,
-					},
+		for i, order := range []float64{2, 3, 1} {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", fmt.Sprintf("id%d", i)),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"noteOrder": order,
 				},
-			}
-			records, err := exhaustRows(db.Query(&query))
+			}), ShouldBeNil)
+		}
 
+		noteOrders := func(query *skydb.Query) []interface{} {
+			records, err := exhaustRows(db.Query(query))
 			So(err, ShouldBeNil)
-			So(records[0], ShouldResemble, record1)
-			So(records[1], ShouldResemble, record2)
-			So(len(records), ShouldEqual, 2)
+
+			orders := []interface{}{}
+			for _, record := range records {
+				orders = append(orders, record.Data["noteOrder"])
+			}
+			return orders
+		}
+
+		Convey("applies default sorts to query without sorts", func() {
+			So(noteOrders(&skydb.Query{
+				Type: "note",
+			}), ShouldResemble, []interface{}{float64(3), float64(2), float64(1)})
 		})
 
-		Convey("query records for not nil item", func() {
-			query := skydb.Query{
+		Convey("applies sorts specified in query", func() {
+			So(noteOrders(&skydb.Query{
 				Type: "note",
-				Predicate: skydb.Predicate{
-					Operator: skydb.NotEqual,
-					Children: []interface{}{
-						skydb.Expression{
-							Type:  skydb.KeyPath,
-							Value: "emotion",
-						},
-						skydb.Expression{
-							Type:  skydb.Literal,
-							Value: nil,
-						},
-					},
-				},
 				Sorts: []skydb.Sort{
-					skydb.Sort{
+					{
 						KeyPath: "noteOrder",
-						Order:   skydb.Ascending,
+						Order:   skydb.Asc,
 					},
 				},
-			}
-			records, err := exhaustRows(db.Query(&query))
+			}), ShouldResemble, []interface{}{float64(1), float64(2), float64(3)})
+		})
 
-			So(err, ShouldBeNil)
-			So(records[0], ShouldResemble, record3)
-			So(len(records), ShouldEqual, 1)
+		Convey("does not apply default sorts of another conn", func() {
+			c2 := getTestConn(t)
+			defer c2.Close()
+			So(c2.PrivateDB("userid").(*database).defaultSorts("note"), ShouldBeNil)
 		})
 	})
+}
 
-	Convey("Database with reference", t, func() {
+func TestQueryFieldOrder(t *testing.T) {
+	Convey("Database", t, func() {
 		c := getTestConn(t)
 		defer cleanupConn(t, c)
 
-		// fixture
-		record1 := skydb.Record{
-			ID:      skydb.NewRecordID("note", "id1"),
-			OwnerID: "user_id",
-			Data: map[string]interface{}{
-				"noteOrder": float64(1),
-			},
-		}
-		record2 := skydb.Record{
-			ID:      skydb.NewRecordID("note", "id2"),
-			OwnerID: "user_id",
-			Data: map[string]interface{}{
-				"noteOrder": float64(2),
-				"category":  skydb.NewReference("category", "important"),
-			},
-		}
-		record3 := skydb.Record{
-			ID:      skydb.NewRecordID("note", "id3"),
-			OwnerID: "user_id",
-			Data: map[string]interface{}{
-				"noteOrder": float64(3),
-				"category":  skydb.NewReference("category", "funny"),
-			},
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("task", skydb.RecordSchema{
+			"priority": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		for i, priority := range []string{"medium", "unknown", "high", "low"} {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("task", fmt.Sprintf("id%d", i)),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"priority": priority,
+				},
+			}), ShouldBeNil)
 		}
-		category1 := skydb.Record{
-			ID:      skydb.NewRecordID("category", "important"),
-			OwnerID: "user_id",
-			Data: map[string]interface{}{
-				"hidden": false,
-			},
+
+		priorities := func(predicate skydb.Predicate, order skydb.SortOrder) []interface{} {
+			records, err := exhaustRows(db.Query(&skydb.Query{
+				Type:      "task",
+				Predicate: predicate,
+				Sorts: []skydb.Sort{
+					{
+						KeyPath: "priority",
+						Order:   order,
+					},
+				},
+			}))
+			So(err, ShouldBeNil)
+
+			result := []interface{}{}
+			for _, record := range records {
+				result = append(result, record.Data["priority"])
+			}
+			return result
 		}
-		category2 := skydb.Record{
-			ID:      skydb.NewRecordID("category", "funny"),
-			OwnerID: "user_id",
-			Data: map[string]interface{}{
-				"hidden": true,
-			},
+
+		priorityPredicate := func(op skydb.Operator, value string) skydb.Predicate {
+			return skydb.Predicate{
+				Operator: op,
+				Children: []interface{}{
+					skydb.Expression{Type: skydb.KeyPath, Value: "priority"},
+					skydb.Expression{Type: skydb.Literal, Value: value},
+				},
+			}
 		}
 
-		db := c.PrivateDB("userid")
-		_, err := db.Extend("category", skydb.RecordSchema{
-			"hidden": skydb.FieldType{Type: skydb.TypeBoolean},
+		Convey("sorts field alphabetically without order", func() {
+			So(priorities(skydb.Predicate{}, skydb.Asc), ShouldResemble, []interface{}{
+				"high", "low", "medium", "unknown",
+			})
 		})
-		So(err, ShouldBeNil)
 
-		_, err = db.Extend("note", skydb.RecordSchema{
-			"noteOrder": skydb.FieldType{Type: skydb.TypeNumber},
-			"category": skydb.FieldType{
-				Type:          skydb.TypeReference,
-				ReferenceType: "category",
+		Convey("with field order", func() {
+			ordered := getTestConnWithConfig(t, c.appName, skydb.Config{
+				FieldOrders: map[string]map[string][]string{
+					"task": {"priority": {"low", "medium", "high"}},
+				},
+			})
+			defer ordered.Close()
+			db = ordered.PrivateDB("userid")
+
+			Convey("sorts field by order of values", func() {
+				So(priorities(skydb.Predicate{}, skydb.Asc), ShouldResemble, []interface{}{
+					"low", "medium", "high", "unknown",
+				})
+				So(priorities(skydb.Predicate{}, skydb.Desc), ShouldResemble, []interface{}{
+					"unknown", "high", "medium", "low",
+				})
+			})
+
+			Convey("compares field by order of values", func() {
+				So(priorities(priorityPredicate(skydb.GreaterThanOrEqual, "medium"), skydb.Asc), ShouldResemble, []interface{}{
+					"medium", "high", "unknown",
+				})
+				So(priorities(priorityPredicate(skydb.LessThan, "high"), skydb.Asc), ShouldResemble, []interface{}{
+					"low", "medium",
+				})
+			})
+		})
+	})
+}
+
+func TestVirtualField(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConnWithConfig(t, testAppName(), skydb.Config{
+			VirtualFields: map[string]map[string]skydb.VirtualFieldFunc{
+				"note": {
+					"contentLength": func(record *skydb.Record) interface{} {
+						content, _ := record.Data["content"].(string)
+						return float64(len(content))
+					},
+				},
 			},
 		})
-		So(err, ShouldBeNil)
+		defer cleanupConn(t, c)
 
-		err = db.Save(&category1)
-		So(err, ShouldBeNil)
-		err = db.Save(&category2)
-		So(err, ShouldBeNil)
-		err = db.Save(&record2)
-		So(err, ShouldBeNil)
-		err = db.Save(&record1)
-		So(err, ShouldBeNil)
-		err = db.Save(&record3)
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+		})
 		So(err, ShouldBeNil)
 
-		Convey("query records by reference", func() {
-			query := skydb.Query{
-				Type: "note",
-				Predicate: skydb.Predicate{
-					Operator: skydb.Equal,
-					Children: []interface{}{
-						skydb.Expression{
-							Type:  skydb.KeyPath,
-							Value: "category",
-						},
-						skydb.Expression{
-							Type:  skydb.Literal,
-							Value: skydb.NewReference("category", "important"),
-						},
-					},
-				},
-			}
-			records, err := exhaustRows(db.Query(&query))
+		So(db.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("note", "id1"),
+			OwnerID: "userid",
+			Data: map[string]interface{}{
+				"content": "Hello World",
+			},
+		}), ShouldBeNil)
 
-			So(err, ShouldBeNil)
-			So(len(records), ShouldEqual, 1)
-			So(records[0], ShouldResemble, record2)
+		Convey("injects virtual field into fetched record", func() {
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id1"), &record), ShouldBeNil)
+			So(record.Data, ShouldResemble, map[string]interface{}{
+				"content":       "Hello World",
+				"contentLength": float64(11),
+			})
 		})
 
-		Convey("query records by comparing field in a referenced record", func() {
-			query := skydb.Query{
+		Convey("injects virtual field into query results", func() {
+			records, err := exhaustRows(db.Query(&skydb.Query{
 				Type: "note",
-				Predicate: skydb.Predicate{
-					Operator: skydb.Equal,
-					Children: []interface{}{
-						skydb.Expression{
-							Type:  skydb.KeyPath,
-							Value: "category.hidden",
-						},
-						skydb.Expression{
-							Type:  skydb.Literal,
-							Value: true,
-						},
-					},
+			}))
+			So(err, ShouldBeNil)
+			So(records, ShouldHaveLength, 1)
+			So(records[0].Data["contentLength"], ShouldEqual, 11)
+		})
+
+		Convey("does not persist virtual field", func() {
+			_, err := db.Extend("note", skydb.RecordSchema{
+				"contentLength": skydb.FieldType{Type: skydb.TypeNumber},
+			})
+			So(err, ShouldBeNil)
+
+			record := skydb.Record{
+				ID:      skydb.NewRecordID("note", "id2"),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"content":       "Bye",
+					"contentLength": float64(100),
 				},
 			}
-			records, err := exhaustRows(db.Query(&query))
+			So(db.Save(&record), ShouldBeNil)
+			So(record.Data["contentLength"], ShouldEqual, 3)
 
+			var contentLength sql.NullFloat64
+			err = c.QueryRowx(`SELECT "contentLength" FROM "note" WHERE _id = 'id2'`).Scan(&contentLength)
 			So(err, ShouldBeNil)
-			So(len(records), ShouldEqual, 1)
-			So(records[0], ShouldResemble, record3)
+			So(contentLength.Valid, ShouldBeFalse)
 		})
 	})
+}
 
-	Convey("Database with location", t, func() {
-		c := getTestConn(t)
+func TestSchemaVersion(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConnWithConfig(t, testAppName(), skydb.Config{
+			SchemaVersions: map[string]int{"note": 1},
+		})
 		defer cleanupConn(t, c)
 
-		record0 := skydb.Record{
-			ID:      skydb.NewRecordID("restaurant", "0"),
-			OwnerID: "someuserid",
-			Data: map[string]interface{}{
-				"location": skydb.NewLocation(0, 0),
-			},
-		}
-		record1 := skydb.Record{
-			ID:      skydb.NewRecordID("restaurant", "1"),
-			OwnerID: "someuserid",
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+			"title":   skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		record := skydb.Record{
+			ID:      skydb.NewRecordID("note", "id1"),
+			OwnerID: "userid",
 			Data: map[string]interface{}{
-				"location": skydb.NewLocation(1, 0),
+				"content": "Hello World",
 			},
 		}
-		record2 := skydb.Record{
-			ID:      skydb.NewRecordID("restaurant", "2"),
-			OwnerID: "someuserid",
-			Data: map[string]interface{}{
-				"location": skydb.NewLocation(0, 1),
-			},
+		So(db.Save(&record), ShouldBeNil)
+		So(record.SchemaVersion, ShouldEqual, 1)
+
+		// versioned returns a Database of the note record type at the
+		// version, up-converted by the migrators
+		versioned := func(version int, migrators map[int]skydb.SchemaMigratorFunc) skydb.Database {
+			versionedConn := getTestConnWithConfig(t, c.appName, skydb.Config{
+				SchemaVersions:  map[string]int{"note": version},
+				SchemaMigrators: map[string]map[int]skydb.SchemaMigratorFunc{"note": migrators},
+			})
+			return versionedConn.PrivateDB("userid")
 		}
 
-		db := c.PublicDB()
-		_, err := db.Extend("restaurant", skydb.RecordSchema{
-			"location": skydb.FieldType{Type: skydb.TypeLocation},
-		})
-		So(err, ShouldBeNil)
-		So(db.Save(&record0), ShouldBeNil)
-		So(db.Save(&record1), ShouldBeNil)
-		So(db.Save(&record2), ShouldBeNil)
-
-		Convey("query within distance", func() {
-			query := skydb.Query{
-				Type: "restaurant",
-				Predicate: skydb.Predicate{
-					Operator: skydb.LessThanOrEqual,
-					Children: []interface{}{
-						skydb.Expression{
-							Type: skydb.Function,
-							Value: skydb.DistanceFunc{
-								Field:    "location",
-								Location: skydb.NewLocation(1, 1),
-							},
-						},
-						skydb.Expression{
-							Type:  skydb.Literal,
-							Value: 157260,
-						},
-					},
+		Convey("up-converts a record of an older version on read", func() {
+			db := versioned(2, map[int]skydb.SchemaMigratorFunc{
+				1: func(record *skydb.Record) error {
+					content, _ := record.Data["content"].(string)
+					record.Data["title"] = fmt.Sprintf("%.5s", content)
+					return nil
 				},
-			}
-			records, err := exhaustRows(db.Query(&query))
+			})
 
-			So(err, ShouldBeNil)
-			So(records, ShouldResemble, []skydb.Record{record0, record1, record2})
-		})
+			fetched := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id1"), &fetched), ShouldBeNil)
+			So(fetched.SchemaVersion, ShouldEqual, 2)
+			So(fetched.Data, ShouldResemble, map[string]interface{}{
+				"content": "Hello World",
+				"title":   "Hello",
+			})
 
-		Convey("query within distance with func on R.H.S.", func() {
-			query := skydb.Query{
-				Type: "restaurant",
-				Predicate: skydb.Predicate{
-					Operator: skydb.GreaterThan,
-					Children: []interface{}{
-						skydb.Expression{
-							Type:  skydb.Literal,
-							Value: 157260,
-						},
-						skydb.Expression{
-							Type: skydb.Function,
-							Value: skydb.DistanceFunc{
-								Field:    "location",
-								Location: skydb.NewLocation(1, 1),
-							},
-						},
-					},
-				},
-			}
-			records, err := exhaustRows(db.Query(&query))
+			records, err := exhaustRows(db.Query(&skydb.Query{
+				Type: "note",
+			}))
+			So(err, ShouldBeNil)
+			So(records, ShouldHaveLength, 1)
+			So(records[0].SchemaVersion, ShouldEqual, 2)
+			So(records[0].Data["title"], ShouldEqual, "Hello")
 
+			var version int
+			err = c.QueryRowx(`SELECT _schema_version FROM "note" WHERE _id = 'id1'`).Scan(&version)
 			So(err, ShouldBeNil)
-			So(records, ShouldResemble, []skydb.Record{record0, record1, record2})
+			So(version, ShouldEqual, 1)
 		})
 
-		Convey("query with computed distance", func() {
-			query := skydb.Query{
-				Type: "restaurant",
-				ComputedKeys: map[string]skydb.Expression{
-					"distance": skydb.Expression{
-						Type: skydb.Function,
-						Value: skydb.DistanceFunc{
-							Field:    "location",
-							Location: skydb.NewLocation(1, 1),
-						},
-					},
+		Convey("stops up-converting at a missing migrator", func() {
+			db := versioned(3, map[int]skydb.SchemaMigratorFunc{
+				2: func(record *skydb.Record) error {
+					record.Data["title"] = "unreachable"
+					return nil
 				},
-			}
-			records, err := exhaustRows(db.Query(&query))
+			})
 
-			So(err, ShouldBeNil)
-			So(len(records), ShouldEqual, 3)
-			So(records[0].Transient["distance"], ShouldAlmostEqual, 157249, 1)
+			fetched := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id1"), &fetched), ShouldBeNil)
+			So(fetched.SchemaVersion, ShouldEqual, 1)
+			So(fetched.Data, ShouldNotContainKey, "title")
 		})
 
-		Convey("query records ordered by distance", func() {
-			query := skydb.Query{
-				Type: "restaurant",
-				Sorts: []skydb.Sort{
-					{
-						Func: skydb.DistanceFunc{
-							Field:    "location",
-							Location: skydb.NewLocation(0, 0),
-						},
-						Order: skydb.Desc,
-					},
+		Convey("returns error of a failed migrator", func() {
+			db := versioned(2, map[int]skydb.SchemaMigratorFunc{
+				1: func(record *skydb.Record) error {
+					return fmt.Errorf("malformed content")
 				},
-			}
+			})
 
-			records, err := exhaustRows(db.Query(&query))
-			So(err, ShouldBeNil)
-			So(records, ShouldResemble, []skydb.Record{record1, record2, record0})
+			fetched := skydb.Record{}
+			err := db.Get(skydb.NewRecordID("note", "id1"), &fetched)
+			So(err, ShouldNotBeNil)
 		})
 	})
+}
 
-	Convey("Database with multiple fields", t, func() {
-		c := getTestConn(t)
-		defer cleanupConn(t, c)
+// searchEngine is a QueryEngine matching queries with a limit, returning
+// the records it holds regardless of the predicate.
+type searchEngine struct {
+	records []skydb.Record
+	queried int
+}
 
-		record0 := skydb.Record{
-			ID:      skydb.NewRecordID("restaurant", "0"),
-			OwnerID: "someuserid",
-			Data: map[string]interface{}{
-				"cuisine": "american",
-				"title":   "American Restaurant",
-			},
-		}
-		record1 := skydb.Record{
-			ID:      skydb.NewRecordID("restaurant", "1"),
-			OwnerID: "someuserid",
-			Data: map[string]interface{}{
-				"cuisine": "chinese",
-				"title":   "Chinese Restaurant",
+func (e *searchEngine) Match(query *skydb.Query) bool {
+	return query.Limit != nil
+}
+
+func (e *searchEngine) Query(db skydb.Database, query *skydb.Query) (*skydb.Rows, error) {
+	e.queried++
+	return skydb.NewRows(skydb.NewMemoryRows(e.records)), nil
+}
+
+func TestQueryEngine(t *testing.T) {
+	Convey("Database", t, func() {
+		engine := &searchEngine{
+			records: []skydb.Record{
+				{
+					ID:      skydb.NewRecordID("note", "searched"),
+					OwnerID: "userid",
+				},
 			},
 		}
-		record2 := skydb.Record{
-			ID:      skydb.NewRecordID("restaurant", "2"),
-			OwnerID: "someuserid",
-			Data: map[string]interface{}{
-				"cuisine": "italian",
-				"title":   "Italian Restaurant",
-			},
+		c := getTestConnWithConfig(t, testAppName(), skydb.Config{
+			QueryEngines: map[string]skydb.QueryEngine{"note": engine},
+		})
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		for _, recordType := range []string{"note", "category"} {
+			_, err := db.Extend(recordType, skydb.RecordSchema{
+				"content": skydb.FieldType{Type: skydb.TypeString},
+			})
+			So(err, ShouldBeNil)
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID(recordType, "stored"),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"content": "Hello World",
+				},
+			}), ShouldBeNil)
 		}
 
-		recordsInDB := []skydb.Record{record0, record1, record2}
+		limit := uint64(10)
 
-		db := c.PublicDB()
-		_, err := db.Extend("restaurant", skydb.RecordSchema{
-			"title":   skydb.FieldType{Type: skydb.TypeString},
-			"cuisine": skydb.FieldType{Type: skydb.TypeString},
+		Convey("delegates matched query of the record type to engine", func() {
+			records, err := exhaustRows(db.Query(&skydb.Query{
+				Type:  "note",
+				Limit: &limit,
+			}))
+			So(err, ShouldBeNil)
+			So(records, ShouldHaveLength, 1)
+			So(records[0].ID.Key, ShouldEqual, "searched")
+			So(engine.queried, ShouldEqual, 1)
 		})
-		So(err, ShouldBeNil)
-		So(db.Save(&record0), ShouldBeNil)
-		So(db.Save(&record1), ShouldBeNil)
-		So(db.Save(&record2), ShouldBeNil)
-
-		Convey("query with desired keys", func() {
-			query := skydb.Query{
-				Type:        "restaurant",
-				DesiredKeys: []string{"cuisine"},
-			}
-			records, err := exhaustRows(db.Query(&query))
 
+		Convey("executes query not matched by engine itself", func() {
+			records, err := exhaustRows(db.Query(&skydb.Query{
+				Type: "note",
+			}))
 			So(err, ShouldBeNil)
-			So(len(records), ShouldEqual, 3)
-			for i, record := range records {
-				So(record.Data["title"], ShouldBeNil)
-				So(record.Data["cuisine"], ShouldEqual, recordsInDB[i].Data["cuisine"])
-			}
+			So(records, ShouldHaveLength, 1)
+			So(records[0].ID.Key, ShouldEqual, "stored")
+			So(engine.queried, ShouldEqual, 0)
 		})
 
-		Convey("query with empty desired keys", func() {
-			query := skydb.Query{
-				Type:        "restaurant",
-				DesiredKeys: []string{},
-			}
-			records, err := exhaustRows(db.Query(&query))
+		Convey("executes query of other record types itself", func() {
+			records, err := exhaustRows(db.Query(&skydb.Query{
+				Type:  "category",
+				Limit: &limit,
+			}))
+			So(err, ShouldBeNil)
+			So(records, ShouldHaveLength, 1)
+			So(records[0].ID.Key, ShouldEqual, "stored")
+			So(engine.queried, ShouldEqual, 0)
+		})
+	})
+}
 
+func TestExtractMaxQueryDuration(t *testing.T) {
+	Convey("extractMaxQueryDuration", t, func() {
+		Convey("extracts from URL", func() {
+			connString, duration, err := extractMaxQueryDuration(
+				"postgres://postgres:@localhost/postgres?max_query_duration=5s&sslmode=disable")
 			So(err, ShouldBeNil)
-			So(len(records), ShouldEqual, 3)
-			for _, record := range records {
-				So(record.Data["title"], ShouldBeNil)
-				So(record.Data["cuisine"], ShouldBeNil)
-			}
+			So(connString, ShouldEqual, "postgres://postgres:@localhost/postgres?sslmode=disable")
+			So(duration, ShouldEqual, 5*time.Second)
 		})
 
-		Convey("query with nil desired keys", func() {
-			query := skydb.Query{
-				Type:        "restaurant",
-				DesiredKeys: nil,
-			}
-			records, err := exhaustRows(db.Query(&query))
+		Convey("extracts from key-value pairs", func() {
+			connString, duration, err := extractMaxQueryDuration(
+				"dbname=skygear max_query_duration=500ms sslmode=disable")
+			So(err, ShouldBeNil)
+			So(connString, ShouldEqual, "dbname=skygear sslmode=disable")
+			So(duration, ShouldEqual, 500*time.Millisecond)
+		})
 
+		Convey("keeps connection string without the parameter", func() {
+			connString, duration, err := extractMaxQueryDuration(
+				"postgres://postgres:@localhost/postgres?sslmode=disable")
 			So(err, ShouldBeNil)
-			So(len(records), ShouldEqual, 3)
-			for i, record := range records {
-				So(record.Data["title"], ShouldEqual, recordsInDB[i].Data["title"])
-				So(record.Data["cuisine"], ShouldEqual, recordsInDB[i].Data["cuisine"])
-			}
+			So(connString, ShouldEqual, "postgres://postgres:@localhost/postgres?sslmode=disable")
+			So(duration, ShouldEqual, 0)
+		})
+
+		Convey("returns error on malformed duration", func() {
+			_, _, err := extractMaxQueryDuration("dbname=skygear max_query_duration=soon")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestQueryTimeout(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+		So(db.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("note", "id1"),
+			OwnerID: "userid",
+		}), ShouldBeNil)
+
+		c.maxQueryDuration = 100 * time.Millisecond
+
+		// A query on the locked table waits until the lock is released,
+		// which makes the query slow.
+		lockTx, err := c.db.Beginx()
+		So(err, ShouldBeNil)
+		_, err = lockTx.Exec(fmt.Sprintf("LOCK TABLE %s IN ACCESS EXCLUSIVE MODE", c.tableName("note")))
+		So(err, ShouldBeNil)
+		defer lockTx.Rollback()
+
+		Convey("returns ErrQueryTimeout on slow query", func() {
+			_, err := db.Query(&skydb.Query{Type: "note"})
+			So(err, ShouldEqual, skydb.ErrQueryTimeout)
+		})
+
+		Convey("returns ErrQueryTimeout in transaction and recovers it", func() {
+			So(c.Begin(), ShouldBeNil)
+			defer c.Rollback()
+
+			_, err := db.Query(&skydb.Query{Type: "note"})
+			So(err, ShouldEqual, skydb.ErrQueryTimeout)
+
+			So(lockTx.Rollback(), ShouldBeNil)
+			records, err := exhaustRows(db.Query(&skydb.Query{Type: "note"}))
+			So(err, ShouldBeNil)
+			So(records, ShouldHaveLength, 1)
 		})
 
-		Convey("query with non-recognized desired keys", func() {
-			query := skydb.Query{
-				Type:        "restaurant",
-				DesiredKeys: []string{"pricing"},
-			}
-			_, err := exhaustRows(db.Query(&query))
+		Convey("returns records of query within duration", func() {
+			So(lockTx.Rollback(), ShouldBeNil)
 
-			So(err, ShouldNotBeNil)
+			records, err := exhaustRows(db.Query(&skydb.Query{Type: "note"}))
+			So(err, ShouldBeNil)
+			So(records, ShouldHaveLength, 1)
+			So(records[0].ID.Key, ShouldEqual, "id1")
 		})
 	})
+}
 
-	Convey("Database with JSON", t, func() {
+func TestQueryCount(t *testing.T) {
+	Convey("Database", t, func() {
 		c := getTestConn(t)
 		defer cleanupConn(t, c)
 
@@ -1068,31 +4553,31 @@ func TestQuery(t *testing.T) {
 			ID:      skydb.NewRecordID("note", "id1"),
 			OwnerID: "user_id",
 			Data: map[string]interface{}{
-				"primaryTag": "red",
-				"tags":       []interface{}{"red", "green"},
+				"noteOrder": float64(1),
+				"content":   "Hello World",
 			},
 		}
 		record2 := skydb.Record{
 			ID:      skydb.NewRecordID("note", "id2"),
 			OwnerID: "user_id",
 			Data: map[string]interface{}{
-				"primaryTag": "yellow",
-				"tags":       []interface{}{"red", "green"},
+				"noteOrder": float64(2),
+				"content":   "Bye World",
 			},
 		}
 		record3 := skydb.Record{
 			ID:      skydb.NewRecordID("note", "id3"),
 			OwnerID: "user_id",
 			Data: map[string]interface{}{
-				"primaryTag": "green",
-				"tags":       []interface{}{"red", "yellow"},
+				"noteOrder": float64(3),
+				"content":   "Good Hello",
 			},
 		}
 
 		db := c.PrivateDB("userid")
 		_, err := db.Extend("note", skydb.RecordSchema{
-			"primaryTag": skydb.FieldType{Type: skydb.TypeString},
-			"tags":       skydb.FieldType{Type: skydb.TypeJSON},
+			"noteOrder": skydb.FieldType{Type: skydb.TypeNumber},
+			"content":   skydb.FieldType{Type: skydb.TypeString},
 		})
 		So(err, ShouldBeNil)
 
@@ -1103,350 +4588,594 @@ func TestQuery(t *testing.T) {
 		err = db.Save(&record3)
 		So(err, ShouldBeNil)
 
-		Convey("query records by literal string in JSON", func() {
+		Convey("count records", func() {
+			query := skydb.Query{
+				Type: "note",
+			}
+			count, err := db.QueryCount(&query)
+
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 3)
+		})
+
+		Convey("count records by content matching", func() {
 			query := skydb.Query{
 				Type: "note",
 				Predicate: skydb.Predicate{
-					Operator: skydb.In,
+					Operator: skydb.Like,
 					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.KeyPath,
+							Value: "content",
+						},
 						skydb.Expression{
 							Type:  skydb.Literal,
-							Value: "yellow",
+							Value: "Hello%",
 						},
+					},
+				},
+			}
+			count, err := db.QueryCount(&query)
+
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+		})
+
+		Convey("count records by content with none matching", func() {
+			query := skydb.Query{
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.Like,
+					Children: []interface{}{
 						skydb.Expression{
 							Type:  skydb.KeyPath,
-							Value: "tags",
+							Value: "content",
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: "Not Exist",
 						},
 					},
 				},
 			}
-			records, err := exhaustRows(db.Query(&query))
+			count, err := db.QueryCount(&query)
 
 			So(err, ShouldBeNil)
-			So(records, ShouldResemble, []skydb.Record{record3})
+			So(count, ShouldEqual, 0)
 		})
 	})
+}
 
-	Convey("Database with ACL", t, func() {
+func TestGroupCount(t *testing.T) {
+	Convey("Database", t, func() {
 		c := getTestConn(t)
 		defer cleanupConn(t, c)
 
-		// fixture
-		record1 := skydb.Record{
-			ID:      skydb.NewRecordID("note", "id1"),
-			OwnerID: "alice",
-			ACL:     skydb.RecordACL{},
-		}
-		record2 := skydb.Record{
-			ID:      skydb.NewRecordID("note", "id2"),
-			OwnerID: "alice",
-			ACL: skydb.RecordACL{
-				skydb.NewRecordACLEntryPublic(skydb.ReadLevel),
-			},
-		}
-		record3 := skydb.Record{
-			ID:      skydb.NewRecordID("note", "id3"),
-			OwnerID: "alice",
-			ACL: skydb.RecordACL{
-				skydb.NewRecordACLEntryDirect("bob", skydb.ReadLevel),
-			},
-		}
-		record4 := skydb.Record{
-			ID:      skydb.NewRecordID("note", "id4"),
-			OwnerID: "alice",
-			ACL: skydb.RecordACL{
-				skydb.NewRecordACLEntryRole("marketing", skydb.ReadLevel),
-			},
-		}
-		record5 := skydb.Record{
-			ID:      skydb.NewRecordID("note", "id5"),
-			OwnerID: "alice",
-			ACL: skydb.RecordACL{
-				skydb.NewRecordACLEntryDirect("bob", skydb.ReadLevel),
-				skydb.NewRecordACLEntryRole("marketing", skydb.ReadLevel),
-			},
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"status":   skydb.FieldType{Type: skydb.TypeString},
+			"priority": skydb.FieldType{Type: skydb.TypeNumber},
+			"content":  skydb.FieldType{Type: skydb.TypeJSON},
+		})
+		So(err, ShouldBeNil)
+
+		statuses := []interface{}{"open", "closed", "open", "pending", "open", nil}
+		for i, status := range statuses {
+			record := skydb.Record{
+				ID:      skydb.NewRecordID("note", fmt.Sprintf("id%d", i)),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"priority": float64(i % 2),
+				},
+			}
+			if status != nil {
+				record.Data["status"] = status
+			}
+			So(db.Save(&record), ShouldBeNil)
 		}
 
-		db := c.PublicDB()
-		_, err := db.Extend("note", skydb.RecordSchema{})
-		So(err, ShouldBeNil)
+		Convey("count records by status", func() {
+			query := skydb.Query{
+				Type: "note",
+			}
+			counts, err := db.GroupCount(&query, "status", skydb.IncludeMissing, nil)
 
-		err = db.Save(&record1)
-		So(err, ShouldBeNil)
-		err = db.Save(&record2)
-		So(err, ShouldBeNil)
-		err = db.Save(&record3)
-		So(err, ShouldBeNil)
-		err = db.Save(&record4)
-		So(err, ShouldBeNil)
-		err = db.Save(&record5)
-		So(err, ShouldBeNil)
+			So(err, ShouldBeNil)
+			So(counts, ShouldResemble, map[interface{}]uint64{
+				"open":    3,
+				"closed":  1,
+				"pending": 1,
+				nil:       1,
+			})
+		})
 
-		sortsByID := []skydb.Sort{
-			skydb.Sort{
-				KeyPath: "_id",
-				Order:   skydb.Ascending,
-			},
-		}
+		Convey("count records by status excluding missing status", func() {
+			query := skydb.Query{
+				Type: "note",
+			}
+			counts, err := db.GroupCount(&query, "status", skydb.ExcludeMissing, nil)
 
-		Convey("can be queried by owner", func() {
+			So(err, ShouldBeNil)
+			So(counts, ShouldResemble, map[interface{}]uint64{
+				"open":    3,
+				"closed":  1,
+				"pending": 1,
+			})
+		})
+
+		Convey("count records by status excluding missing status having count equal to 1", func() {
 			query := skydb.Query{
-				Type:       "note",
-				ViewAsUser: &skydb.UserInfo{ID: "alice"},
-				Sorts:      sortsByID,
+				Type: "note",
 			}
-			records, err := exhaustRows(db.Query(&query))
+			counts, err := db.GroupCount(&query, "status", skydb.ExcludeMissing, &skydb.HavingCount{
+				Operator: skydb.Equal,
+				Count:    1,
+			})
 
 			So(err, ShouldBeNil)
-			So(records, ShouldResemble, []skydb.Record{record1, record2, record3, record4, record5})
+			So(counts, ShouldResemble, map[interface{}]uint64{
+				"closed":  1,
+				"pending": 1,
+			})
 		})
 
-		Convey("can be queried by public", func() {
+		Convey("count records by status with predicate", func() {
 			query := skydb.Query{
-				Type:       "note",
-				ViewAsUser: nil,
-				Sorts:      sortsByID,
+				Type: "note",
+				Predicate: skydb.Predicate{
+					Operator: skydb.Equal,
+					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.KeyPath,
+							Value: "priority",
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: 0,
+						},
+					},
+				},
 			}
-			records, err := exhaustRows(db.Query(&query))
+			counts, err := db.GroupCount(&query, "status", skydb.IncludeMissing, nil)
 
 			So(err, ShouldBeNil)
-			So(records, ShouldResemble, []skydb.Record{record2})
+			So(counts, ShouldResemble, map[interface{}]uint64{
+				"open": 3,
+			})
 		})
 
-		Convey("can be queried by explicit user", func() {
+		Convey("count records by number", func() {
 			query := skydb.Query{
-				Type:       "note",
-				ViewAsUser: &skydb.UserInfo{ID: "bob"},
-				Sorts:      sortsByID,
+				Type: "note",
 			}
-			records, err := exhaustRows(db.Query(&query))
+			counts, err := db.GroupCount(&query, "priority", skydb.IncludeMissing, nil)
 
 			So(err, ShouldBeNil)
-			So(records, ShouldResemble, []skydb.Record{record2, record3, record5})
+			So(counts, ShouldResemble, map[interface{}]uint64{
+				float64(0): 3,
+				float64(1): 3,
+			})
+		})
+
+		Convey("count records by status having count greater than 1", func() {
+			query := skydb.Query{
+				Type: "note",
+			}
+			counts, err := db.GroupCount(&query, "status", skydb.IncludeMissing, &skydb.HavingCount{
+				Operator: skydb.GreaterThan,
+				Count:    1,
+			})
+
+			So(err, ShouldBeNil)
+			So(counts, ShouldResemble, map[interface{}]uint64{
+				"open": 3,
+			})
+		})
+
+		Convey("count records by status having count equal to 1", func() {
+			query := skydb.Query{
+				Type: "note",
+			}
+			counts, err := db.GroupCount(&query, "status", skydb.IncludeMissing, &skydb.HavingCount{
+				Operator: skydb.Equal,
+				Count:    1,
+			})
+
+			So(err, ShouldBeNil)
+			So(counts, ShouldResemble, map[interface{}]uint64{
+				"closed":  1,
+				"pending": 1,
+				nil:       1,
+			})
+		})
+
+		Convey("errors on unsupported having operator", func() {
+			query := skydb.Query{
+				Type: "note",
+			}
+			_, err := db.GroupCount(&query, "status", skydb.IncludeMissing, &skydb.HavingCount{
+				Operator: skydb.Like,
+				Count:    1,
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("errors on unknown key", func() {
+			query := skydb.Query{
+				Type: "note",
+			}
+			_, err := db.GroupCount(&query, "notexist", skydb.IncludeMissing, nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("errors on ungroupable key", func() {
+			query := skydb.Query{
+				Type: "note",
+			}
+			_, err := db.GroupCount(&query, "content", skydb.IncludeMissing, nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestQueryGrouped(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("task", skydb.RecordSchema{
+			"status":   skydb.FieldType{Type: skydb.TypeString},
+			"priority": skydb.FieldType{Type: skydb.TypeNumber},
+			"content":  skydb.FieldType{Type: skydb.TypeJSON},
 		})
+		So(err, ShouldBeNil)
+
+		statuses := []interface{}{"open", "closed", "open", nil, "open", "closed"}
+		for i, status := range statuses {
+			record := skydb.Record{
+				ID:      skydb.NewRecordID("task", fmt.Sprintf("id%d", i)),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"priority": float64(i),
+				},
+			}
+			if status != nil {
+				record.Data["status"] = status
+			}
+			So(db.Save(&record), ShouldBeNil)
+		}
+
+		groupKeys := func(groups map[interface{}][]skydb.Record) map[interface{}][]string {
+			keys := map[interface{}][]string{}
+			for value, records := range groups {
+				for _, record := range records {
+					keys[value] = append(keys[value], record.ID.Key)
+				}
+			}
+			return keys
+		}
 
-		Convey("can be queried by explicit role", func() {
+		Convey("groups records by status with sorts applied within groups", func() {
 			query := skydb.Query{
-				Type: "note",
-				ViewAsUser: &skydb.UserInfo{
-					ID:    "carol",
-					Roles: []string{"marketing"},
+				Type: "task",
+				Sorts: []skydb.Sort{
+					{KeyPath: "priority", Order: skydb.Descending},
 				},
-				Sorts: sortsByID,
 			}
-			records, err := exhaustRows(db.Query(&query))
+			groups, err := db.QueryGrouped(&query, "status")
 
 			So(err, ShouldBeNil)
-			So(records, ShouldResemble, []skydb.Record{record2, record4, record5})
+			So(groupKeys(groups), ShouldResemble, map[interface{}][]string{
+				"open":   {"id4", "id2", "id0"},
+				"closed": {"id5", "id1"},
+				nil:      {"id3"},
+			})
 		})
 
-		Convey("can be queried by explicit user and role", func() {
+		Convey("groups records matching predicate", func() {
 			query := skydb.Query{
-				Type: "note",
-				ViewAsUser: &skydb.UserInfo{
-					ID:    "bob",
-					Roles: []string{"marketing"},
+				Type: "task",
+				Predicate: skydb.Predicate{
+					Operator: skydb.GreaterThan,
+					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.KeyPath,
+							Value: "priority",
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: 1,
+						},
+					},
+				},
+				Sorts: []skydb.Sort{
+					{KeyPath: "priority", Order: skydb.Ascending},
 				},
-				Sorts: sortsByID,
 			}
-			records, err := exhaustRows(db.Query(&query))
+			groups, err := db.QueryGrouped(&query, "status")
 
 			So(err, ShouldBeNil)
-			So(records, ShouldResemble, []skydb.Record{record2, record3, record4, record5})
+			So(groupKeys(groups), ShouldResemble, map[interface{}][]string{
+				"open":   {"id2", "id4"},
+				"closed": {"id5"},
+				nil:      {"id3"},
+			})
 		})
 
-		Convey("can be queried with bypass access control", func() {
-			query := skydb.Query{
-				Type: "note",
-				ViewAsUser: &skydb.UserInfo{
-					ID: "dave",
-				},
-				Sorts:               sortsByID,
-				BypassAccessControl: true,
-			}
-			records, err := exhaustRows(db.Query(&query))
+		Convey("errors on key of unsupported type", func() {
+			_, err := db.QueryGrouped(&skydb.Query{Type: "task"}, "content")
+			So(err, ShouldNotBeNil)
+		})
 
+		Convey("errors on unknown key", func() {
+			_, err := db.QueryGrouped(&skydb.Query{Type: "task"}, "notexist")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("returns no groups for type not yet created", func() {
+			groups, err := db.QueryGrouped(&skydb.Query{Type: "notexist"}, "status")
 			So(err, ShouldBeNil)
-			So(records, ShouldResemble, []skydb.Record{record1, record2, record3, record4, record5})
+			So(groups, ShouldBeEmpty)
 		})
 	})
+}
 
-	Convey("Empty Conn", t, func() {
+func TestAggregate(t *testing.T) {
+	Convey("Database", t, func() {
 		c := getTestConn(t)
 		defer cleanupConn(t, c)
 
-		Convey("gets no users", func() {
-			userinfo := skydb.UserInfo{}
-			err := c.GetUser("notexistuserid", &userinfo)
-			So(err, ShouldEqual, skydb.ErrUserNotFound)
+		db := c.PrivateDB("userid")
+		_, err := db.Extend("order", skydb.RecordSchema{
+			"amount": skydb.FieldType{Type: skydb.TypeNumber},
+			"item":   skydb.FieldType{Type: skydb.TypeString},
 		})
+		So(err, ShouldBeNil)
 
-		Convey("gets no users with principal", func() {
-			userinfo := skydb.UserInfo{}
-			err := c.GetUserByPrincipalID("com.example:johndoe", &userinfo)
-			So(err, ShouldEqual, skydb.ErrUserNotFound)
-		})
+		amounts := []interface{}{float64(1), float64(2), nil, float64(3), float64(6)}
+		for i, amount := range amounts {
+			record := skydb.Record{
+				ID:      skydb.NewRecordID("order", fmt.Sprintf("id%d", i)),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"item": "apple",
+				},
+			}
+			if amount != nil {
+				record.Data["amount"] = amount
+			}
+			So(db.Save(&record), ShouldBeNil)
+		}
 
-		Convey("query no users", func() {
-			emails := []string{"user@example.com"}
-			result, err := c.QueryUser(emails, []string{})
+		query := skydb.Query{
+			Type: "order",
+		}
+
+		Convey("sum of amount", func() {
+			result, skipped, err := db.Aggregate(&query, "amount", skydb.SumAgg)
 			So(err, ShouldBeNil)
-			So(len(result), ShouldEqual, 0)
+			So(result, ShouldEqual, 12)
+			So(skipped, ShouldEqual, 1)
 		})
 
-		Convey("updates no users", func() {
-			userinfo := skydb.UserInfo{
-				ID: "notexistuserid",
-			}
-			err := c.UpdateUser(&userinfo)
-			So(err, ShouldEqual, skydb.ErrUserNotFound)
+		Convey("average of amount", func() {
+			result, skipped, err := db.Aggregate(&query, "amount", skydb.AvgAgg)
+			So(err, ShouldBeNil)
+			So(result, ShouldEqual, 3)
+			So(skipped, ShouldEqual, 1)
 		})
 
-		Convey("deletes no users", func() {
-			err := c.DeleteUser("notexistuserid")
-			So(err, ShouldEqual, skydb.ErrUserNotFound)
+		Convey("minimum of amount", func() {
+			result, skipped, err := db.Aggregate(&query, "amount", skydb.MinAgg)
+			So(err, ShouldBeNil)
+			So(result, ShouldEqual, 1)
+			So(skipped, ShouldEqual, 1)
 		})
 
-		Convey("gets no devices", func() {
-			device := skydb.Device{}
-			err := c.GetDevice("notexistdeviceid", &device)
-			So(err, ShouldEqual, skydb.ErrDeviceNotFound)
+		Convey("maximum of amount", func() {
+			result, skipped, err := db.Aggregate(&query, "amount", skydb.MaxAgg)
+			So(err, ShouldBeNil)
+			So(result, ShouldEqual, 6)
+			So(skipped, ShouldEqual, 1)
 		})
 
-		Convey("deletes no devices", func() {
-			err := c.DeleteDevice("notexistdeviceid")
-			So(err, ShouldEqual, skydb.ErrDeviceNotFound)
+		Convey("aggregate with predicate", func() {
+			query.Predicate = skydb.Predicate{
+				Operator: skydb.GreaterThan,
+				Children: []interface{}{
+					skydb.Expression{
+						Type:  skydb.KeyPath,
+						Value: "amount",
+					},
+					skydb.Expression{
+						Type:  skydb.Literal,
+						Value: 1,
+					},
+				},
+			}
+			result, skipped, err := db.Aggregate(&query, "amount", skydb.SumAgg)
+			So(err, ShouldBeNil)
+			So(result, ShouldEqual, 11)
+			So(skipped, ShouldEqual, 0)
 		})
 
-		Convey("Empty Database", func() {
-			db := c.PublicDB()
-
-			Convey("gets nothing", func() {
-				record := skydb.Record{}
-
-				err := db.Get(skydb.NewRecordID("type", "notexistid"), &record)
-
-				So(err, ShouldEqual, skydb.ErrRecordNotFound)
-			})
-
-			Convey("deletes nothing", func() {
-				err := db.Delete(skydb.NewRecordID("type", "notexistid"))
-				So(err, ShouldEqual, skydb.ErrRecordNotFound)
-			})
-
-			Convey("queries nothing", func() {
-				query := skydb.Query{
-					Type: "notexisttype",
-				}
-
-				records, err := exhaustRows(db.Query(&query))
-
-				So(err, ShouldBeNil)
-				So(records, ShouldBeEmpty)
-			})
+		Convey("errors on non-numeric key", func() {
+			_, _, err := db.Aggregate(&query, "item", skydb.SumAgg)
+			So(err, ShouldNotBeNil)
 		})
 	})
 }
 
-func TestQueryCount(t *testing.T) {
-	Convey("Database", t, func() {
-		c := getTestConn(t)
+func TestRollup(t *testing.T) {
+	Convey("Database with rollups", t, func() {
+		c := getTestConnWithConfig(t, testAppName(), skydb.Config{
+			Rollups: map[string]skydb.Rollup{
+				"daily_sale_count": {
+					SourceType: "sale",
+					GroupKey:   "day",
+				},
+				"daily_sale_amount": {
+					SourceType: "sale",
+					GroupKey:   "day",
+					Aggregate:  skydb.SumAgg,
+					Field:      "amount",
+				},
+			},
+		})
 		defer cleanupConn(t, c)
 
-		// fixture
-		record1 := skydb.Record{
-			ID:      skydb.NewRecordID("note", "id1"),
-			OwnerID: "user_id",
-			Data: map[string]interface{}{
-				"noteOrder": float64(1),
-				"content":   "Hello World",
-			},
+		db := c.PublicDB()
+		_, err := db.Extend("sale", skydb.RecordSchema{
+			"day":    skydb.FieldType{Type: skydb.TypeString},
+			"amount": skydb.FieldType{Type: skydb.TypeNumber},
+		})
+		So(err, ShouldBeNil)
+
+		sales := []struct {
+			key    string
+			day    string
+			amount float64
+		}{
+			{"sale0", "2016-01-01", 1},
+			{"sale1", "2016-01-01", 2},
+			{"sale2", "2016-01-02", 4},
 		}
-		record2 := skydb.Record{
-			ID:      skydb.NewRecordID("note", "id2"),
-			OwnerID: "user_id",
-			Data: map[string]interface{}{
-				"noteOrder": float64(2),
-				"content":   "Bye World",
-			},
+		for _, sale := range sales {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("sale", sale.key),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"day":    sale.day,
+					"amount": sale.amount,
+				},
+			}), ShouldBeNil)
 		}
-		record3 := skydb.Record{
-			ID:      skydb.NewRecordID("note", "id3"),
-			OwnerID: "user_id",
-			Data: map[string]interface{}{
-				"noteOrder": float64(3),
-				"content":   "Good Hello",
-			},
+
+		rollupValue := func(derivedType string, key string) interface{} {
+			record := skydb.Record{}
+			if err := db.Get(skydb.NewRecordID(derivedType, key), &record); err != nil {
+				return err
+			}
+			return record.Data["value"]
 		}
 
-		db := c.PrivateDB("userid")
-		_, err := db.Extend("note", skydb.RecordSchema{
-			"noteOrder": skydb.FieldType{Type: skydb.TypeNumber},
-			"content":   skydb.FieldType{Type: skydb.TypeString},
-		})
-		So(err, ShouldBeNil)
+		Convey("aggregates inserted records by group", func() {
+			So(rollupValue("daily_sale_count", "2016-01-01"), ShouldEqual, 2)
+			So(rollupValue("daily_sale_count", "2016-01-02"), ShouldEqual, 1)
+			So(rollupValue("daily_sale_amount", "2016-01-01"), ShouldEqual, 3)
+			So(rollupValue("daily_sale_amount", "2016-01-02"), ShouldEqual, 4)
 
-		err = db.Save(&record2)
-		So(err, ShouldBeNil)
-		err = db.Save(&record1)
-		So(err, ShouldBeNil)
-		err = db.Save(&record3)
-		So(err, ShouldBeNil)
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("daily_sale_count", "2016-01-01"), &record), ShouldBeNil)
+			So(record.Data["group"], ShouldEqual, "2016-01-01")
+		})
 
-		Convey("count records", func() {
+		Convey("queries derived records", func() {
 			query := skydb.Query{
-				Type: "note",
+				Type: "daily_sale_amount",
+				Sorts: []skydb.Sort{
+					{
+						KeyPath: "group",
+						Order:   skydb.Ascending,
+					},
+				},
 			}
-			count, err := db.QueryCount(&query)
-
+			records, err := exhaustRows(db.Query(&query))
 			So(err, ShouldBeNil)
-			So(count, ShouldEqual, 3)
+			So(len(records), ShouldEqual, 2)
+			So(records[0].Data["group"], ShouldEqual, "2016-01-01")
+			So(records[0].Data["value"], ShouldEqual, 3)
+			So(records[1].Data["group"], ShouldEqual, "2016-01-02")
+			So(records[1].Data["value"], ShouldEqual, 4)
 		})
 
-		Convey("count records by content matching", func() {
-			query := skydb.Query{
-				Type: "note",
+		Convey("updates derived records on delete", func() {
+			So(db.Delete(skydb.NewRecordID("sale", "sale0")), ShouldBeNil)
+			So(rollupValue("daily_sale_count", "2016-01-01"), ShouldEqual, 1)
+			So(rollupValue("daily_sale_amount", "2016-01-01"), ShouldEqual, 2)
+		})
+
+		Convey("moves record between groups on update", func() {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("sale", "sale2"),
+				OwnerID: "userid",
+				Data: map[string]interface{}{
+					"day":    "2016-01-01",
+					"amount": float64(4),
+				},
+			}), ShouldBeNil)
+			So(rollupValue("daily_sale_count", "2016-01-01"), ShouldEqual, 3)
+			So(rollupValue("daily_sale_amount", "2016-01-01"), ShouldEqual, 7)
+			So(rollupValue("daily_sale_count", "2016-01-02"), ShouldEqual, skydb.ErrRecordNotFound)
+			So(rollupValue("daily_sale_amount", "2016-01-02"), ShouldEqual, skydb.ErrRecordNotFound)
+		})
+
+		Convey("removes derived record when group is emptied", func() {
+			So(db.Delete(skydb.NewRecordID("sale", "sale2")), ShouldBeNil)
+			So(rollupValue("daily_sale_count", "2016-01-02"), ShouldEqual, skydb.ErrRecordNotFound)
+			So(rollupValue("daily_sale_count", "2016-01-01"), ShouldEqual, 2)
+		})
+
+		dayQuery := func(day string) *skydb.Query {
+			return &skydb.Query{
+				Type: "sale",
 				Predicate: skydb.Predicate{
-					Operator: skydb.Like,
+					Operator: skydb.Equal,
 					Children: []interface{}{
-						skydb.Expression{
-							Type:  skydb.KeyPath,
-							Value: "content",
-						},
-						skydb.Expression{
-							Type:  skydb.Literal,
-							Value: "Hello%",
-						},
+						skydb.Expression{Type: skydb.KeyPath, Value: "day"},
+						skydb.Expression{Type: skydb.Literal, Value: day},
 					},
 				},
+				BypassAccessControl: true,
 			}
-			count, err := db.QueryCount(&query)
+		}
 
+		Convey("updates derived records on delete by query", func() {
+			n, err := db.DeleteByQuery(dayQuery("2016-01-01"))
 			So(err, ShouldBeNil)
-			So(count, ShouldEqual, 1)
+			So(n, ShouldEqual, 2)
+			So(rollupValue("daily_sale_count", "2016-01-01"), ShouldEqual, skydb.ErrRecordNotFound)
+			So(rollupValue("daily_sale_count", "2016-01-02"), ShouldEqual, 1)
 		})
 
-		Convey("count records by content with none matching", func() {
-			query := skydb.Query{
-				Type: "note",
-				Predicate: skydb.Predicate{
-					Operator: skydb.Like,
-					Children: []interface{}{
-						skydb.Expression{
-							Type:  skydb.KeyPath,
-							Value: "content",
-						},
-						skydb.Expression{
-							Type:  skydb.Literal,
-							Value: "Not Exist",
-						},
+		Convey("updates derived records on update by query", func() {
+			n, err := db.UpdateByQuery(dayQuery("2016-01-01"), map[string]interface{}{
+				"amount": float64(10),
+			})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+			So(rollupValue("daily_sale_count", "2016-01-01"), ShouldEqual, 2)
+			So(rollupValue("daily_sale_amount", "2016-01-01"), ShouldEqual, 20)
+		})
+
+		Convey("derives records from existing records when configured", func() {
+			configured := getTestConnWithConfig(t, c.appName, skydb.Config{
+				Rollups: map[string]skydb.Rollup{
+					"daily_sale_max": {
+						SourceType: "sale",
+						GroupKey:   "day",
+						Aggregate:  skydb.MaxAgg,
+						Field:      "amount",
 					},
 				},
-			}
-			count, err := db.QueryCount(&query)
-
+			})
+			defer configured.Close()
+			configuredDB := configured.PublicDB()
+			_, err := configuredDB.Extend("sale", skydb.RecordSchema{})
 			So(err, ShouldBeNil)
-			So(count, ShouldEqual, 0)
+			So(rollupValue("daily_sale_max", "2016-01-01"), ShouldEqual, 2)
+			So(rollupValue("daily_sale_max", "2016-01-02"), ShouldEqual, 4)
+
+			Convey("aggregating maximum again when it is removed", func() {
+				So(configuredDB.Delete(skydb.NewRecordID("sale", "sale1")), ShouldBeNil)
+				So(rollupValue("daily_sale_max", "2016-01-01"), ShouldEqual, 1)
+			})
+
+			Convey("stopping maintaining removed rollups", func() {
+				So(db.Delete(skydb.NewRecordID("sale", "sale2")), ShouldBeNil)
+				So(rollupValue("daily_sale_count", "2016-01-02"), ShouldEqual, 1)
+			})
 		})
 	})
 }
@@ -2477,3 +6206,15 @@ func TestRecordUnknownField(t *testing.T) {
 		})
 	})
 }
+
+// haversineDistance returns the distance in meters between two locations
+// on the sphere used by ST_Distance_Sphere.
+func haversineDistance(from, to skydb.Location) float64 {
+	const radius = 6370986
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := rad(to.Lat() - from.Lat())
+	dLng := rad(to.Lng() - from.Lng())
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(from.Lat()))*math.Cos(rad(to.Lat()))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * radius * math.Asin(math.Sqrt(a))
+}
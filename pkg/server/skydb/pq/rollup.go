@@ -0,0 +1,335 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+)
+
+// rollupColumnPrefix is the prefix of the columns of a derived record
+// type holding the state of its rollup, which are not record fields.
+const rollupColumnPrefix = "_rollup_"
+
+// rollupTrigger is the trigger maintaining the derived records of a
+// rollup, named after the rollup such that a changed rollup has a
+// trigger of another name.
+type rollupTrigger struct {
+	name        string
+	derivedType string
+	rollup      skydb.Rollup
+}
+
+// rollupTriggers returns the triggers of the rollups of records of
+// sourceType, skipping rollups of fields not in typemap.
+func (db *database) rollupTriggers(sourceType string, typemap skydb.RecordSchema) []rollupTrigger {
+	triggers := []rollupTrigger{}
+	for derivedType, rollup := range db.c.config.Rollups {
+		if rollup.SourceType != sourceType {
+			continue
+		}
+		if _, ok := typemap[rollup.GroupKey]; !ok {
+			continue
+		}
+		if _, ok := typemap[rollup.Field]; rollup.Aggregate != 0 && !ok {
+			continue
+		}
+
+		sum := sha1.Sum([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%s",
+			derivedType, rollup.GroupKey, rollup.Aggregate, rollup.Field)))
+		triggers = append(triggers, rollupTrigger{
+			name:        boundedIdentifier(fmt.Sprintf("rollup_%s_%s", derivedType, hex.EncodeToString(sum[:])[:8])),
+			derivedType: derivedType,
+			rollup:      rollup,
+		})
+	}
+	sort.Slice(triggers, func(i, j int) bool {
+		return triggers[i].name < triggers[j].name
+	})
+	return triggers
+}
+
+// outdatedRollups returns the rollup triggers of records of sourceType
+// to be created, and the names of the rollup triggers on its table not
+// of a configured rollup.
+func (db *database) outdatedRollups(sourceType string, typemap skydb.RecordSchema, tableExists bool) ([]rollupTrigger, []string, error) {
+	existing := map[string]bool{}
+	if tableExists {
+		rows, err := db.c.Queryx(`
+SELECT t.tgname
+FROM pg_catalog.pg_trigger t
+     JOIN pg_catalog.pg_class c ON c.oid = t.tgrelid
+     JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+WHERE n.nspname = $1 AND c.relname = $2 AND t.tgname LIKE 'rollup\_%'`,
+			db.schemaName(), sourceType)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return nil, nil, err
+			}
+			existing[name] = true
+		}
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	missing := []rollupTrigger{}
+	for _, trigger := range db.rollupTriggers(sourceType, typemap) {
+		if existing[trigger.name] {
+			delete(existing, trigger.name)
+		} else {
+			missing = append(missing, trigger)
+		}
+	}
+
+	stale := []string{}
+	for name := range existing {
+		stale = append(stale, name)
+	}
+	sort.Strings(stale)
+	return missing, stale, nil
+}
+
+// extendDerivedType extends the derived record type of the rollup to
+// hold the group and the value of its groups, and the state of the
+// rollup.
+func (db *database) extendDerivedType(trigger rollupTrigger, groupType skydb.FieldType) error {
+	if groupType.Type == skydb.TypeSequence {
+		groupType.Type = skydb.TypeInteger
+	}
+	_, err := db.Extend(trigger.derivedType, skydb.RecordSchema{
+		"group": skydb.FieldType{
+			Type:          groupType.Type,
+			ReferenceType: groupType.ReferenceType,
+		},
+		"value":                            skydb.FieldType{Type: skydb.TypeNumber},
+		rollupColumnPrefix + "count":       skydb.FieldType{Type: skydb.TypeInteger},
+		rollupColumnPrefix + "field_count": skydb.FieldType{Type: skydb.TypeInteger},
+		rollupColumnPrefix + "sum":         skydb.FieldType{Type: skydb.TypeNumber},
+	})
+	return err
+}
+
+// createRollup creates the trigger maintaining the derived records of
+// the rollup, and derives the records from the existing source records.
+//
+// The trigger adds each written source record to its group and removes
+// it from the group it was in, whatever writes it, such that records
+// written in bulk or deleted by a foreign key are rolled up as well.
+// Writes to the same group are serialized by an advisory lock of the
+// group.
+func (db *database) createRollup(tx *sqlx.Tx, trigger rollupTrigger, groupType skydb.FieldType) error {
+	function := db.schemaName() + "." + pq.QuoteIdentifier(trigger.name)
+	if _, err := tx.Exec(db.createRollupFunctionStmt(function, trigger, groupType)); err != nil {
+		return err
+	}
+
+	stmt := fmt.Sprintf(`CREATE TRIGGER %s
+		AFTER INSERT OR UPDATE OR DELETE ON %s FOR EACH ROW
+		EXECUTE PROCEDURE %s()`,
+		pq.QuoteIdentifier(trigger.name),
+		db.tableName(trigger.rollup.SourceType),
+		function)
+	if _, err := tx.Exec(stmt); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s", db.tableName(trigger.derivedType))); err != nil {
+		return err
+	}
+
+	valueSQL := rollupAggregateSQL(trigger.rollup.Aggregate)
+	stmt = fmt.Sprintf(`INSERT INTO %[1]s
+		(_id, _database_id, _owner_id, _created_at, _created_by, _updated_at, _updated_by,
+		 "group", "value", _rollup_count, _rollup_field_count, _rollup_sum)
+	SELECT key, '', min(_owner_id), $1, min(_owner_id), $1, min(_owner_id),
+		(array_agg(grp))[1], %[2]s, count(*), count(value), COALESCE(sum(value), 0)
+	FROM (
+		SELECT %[3]s AS key, s.%[4]s AS grp, s._owner_id, %[5]s AS value
+		FROM %[6]s AS s
+	) AS s
+	WHERE key IS NOT NULL
+	GROUP BY key`,
+		db.tableName(trigger.derivedType),
+		valueSQL,
+		rollupKeySQL("s", trigger.rollup.GroupKey, groupType),
+		pq.QuoteIdentifier(trigger.rollup.GroupKey),
+		rollupValueSQL("s", trigger.rollup),
+		db.tableName(trigger.rollup.SourceType))
+	_, err := tx.Exec(stmt, time.Now().UTC())
+	return err
+}
+
+// dropRollup drops the rollup trigger of name and its function. The
+// derived records are kept.
+func (db *database) dropRollup(tx *sqlx.Tx, name string) error {
+	_, err := tx.Exec(fmt.Sprintf("DROP FUNCTION IF EXISTS %s.%s() CASCADE",
+		db.schemaName(), pq.QuoteIdentifier(name)))
+	return err
+}
+
+func (db *database) createRollupFunctionStmt(function string, trigger rollupTrigger, groupType skydb.FieldType) string {
+	derived := db.tableName(trigger.derivedType)
+	source := db.tableName(trigger.rollup.SourceType)
+	group := pq.QuoteIdentifier(trigger.rollup.GroupKey)
+	lockKey, _ := quoteLiteral(db.schemaName() + "." + trigger.derivedType)
+
+	// The value of a group is updated incrementally, except the minimum
+	// or maximum, which is aggregated again if the record holding it is
+	// removed from the group.
+	var removeSQL, addSQL, valueSQL string
+	switch trigger.rollup.Aggregate {
+	case skydb.MinAgg, skydb.MaxAgg:
+		fn, agg := "LEAST", "min"
+		if trigger.rollup.Aggregate == skydb.MaxAgg {
+			fn, agg = "GREATEST", "max"
+		}
+		removeSQL = fmt.Sprintf(`UPDATE %[1]s AS d
+				SET "value" = COALESCE((SELECT %[2]s(s.%[3]s) FROM %[4]s AS s WHERE s.%[5]s = d."group"), 0)
+				WHERE d._id = old_key AND old_value IS NOT NULL AND d."value" = old_value;`,
+			derived, agg, pq.QuoteIdentifier(trigger.rollup.Field), source, group)
+		addSQL = fmt.Sprintf(`UPDATE %[1]s
+				SET "value" = CASE WHEN _rollup_field_count = 1 THEN new_value ELSE %[2]s("value", new_value) END
+				WHERE _id = new_key AND new_value IS NOT NULL;`,
+			derived, fn)
+	case skydb.SumAgg:
+		valueSQL = "_rollup_sum"
+	case skydb.AvgAgg:
+		valueSQL = "COALESCE(_rollup_sum / NULLIF(_rollup_field_count, 0), 0)"
+	default:
+		valueSQL = "_rollup_count"
+	}
+	if valueSQL != "" {
+		valueSQL = fmt.Sprintf(`UPDATE %s SET "value" = %s WHERE _id IN (old_key, new_key);`,
+			derived, valueSQL)
+	}
+
+	return fmt.Sprintf(`CREATE OR REPLACE FUNCTION %[1]s() RETURNS TRIGGER AS $$
+	DECLARE
+		old_key text;
+		new_key text;
+		old_value double precision;
+		new_value double precision;
+		now_utc timestamp without time zone := timezone('UTC', now());
+	BEGIN
+		IF TG_OP <> 'INSERT' THEN
+			old_key := %[4]s;
+			old_value := %[5]s;
+		END IF;
+		IF TG_OP <> 'DELETE' THEN
+			new_key := %[6]s;
+			new_value := %[7]s;
+		END IF;
+		IF old_key IS NOT DISTINCT FROM new_key AND old_value IS NOT DISTINCT FROM new_value THEN
+			RETURN NULL;
+		END IF;
+
+		-- Groups are locked in order of their keys to avoid deadlocks.
+		IF old_key IS NOT NULL AND (new_key IS NULL OR old_key < new_key) THEN
+			PERFORM pg_advisory_xact_lock(hashtext(%[8]s), hashtext(old_key));
+		END IF;
+		IF new_key IS NOT NULL THEN
+			PERFORM pg_advisory_xact_lock(hashtext(%[8]s), hashtext(new_key));
+		END IF;
+		IF old_key IS NOT NULL AND new_key IS NOT NULL AND old_key > new_key THEN
+			PERFORM pg_advisory_xact_lock(hashtext(%[8]s), hashtext(old_key));
+		END IF;
+
+		IF old_key IS NOT NULL THEN
+			UPDATE %[2]s SET
+				_rollup_count = _rollup_count - 1,
+				_rollup_field_count = _rollup_field_count - (old_value IS NOT NULL)::integer,
+				_rollup_sum = _rollup_sum - COALESCE(old_value, 0),
+				_updated_at = now_utc
+			WHERE _id = old_key;
+			DELETE FROM %[2]s WHERE _id = old_key AND _rollup_count <= 0;
+			%[9]s
+		END IF;
+
+		IF new_key IS NOT NULL THEN
+			INSERT INTO %[2]s AS d
+				(_id, _database_id, _owner_id, _created_at, _created_by, _updated_at, _updated_by,
+				 "group", "value", _rollup_count, _rollup_field_count, _rollup_sum)
+			VALUES (new_key, '', NEW._owner_id, now_utc, NEW._owner_id, now_utc, NEW._owner_id,
+				NEW.%[3]s, 0, 1, (new_value IS NOT NULL)::integer, COALESCE(new_value, 0))
+			ON CONFLICT (_id) DO UPDATE SET
+				_rollup_count = d._rollup_count + 1,
+				_rollup_field_count = d._rollup_field_count + (new_value IS NOT NULL)::integer,
+				_rollup_sum = d._rollup_sum + COALESCE(new_value, 0),
+				_updated_at = now_utc;
+			%[10]s
+		END IF;
+
+		%[11]s
+		RETURN NULL;
+	END;
+$$ LANGUAGE plpgsql`,
+		function,
+		derived,
+		group,
+		rollupKeySQL("OLD", trigger.rollup.GroupKey, groupType),
+		rollupValueSQL("OLD", trigger.rollup),
+		rollupKeySQL("NEW", trigger.rollup.GroupKey, groupType),
+		rollupValueSQL("NEW", trigger.rollup),
+		lockKey,
+		removeSQL,
+		addSQL,
+		valueSQL)
+}
+
+// rollupKeySQL returns the SQL of the key of the derived record of the
+// group of row, which is the value of the group key in text, or NULL if
+// row is not rolled up.
+func rollupKeySQL(row string, groupKey string, groupType skydb.FieldType) string {
+	column := row + "." + pq.QuoteIdentifier(groupKey)
+	if groupType.Type == skydb.TypeDateTime {
+		// Formats the time as time.RFC3339Nano does in UTC.
+		return fmt.Sprintf(`rtrim(rtrim(to_char(%s, 'YYYY-MM-DD"T"HH24:MI:SS.US'), '0'), '.') || 'Z'`, column)
+	}
+	return fmt.Sprintf(`NULLIF(%s::text, '')`, column)
+}
+
+// rollupValueSQL returns the SQL of the value of row aggregated by the
+// rollup, or NULL if the rollup counts records.
+func rollupValueSQL(row string, rollup skydb.Rollup) string {
+	if rollup.Aggregate == 0 {
+		return "NULL::double precision"
+	}
+	return fmt.Sprintf("%s.%s::double precision", row, pq.QuoteIdentifier(rollup.Field))
+}
+
+// rollupAggregateSQL returns the SQL aggregating the values of a group
+// by the aggregate function, or counting the records of a group if fn
+// is zero.
+func rollupAggregateSQL(fn skydb.AggFunc) string {
+	if fn == 0 {
+		return "count(*)"
+	}
+	aggSQL, _ := aggFuncSQL(fn)
+	return fmt.Sprintf("COALESCE(%s(value), 0)", aggSQL)
+}
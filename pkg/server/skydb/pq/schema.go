@@ -16,8 +16,11 @@ package pq
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/Sirupsen/logrus"
@@ -34,7 +37,25 @@ func (db *database) Extend(recordType string, recordSchema skydb.RecordSchema) (
 		return
 	}
 
-	if len(remoteRecordSchema) > 0 && remoteRecordSchema.DefinitionSupersetOf(recordSchema) {
+	outdatedPolicies, err := db.outdatedDeletePolicies(recordType, remoteRecordSchema)
+	if err != nil {
+		return
+	}
+
+	mergedSchema := skydb.RecordSchema{}
+	for key, schema := range recordSchema {
+		mergedSchema[key] = schema
+	}
+	for key, schema := range remoteRecordSchema {
+		mergedSchema[key] = schema
+	}
+	missingRollups, staleRollups, err := db.outdatedRollups(recordType, mergedSchema, len(remoteRecordSchema) > 0)
+	if err != nil {
+		return
+	}
+
+	if len(remoteRecordSchema) > 0 && remoteRecordSchema.DefinitionSupersetOf(recordSchema) &&
+		len(outdatedPolicies) == 0 && len(missingRollups) == 0 && len(staleRollups) == 0 {
 		// The current record schema is superset of requested record
 		// schema. There is no need to extend the schema.
 		return
@@ -50,6 +71,12 @@ func (db *database) Extend(recordType string, recordSchema skydb.RecordSchema) (
 		return
 	}
 
+	for _, trigger := range missingRollups {
+		if err := db.extendDerivedType(trigger, mergedSchema[trigger.rollup.GroupKey]); err != nil {
+			return false, fmt.Errorf("failed to extend derived record type %s: %s", trigger.derivedType, err)
+		}
+	}
+
 	// Begin transaction for schema migration
 	tx, err := db.c.db.Beginx()
 	if err != nil {
@@ -65,16 +92,21 @@ func (db *database) Extend(recordType string, recordSchema skydb.RecordSchema) (
 	}
 
 	updatingSchema := skydb.RecordSchema{}
+	validationErr := skydb.ValidationError{}
 	for key, schema := range recordSchema {
 		remoteSchema, ok := remoteRecordSchema[key]
 		if !ok {
 			updatingSchema[key] = schema
 		} else if isConflict(remoteSchema, schema) {
-			return false, fmt.Errorf("conflicting schema %v => %v", remoteSchema, schema)
+			validationErr.Add(key, skydb.FieldTypeConflict,
+				fmt.Sprintf("conflicting schema on %s: %v => %v", key, remoteSchema, schema))
 		}
 
 		// same data type, do nothing
 	}
+	if err := validationErr.Err(); err != nil {
+		return false, err
+	}
 
 	if len(updatingSchema) > 0 {
 		stmt := db.addColumnStmt(recordType, updatingSchema)
@@ -84,9 +116,47 @@ func (db *database) Extend(recordType string, recordSchema skydb.RecordSchema) (
 			return false, fmt.Errorf("failed to alter table: %s", err)
 		}
 
+		for column, schema := range updatingSchema {
+			if schema.Type != skydb.TypeReference {
+				continue
+			}
+
+			// Index reference columns such that records referencing
+			// a record can be found efficiently.
+			stmt := db.createReferenceIndexStmt(recordType, column)
+			if _, err := tx.Exec(stmt); err != nil {
+				return false, fmt.Errorf("failed to create reference index: %s", err)
+			}
+
+			policy := db.deletePolicy(recordType, column)
+			if policy == skydb.DeleteSetNull {
+				stmt := db.createSetNullTriggerStmt(recordType, column)
+				if _, err := tx.Exec(stmt); err != nil {
+					return false, fmt.Errorf("failed to create set null trigger: %s", err)
+				}
+			}
+		}
+
 		extended = true
 	}
 
+	for _, p := range outdatedPolicies {
+		if err := db.alterDeletePolicy(tx, recordType, p); err != nil {
+			return false, fmt.Errorf("failed to alter delete policy of %s: %s", p.column, err)
+		}
+	}
+
+	for _, name := range staleRollups {
+		if err := db.dropRollup(tx, name); err != nil {
+			return false, fmt.Errorf("failed to drop rollup %s: %s", name, err)
+		}
+	}
+	for _, trigger := range missingRollups {
+		if err := db.createRollup(tx, trigger, mergedSchema[trigger.rollup.GroupKey]); err != nil {
+			return false, fmt.Errorf("failed to create rollup %s: %s", trigger.derivedType, err)
+		}
+	}
+
 	if err = tx.Commit(); err != nil {
 		return false, fmt.Errorf("unable to commit transaction for Extend: %s", err)
 	}
@@ -104,13 +174,24 @@ func (db *database) RenameSchema(recordType, oldName, newName string) error {
 	}
 
 	tableName := db.tableName(recordType)
-	oldName = pq.QuoteIdentifier(oldName)
-	newName = pq.QuoteIdentifier(newName)
 
-	stmt := fmt.Sprintf("ALTER TABLE %s RENAME %s TO %s", tableName, oldName, newName)
+	stmt := fmt.Sprintf("ALTER TABLE %s RENAME %s TO %s", tableName,
+		pq.QuoteIdentifier(oldName), pq.QuoteIdentifier(newName))
 	if _, err := db.c.Exec(stmt); err != nil {
 		return fmt.Errorf("failed to alter table: %s", err)
 	}
+
+	// The set null trigger of a reference column is named after and
+	// stamps the column, so it is recreated for the new name.
+	dropped, err := db.dropSetNullTrigger(recordType, oldName)
+	if err != nil {
+		return fmt.Errorf("failed to drop set null trigger: %s", err)
+	}
+	if dropped {
+		if _, err := db.c.Exec(db.createSetNullTriggerStmt(recordType, newName)); err != nil {
+			return fmt.Errorf("failed to create set null trigger: %s", err)
+		}
+	}
 	return nil
 }
 
@@ -121,6 +202,10 @@ func (db *database) DeleteSchema(recordType, columnName string) error {
 		return skyerr.NewError(skyerr.IncompatibleSchema, "Record schema requires migration but migration is disabled.")
 	}
 
+	if _, err := db.dropSetNullTrigger(recordType, columnName); err != nil {
+		return fmt.Errorf("failed to drop set null trigger: %s", err)
+	}
+
 	tableName := db.tableName(recordType)
 	columnName = pq.QuoteIdentifier(columnName)
 
@@ -171,6 +256,58 @@ func (db *database) GetRecordSchemas() (map[string]skydb.RecordSchema, error) {
 	return result, nil
 }
 
+// ListTypes checks the table of each record type for a record of the
+// Database, which is served by the index on _database_id.
+func (db *database) ListTypes() ([]string, error) {
+	rows, err := db.c.Queryx(`
+	SELECT table_name
+	FROM information_schema.tables
+	WHERE (table_name NOT LIKE '\_%') AND (table_schema=$1)
+		AND (table_type = 'BASE TABLE')
+	`, db.schemaName())
+	if err != nil {
+		return nil, err
+	}
+
+	recordTypes := []string{}
+	for rows.Next() {
+		var recordType string
+		if err := rows.Scan(&recordType); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		recordTypes = append(recordTypes, recordType)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	types := []string{}
+	for _, recordType := range recordTypes {
+		where := ""
+		args := []interface{}{}
+		if db.DatabaseType() != skydb.UnionDatabase {
+			where = "WHERE _database_id = $1"
+			args = append(args, db.userID)
+		}
+
+		var exists bool
+		err := db.c.Get(&exists, fmt.Sprintf(
+			"SELECT EXISTS (SELECT 1 FROM %s %s)",
+			db.tableName(recordType), where), args...)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			types = append(types, recordType)
+		}
+	}
+
+	sort.Strings(types)
+	return types, nil
+}
+
 func createTable(tx *sqlx.Tx, tableName string) error {
 	stmt := createTableStmt(tableName)
 	log.WithField("stmt", stmt).Debugln("Creating table")
@@ -188,6 +325,16 @@ func createTable(tx *sqlx.Tx, tableName string) error {
 		return err
 	}
 
+	stmt = fmt.Sprintf(`
+		CREATE TRIGGER trigger_log_record_change
+		AFTER INSERT OR UPDATE OR DELETE ON %s FOR EACH ROW
+		EXECUTE PROCEDURE public.log_record_change();
+	`, tableName)
+	log.WithField("stmt", stmt).Debugln("Creating trigger")
+	if _, err := tx.Exec(stmt); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -202,6 +349,16 @@ func dropTable(tx *sqlx.Tx, tableName string) error {
 		return err
 	}
 
+	stmt = fmt.Sprintf(`
+		DROP TRIGGER IF EXISTS trigger_log_record_change
+		ON %s
+		CASCADE
+	`, tableName)
+	log.WithField("stmt", stmt).Debugln("Deleting trigger")
+	if _, err := tx.Exec(stmt); err != nil {
+		return err
+	}
+
 	stmt = fmt.Sprintf(`
 		DROP TABLE IF EXISTS %s
 		CASCADE
@@ -225,6 +382,8 @@ CREATE TABLE %s (
     _created_by text,
     _updated_at timestamp without time zone NOT NULL,
     _updated_by text,
+    _null_fields jsonb,
+    _schema_version integer,
     PRIMARY KEY(_id, _database_id, _owner_id),
     UNIQUE (_id)
 );
@@ -463,9 +622,10 @@ func (db *database) addColumnStmt(recordType string, recordSchema skydb.RecordSc
 		buf.WriteByte(',')
 		switch schema.Type {
 		case skydb.TypeAsset:
-			db.writeForeignKeyConstraint(&buf, column, "_asset", "id")
+			db.writeForeignKeyConstraint(&buf, column, "_asset", "id", skydb.DeleteRestrict)
 		case skydb.TypeReference:
-			db.writeForeignKeyConstraint(&buf, column, schema.ReferenceType, "_id")
+			policy := db.deletePolicy(recordType, column)
+			db.writeForeignKeyConstraint(&buf, column, schema.ReferenceType, "_id", policy)
 		}
 	}
 
@@ -475,14 +635,196 @@ func (db *database) addColumnStmt(recordType string, recordSchema skydb.RecordSc
 	return buf.String()
 }
 
-func (db *database) writeForeignKeyConstraint(buf *bytes.Buffer, localCol, referent, remoteCol string) {
+func (db *database) createReferenceIndexStmt(recordType, column string) string {
+	return fmt.Sprintf("CREATE INDEX %s ON %s (%s)",
+		pq.QuoteIdentifier(fmt.Sprintf("%s_%s_ref", recordType, column)),
+		db.tableName(recordType),
+		pq.QuoteIdentifier(column))
+}
+
+func (db *database) writeForeignKeyConstraint(buf *bytes.Buffer, localCol, referent, remoteCol string, policy skydb.DeletePolicy) {
 	buf.Write([]byte(`ADD CONSTRAINT `))
 	buf.WriteString(pq.QuoteIdentifier(fmt.Sprintf(`fk_%s_%s_%s`, localCol, referent, remoteCol)))
-	buf.Write([]byte(` FOREIGN KEY (`))
+	buf.WriteByte(' ')
+	db.writeForeignKey(buf, localCol, referent, remoteCol, policy)
+	buf.WriteByte(',')
+}
+
+func (db *database) writeForeignKey(buf *bytes.Buffer, localCol, referent, remoteCol string, policy skydb.DeletePolicy) {
+	buf.Write([]byte(`FOREIGN KEY (`))
 	buf.WriteString(pq.QuoteIdentifier(localCol))
 	buf.Write([]byte(`) REFERENCES `))
 	buf.WriteString(db.tableName(referent))
 	buf.Write([]byte(` (`))
 	buf.WriteString(pq.QuoteIdentifier(remoteCol))
-	buf.Write([]byte(`),`))
+	buf.Write([]byte(`)`))
+	switch policy {
+	case skydb.DeleteCascade:
+		buf.Write([]byte(` ON DELETE CASCADE`))
+	case skydb.DeleteSetNull:
+		buf.Write([]byte(` ON DELETE SET NULL`))
+	}
 }
+
+// deletePolicy returns the delete policy of a reference column. The
+// group of a derived record type is deleted with the record it
+// references, as no records remain in the group once it is deleted.
+func (db *database) deletePolicy(recordType, column string) skydb.DeletePolicy {
+	if _, ok := db.c.config.Rollups[recordType]; ok && column == "group" {
+		return skydb.DeleteCascade
+	}
+	return db.c.config.DeletePolicies[recordType][column]
+}
+
+// referenceDeletePolicy is the delete policy enforced by the foreign key
+// constraint of a reference column.
+type referenceDeletePolicy struct {
+	constraint    string
+	column        string
+	referenceType string
+	policy        skydb.DeletePolicy
+}
+
+// outdatedDeletePolicies returns the delete policies of the reference
+// columns of the record type whose foreign key does not enforce the
+// configured delete policy.
+func (db *database) outdatedDeletePolicies(recordType string, typemap skydb.RecordSchema) ([]referenceDeletePolicy, error) {
+	hasReference := false
+	for _, schema := range typemap {
+		if schema.Type == skydb.TypeReference {
+			hasReference = true
+			break
+		}
+	}
+	if !hasReference {
+		return nil, nil
+	}
+
+	rows, err := db.c.Queryx(`
+SELECT con.conname, a.attname, ref.relname, con.confdeltype
+FROM pg_catalog.pg_constraint con
+     JOIN pg_catalog.pg_class c ON c.oid = con.conrelid
+     JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+     JOIN pg_catalog.pg_class ref ON ref.oid = con.confrelid
+     JOIN pg_catalog.pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = con.conkey[1]
+WHERE con.contype = 'f' AND n.nspname = $1 AND c.relname = $2 AND ref.relname <> '_asset'`,
+		db.schemaName(), recordType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	outdated := []referenceDeletePolicy{}
+	for rows.Next() {
+		var (
+			p          referenceDeletePolicy
+			deleteType string
+		)
+		if err := rows.Scan(&p.constraint, &p.column, &p.referenceType, &deleteType); err != nil {
+			return nil, err
+		}
+
+		var remotePolicy skydb.DeletePolicy
+		switch deleteType {
+		case "c":
+			remotePolicy = skydb.DeleteCascade
+		case "n":
+			remotePolicy = skydb.DeleteSetNull
+		default:
+			remotePolicy = skydb.DeleteRestrict
+		}
+
+		p.policy = db.deletePolicy(recordType, p.column)
+		if p.policy != remotePolicy {
+			outdated = append(outdated, p)
+		}
+	}
+	return outdated, rows.Err()
+}
+
+// alterDeletePolicy replaces the foreign key constraint of a reference
+// column with one enforcing the delete policy.
+func (db *database) alterDeletePolicy(tx *sqlx.Tx, recordType string, p referenceDeletePolicy) error {
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "ALTER TABLE %s DROP CONSTRAINT %s, ADD CONSTRAINT %[2]s ",
+		db.tableName(recordType), pq.QuoteIdentifier(p.constraint))
+	db.writeForeignKey(&buf, p.column, p.referenceType, "_id", p.policy)
+	if _, err := tx.Exec(buf.String()); err != nil {
+		return err
+	}
+
+	stmt := fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s",
+		pq.QuoteIdentifier(setNullTriggerName(recordType, p.column)), db.tableName(recordType))
+	if _, err := tx.Exec(stmt); err != nil {
+		return err
+	}
+
+	if p.policy == skydb.DeleteSetNull {
+		if _, err := tx.Exec(db.createSetNullTriggerStmt(recordType, p.column)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createSetNullTriggerStmt returns the statement creating the trigger
+// that stamps the records whose reference column is set to null by the
+// foreign key, such that the change is seen by sync and the field is
+// saved as null. Only updates made by the foreign key, which are nested
+// in its trigger, are stamped.
+func (db *database) createSetNullTriggerStmt(recordType, column string) string {
+	literal, _ := quoteLiteral(column)
+	return fmt.Sprintf(`CREATE TRIGGER %s
+		BEFORE UPDATE OF %s ON %s FOR EACH ROW
+		WHEN (OLD.%[2]s IS NOT NULL AND NEW.%[2]s IS NULL AND pg_trigger_depth() > 0)
+		EXECUTE PROCEDURE public.set_null_reference(%[4]s)`,
+		pq.QuoteIdentifier(setNullTriggerName(recordType, column)),
+		pq.QuoteIdentifier(column),
+		db.tableName(recordType),
+		literal)
+}
+
+// dropSetNullTrigger drops the set null trigger of the column, and
+// returns whether the column had one.
+func (db *database) dropSetNullTrigger(recordType, column string) (bool, error) {
+	name := setNullTriggerName(recordType, column)
+
+	var exists bool
+	err := db.c.QueryRowx(`
+SELECT EXISTS (
+	SELECT 1
+	FROM pg_catalog.pg_trigger t
+	     JOIN pg_catalog.pg_class c ON c.oid = t.tgrelid
+	     JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+	WHERE t.tgname = $1 AND c.relname = $2 AND n.nspname = $3
+)`, name, recordType, db.schemaName()).Scan(&exists)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	stmt := fmt.Sprintf("DROP TRIGGER %s ON %s", pq.QuoteIdentifier(name), db.tableName(recordType))
+	if _, err := db.c.Exec(stmt); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func setNullTriggerName(recordType, column string) string {
+	return boundedIdentifier(fmt.Sprintf("trigger_set_null_%s_%s", recordType, column))
+}
+
+// boundedIdentifier returns name if it fits the identifier length limit
+// of PostgreSQL, or name truncated and suffixed with its hash otherwise,
+// such that long names are neither truncated by PostgreSQL nor collide.
+func boundedIdentifier(name string) string {
+	if len(name) <= maxIdentifierLength {
+		return name
+	}
+	sum := sha1.Sum([]byte(name))
+	suffix := "_" + hex.EncodeToString(sum[:])[:8]
+	return name[:maxIdentifierLength-len(suffix)] + suffix
+}
+
+// maxIdentifierLength is the maximum length in bytes of identifiers in
+// PostgreSQL, beyond which identifiers are truncated.
+const maxIdentifierLength = 63
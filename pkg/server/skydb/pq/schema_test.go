@@ -283,6 +283,28 @@ func TestExtend(t *testing.T) {
 			So(err.Error(), ShouldStartWith, "conflicting schema")
 		})
 
+		Convey("collects all conflicts with existing column types", func() {
+			_, err := db.Extend("note", skydb.RecordSchema{
+				"content":   skydb.FieldType{Type: skydb.TypeString},
+				"noteOrder": skydb.FieldType{Type: skydb.TypeNumber},
+				"createdAt": skydb.FieldType{Type: skydb.TypeDateTime},
+			})
+			So(err, ShouldBeNil)
+
+			_, err = db.Extend("note", skydb.RecordSchema{
+				"content":   skydb.FieldType{Type: skydb.TypeNumber},
+				"noteOrder": skydb.FieldType{Type: skydb.TypeString},
+				"createdAt": skydb.FieldType{Type: skydb.TypeDateTime},
+			})
+			validationErr, ok := err.(*skydb.ValidationError)
+			So(ok, ShouldBeTrue)
+			So(len(validationErr.Errors), ShouldEqual, 2)
+			So(validationErr.Errors[0].Field, ShouldEqual, "content")
+			So(validationErr.Errors[0].Code, ShouldEqual, skydb.FieldTypeConflict)
+			So(validationErr.Errors[1].Field, ShouldEqual, "noteOrder")
+			So(validationErr.Errors[1].Code, ShouldEqual, skydb.FieldTypeConflict)
+		})
+
 		Convey("creates empty table", func() {
 			extended, err := db.Extend("note", skydb.RecordSchema{})
 			So(err, ShouldBeNil)
@@ -542,3 +564,51 @@ func TestExtend(t *testing.T) {
 		})
 	})
 }
+
+func TestListTypes(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		privateDB := c.PrivateDB("userid")
+		for _, recordType := range []string{"note", "category", "empty"} {
+			_, err := db.Extend(recordType, skydb.RecordSchema{
+				"name": skydb.FieldType{Type: skydb.TypeString},
+			})
+			So(err, ShouldBeNil)
+		}
+		_, err := privateDB.Extend("secret", skydb.RecordSchema{
+			"name": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+
+		for _, id := range []skydb.RecordID{
+			skydb.NewRecordID("note", "1"),
+			skydb.NewRecordID("note", "2"),
+			skydb.NewRecordID("category", "1"),
+		} {
+			So(db.Save(&skydb.Record{ID: id, OwnerID: "userid"}), ShouldBeNil)
+		}
+		So(privateDB.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("secret", "1"),
+			OwnerID: "userid",
+		}), ShouldBeNil)
+
+		Convey("lists sorted types having records in the database", func() {
+			types, err := db.ListTypes()
+			So(err, ShouldBeNil)
+			So(types, ShouldResemble, []string{"category", "note"})
+
+			types, err = privateDB.ListTypes()
+			So(err, ShouldBeNil)
+			So(types, ShouldResemble, []string{"secret"})
+		})
+
+		Convey("lists types of all databases in union database", func() {
+			types, err := c.UnionDB().ListTypes()
+			So(err, ShouldBeNil)
+			So(types, ShouldResemble, []string{"category", "note", "secret"})
+		})
+	})
+}
@@ -0,0 +1,143 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"math"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+)
+
+// specialFloatKey is the key of the object a special float is encoded
+// as in a JSON field.
+const specialFloatKey = "$float"
+
+func (db *database) specialFloatPolicy(recordType string) skydb.SpecialFloatPolicy {
+	return db.c.config.SpecialFloatPolicies[recordType]
+}
+
+// applySpecialFloatPolicy checks the data converted from a record of the
+// record type for special floats, which are rejected or encoded
+// according to the policy of the record type.
+func (db *database) applySpecialFloatPolicy(recordType string, data map[string]interface{}) error {
+	policy := db.specialFloatPolicy(recordType)
+	for key, value := range data {
+		switch value := value.(type) {
+		case float64:
+			if isSpecialFloat(value) && policy == skydb.RejectSpecialFloats {
+				return skydb.ErrSpecialFloat
+			}
+		case jsonSliceValue, jsonMapValue:
+			if !containsSpecialFloat(value) {
+				continue
+			}
+			if policy == skydb.RejectSpecialFloats {
+				return skydb.ErrSpecialFloat
+			}
+			data[key] = encodeSpecialFloats(value)
+		}
+	}
+	return nil
+}
+
+func isSpecialFloat(f float64) bool {
+	return math.IsNaN(f) || math.IsInf(f, 0)
+}
+
+func containsSpecialFloat(value interface{}) bool {
+	switch value := value.(type) {
+	case float64:
+		return isSpecialFloat(value)
+	case jsonSliceValue:
+		return containsSpecialFloat([]interface{}(value))
+	case jsonMapValue:
+		return containsSpecialFloat(map[string]interface{}(value))
+	case []interface{}:
+		for _, v := range value {
+			if containsSpecialFloat(v) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, v := range value {
+			if containsSpecialFloat(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encodeSpecialFloats returns a copy of value with special floats replaced
+// by the objects they are encoded as.
+func encodeSpecialFloats(value interface{}) interface{} {
+	switch value := value.(type) {
+	case float64:
+		switch {
+		case math.IsNaN(value):
+			return map[string]interface{}{specialFloatKey: "NaN"}
+		case math.IsInf(value, 1):
+			return map[string]interface{}{specialFloatKey: "Inf"}
+		case math.IsInf(value, -1):
+			return map[string]interface{}{specialFloatKey: "-Inf"}
+		}
+	case jsonSliceValue:
+		return jsonSliceValue(encodeSpecialFloats([]interface{}(value)).([]interface{}))
+	case jsonMapValue:
+		return jsonMapValue(encodeSpecialFloats(map[string]interface{}(value)).(map[string]interface{}))
+	case []interface{}:
+		encoded := make([]interface{}, len(value))
+		for i, v := range value {
+			encoded[i] = encodeSpecialFloats(v)
+		}
+		return encoded
+	case map[string]interface{}:
+		encoded := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			encoded[k] = encodeSpecialFloats(v)
+		}
+		return encoded
+	}
+	return value
+}
+
+// decodeSpecialFloats returns value decoded from a JSON field with the
+// objects special floats are encoded as replaced by the special floats.
+// It modifies value in place.
+func decodeSpecialFloats(value interface{}) interface{} {
+	switch value := value.(type) {
+	case []interface{}:
+		for i, v := range value {
+			value[i] = decodeSpecialFloats(v)
+		}
+	case map[string]interface{}:
+		if len(value) == 1 {
+			if name, ok := value[specialFloatKey].(string); ok {
+				switch name {
+				case "NaN":
+					return math.NaN()
+				case "Inf":
+					return math.Inf(1)
+				case "-Inf":
+					return math.Inf(-1)
+				}
+			}
+		}
+		for k, v := range value {
+			value[k] = decodeSpecialFloats(v)
+		}
+	}
+	return value
+}
@@ -0,0 +1,124 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pq
+
+import (
+	"math"
+	"testing"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSpecialFloatEncoding(t *testing.T) {
+	Convey("encodeSpecialFloats", t, func() {
+		value := jsonMapValue{
+			"nan":    math.NaN(),
+			"inf":    []interface{}{math.Inf(1), 1.5},
+			"nested": map[string]interface{}{"negInf": math.Inf(-1)},
+		}
+
+		encoded := encodeSpecialFloats(value)
+		So(encoded, ShouldResemble, jsonMapValue{
+			"nan":    map[string]interface{}{"$float": "NaN"},
+			"inf":    []interface{}{map[string]interface{}{"$float": "Inf"}, 1.5},
+			"nested": map[string]interface{}{"negInf": map[string]interface{}{"$float": "-Inf"}},
+		})
+		So(containsSpecialFloat(encoded), ShouldBeFalse)
+		So(math.IsNaN(value["nan"].(float64)), ShouldBeTrue)
+
+		Convey("decodes back to special floats", func() {
+			decoded := decodeSpecialFloats(map[string]interface{}(encoded.(jsonMapValue))).(map[string]interface{})
+			So(math.IsNaN(decoded["nan"].(float64)), ShouldBeTrue)
+			So(decoded["inf"], ShouldResemble, []interface{}{math.Inf(1), 1.5})
+			So(decoded["nested"], ShouldResemble, map[string]interface{}{"negInf": math.Inf(-1)})
+		})
+	})
+
+	Convey("decodeSpecialFloats", t, func() {
+		Convey("keeps objects with other keys", func() {
+			value := map[string]interface{}{"$float": "NaN", "other": 1.0}
+			So(decodeSpecialFloats(value), ShouldResemble, map[string]interface{}{"$float": "NaN", "other": 1.0})
+		})
+	})
+}
+
+func TestSpecialFloatPolicy(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		_, err := db.Extend("reading", skydb.RecordSchema{
+			"value":   skydb.FieldType{Type: skydb.TypeNumber},
+			"samples": skydb.FieldType{Type: skydb.TypeJSON},
+		})
+		So(err, ShouldBeNil)
+
+		reading := func(key string, value float64, samples []interface{}) *skydb.Record {
+			return &skydb.Record{
+				ID:      skydb.NewRecordID("reading", key),
+				OwnerID: "userid",
+				Data:    skydb.Data{"value": value, "samples": samples},
+			}
+		}
+
+		Convey("rejects special floats by default", func() {
+			So(db.Save(reading("1", math.NaN(), []interface{}{1.0})), ShouldEqual, skydb.ErrSpecialFloat)
+			So(db.Save(reading("2", 1, []interface{}{math.Inf(1)})), ShouldEqual, skydb.ErrSpecialFloat)
+			So(db.Create(reading("3", math.Inf(-1), nil), skydb.FailOnCollision), ShouldEqual, skydb.ErrSpecialFloat)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("reading", "1"), &record), ShouldEqual, skydb.ErrRecordNotFound)
+		})
+
+		Convey("returns data in the form of encoded special floats intact by default", func() {
+			samples := []interface{}{map[string]interface{}{"$float": "NaN"}}
+			So(db.Save(reading("1", 1, samples)), ShouldBeNil)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("reading", "1"), &record), ShouldBeNil)
+			So(record.Data["samples"], ShouldResemble, samples)
+		})
+
+		Convey("saves and loads special floats when encoded", func() {
+			encoding := getTestConnWithConfig(t, c.appName, skydb.Config{
+				SpecialFloatPolicies: map[string]skydb.SpecialFloatPolicy{
+					"reading": skydb.EncodeSpecialFloats,
+				},
+			})
+			defer encoding.Close()
+			db := encoding.PublicDB()
+
+			So(db.Save(reading("1", math.NaN(), []interface{}{math.Inf(1), math.Inf(-1), math.NaN(), 2.0})), ShouldBeNil)
+			So(db.Save(reading("2", math.Inf(1), nil)), ShouldBeNil)
+			So(db.Save(reading("3", math.Inf(-1), nil)), ShouldBeNil)
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("reading", "1"), &record), ShouldBeNil)
+			So(math.IsNaN(record.Data["value"].(float64)), ShouldBeTrue)
+			samples := record.Data["samples"].([]interface{})
+			So(samples[0], ShouldEqual, math.Inf(1))
+			So(samples[1], ShouldEqual, math.Inf(-1))
+			So(math.IsNaN(samples[2].(float64)), ShouldBeTrue)
+			So(samples[3], ShouldEqual, 2.0)
+
+			So(db.Get(skydb.NewRecordID("reading", "2"), &record), ShouldBeNil)
+			So(record.Data["value"], ShouldEqual, math.Inf(1))
+			So(db.Get(skydb.NewRecordID("reading", "3"), &record), ShouldBeNil)
+			So(record.Data["value"], ShouldEqual, math.Inf(-1))
+		})
+	})
+}
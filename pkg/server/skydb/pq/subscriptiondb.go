@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -123,7 +124,25 @@ func (p *jsonPredicate) UnmarshalJSON(data []byte) error {
 
 	p.Operator = v.Operator
 
-	if v.Operator.IsCompound() {
+	if v.Operator == skydb.AnyMatch {
+		children := []json.RawMessage{}
+		if err := json.Unmarshal(v.Children, &children); err != nil {
+			return err
+		}
+		if len(children) != 2 {
+			return fmt.Errorf("got len(children) = %d, want 2", len(children))
+		}
+
+		expr := skydb.Expression{}
+		if err := json.Unmarshal(children[0], &expr); err != nil {
+			return err
+		}
+		pred := jsonPredicate{}
+		if err := json.Unmarshal(children[1], &pred); err != nil {
+			return err
+		}
+		p.Children = []interface{}{expr, skydb.Predicate(pred)}
+	} else if v.Operator.IsCompound() {
 		predicates := []jsonPredicate{}
 		if err := json.Unmarshal(v.Children, &predicates); err != nil {
 			return err
@@ -195,19 +214,14 @@ func (db *database) SaveSubscription(subscription *skydb.Subscription) error {
 		nullinfo.NotificationInfo, nullinfo.Valid = *subscription.NotificationInfo, true
 	}
 
-	pkData := map[string]interface{}{
-		"id":        subscription.ID,
-		"user_id":   db.userID,
-		"device_id": subscription.DeviceID,
-	}
-
-	data := map[string]interface{}{
-		"type":              subscription.Type,
-		"notification_info": nullinfo,
-		"query":             queryValue(subscription.Query),
-	}
-
-	builder := upsertQuery(db.tableName("_subscription"), pkData, data)
+	// Unlike upsertQuery, ON CONFLICT updates the subscription inserted
+	// by a concurrent save instead of failing on the primary key, such
+	// that concurrent saves of the same subscription all succeed.
+	builder := psql.Insert(db.tableName("_subscription")).
+		Columns("id", "user_id", "device_id", "type", "notification_info", "query").
+		Values(subscription.ID, db.userID, subscription.DeviceID, subscription.Type, nullinfo, queryValue(subscription.Query)).
+		Suffix(`ON CONFLICT (user_id, device_id, id) DO UPDATE
+			SET (type, notification_info, query) = (EXCLUDED.type, EXCLUDED.notification_info, EXCLUDED.query)`)
 
 	_, err := db.c.ExecWith(builder)
 	if isDeviceNotFound(err) {
@@ -390,16 +404,47 @@ func predMatchRecord(p *skydb.Predicate, record *skydb.Record) (b bool) {
 		}
 	case skydb.Not:
 		b = !predMatchRecord(&p.GetSubPredicates()[0], record)
+	case skydb.AnyMatch:
+		keyPath, elementPredicate := p.GetAnyMatchOperands()
+		return anyElementMatch(&elementPredicate, record.Get(keyPath))
+	case skydb.IsNull:
+		// A field saved as null is present with a nil value, while
+		// a field never saved is not present at all.
+		value, ok := record.Data[p.GetExpressions()[0].Value.(string)]
+		return ok && value == nil
+	case skydb.IsAbsent:
+		_, ok := record.Data[p.GetExpressions()[0].Value.(string)]
+		return !ok
 	case skydb.Equal:
 		lv, rv := extractBinaryOperands(p.GetExpressions(), record)
-		return reflect.DeepEqual(lv, rv)
-	// case skydb.GreaterThan:
-	// case skydb.LessThan:
-	// case skydb.GreaterThanOrEqual:
-	// case skydb.LessThanOrEqual:
+		return equalValues(lv, rv)
+	case skydb.GreaterThan, skydb.LessThan, skydb.GreaterThanOrEqual, skydb.LessThanOrEqual:
+		lv, rv := extractBinaryOperands(p.GetExpressions(), record)
+		order, ok := compareValues(lv, rv)
+		if !ok {
+			return false
+		}
+		switch p.Operator {
+		case skydb.GreaterThan:
+			return order > 0
+		case skydb.LessThan:
+			return order < 0
+		case skydb.GreaterThanOrEqual:
+			return order >= 0
+		default:
+			return order <= 0
+		}
 	case skydb.NotEqual:
 		lv, rv := extractBinaryOperands(p.GetExpressions(), record)
-		return !reflect.DeepEqual(lv, rv)
+		return !equalValues(lv, rv)
+	case skydb.EqualIgnoreCase:
+		lv, rv := extractBinaryOperands(p.GetExpressions(), record)
+		ls, lok := lv.(string)
+		rs, rok := rv.(string)
+		if lok && rok {
+			return strings.EqualFold(ls, rs)
+		}
+		return equalValues(lv, rv)
 	case skydb.In:
 		lv, rv := extractBinaryOperands(p.GetExpressions(), record)
 		haystack, ok := rv.([]interface{})
@@ -410,6 +455,30 @@ func predMatchRecord(p *skydb.Predicate, record *skydb.Record) (b bool) {
 		return deepEqualIn(lv, haystack)
 	// case skydb.Like:
 	// case skydb.ILike:
+	case skydb.Functional:
+		expr := p.GetExpressions()[0]
+		switch f := expr.Value.(type) {
+		case skydb.WithinPolygonFunc:
+			switch loc := record.Get(f.Field).(type) {
+			case skydb.Location:
+				return f.Contains(loc)
+			case *skydb.Location:
+				return loc != nil && f.Contains(*loc)
+			default:
+				return false
+			}
+		case skydb.ReferenceTypeFunc:
+			switch ref := record.Get(f.Field).(type) {
+			case skydb.Reference:
+				return !ref.IsEmpty() && ref.Type() == f.Type
+			case *skydb.Reference:
+				return ref != nil && !ref.IsEmpty() && ref.Type() == f.Type
+			default:
+				return false
+			}
+		default:
+			log.Panicf("unsupported function for functional predicate = %T", expr.Value)
+		}
 	default:
 		log.Panicf("unknown Predicate.Operator = %v", p.Operator)
 	}
@@ -417,6 +486,27 @@ func predMatchRecord(p *skydb.Predicate, record *skydb.Record) (b bool) {
 	return
 }
 
+// anyElementMatch returns whether any map in the array value satisfies
+// the predicate. Values that are not arrays and elements that are not
+// maps never match.
+func anyElementMatch(p *skydb.Predicate, value interface{}) bool {
+	elements, ok := value.([]interface{})
+	if !ok {
+		return false
+	}
+
+	for _, element := range elements {
+		data, ok := element.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if predMatchRecord(p, &skydb.Record{Data: data}) {
+			return true
+		}
+	}
+	return false
+}
+
 func extractBinaryOperands(exprs []skydb.Expression, record *skydb.Record) (lv interface{}, rv interface{}) {
 	lv = extractValue(exprs[0], record)
 	rv = extractValue(exprs[1], record)
@@ -443,9 +533,137 @@ func extractValue(expr skydb.Expression, record *skydb.Record) interface{} {
 
 func deepEqualIn(needle interface{}, haystack []interface{}) bool {
 	for _, hay := range haystack {
-		if reflect.DeepEqual(needle, hay) {
+		if equalValues(needle, hay) {
 			return true
 		}
 	}
 	return false
 }
+
+// equalValues returns whether lv and rv are equal. Times are equal if
+// they are the same instant, references if they refer to the same
+// record, and numbers if they have the same value regardless of type.
+// Other values are compared deeply.
+func equalValues(lv, rv interface{}) bool {
+	if lt, rt, ok := timeOperands(lv, rv); ok {
+		return lt.Equal(rt)
+	}
+
+	if lf, ok := asFloat(lv); ok {
+		if rf, ok := asFloat(rv); ok {
+			return lf == rf
+		}
+	}
+
+	if lref, ok := asReference(lv); ok {
+		if rref, ok := asReference(rv); ok {
+			return lref.ID == rref.ID
+		}
+	}
+
+	return reflect.DeepEqual(lv, rv)
+}
+
+// compareValues returns -1, 0 or 1 if lv is less than, equal to or
+// greater than rv, or false if they cannot be ordered. Numbers, strings
+// and times can be ordered with values of the same kind; times are
+// ordered chronologically.
+func compareValues(lv, rv interface{}) (int, bool) {
+	if lt, rt, ok := timeOperands(lv, rv); ok {
+		switch {
+		case lt.Before(rt):
+			return -1, true
+		case lt.After(rt):
+			return 1, true
+		}
+		return 0, true
+	}
+
+	if lf, ok := asFloat(lv); ok {
+		if rf, ok := asFloat(rv); ok {
+			switch {
+			case lf < rf:
+				return -1, true
+			case lf > rf:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+
+	if ls, ok := lv.(string); ok {
+		if rs, ok := rv.(string); ok {
+			return strings.Compare(ls, rs), true
+		}
+	}
+
+	return 0, false
+}
+
+// timeOperands returns lv and rv as times if either is a time and the
+// other is a time or a string in RFC 3339 or YYYY-MM-DD format.
+func timeOperands(lv, rv interface{}) (time.Time, time.Time, bool) {
+	lt, lok := asTime(lv)
+	rt, rok := asTime(rv)
+	switch {
+	case lok && rok:
+		return lt, rt, true
+	case lok:
+		if s, ok := rv.(string); ok {
+			if t, err := parseTimeString(s); err == nil {
+				return lt, t, true
+			}
+		}
+	case rok:
+		if s, ok := lv.(string); ok {
+			if t, err := parseTimeString(s); err == nil {
+				return t, rt, true
+			}
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+func asTime(value interface{}) (time.Time, bool) {
+	switch value := value.(type) {
+	case time.Time:
+		return value, true
+	case *time.Time:
+		if value != nil {
+			return *value, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func parseTimeString(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+func asReference(value interface{}) (skydb.Reference, bool) {
+	switch value := value.(type) {
+	case skydb.Reference:
+		return value, true
+	case *skydb.Reference:
+		if value != nil {
+			return *value, true
+		}
+	}
+	return skydb.Reference{}, false
+}
+
+func asFloat(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case int64:
+		return float64(value), true
+	case int:
+		return float64(value), true
+	}
+	return 0, false
+}
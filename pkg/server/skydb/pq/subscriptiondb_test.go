@@ -16,7 +16,9 @@ package pq
 
 import (
 	"bytes"
+	"fmt"
 	"math/rand"
+	"sync"
 	"testing"
 	"time"
 
@@ -405,6 +407,83 @@ func subscriptionForTest(deviceID, id, queryRecordType string) skydb.Subscriptio
 	}
 }
 
+func TestConcurrentSubscriptionUpdates(t *testing.T) {
+	Convey("Database", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		addUser(t, c, "userid")
+		addDevice(t, c, "userid", "device0")
+
+		const workers = 4
+		dbs := make([]skydb.Database, workers+1)
+		for i := range dbs {
+			conn, err := Open(c.appName, skydb.RoleBasedAccess, "", false, skydb.Config{})
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			dbs[i] = conn.PublicDB()
+		}
+
+		Convey("saves and deletes subscriptions in parallel with matching", func() {
+			errs := make(chan error, workers*20)
+			var wg sync.WaitGroup
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func(db skydb.Database, id string) {
+					defer wg.Done()
+					shared := subscriptionForTest("device0", "shared", "type0")
+					own := subscriptionForTest("device0", id, "type0")
+					for j := 0; j < 10; j++ {
+						if err := db.SaveSubscription(&shared); err != nil {
+							errs <- err
+						}
+						if err := db.SaveSubscription(&own); err != nil {
+							errs <- err
+						}
+						if err := db.DeleteSubscription(id, "device0"); err != nil {
+							errs <- err
+						}
+					}
+				}(dbs[i], fmt.Sprintf("own%d", i))
+			}
+
+			done := make(chan struct{})
+			matched := make(chan []skydb.Subscription, 1)
+			go func() {
+				record := skydb.Record{ID: skydb.NewRecordID("type0", "recordid")}
+				malformed := []skydb.Subscription{}
+				for {
+					for _, sub := range dbs[workers].GetMatchingSubscriptions(&record) {
+						if sub.Type != "query" || sub.DeviceID != "device0" || sub.Query.Type != "type0" {
+							malformed = append(malformed, sub)
+						}
+					}
+					select {
+					case <-done:
+						matched <- malformed
+						return
+					default:
+					}
+				}
+			}()
+
+			wg.Wait()
+			close(done)
+			close(errs)
+
+			for err := range errs {
+				So(err, ShouldBeNil)
+			}
+			So(<-matched, ShouldBeEmpty)
+
+			record := skydb.Record{ID: skydb.NewRecordID("type0", "recordid")}
+			So(dbs[workers].GetMatchingSubscriptions(&record), ShouldResemble, []skydb.Subscription{
+				subscriptionForTest("device0", "shared", "type0"),
+			})
+		})
+	})
+}
+
 func TestPredicateMatchRecord(t *testing.T) {
 	Convey("Records", t, func() {
 		record1 := skydb.Record{ID: skydb.NewRecordID("record", "id")}
@@ -447,5 +526,319 @@ func TestPredicateMatchRecord(t *testing.T) {
 
 			So(predMatchRecord(&predicate, &record1), ShouldBeFalse)
 		})
+
+		Convey("Match record with predicate equal ignoring case", func() {
+			predicate := skydb.Predicate{
+				Operator: skydb.EqualIgnoreCase,
+				Children: []interface{}{
+					skydb.Expression{
+						Type:  skydb.KeyPath,
+						Value: "category",
+					},
+					skydb.Expression{
+						Type:  skydb.Literal,
+						Value: "Recipe",
+					},
+				},
+			}
+			So(predMatchRecord(&predicate, &record1), ShouldBeTrue)
+
+			record1.Data["category"] = "RECIPE"
+			So(predMatchRecord(&predicate, &record1), ShouldBeTrue)
+
+			record1.Data["category"] = "recipes"
+			So(predMatchRecord(&predicate, &record1), ShouldBeFalse)
+
+			predicate.Children[1] = skydb.Expression{
+				Type:  skydb.Literal,
+				Value: "STRASSE",
+			}
+			record1.Data["category"] = "straße"
+			So(predMatchRecord(&predicate, &record1), ShouldBeFalse)
+
+			predicate.Children[1] = skydb.Expression{
+				Type:  skydb.Literal,
+				Value: "ΣΊΣΥΦΟΣ",
+			}
+			record1.Data["category"] = "σίσυφος"
+			So(predMatchRecord(&predicate, &record1), ShouldBeTrue)
+		})
+
+		Convey("Match record with predicate equal ignoring case on non-string", func() {
+			predicate := skydb.Predicate{
+				Operator: skydb.EqualIgnoreCase,
+				Children: []interface{}{
+					skydb.Expression{
+						Type:  skydb.KeyPath,
+						Value: "rating",
+					},
+					skydb.Expression{
+						Type:  skydb.Literal,
+						Value: float64(5),
+					},
+				},
+			}
+
+			record1.Data["rating"] = float64(5)
+			So(predMatchRecord(&predicate, &record1), ShouldBeTrue)
+
+			record1.Data["rating"] = float64(4)
+			So(predMatchRecord(&predicate, &record1), ShouldBeFalse)
+		})
+
+		Convey("Match record with predicate within polygon", func() {
+			predicate := skydb.Predicate{
+				Operator: skydb.Functional,
+				Children: []interface{}{
+					skydb.Expression{
+						Type: skydb.Function,
+						Value: skydb.WithinPolygonFunc{
+							Field: "location",
+							Polygon: []skydb.Location{
+								skydb.NewLocation(0, 0),
+								skydb.NewLocation(10, 0),
+								skydb.NewLocation(10, 10),
+								skydb.NewLocation(0, 10),
+							},
+						},
+					},
+				},
+			}
+
+			record1.Data["location"] = skydb.NewLocation(5, 5)
+			So(predMatchRecord(&predicate, &record1), ShouldBeTrue)
+
+			record1.Data["location"] = skydb.NewLocation(0, 5)
+			So(predMatchRecord(&predicate, &record1), ShouldBeTrue)
+
+			record1.Data["location"] = skydb.NewLocation(15, 5)
+			So(predMatchRecord(&predicate, &record1), ShouldBeFalse)
+
+			delete(record1.Data, "location")
+			So(predMatchRecord(&predicate, &record1), ShouldBeFalse)
+		})
+
+		Convey("Match record with predicate reference type", func() {
+			predicate := skydb.Predicate{
+				Operator: skydb.Functional,
+				Children: []interface{}{
+					skydb.Expression{
+						Type: skydb.Function,
+						Value: skydb.ReferenceTypeFunc{
+							Field: "project",
+							Type:  "project",
+						},
+					},
+				},
+			}
+
+			record1.Data["project"] = skydb.NewReference("project", "project1")
+			So(predMatchRecord(&predicate, &record1), ShouldBeTrue)
+
+			record1.Data["project"] = skydb.NewReference("milestone", "milestone1")
+			So(predMatchRecord(&predicate, &record1), ShouldBeFalse)
+
+			record1.Data["project"] = "project1"
+			So(predMatchRecord(&predicate, &record1), ShouldBeFalse)
+
+			delete(record1.Data, "project")
+			So(predMatchRecord(&predicate, &record1), ShouldBeFalse)
+		})
+
+		Convey("Match record with predicate any match", func() {
+			predicate := skydb.Predicate{
+				Operator: skydb.AnyMatch,
+				Children: []interface{}{
+					skydb.Expression{
+						Type:  skydb.KeyPath,
+						Value: "ingredients",
+					},
+					skydb.Predicate{
+						Operator: skydb.And,
+						Children: []interface{}{
+							skydb.Predicate{
+								Operator: skydb.Equal,
+								Children: []interface{}{
+									skydb.Expression{
+										Type:  skydb.KeyPath,
+										Value: "name",
+									},
+									skydb.Expression{
+										Type:  skydb.Literal,
+										Value: "egg",
+									},
+								},
+							},
+							skydb.Predicate{
+								Operator: skydb.NotEqual,
+								Children: []interface{}{
+									skydb.Expression{
+										Type:  skydb.KeyPath,
+										Value: "optional",
+									},
+									skydb.Expression{
+										Type:  skydb.Literal,
+										Value: true,
+									},
+								},
+							},
+						},
+					},
+				},
+			}
+
+			record1.Data["ingredients"] = []interface{}{
+				map[string]interface{}{"name": "flour"},
+				map[string]interface{}{"name": "egg", "optional": false},
+			}
+			So(predMatchRecord(&predicate, &record1), ShouldBeTrue)
+
+			record1.Data["ingredients"] = []interface{}{
+				map[string]interface{}{"name": "flour"},
+				map[string]interface{}{"name": "egg", "optional": true},
+				"egg",
+			}
+			So(predMatchRecord(&predicate, &record1), ShouldBeFalse)
+
+			record1.Data["ingredients"] = []interface{}{}
+			So(predMatchRecord(&predicate, &record1), ShouldBeFalse)
+
+			record1.Data["ingredients"] = map[string]interface{}{"name": "egg"}
+			So(predMatchRecord(&predicate, &record1), ShouldBeFalse)
+
+			delete(record1.Data, "ingredients")
+			So(predMatchRecord(&predicate, &record1), ShouldBeFalse)
+		})
+
+		Convey("Match record with predicate null and absent", func() {
+			isNull := skydb.Predicate{
+				Operator: skydb.IsNull,
+				Children: []interface{}{
+					skydb.Expression{
+						Type:  skydb.KeyPath,
+						Value: "content",
+					},
+				},
+			}
+			isAbsent := skydb.Predicate{
+				Operator: skydb.IsAbsent,
+				Children: isNull.Children,
+			}
+
+			record1.Data["content"] = nil
+			So(predMatchRecord(&isNull, &record1), ShouldBeTrue)
+			So(predMatchRecord(&isAbsent, &record1), ShouldBeFalse)
+
+			delete(record1.Data, "content")
+			So(predMatchRecord(&isNull, &record1), ShouldBeFalse)
+			So(predMatchRecord(&isAbsent, &record1), ShouldBeTrue)
+
+			record1.Data["content"] = "some content"
+			So(predMatchRecord(&isNull, &record1), ShouldBeFalse)
+			So(predMatchRecord(&isAbsent, &record1), ShouldBeFalse)
+		})
+
+		Convey("Match record with predicate comparing dates", func() {
+			record1.Data["publishedAt"] = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+			compare := func(operator skydb.Operator, value interface{}) bool {
+				return predMatchRecord(&skydb.Predicate{
+					Operator: operator,
+					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.KeyPath,
+							Value: "publishedAt",
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: value,
+						},
+					},
+				}, &record1)
+			}
+
+			newYear := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			So(compare(skydb.GreaterThan, newYear), ShouldBeTrue)
+			So(compare(skydb.LessThan, newYear), ShouldBeFalse)
+			So(compare(skydb.GreaterThan, "2024-01-01"), ShouldBeTrue)
+			So(compare(skydb.LessThanOrEqual, "2024-03-01T12:00:00Z"), ShouldBeTrue)
+			So(compare(skydb.GreaterThanOrEqual, "2024-06-01"), ShouldBeFalse)
+
+			// the same instant in another location is equal
+			sameInstant := time.Date(2024, 3, 1, 20, 0, 0, 0, time.FixedZone("HKT", 8*60*60))
+			So(compare(skydb.Equal, sameInstant), ShouldBeTrue)
+			So(compare(skydb.NotEqual, sameInstant), ShouldBeFalse)
+
+			So(compare(skydb.GreaterThan, 1.0), ShouldBeFalse)
+		})
+
+		Convey("Match record with predicate comparing numbers and strings", func() {
+			record1.Data["rating"] = int64(4)
+			compare := func(operator skydb.Operator, keyPath string, value interface{}) bool {
+				return predMatchRecord(&skydb.Predicate{
+					Operator: operator,
+					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.KeyPath,
+							Value: keyPath,
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: value,
+						},
+					},
+				}, &record1)
+			}
+
+			So(compare(skydb.GreaterThan, "rating", 3.5), ShouldBeTrue)
+			So(compare(skydb.LessThanOrEqual, "rating", 4.0), ShouldBeTrue)
+			So(compare(skydb.Equal, "rating", 4.0), ShouldBeTrue)
+			So(compare(skydb.LessThan, "category", "story"), ShouldBeTrue)
+			So(compare(skydb.GreaterThan, "category", 1.0), ShouldBeFalse)
+		})
+
+		Convey("Match record with predicate equal on references", func() {
+			record1.Data["author"] = skydb.NewReference("user", "alice")
+			equal := func(value interface{}) bool {
+				return predMatchRecord(&skydb.Predicate{
+					Operator: skydb.Equal,
+					Children: []interface{}{
+						skydb.Expression{
+							Type:  skydb.KeyPath,
+							Value: "author",
+						},
+						skydb.Expression{
+							Type:  skydb.Literal,
+							Value: value,
+						},
+					},
+				}, &record1)
+			}
+
+			So(equal(skydb.NewReference("user", "alice")), ShouldBeTrue)
+			So(equal(skydb.NewReference("user", "bob")), ShouldBeFalse)
+			So(equal(skydb.NewReference("admin", "alice")), ShouldBeFalse)
+
+			ref := skydb.NewReference("user", "alice")
+			record1.Data["author"] = &ref
+			So(equal(skydb.NewReference("user", "alice")), ShouldBeTrue)
+
+			in := skydb.Predicate{
+				Operator: skydb.In,
+				Children: []interface{}{
+					skydb.Expression{
+						Type:  skydb.KeyPath,
+						Value: "author",
+					},
+					skydb.Expression{
+						Type: skydb.Literal,
+						Value: []interface{}{
+							skydb.NewReference("user", "bob"),
+							skydb.NewReference("user", "alice"),
+						},
+					},
+				},
+			}
+			So(predMatchRecord(&in, &record1), ShouldBeTrue)
+		})
 	})
 }
@@ -132,3 +132,60 @@ func TestTxDB(t *testing.T) {
 		})
 	})
 }
+
+func TestSnapshot(t *testing.T) {
+	Convey("Conn", t, func() {
+		c := getTestConn(t)
+		defer cleanupConn(t, c)
+
+		db := c.PublicDB()
+		_, err := db.Extend("note", skydb.RecordSchema{
+			"content": skydb.FieldType{Type: skydb.TypeString},
+		})
+		So(err, ShouldBeNil)
+		So(db.Save(&skydb.Record{
+			ID:      skydb.NewRecordID("note", "1"),
+			OwnerID: "ownerID",
+			Data:    map[string]interface{}{"content": "original"},
+		}), ShouldBeNil)
+
+		snapshot, err := c.OpenSnapshot()
+		So(err, ShouldBeNil)
+		defer snapshot.Close()
+
+		Convey("does not show writes after snapshot creation", func() {
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "1"),
+				OwnerID: "ownerID",
+				Data:    map[string]interface{}{"content": "updated"},
+			}), ShouldBeNil)
+			So(db.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "2"),
+				OwnerID: "ownerID",
+				Data:    map[string]interface{}{"content": "new"},
+			}), ShouldBeNil)
+
+			record := skydb.Record{}
+			So(snapshot.Get(skydb.NewRecordID("note", "1"), &record), ShouldBeNil)
+			So(record.Data["content"], ShouldEqual, "original")
+			So(snapshot.Get(skydb.NewRecordID("note", "2"), &record), ShouldEqual, skydb.ErrRecordNotFound)
+
+			count, err := snapshot.QueryCount(&skydb.Query{Type: "note"})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+
+			So(db.Get(skydb.NewRecordID("note", "1"), &record), ShouldBeNil)
+			So(record.Data["content"], ShouldEqual, "updated")
+		})
+
+		Convey("is read only", func() {
+			So(snapshot.IsReadOnly(), ShouldBeTrue)
+			So(snapshot.Save(&skydb.Record{
+				ID:      skydb.NewRecordID("note", "1"),
+				OwnerID: "ownerID",
+				Data:    map[string]interface{}{"content": "updated"},
+			}), ShouldEqual, skydb.ErrDatabaseIsReadOnly)
+			So(snapshot.Delete(skydb.NewRecordID("note", "1")), ShouldEqual, skydb.ErrDatabaseIsReadOnly)
+		})
+	})
+}
@@ -15,6 +15,7 @@
 package pq
 
 import (
+	"database/sql"
 	"database/sql/driver"
 	"encoding/hex"
 	"encoding/json"
@@ -61,6 +62,18 @@ func (nj *nullJSON) Scan(value interface{}) error {
 	return err
 }
 
+// lenientScanner scans a column with Scanner, but keeps the error
+// instead of failing the scan of the whole row.
+type lenientScanner struct {
+	sql.Scanner
+	err error
+}
+
+func (ls *lenientScanner) Scan(value interface{}) error {
+	ls.err = ls.Scanner.Scan(value)
+	return nil
+}
+
 // nullJSONStringSlice will reject empty member, since pq will give [null]
 // array if we use `array_to_json` on null column. So the result slice will be
 // []string{}, but not []string{""}
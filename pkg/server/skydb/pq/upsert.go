@@ -17,6 +17,7 @@ package pq
 import (
 	"bytes"
 	"strconv"
+	"strings"
 	"text/template"
 
 	sq "github.com/lann/squirrel"
@@ -28,7 +29,7 @@ const upsertTemplateText = `
 WITH updated AS (
 	{{if .UpdateCols }}
 		UPDATE {{.Table}}
-		SET ({{template "commaSeparatedList" .UpdateCols}}) = ({{placeholderList (len .Keys) (len .UpdateCols)}})
+		SET ({{template "commaSeparatedList" .UpdateCols}}) = ({{join .UpdateValues ","}})
 		WHERE {{range $i, $_ := .Keys}}{{if $i}} AND {{end}}{{quoted .}} = ${{addOne $i}}{{end}}
 		RETURNING *
 	{{else}}
@@ -50,6 +51,7 @@ SELECT * FROM inserted;
 
 var funcMap = template.FuncMap{
 	"addOne": func(n int) int { return n + 1 },
+	"join":   strings.Join,
 	"quoted": pq.QuoteIdentifier,
 	"placeholderList": func(i, n int) string {
 		b := bytes.Buffer{}
@@ -117,6 +119,7 @@ type upsertQueryBuilder struct {
 	pkData         map[string]interface{}
 	data           map[string]interface{}
 	updateIngnores map[string]struct{}
+	updateExprs    map[string]sq.Sqlizer
 }
 
 // TODO(limouren): we can support a better fluent builder like this
@@ -130,7 +133,7 @@ type upsertQueryBuilder struct {
 //		})
 //
 func upsertQuery(table string, pkData, data map[string]interface{}) *upsertQueryBuilder {
-	return &upsertQueryBuilder{table, pkData, data, map[string]struct{}{}}
+	return &upsertQueryBuilder{table, pkData, data, map[string]struct{}{}, map[string]sq.Sqlizer{}}
 }
 
 func (upsert *upsertQueryBuilder) IgnoreKeyOnUpdate(col string) *upsertQueryBuilder {
@@ -138,7 +141,17 @@ func (upsert *upsertQueryBuilder) IgnoreKeyOnUpdate(col string) *upsertQueryBuil
 	return upsert
 }
 
-// err always returns nil
+// SetOnUpdate makes the upsert update col to the value of expr, which
+// may refer to the current value of columns, rather than to the value
+// of col in data. The value in data is still inserted.
+//
+// The SQL of expr is in question placeholder format.
+func (upsert *upsertQueryBuilder) SetOnUpdate(col string, expr sq.Sqlizer) *upsertQueryBuilder {
+	upsert.updateExprs[col] = expr
+	return upsert
+}
+
+// err is returned only if an update expression fails to build
 func (upsert *upsertQueryBuilder) ToSql() (sql string, args []interface{}, err error) {
 	// extract columns values pair
 	pks, pkArgs := extractKeyAndValue(upsert.pkData)
@@ -147,23 +160,46 @@ func (upsert *upsertQueryBuilder) ToSql() (sql string, args []interface{}, err e
 	cols, args, ignored := sortColsArgs(cols, args, upsert.updateIngnores)
 	updateCols := cols[:len(cols)-ignored]
 
+	// Arguments of update expressions follow those of the keys and data.
+	args = append(pkArgs, args...)
+	updateValues := make([]string, len(updateCols))
+	for i, col := range updateCols {
+		expr, ok := upsert.updateExprs[col]
+		if !ok {
+			updateValues[i] = "$" + strconv.Itoa(len(pks)+i+1)
+			continue
+		}
+
+		exprSQL, exprArgs, err := expr.ToSql()
+		if err != nil {
+			return "", nil, err
+		}
+		for _, exprArg := range exprArgs {
+			args = append(args, exprArg)
+			exprSQL = strings.Replace(exprSQL, "?", "$"+strconv.Itoa(len(args)), 1)
+		}
+		updateValues[i] = exprSQL
+	}
+
 	b := bytes.Buffer{}
 	err = upsertTemplate.Execute(&b, struct {
-		Table      string
-		Keys       []string
-		UpdateCols []string
-		InsertCols []string
+		Table        string
+		Keys         []string
+		UpdateCols   []string
+		UpdateValues []string
+		InsertCols   []string
 	}{
-		Table:      upsert.table,
-		Keys:       pks,
-		UpdateCols: updateCols,
-		InsertCols: append(pks, cols...),
+		Table:        upsert.table,
+		Keys:         pks,
+		UpdateCols:   updateCols,
+		UpdateValues: updateValues,
+		InsertCols:   append(pks, cols...),
 	})
 	if err != nil {
 		panic(err)
 	}
 
-	return b.String(), append(pkArgs, args...), nil
+	return b.String(), args, nil
 }
 
 func extractKeyAndValue(data map[string]interface{}) (keys []string, values []interface{}) {
@@ -16,6 +16,7 @@ package skydb
 
 import (
 	"fmt"
+	"math"
 	"strings"
 
 	"github.com/skygeario/skygear-server/pkg/server/skyerr"
@@ -36,12 +37,61 @@ const (
 //
 // Record order can be sorted w.r.t. a record field or a value returned
 // from a predefined function.
+//
+// Collation optionally names the collation used to compare string values
+// of KeyPath, such as "C" for byte-wise order or a locale-aware collation
+// for internationalized listings. An empty Collation compares values with
+// the default collation of the Database.
+//
+// MissingAs optionally specifies the value records are sorted by when
+// KeyPath is null or absent, e.g. 0 to sort records without a priority
+// along with those of priority 0. A nil MissingAs sorts such records by
+// null.
 type Sort struct {
-	KeyPath string
-	Func    Func
-	Order   SortOrder
+	KeyPath   string
+	Func      Func
+	Order     SortOrder
+	Collation string
+	MissingAs interface{}
 }
 
+// AggFunc denotes an aggregate function computed over a numeric field
+// of the Records matching a Query.
+type AggFunc int
+
+// A list of AggFunc, their meaning is self descriptive.
+const (
+	SumAgg AggFunc = iota + 1
+	AvgAgg
+	MinAgg
+	MaxAgg
+)
+
+// HavingCount filters the groups returned by Database.GroupCount to
+// those whose number of records compares with Count using Operator,
+// e.g. groups having more than 10 records.
+//
+// Operator must be one of Equal, NotEqual, GreaterThan, LessThan,
+// GreaterThanOrEqual and LessThanOrEqual.
+type HavingCount struct {
+	Operator Operator
+	Count    uint64
+}
+
+// MissingGroupPolicy specifies how Database.GroupCount counts records
+// without a value for the field records are grouped by.
+type MissingGroupPolicy int
+
+const (
+	// IncludeMissing counts records without a value for the field under
+	// the nil key.
+	IncludeMissing MissingGroupPolicy = iota
+
+	// ExcludeMissing does not count records without a value for the
+	// field.
+	ExcludeMissing
+)
+
 // Operator denotes how the result of a predicate is determined from
 // its subpredicates or subexpressions.
 //go:generate stringer -type=Operator
@@ -62,6 +112,15 @@ const (
 	ILike
 	In
 	Functional
+	EqualIgnoreCase
+	AnyMatch
+
+	// IsNull matches records having the field of the key path saved as
+	// null, while IsAbsent matches records never having the field saved.
+	// Unlike comparing with null using Equal, which matches both, they
+	// tell the two apart.
+	IsNull
+	IsAbsent
 )
 
 // IsCompound checks whether the Operator is a compound operator, meaning the
@@ -81,7 +140,7 @@ func (op Operator) IsBinary() bool {
 	switch op {
 	default:
 		return false
-	case Equal, GreaterThan, LessThan, GreaterThanOrEqual, LessThanOrEqual, NotEqual, Like, ILike, In:
+	case Equal, GreaterThan, LessThan, GreaterThanOrEqual, LessThanOrEqual, NotEqual, Like, ILike, In, EqualIgnoreCase:
 		return true
 	}
 }
@@ -92,7 +151,7 @@ func (op Operator) IsCommutative() bool {
 	switch op {
 	default:
 		return false
-	case Equal, NotEqual:
+	case Equal, NotEqual, EqualIgnoreCase:
 		return true
 	}
 }
@@ -194,6 +253,12 @@ func (p Predicate) validate(parentPredicate *Predicate) skyerr.Error {
 		return skyerr.NewErrorf(skyerr.RecordQueryInvalid,
 			"functional predicate must have 1 operand, got %d", len(p.Children))
 	}
+	if p.Operator == AnyMatch {
+		return p.validateAnyMatchPredicate(parentPredicate)
+	}
+	if p.Operator == IsNull || p.Operator == IsAbsent {
+		return p.validatePresencePredicate(parentPredicate)
+	}
 
 	if p.Operator.IsCompound() {
 		for _, child := range p.Children {
@@ -222,7 +287,7 @@ func (p Predicate) validate(parentPredicate *Predicate) skyerr.Error {
 		return p.validateInPredicate(parentPredicate)
 	case Functional:
 		return p.validateFunctionalPredicate(parentPredicate)
-	case Equal:
+	case Equal, EqualIgnoreCase:
 		return p.validateEqualPredicate(parentPredicate)
 	}
 	return nil
@@ -266,6 +331,22 @@ func (p Predicate) validateFunctionalPredicate(parentPredicate *Predicate) skyer
 			return skyerr.NewError(skyerr.NotSupported,
 				`user discover predicate cannot be combined with other predicates`)
 		}
+	case WithinPolygonFunc:
+		if len(f.Polygon) < 3 {
+			return skyerr.NewErrorf(skyerr.RecordQueryInvalid,
+				`polygon must have at least 3 vertices, got %d`,
+				len(f.Polygon))
+		}
+	case ReferenceTypeFunc:
+		if f.Type == "" {
+			return skyerr.NewError(skyerr.RecordQueryInvalid,
+				`reference type predicate must specify a record type`)
+		}
+	case OwnerFunc:
+		if len(f.OwnerIDs) == 0 && !f.IncludePublic {
+			return skyerr.NewError(skyerr.RecordQueryInvalid,
+				`owner predicate must specify owners or include public records`)
+		}
 	default:
 		return skyerr.NewError(skyerr.NotSupported,
 			`unsupported function for functional predicate`)
@@ -297,6 +378,84 @@ func (p Predicate) validateEqualPredicate(parentPredicate *Predicate) skyerr.Err
 	return nil
 }
 
+// validateAnyMatchPredicate checks that an AnyMatch predicate consists of
+// a key path to the array followed by the predicate to apply to each
+// element. Key paths in the element predicate refer to fields of the
+// element rather than of the record.
+func (p Predicate) validateAnyMatchPredicate(parentPredicate *Predicate) skyerr.Error {
+	if len(p.Children) != 2 {
+		return skyerr.NewErrorf(skyerr.RecordQueryInvalid,
+			"any match predicate must have 2 operands, got %d", len(p.Children))
+	}
+
+	expr, ok := p.Children[0].(Expression)
+	if !ok || !expr.IsKeyPath() {
+		return skyerr.NewError(skyerr.RecordQueryInvalid,
+			`left operand of any match predicate must be a key path`)
+	}
+
+	elementPredicate, ok := p.Children[1].(Predicate)
+	if !ok || elementPredicate.IsEmpty() {
+		return skyerr.NewError(skyerr.RecordQueryInvalid,
+			`right operand of any match predicate must be a predicate`)
+	}
+
+	if err := elementPredicate.validateElementPredicate(); err != nil {
+		return err
+	}
+	return elementPredicate.validate(&p)
+}
+
+// validateElementPredicate rejects operators that cannot be evaluated
+// against an element of an array.
+func (p Predicate) validateElementPredicate() skyerr.Error {
+	switch {
+	case p.Operator == Functional:
+		return skyerr.NewError(skyerr.NotSupported,
+			`functional predicate cannot be applied to array elements`)
+	case p.Operator == IsNull || p.Operator == IsAbsent:
+		return skyerr.NewError(skyerr.NotSupported,
+			`null or absent predicate cannot be applied to array elements`)
+	case p.Operator.IsCompound():
+		for _, child := range p.Children {
+			predicate, ok := child.(Predicate)
+			if !ok {
+				continue
+			}
+			if err := predicate.validateElementPredicate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validatePresencePredicate checks that an IsNull or IsAbsent predicate
+// has a key path as its only operand.
+func (p Predicate) validatePresencePredicate(parentPredicate *Predicate) skyerr.Error {
+	if len(p.Children) != 1 {
+		return skyerr.NewErrorf(skyerr.RecordQueryInvalid,
+			"null or absent predicate must have 1 operand, got %d", len(p.Children))
+	}
+
+	expr, ok := p.Children[0].(Expression)
+	if !ok || !expr.IsKeyPath() {
+		return skyerr.NewError(skyerr.RecordQueryInvalid,
+			`operand of null or absent predicate must be a key path`)
+	}
+	return nil
+}
+
+// GetAnyMatchOperands returns the key path of the array and the predicate
+// to apply to its elements.
+//
+// This method is only valid when Operator is AnyMatch. Caller is
+// responsible to check for this preconditions. Otherwise the method
+// will panic.
+func (p Predicate) GetAnyMatchOperands() (string, Predicate) {
+	return p.Children[0].(Expression).Value.(string), p.Children[1].(Predicate)
+}
+
 // GetSubPredicates returns Predicate.Children as []Predicate.
 //
 // This method is only valid when Operator is either And, Or and Not. Caller
@@ -309,6 +468,31 @@ func (p Predicate) GetSubPredicates() (ps []Predicate) {
 	return
 }
 
+// GeoDistanceFunc returns the DistanceFunc compared by the Predicate to
+// limit records to those within a distance of a location. The Predicate
+// and its sub-predicates combined by And are searched.
+func (p Predicate) GeoDistanceFunc() (DistanceFunc, bool) {
+	switch p.Operator {
+	case And:
+		for _, child := range p.Children {
+			if pred, ok := child.(Predicate); ok {
+				if f, ok := pred.GeoDistanceFunc(); ok {
+					return f, true
+				}
+			}
+		}
+	case LessThan, LessThanOrEqual, GreaterThan, GreaterThanOrEqual:
+		for _, child := range p.Children {
+			if expr, ok := child.(Expression); ok && expr.Type == Function {
+				if f, ok := expr.Value.(DistanceFunc); ok {
+					return f, true
+				}
+			}
+		}
+	}
+	return DistanceFunc{}, false
+}
+
 // GetExpressions returns Predicate.Children as []Expression.
 //
 // This method is only valid when Operator is binary operator. Caller
@@ -333,6 +517,20 @@ type Query struct {
 	Limit        *uint64
 	Offset       uint64
 
+	// IncludeDistance adds to each record of a geo query the distance in
+	// meters from the location of the query as the transient field
+	// "_distance", which can also be sorted by as a key path. A geo query
+	// is one whose Predicate compares a DistanceFunc; IncludeDistance has
+	// no effect on other queries.
+	IncludeDistance bool
+
+	// After, if not nil, limits the query to records ordered after it by
+	// Sorts followed by _id, as set by ResumeQuery. Sorts must be on
+	// key paths of the record itself for After to apply. A query without
+	// Sorts is resumed in the order of _id, so it should be sorted by _id
+	// to be resumed without gaps.
+	After *Record
+
 	// The following fields are generated from the server side, rather
 	// than supplied from the client side.
 	ViewAsUser          *UserInfo
@@ -361,6 +559,63 @@ func (f DistanceFunc) Args() []interface{} {
 	return []interface{}{f.Field, f.Location}
 }
 
+// ArrayLengthFunc represents a function that returns the number of
+// elements of the array at a Record's field. It can be compared with a
+// number using the comparison operators.
+//
+// A Record whose field is not an array does not match the comparison,
+// unless NonArrayAsEmpty is true, in which case its length is 0.
+type ArrayLengthFunc struct {
+	Field           string
+	NonArrayAsEmpty bool
+}
+
+// Args implements the Func interface
+func (f ArrayLengthFunc) Args() []interface{} {
+	return []interface{}{f.Field, f.NonArrayAsEmpty}
+}
+
+// WithinPolygonFunc represents a function that is used to evaluate whether
+// a Record's location field is inside a user supplied polygon.
+//
+// The polygon is formed by connecting Polygon in order and closing the
+// last vertex with the first one. Its edges are straight lines on the
+// longitude-latitude plane, hence a polygon crossing the antimeridian
+// is not supported. Location on the boundary of the polygon is considered
+// inside.
+type WithinPolygonFunc struct {
+	Field   string
+	Polygon []Location
+}
+
+// Args implements the Func interface
+func (f WithinPolygonFunc) Args() []interface{} {
+	return []interface{}{f.Field, f.Polygon}
+}
+
+// Contains returns whether the location is inside the polygon by
+// the ray casting algorithm.
+func (f WithinPolygonFunc) Contains(loc Location) bool {
+	x, y := loc.Lng(), loc.Lat()
+	inside := false
+	for i, j := 0, len(f.Polygon)-1; i < len(f.Polygon); j, i = i, i+1 {
+		xi, yi := f.Polygon[i].Lng(), f.Polygon[i].Lat()
+		xj, yj := f.Polygon[j].Lng(), f.Polygon[j].Lat()
+
+		// location on the edge
+		if (x-xi)*(yj-yi) == (xj-xi)*(y-yi) &&
+			math.Min(xi, xj) <= x && x <= math.Max(xi, xj) &&
+			math.Min(yi, yj) <= y && y <= math.Max(yi, yj) {
+			return true
+		}
+
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
 // CountFunc represents a function that count number of rows matching
 // a query
 type CountFunc struct {
@@ -372,6 +627,50 @@ func (f CountFunc) Args() []interface{} {
 	return []interface{}{}
 }
 
+// ReferenceTypeFunc represents a function that is used to evaluate
+// whether a Record's field holds a reference to a record of the
+// specified type, regardless of which record is referenced.
+type ReferenceTypeFunc struct {
+	Field string
+	Type  string
+}
+
+// Args implements the Func interface
+func (f ReferenceTypeFunc) Args() []interface{} {
+	return []interface{}{f.Field, f.Type}
+}
+
+// OwnerFunc represents a function that is used to evaluate whether
+// a Record is owned by any of the specified users, or is readable by
+// the public if IncludePublic is true.
+type OwnerFunc struct {
+	OwnerIDs      []string
+	IncludePublic bool
+}
+
+// Args implements the Func interface
+func (f OwnerFunc) Args() []interface{} {
+	return []interface{}{f.OwnerIDs, f.IncludePublic}
+}
+
+// NewOwnerPredicate returns a Predicate matching records owned by any
+// of ownerIDs, and records readable by the public if includePublic is
+// true.
+func NewOwnerPredicate(ownerIDs []string, includePublic bool) Predicate {
+	return Predicate{
+		Operator: Functional,
+		Children: []interface{}{
+			Expression{
+				Type: Function,
+				Value: OwnerFunc{
+					OwnerIDs:      ownerIDs,
+					IncludePublic: includePublic,
+				},
+			},
+		},
+	}
+}
+
 // UserRelationFunc represents a function that is used to evaulate
 // whether a record satisfy certain user-based relation
 type UserRelationFunc struct {
@@ -439,3 +738,16 @@ type UserDataFunc struct {
 func (f UserDataFunc) Args() []interface{} {
 	return []interface{}{}
 }
+
+// QueryEngine executes queries of a record type in place of the built-in
+// query of a Database, such as by an external full-text search index.
+type QueryEngine interface {
+	// Match reports whether the engine executes the query. Queries not
+	// matched are executed by the Database itself.
+	Match(query *Query) bool
+
+	// Query executes the query and returns the records matched. db is the
+	// Database the query is executed against, from which an engine
+	// returning record IDs from an external index fetches the records.
+	Query(db Database, query *Query) (*Rows, error)
+}
@@ -56,6 +56,38 @@ func TestUserDiscoverFunc(t *testing.T) {
 	})
 }
 
+func TestWithinPolygonFunc(t *testing.T) {
+	Convey("func with a concave polygon", t, func() {
+		f := WithinPolygonFunc{
+			Field: "location",
+			Polygon: []Location{
+				NewLocation(0, 0),
+				NewLocation(10, 0),
+				NewLocation(10, 10),
+				NewLocation(5, 5),
+				NewLocation(0, 10),
+			},
+		}
+
+		Convey("should contain location inside", func() {
+			So(f.Contains(NewLocation(2, 2)), ShouldBeTrue)
+			So(f.Contains(NewLocation(8, 7)), ShouldBeTrue)
+		})
+
+		Convey("should not contain location outside", func() {
+			So(f.Contains(NewLocation(5, 8)), ShouldBeFalse)
+			So(f.Contains(NewLocation(-1, 5)), ShouldBeFalse)
+			So(f.Contains(NewLocation(11, 5)), ShouldBeFalse)
+		})
+
+		Convey("should contain location on the boundary", func() {
+			So(f.Contains(NewLocation(5, 0)), ShouldBeTrue)
+			So(f.Contains(NewLocation(10, 10)), ShouldBeTrue)
+			So(f.Contains(NewLocation(2.5, 7.5)), ShouldBeTrue)
+		})
+	})
+}
+
 func TestMalformedPredicate(t *testing.T) {
 	Convey("Predicate with Equal", t, func() {
 		Convey("comparing array", func() {
@@ -172,6 +204,29 @@ func TestMalformedPredicate(t *testing.T) {
 		})
 	})
 
+	Convey("Predicate with Within Polygon", t, func() {
+		Convey("polygon with less than 3 vertices", func() {
+			predicate := Predicate{
+				Functional,
+				[]interface{}{
+					Expression{
+						Type: Function,
+						Value: WithinPolygonFunc{
+							Field: "location",
+							Polygon: []Location{
+								NewLocation(0, 0),
+								NewLocation(10, 0),
+							},
+						},
+					},
+				},
+			}
+
+			err := predicate.Validate()
+			So(err, ShouldNotBeNil)
+		})
+	})
+
 	Convey("Predicate with User Discover", t, func() {
 		Convey("cannot be combined", func() {
 			predicate := Predicate{
@@ -197,5 +252,150 @@ func TestMalformedPredicate(t *testing.T) {
 			err := predicate.Validate()
 			So(err, ShouldNotBeNil)
 		})
+
+		Convey("owner predicate without owners and public records", func() {
+			predicate := NewOwnerPredicate(nil, false)
+
+			err := predicate.Validate()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("owner predicate", func() {
+			predicate := NewOwnerPredicate([]string{"alice", "bob"}, true)
+
+			err := predicate.Validate()
+			So(err, ShouldBeNil)
+		})
+	})
+
+	Convey("Predicate with Any Match", t, func() {
+		elementPredicate := Predicate{
+			Equal,
+			[]interface{}{
+				Expression{KeyPath, "name"},
+				Expression{Literal, "apple"},
+			},
+		}
+
+		Convey("valid", func() {
+			predicate := Predicate{
+				AnyMatch,
+				[]interface{}{
+					Expression{KeyPath, "items"},
+					elementPredicate,
+				},
+			}
+
+			err := predicate.Validate()
+			So(err, ShouldBeNil)
+		})
+
+		Convey("literal on left hand side", func() {
+			predicate := Predicate{
+				AnyMatch,
+				[]interface{}{
+					Expression{Literal, "items"},
+					elementPredicate,
+				},
+			}
+
+			err := predicate.Validate()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("expression on right hand side", func() {
+			predicate := Predicate{
+				AnyMatch,
+				[]interface{}{
+					Expression{KeyPath, "items"},
+					Expression{Literal, "apple"},
+				},
+			}
+
+			err := predicate.Validate()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("functional element predicate", func() {
+			predicate := Predicate{
+				AnyMatch,
+				[]interface{}{
+					Expression{KeyPath, "items"},
+					Predicate{
+						Functional,
+						[]interface{}{
+							Expression{
+								Type: Function,
+								Value: ReferenceTypeFunc{
+									Field: "product",
+									Type:  "product",
+								},
+							},
+						},
+					},
+				},
+			}
+
+			err := predicate.Validate()
+			So(err, ShouldNotBeNil)
+		})
+	})
+	Convey("Predicate with IsNull and IsAbsent", t, func() {
+		Convey("valid", func() {
+			for _, op := range []Operator{IsNull, IsAbsent} {
+				predicate := Predicate{
+					op,
+					[]interface{}{
+						Expression{KeyPath, "content"},
+					},
+				}
+
+				err := predicate.Validate()
+				So(err, ShouldBeNil)
+			}
+		})
+
+		Convey("literal operand", func() {
+			predicate := Predicate{
+				IsNull,
+				[]interface{}{
+					Expression{Literal, "content"},
+				},
+			}
+
+			err := predicate.Validate()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("more than 1 operand", func() {
+			predicate := Predicate{
+				IsAbsent,
+				[]interface{}{
+					Expression{KeyPath, "content"},
+					Expression{Literal, nil},
+				},
+			}
+
+			err := predicate.Validate()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("element predicate of any match", func() {
+			predicate := Predicate{
+				AnyMatch,
+				[]interface{}{
+					Expression{KeyPath, "items"},
+					Predicate{
+						IsNull,
+						[]interface{}{
+							Expression{KeyPath, "name"},
+						},
+					},
+				},
+			}
+
+			err := predicate.Validate()
+			So(err, ShouldNotBeNil)
+		})
 	})
 }
@@ -69,6 +69,13 @@ func (id *RecordID) IsEmpty() bool {
 	return id.Type == "" && id.Key == ""
 }
 
+// RecordKey is the ID of a record together with the time the record was
+// last updated, which tells whether a copy of the record is up to date.
+type RecordKey struct {
+	ID        RecordID
+	UpdatedAt time.Time
+}
+
 // RecordACLEntry grants access to a record by relation or by user_id
 type RecordACLEntry struct {
 	Relation string   `json:"relation,omitempty"`
@@ -281,6 +288,15 @@ type Record struct {
 	ACL        RecordACL
 	Data       Data
 	Transient  Data `json:"-"`
+
+	// SchemaVersion is the schema version of the record type under which
+	// the Record is written, or 0 if the record type is not versioned.
+	SchemaVersion int
+
+	// DroppedFields are the fields that failed to decode and are absent
+	// from Data, when the record type is decoded leniently. A Record with
+	// dropped fields is only partially decoded.
+	DroppedFields []string `json:"-"`
 }
 
 // Get returns the value specified by key. If no value is associated
@@ -365,7 +381,18 @@ func (r *Record) Set(key string, i interface{}) {
 }
 
 func (r *Record) Accessible(userinfo *UserInfo, level ACLLevel) bool {
-	if r.ACL == nil {
+	return r.AccessibleWithDefaultACL(userinfo, level, nil)
+}
+
+// AccessibleWithDefaultACL is like Accessible, except that defaultACL
+// governs the access if the record has no ACL of its own. A record with
+// neither is accessible to everyone.
+func (r *Record) AccessibleWithDefaultACL(userinfo *UserInfo, level ACLLevel, defaultACL RecordACL) bool {
+	acl := r.ACL
+	if acl == nil {
+		acl = defaultACL
+	}
+	if acl == nil {
 		return true
 	}
 	userID := ""
@@ -379,7 +406,58 @@ func (r *Record) Accessible(userinfo *UserInfo, level ACLLevel) bool {
 		return true
 	}
 
-	return r.ACL.Accessible(userinfo, level)
+	return acl.Accessible(userinfo, level)
+}
+
+// VirtualFieldFunc computes the value of a virtual field of the Record.
+type VirtualFieldFunc func(record *Record) interface{}
+
+// SchemaMigratorFunc up-converts the Record from the schema version it is
+// written under to the next version.
+type SchemaMigratorFunc func(record *Record) error
+
+// FieldMask hides the value of a field from readers who are not
+// privileged to read it. The owner of a record and users having any of
+// Roles are privileged.
+type FieldMask struct {
+	Roles []string
+
+	// Replacement is returned in place of the field value to unprivileged
+	// readers. The field is removed if Replacement is nil.
+	Replacement interface{}
+}
+
+// MaskFields applies masks, keyed by field name, to the Record as read
+// by the user. The user is nil for an unauthenticated reader.
+//
+// Data of the Record is copied before a field is masked, leaving records
+// sharing the same Data intact.
+func (r *Record) MaskFields(masks map[string]FieldMask, userinfo *UserInfo) {
+	copied := false
+	for fieldName, mask := range masks {
+		if _, ok := r.Data[fieldName]; !ok {
+			continue
+		}
+
+		if userinfo != nil && (r.OwnerID == userinfo.ID || userinfo.HasAnyRoles(mask.Roles)) {
+			continue
+		}
+
+		if !copied {
+			data := Data{}
+			for key, value := range r.Data {
+				data[key] = value
+			}
+			r.Data = data
+			copied = true
+		}
+
+		if mask.Replacement == nil {
+			delete(r.Data, fieldName)
+		} else {
+			r.Data[fieldName] = mask.Replacement
+		}
+	}
 }
 
 // RecordSchema is a mapping of record key to its value's data type or reference
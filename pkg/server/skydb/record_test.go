@@ -101,6 +101,25 @@ func TestRecordACL(t *testing.T) {
 			So(note.Accessible(nil, ReadLevel), ShouldBeTrue)
 		})
 
+		Convey("Check access right base on default ACL", func() {
+			defaultACL := RecordACL{
+				NewRecordACLEntryRole("admin", ReadLevel),
+			}
+			note := Record{
+				ID:         NewRecordID("note", "0"),
+				DatabaseID: "",
+			}
+
+			So(note.AccessibleWithDefaultACL(userinfo, ReadLevel, defaultACL), ShouldBeTrue)
+			So(note.AccessibleWithDefaultACL(stranger, ReadLevel, defaultACL), ShouldBeFalse)
+			So(note.AccessibleWithDefaultACL(stranger, ReadLevel, nil), ShouldBeTrue)
+
+			note.ACL = RecordACL{
+				NewRecordACLEntryPublic(ReadLevel),
+			}
+			So(note.AccessibleWithDefaultACL(stranger, ReadLevel, defaultACL), ShouldBeTrue)
+		})
+
 		Convey("Check access right base on role", func() {
 			note := Record{
 				ID:         NewRecordID("note", "0"),
@@ -170,6 +189,76 @@ func TestRecordACL(t *testing.T) {
 	})
 }
 
+func TestRecordMaskFields(t *testing.T) {
+	Convey("Record with masked fields", t, func() {
+		masks := map[string]FieldMask{
+			"ssn": {
+				Roles: []string{"hr"},
+			},
+			"salary": {
+				Roles:       []string{"hr", "finance"},
+				Replacement: float64(0),
+			},
+		}
+		data := Data{
+			"name":   "John",
+			"ssn":    "078-05-1120",
+			"salary": float64(5000),
+		}
+		employee := Record{
+			ID:      NewRecordID("employee", "john"),
+			OwnerID: "john",
+			Data:    data,
+		}
+
+		Convey("keeps fields for privileged user", func() {
+			employee.MaskFields(masks, &UserInfo{
+				ID:    "admin",
+				Roles: []string{"hr"},
+			})
+			So(employee.Data, ShouldResemble, Data{
+				"name":   "John",
+				"ssn":    "078-05-1120",
+				"salary": float64(5000),
+			})
+		})
+
+		Convey("keeps fields for owner", func() {
+			employee.MaskFields(masks, &UserInfo{
+				ID: "john",
+			})
+			So(employee.Data, ShouldResemble, Data{
+				"name":   "John",
+				"ssn":    "078-05-1120",
+				"salary": float64(5000),
+			})
+		})
+
+		Convey("removes or replaces fields for unprivileged user", func() {
+			employee.MaskFields(masks, &UserInfo{
+				ID:    "jane",
+				Roles: []string{"finance"},
+			})
+			So(employee.Data, ShouldResemble, Data{
+				"name":   "John",
+				"salary": float64(5000),
+			})
+
+			employee.MaskFields(masks, nil)
+			So(employee.Data, ShouldResemble, Data{
+				"name":   "John",
+				"salary": float64(0),
+			})
+		})
+
+		Convey("leaves shared data intact", func() {
+			employee.MaskFields(masks, nil)
+			So(data["ssn"], ShouldEqual, "078-05-1120")
+			So(data["salary"], ShouldEqual, float64(5000))
+		})
+	})
+}
+
 func TestRecordSchema(t *testing.T) {
 	Convey("RecordSchema", t, func() {
 		target := RecordSchema{
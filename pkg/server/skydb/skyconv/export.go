@@ -0,0 +1,45 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconv
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+)
+
+// ExportQuery executes query against db and writes each matching record
+// to w as a line of JSON in the JSONRecord format.
+//
+// Records are written as they are scanned from the result, so the
+// matching records are never held in memory at once.
+func ExportQuery(db skydb.Database, query *skydb.Query, w io.Writer) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	encoder := json.NewEncoder(w)
+	for rows.Scan() {
+		record := rows.Record()
+		if err := encoder.Encode((*JSONRecord)(&record)); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,91 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconv
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	"github.com/skygeario/skygear-server/pkg/server/skydb/mock_skydb"
+	. "github.com/skygeario/skygear-server/pkg/server/skytest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExportQuery(t *testing.T) {
+	Convey("ExportQuery", t, func() {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		db := mock_skydb.NewMockDatabase(ctrl)
+		query := &skydb.Query{
+			Type: "note",
+			Predicate: skydb.Predicate{
+				Operator: skydb.Equal,
+				Children: []interface{}{
+					skydb.Expression{Type: skydb.KeyPath, Value: "status"},
+					skydb.Expression{Type: skydb.Literal, Value: "open"},
+				},
+			},
+		}
+
+		Convey("writes matching records as JSON lines", func() {
+			db.EXPECT().Query(query).Return(skydb.NewRows(skydb.NewMemoryRows([]skydb.Record{
+				{
+					ID:      skydb.NewRecordID("note", "id1"),
+					OwnerID: "userid",
+					Data:    map[string]interface{}{"status": "open"},
+				},
+				{
+					ID:      skydb.NewRecordID("note", "id3"),
+					OwnerID: "userid",
+					Data:    map[string]interface{}{"status": "open"},
+				},
+			})), nil)
+
+			buf := bytes.Buffer{}
+			So(ExportQuery(db, query, &buf), ShouldBeNil)
+
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			So(len(lines), ShouldEqual, 2)
+			So(lines[0], ShouldEqualJSON, `{
+				"_id": "note/id1",
+				"_type": "record",
+				"_access": null,
+				"_ownerID": "userid",
+				"status": "open"
+			}`)
+			So(lines[1], ShouldEqualJSON, `{
+				"_id": "note/id3",
+				"_type": "record",
+				"_access": null,
+				"_ownerID": "userid",
+				"status": "open"
+			}`)
+			So(buf.String(), ShouldNotContainSubstring, "note/id2")
+		})
+
+		Convey("returns query error", func() {
+			db.EXPECT().Query(query).Return(nil, errors.New("query failed"))
+
+			buf := bytes.Buffer{}
+			So(ExportQuery(db, query, &buf), ShouldNotBeNil)
+			So(buf.Len(), ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,135 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+)
+
+// ImportErrorFunc is called by Import with the line number, starting from
+// 1, and the error of a record that cannot be imported. Import continues
+// with the next record if it returns true, and stops otherwise.
+type ImportErrorFunc func(line int, err error) bool
+
+// ImportResult reports the number of records imported by Import and the
+// number of records failed to be imported.
+type ImportResult struct {
+	Succeeded int
+	Failed    int
+}
+
+// Import reads records from r, each as a line of JSON in the JSONRecord
+// format as written by ExportQuery, and saves them to db. Blank lines
+// are skipped.
+//
+// A record fails to be imported if its line is malformed or db fails to
+// save it. The failure is passed to onError, which decides whether Import
+// continues. If onError is nil or returns false, Import stops and returns
+// the error of the record. An error reading r always stops Import.
+func Import(db skydb.Database, r io.Reader, onError ImportErrorFunc) (ImportResult, error) {
+	result := ImportResult{}
+	reader := bufio.NewReader(r)
+	for lineNum := 1; ; lineNum++ {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return result, readErr
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			if err := importRecord(db, line); err != nil {
+				result.Failed++
+				if onError == nil || !onError(lineNum, err) {
+					return result, fmt.Errorf("line %d: %v", lineNum, err)
+				}
+			} else {
+				result.Succeeded++
+			}
+		}
+
+		if readErr == io.EOF {
+			return result, nil
+		}
+	}
+}
+
+func importRecord(db skydb.Database, line []byte) error {
+	record := skydb.Record{}
+	if err := UnmarshalRecord(line, &record); err != nil {
+		return err
+	}
+
+	return db.Save(&record)
+}
+
+// UnmarshalRecord reads a record in the JSONRecord format as written by
+// ExportQuery, including the record metadata, into record.
+func UnmarshalRecord(data []byte, record *skydb.Record) error {
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+
+	if err := importRecordMeta(record, m); err != nil {
+		return err
+	}
+	return (*JSONRecord)(record).FromMap(m)
+}
+
+// importRecordMeta reads the record metadata written by
+// JSONRecord.MarshalJSON, which is not read by JSONRecord.FromMap.
+func importRecordMeta(record *skydb.Record, m map[string]interface{}) error {
+	stringValues := map[string]*string{
+		"_ownerID":    &record.OwnerID,
+		"_created_by": &record.CreatorID,
+		"_updated_by": &record.UpdaterID,
+	}
+	for key, p := range stringValues {
+		if value, ok := m[key]; ok {
+			s, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("key %s is of type %T, not string", key, value)
+			}
+			*p = s
+		}
+	}
+
+	timeValues := map[string]*time.Time{
+		"_created_at": &record.CreatedAt,
+		"_updated_at": &record.UpdatedAt,
+	}
+	for key, p := range timeValues {
+		if value, ok := m[key]; ok {
+			s, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("key %s is of type %T, not string", key, value)
+			}
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return fmt.Errorf("key %s is not a valid time: %v", key, err)
+			}
+			*p = t.UTC()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconv
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	"github.com/skygeario/skygear-server/pkg/server/skydb/skydbtest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestImport(t *testing.T) {
+	Convey("Import", t, func() {
+		db := skydbtest.NewMapDB()
+		input := strings.Join([]string{
+			`{"_id": "note/id1", "_type": "record", "_access": null, "_ownerID": "userid", "_created_at": "2016-06-01T12:00:00Z", "status": "open"}`,
+			`{"_id": "note/id2", "_type": "record", "_access": null, "_ownerID": "userid", "status": `,
+			``,
+			`{"_id": "id3", "_type": "record", "_access": null, "_ownerID": "userid"}`,
+			`{"_id": "note/id4", "_type": "record", "_access": null, "_ownerID": "userid", "status": "closed"}`,
+		}, "\n")
+
+		Convey("imports good records and reports bad ones", func() {
+			failedLines := []int{}
+			result, err := Import(db, strings.NewReader(input), func(line int, err error) bool {
+				So(err, ShouldNotBeNil)
+				failedLines = append(failedLines, line)
+				return true
+			})
+
+			So(err, ShouldBeNil)
+			So(result, ShouldResemble, ImportResult{Succeeded: 2, Failed: 2})
+			So(failedLines, ShouldResemble, []int{2, 4})
+
+			record := skydb.Record{}
+			So(db.Get(skydb.NewRecordID("note", "id1"), &record), ShouldBeNil)
+			So(record.OwnerID, ShouldEqual, "userid")
+			So(record.CreatedAt, ShouldResemble, time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC))
+			So(record.Data, ShouldResemble, skydb.Data{"status": "open"})
+
+			So(db.Get(skydb.NewRecordID("note", "id4"), &record), ShouldBeNil)
+			So(record.Data, ShouldResemble, skydb.Data{"status": "closed"})
+		})
+
+		Convey("stops at the first bad record if error func returns false", func() {
+			result, err := Import(db, strings.NewReader(input), func(line int, err error) bool {
+				return false
+			})
+
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "line 2: ")
+			So(result, ShouldResemble, ImportResult{Succeeded: 1, Failed: 1})
+			So(db.RecordMap, ShouldContainKey, "note/id1")
+			So(db.RecordMap, ShouldNotContainKey, "note/id4")
+		})
+
+		Convey("stops at the first bad record without error func", func() {
+			result, err := Import(db, strings.NewReader(input), nil)
+
+			So(err, ShouldNotBeNil)
+			So(result, ShouldResemble, ImportResult{Succeeded: 1, Failed: 1})
+		})
+
+		Convey("returns read error", func() {
+			_, err := Import(db, failingReader{}, func(line int, err error) bool {
+				return true
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -71,6 +71,9 @@ func (record *JSONRecord) MarshalJSON() ([]byte, error) {
 	if record.UpdaterID != "" {
 		m["_updated_by"] = record.UpdaterID
 	}
+	if record.SchemaVersion != 0 {
+		m["_schemaVersion"] = record.SchemaVersion
+	}
 
 	transient := record.marshalTransient(record.Transient)
 	if len(transient) > 0 {
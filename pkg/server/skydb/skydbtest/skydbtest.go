@@ -267,10 +267,12 @@ type RecordSchemaMap map[string]skydb.RecordSchema
 
 // MapDB is a naive memory implementation of skydb.Database.
 type MapDB struct {
-	RecordMap       RecordMap
-	SubscriptionMap SubscriptionMap
-	RecordSchemaMap RecordSchemaMap
-	DBConn          skydb.Conn
+	RecordMap        RecordMap
+	SubscriptionMap  SubscriptionMap
+	RecordSchemaMap  RecordSchemaMap
+	DefaultRecordACL skydb.RecordACL
+	FieldMaskMap     map[string]map[string]skydb.FieldMask
+	DBConn           skydb.Conn
 	skydb.Database
 }
 
@@ -297,6 +299,22 @@ func (db *MapDB) UserRecordType() string {
 	return "user"
 }
 
+// SetDefaultACL sets DefaultRecordACL.
+func (db *MapDB) SetDefaultACL(acl skydb.RecordACL) error {
+	db.DefaultRecordACL = acl
+	return nil
+}
+
+// DefaultACL returns DefaultRecordACL.
+func (db *MapDB) DefaultACL() (skydb.RecordACL, error) {
+	return db.DefaultRecordACL, nil
+}
+
+// FieldMasks returns the masks of a record type in FieldMaskMap.
+func (db *MapDB) FieldMasks(recordType string) map[string]skydb.FieldMask {
+	return db.FieldMaskMap[recordType]
+}
+
 // Get returns a Record from RecordMap.
 func (db *MapDB) Get(id skydb.RecordID, record *skydb.Record) error {
 	r, ok := db.RecordMap[id.String()]
@@ -314,6 +332,29 @@ func (db *MapDB) Save(record *skydb.Record) error {
 	return nil
 }
 
+// SaveWithResult assigns Record to RecordMap like Save, and returns the
+// Record it replaces.
+func (db *MapDB) SaveWithResult(record *skydb.Record) (skydb.SaveResult, error) {
+	result := skydb.SaveResult{Record: record}
+	if previous, ok := db.RecordMap[record.ID.String()]; ok {
+		result.Previous = &previous
+	}
+	return result, db.Save(record)
+}
+
+// SaveIfMatch assigns Record to RecordMap if the stored Record was
+// last updated at updatedAt.
+func (db *MapDB) SaveIfMatch(record *skydb.Record, updatedAt time.Time) error {
+	r, ok := db.RecordMap[record.ID.String()]
+	if !ok {
+		return skydb.ErrRecordNotFound
+	}
+	if !r.UpdatedAt.Equal(updatedAt) {
+		return skydb.ErrRecordConflict
+	}
+	return db.Save(record)
+}
+
 // Delete remove the specified key from RecordMap.
 func (db *MapDB) Delete(id skydb.RecordID) error {
 	_, ok := db.RecordMap[id.String()]
@@ -0,0 +1,76 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skydb
+
+import (
+	"sort"
+	"strings"
+)
+
+// FieldTypeConflict is the code of a FieldError where the value of
+// a field conflicts with the type of the field in the record schema.
+const FieldTypeConflict = "TypeConflict"
+
+// FieldError describes why the value of a field of a Record is rejected.
+type FieldError struct {
+	// Field is the key path of the rejected field.
+	Field string `json:"field"`
+
+	// Code identifies the kind of problem, such as FieldTypeConflict.
+	Code string `json:"code"`
+
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when a Record is rejected because of
+// problems with its fields. It collects all problems found rather than
+// only the first one, such that callers can map them back to each field.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+// Add appends a problem with the field at the key path.
+func (e *ValidationError) Add(field, code, message string) {
+	e.Errors = append(e.Errors, FieldError{
+		Field:   field,
+		Code:    code,
+		Message: message,
+	})
+}
+
+// Err returns the ValidationError with its problems sorted by field, or
+// nil if no problems were added.
+func (e *ValidationError) Err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+
+	sort.Stable(byField(e.Errors))
+	return e
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, fieldErr := range e.Errors {
+		messages[i] = fieldErr.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+type byField []FieldError
+
+func (errs byField) Len() int           { return len(errs) }
+func (errs byField) Swap(i, j int)      { errs[i], errs[j] = errs[j], errs[i] }
+func (errs byField) Less(i, j int) bool { return errs[i].Field < errs[j].Field }
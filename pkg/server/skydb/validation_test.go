@@ -0,0 +1,44 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skydb
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValidationError(t *testing.T) {
+	Convey("ValidationError", t, func() {
+		Convey("is nil without problems", func() {
+			validationErr := ValidationError{}
+			So(validationErr.Err(), ShouldBeNil)
+		})
+
+		Convey("collects problems sorted by field", func() {
+			validationErr := ValidationError{}
+			validationErr.Add("title", FieldTypeConflict, "title conflicts")
+			validationErr.Add("content", FieldTypeConflict, "content conflicts")
+
+			err := validationErr.Err()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "content conflicts; title conflicts")
+			So(validationErr.Errors, ShouldResemble, []FieldError{
+				{"content", FieldTypeConflict, "content conflicts"},
+				{"title", FieldTypeConflict, "title conflicts"},
+			})
+		})
+	})
+}
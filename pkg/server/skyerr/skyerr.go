@@ -127,6 +127,10 @@ const (
 	// PluginInitializing occurs when any of the plugins are initializing
 	PluginInitializing
 
+	// QueryTimeout occurs when a record query exceeds the maximum query
+	// duration of the database
+	QueryTimeout
+
 	// Error codes for expected error condition should be placed
 	// above this line.
 )
@@ -0,0 +1,163 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subscription
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+)
+
+// BatchNotification encapsulates notices sent to a device in a single
+// notification.
+type BatchNotification struct {
+	Notices []Notice
+}
+
+// BatchNotifier is the interface implemented by a Notifier that knows how
+// to deliver a BatchNotification to a device in a single notification.
+type BatchNotifier interface {
+	Notifier
+
+	// NotifyBatch sends the notices of a batch to the device.
+	NotifyBatch(device skydb.Device, batch BatchNotification) error
+}
+
+// notifyBatch sends the batch to the device with the notifier. Each notice
+// in the batch is sent separately if the notifier cannot send batches.
+func notifyBatch(notifier Notifier, device skydb.Device, batch BatchNotification) error {
+	if batchNotifier, ok := notifier.(BatchNotifier); ok {
+		return batchNotifier.NotifyBatch(device, batch)
+	}
+
+	var lasterr error
+	for _, notice := range batch.Notices {
+		if err := notifier.Notify(device, notice); err != nil {
+			lasterr = err
+		}
+	}
+	return lasterr
+}
+
+// BatchingNotifier is a Notifier which groups notices to the same device
+// within a flush window, and sends them as a single BatchNotification
+// with the underlying Notifier.
+type BatchingNotifier struct {
+	notifier     Notifier
+	window       time.Duration
+	maxBatchSize int
+
+	mutex   sync.Mutex
+	pending map[string]*pendingBatch
+}
+
+type pendingBatch struct {
+	device  skydb.Device
+	notices []Notice
+	timer   *time.Timer
+}
+
+// NewBatchingNotifier returns a BatchingNotifier which sends batches with
+// notifier. A batch is sent when window has elapsed since its first
+// notice, or when it has maxBatchSize notices. Batches are unlimited in
+// size if maxBatchSize is not positive.
+func NewBatchingNotifier(notifier Notifier, window time.Duration, maxBatchSize int) *BatchingNotifier {
+	return &BatchingNotifier{
+		notifier:     notifier,
+		window:       window,
+		maxBatchSize: maxBatchSize,
+		pending:      map[string]*pendingBatch{},
+	}
+}
+
+// CanNotify returns whether the underlying Notifier can send notice to
+// the device.
+func (n *BatchingNotifier) CanNotify(device skydb.Device) bool {
+	return n.notifier.CanNotify(device)
+}
+
+// Notify adds the notice to the pending batch of the device. An error is
+// returned only if adding the notice fills the batch and sending it
+// fails.
+func (n *BatchingNotifier) Notify(device skydb.Device, notice Notice) error {
+	n.mutex.Lock()
+	batch, ok := n.pending[device.ID]
+	if !ok {
+		batch = &pendingBatch{device: device}
+		batch.timer = time.AfterFunc(n.window, func() {
+			n.flush(device.ID, batch)
+		})
+		n.pending[device.ID] = batch
+	}
+	batch.notices = append(batch.notices, notice)
+
+	full := n.maxBatchSize > 0 && len(batch.notices) >= n.maxBatchSize
+	if full {
+		batch.timer.Stop()
+		delete(n.pending, device.ID)
+	}
+	n.mutex.Unlock()
+
+	if full {
+		return n.send(batch)
+	}
+	return nil
+}
+
+// Flush sends all pending batches without waiting for their flush
+// windows to elapse.
+func (n *BatchingNotifier) Flush() {
+	n.mutex.Lock()
+	batches := make([]*pendingBatch, 0, len(n.pending))
+	for deviceID, batch := range n.pending {
+		batch.timer.Stop()
+		delete(n.pending, deviceID)
+		batches = append(batches, batch)
+	}
+	n.mutex.Unlock()
+
+	for _, batch := range batches {
+		n.sendAndLog(batch)
+	}
+}
+
+func (n *BatchingNotifier) flush(deviceID string, batch *pendingBatch) {
+	n.mutex.Lock()
+	if n.pending[deviceID] != batch {
+		// the batch has been sent when it became full
+		n.mutex.Unlock()
+		return
+	}
+	delete(n.pending, deviceID)
+	n.mutex.Unlock()
+
+	n.sendAndLog(batch)
+}
+
+func (n *BatchingNotifier) send(batch *pendingBatch) error {
+	return notifyBatch(n.notifier, batch.device, BatchNotification{batch.notices})
+}
+
+func (n *BatchingNotifier) sendAndLog(batch *pendingBatch) {
+	if err := n.send(batch); err != nil {
+		log.WithFields(logrus.Fields{
+			"device": batch.device,
+			"count":  len(batch.notices),
+			"err":    err,
+		}).Errorln("subscription: failed to send batch notification")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subscription
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type recordingBatchNotifier struct {
+	mutex   sync.Mutex
+	batches map[string][]BatchNotification
+	sent    chan string
+}
+
+func newRecordingBatchNotifier() *recordingBatchNotifier {
+	return &recordingBatchNotifier{
+		batches: map[string][]BatchNotification{},
+		sent:    make(chan string, 10),
+	}
+}
+
+func (n *recordingBatchNotifier) CanNotify(device skydb.Device) bool {
+	return true
+}
+
+func (n *recordingBatchNotifier) Notify(device skydb.Device, notice Notice) error {
+	return n.NotifyBatch(device, BatchNotification{[]Notice{notice}})
+}
+
+func (n *recordingBatchNotifier) NotifyBatch(device skydb.Device, batch BatchNotification) error {
+	n.mutex.Lock()
+	n.batches[device.ID] = append(n.batches[device.ID], batch)
+	n.mutex.Unlock()
+	n.sent <- device.ID
+	return nil
+}
+
+func (n *recordingBatchNotifier) Batches(deviceID string) []BatchNotification {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.batches[deviceID]
+}
+
+func TestBatchingNotifier(t *testing.T) {
+	Convey("BatchingNotifier", t, func() {
+		deviceA := skydb.Device{ID: "device-a"}
+		deviceB := skydb.Device{ID: "device-b"}
+		notice := func(seqNum uint64) Notice {
+			return Notice{SeqNum: seqNum, SubscriptionID: "subscription-id"}
+		}
+
+		Convey("coalesces notices to a device within the window", func() {
+			recorder := newRecordingBatchNotifier()
+			notifier := NewBatchingNotifier(recorder, 50*time.Millisecond, 100)
+
+			So(notifier.Notify(deviceA, notice(1)), ShouldBeNil)
+			So(notifier.Notify(deviceA, notice(2)), ShouldBeNil)
+			So(notifier.Notify(deviceA, notice(3)), ShouldBeNil)
+			So(recorder.Batches("device-a"), ShouldBeEmpty)
+
+			select {
+			case deviceID := <-recorder.sent:
+				So(deviceID, ShouldEqual, "device-a")
+			case <-time.After(time.Second):
+				t.Fatal("batch is not sent after the window")
+			}
+
+			So(recorder.Batches("device-a"), ShouldResemble, []BatchNotification{
+				{[]Notice{notice(1), notice(2), notice(3)}},
+			})
+		})
+
+		Convey("keeps batches of different devices apart", func() {
+			recorder := newRecordingBatchNotifier()
+			notifier := NewBatchingNotifier(recorder, time.Hour, 100)
+
+			So(notifier.Notify(deviceA, notice(1)), ShouldBeNil)
+			So(notifier.Notify(deviceB, notice(2)), ShouldBeNil)
+			So(notifier.Notify(deviceA, notice(3)), ShouldBeNil)
+			notifier.Flush()
+
+			So(recorder.Batches("device-a"), ShouldResemble, []BatchNotification{
+				{[]Notice{notice(1), notice(3)}},
+			})
+			So(recorder.Batches("device-b"), ShouldResemble, []BatchNotification{
+				{[]Notice{notice(2)}},
+			})
+		})
+
+		Convey("sends a batch immediately when it is full", func() {
+			recorder := newRecordingBatchNotifier()
+			notifier := NewBatchingNotifier(recorder, time.Hour, 2)
+
+			So(notifier.Notify(deviceA, notice(1)), ShouldBeNil)
+			So(recorder.Batches("device-a"), ShouldBeEmpty)
+			So(notifier.Notify(deviceA, notice(2)), ShouldBeNil)
+			So(recorder.Batches("device-a"), ShouldResemble, []BatchNotification{
+				{[]Notice{notice(1), notice(2)}},
+			})
+
+			So(notifier.Notify(deviceA, notice(3)), ShouldBeNil)
+			notifier.Flush()
+			So(recorder.Batches("device-a"), ShouldResemble, []BatchNotification{
+				{[]Notice{notice(1), notice(2)}},
+				{[]Notice{notice(3)}},
+			})
+		})
+
+		Convey("sends notices one by one with a notifier without batch support", func() {
+			notices := []Notice{}
+			notifier := NewBatchingNotifier(notifyFunc(func(device skydb.Device, notice Notice) error {
+				notices = append(notices, notice)
+				return nil
+			}), time.Hour, 100)
+
+			So(notifier.Notify(deviceA, notice(1)), ShouldBeNil)
+			So(notifier.Notify(deviceA, notice(2)), ShouldBeNil)
+			notifier.Flush()
+
+			So(notices, ShouldResemble, []Notice{notice(1), notice(2)})
+		})
+	})
+}
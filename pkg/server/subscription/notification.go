@@ -17,6 +17,7 @@ package subscription
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 
@@ -45,21 +46,75 @@ type Notifier interface {
 	Notify(device skydb.Device, notice Notice) error
 }
 
+// pushDedupCapacity is the number of recent push sends remembered to
+// detect duplicates.
+const pushDedupCapacity = 1024
+
+// pushKey identifies a notice pushed to a device push token. Devices
+// registered more than once share the same push token, and would receive
+// the same notice more than once without it.
+type pushKey struct {
+	deviceType     string
+	token          string
+	subscriptionID string
+	seqNum         uint64
+}
+
 type pushNotifier struct {
 	sender push.Sender
+
+	mutex  sync.Mutex
+	sent   map[pushKey]struct{}
+	recent []pushKey
 }
 
 // NewPushNotifier returns an Notifier which sends Notice
 // using the given push.Sender.
+//
+// A notice is pushed to a device push token at most once, even if the
+// token is registered by more than one device.
 func NewPushNotifier(sender push.Sender) Notifier {
-	return &pushNotifier{sender}
+	return &pushNotifier{
+		sender: sender,
+		sent:   map[pushKey]struct{}{},
+	}
 }
 
 func (notifier *pushNotifier) CanNotify(device skydb.Device) bool {
 	return device.Type == "ios"
 }
 
+// markSent records that the notice is pushed to the token of the device,
+// and returns false if it was pushed already.
+func (notifier *pushNotifier) markSent(device skydb.Device, notice Notice) bool {
+	if device.Token == "" {
+		return true
+	}
+
+	key := pushKey{device.Type, device.Token, notice.SubscriptionID, notice.SeqNum}
+
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+
+	if _, ok := notifier.sent[key]; ok {
+		return false
+	}
+
+	if len(notifier.recent) >= pushDedupCapacity {
+		delete(notifier.sent, notifier.recent[0])
+		notifier.recent = notifier.recent[1:]
+	}
+	notifier.sent[key] = struct{}{}
+	notifier.recent = append(notifier.recent, key)
+	return true
+}
+
 func (notifier *pushNotifier) Notify(device skydb.Device, notice Notice) error {
+	if !notifier.markSent(device, notice) {
+		log.Debugf("push-notifier: notice already pushed to token of device id = %s", device.ID)
+		return nil
+	}
+
 	customMap := map[string]interface{}{
 		"aps": map[string]interface{}{
 			"content_available": 1,
@@ -73,6 +128,34 @@ func (notifier *pushNotifier) Notify(device skydb.Device, notice Notice) error {
 	return notifier.sender.Send(push.MapMapper(customMap), device)
 }
 
+func (notifier *pushNotifier) NotifyBatch(device skydb.Device, batch BatchNotification) error {
+	notices := []map[string]interface{}{}
+	for _, notice := range batch.Notices {
+		if !notifier.markSent(device, notice) {
+			continue
+		}
+		notices = append(notices, map[string]interface{}{
+			"seq-num":         notice.SeqNum,
+			"subscription-id": notice.SubscriptionID,
+		})
+	}
+	if len(notices) == 0 {
+		log.Debugf("push-notifier: batch already pushed to token of device id = %s", device.ID)
+		return nil
+	}
+
+	customMap := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"content_available": 1,
+		},
+		"_skygear": map[string]interface{}{
+			"notices": notices,
+		},
+	}
+
+	return notifier.sender.Send(push.MapMapper(customMap), device)
+}
+
 type hubNotifier pubsub.Hub
 
 // NewHubNotifier returns an Notifier which sends Notice thru the supplied
@@ -101,6 +184,30 @@ func (n *hubNotifier) Notify(device skydb.Device, notice Notice) error {
 	return err
 }
 
+func (n *hubNotifier) NotifyBatch(device skydb.Device, batch BatchNotification) error {
+	type jsonNotice struct {
+		SeqNum         uint64 `json:"seq-num"`
+		SubscriptionID string `json:"subscription-id"`
+	}
+
+	notices := make([]jsonNotice, len(batch.Notices))
+	for i, notice := range batch.Notices {
+		notices[i] = jsonNotice{notice.SeqNum, notice.SubscriptionID}
+	}
+	data, err := json.Marshal(struct {
+		Notices []jsonNotice `json:"notices"`
+	}{notices})
+
+	if err == nil {
+		(*pubsub.Hub)(n).Broadcast <- pubsub.Parcel{
+			Channel: fmt.Sprintf("_sub_%s", device.ID),
+			Data:    data,
+		}
+	}
+
+	return err
+}
+
 type multiNotifier []Notifier
 
 // NewMultiNotifier returns a Notifier which sends Notice to multiple
@@ -140,3 +247,31 @@ func (ns multiNotifier) Notify(device skydb.Device, notice Notice) error {
 
 	return lasterr
 }
+
+func (ns multiNotifier) NotifyBatch(device skydb.Device, batch BatchNotification) error {
+	errCh := make(chan error)
+	n := 0
+	for _, notifier := range ns {
+		notifier := notifier
+		if notifier.CanNotify(device) {
+			n++
+			go func() {
+				errCh <- notifyBatch(notifier, device, batch)
+			}()
+		}
+	}
+
+	var lasterr error
+	for i := 0; i < n; i++ {
+		if err := <-errCh; err != nil {
+			lasterr = err
+			log.WithFields(logrus.Fields{
+				"device": device,
+				"count":  len(batch.Notices),
+				"err":    err,
+			}).Errorf("multi-notifier: failed to send batch notification")
+		}
+	}
+
+	return lasterr
+}
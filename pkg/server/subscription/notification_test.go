@@ -0,0 +1,79 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subscription
+
+import (
+	"testing"
+
+	"github.com/skygeario/skygear-server/pkg/server/push"
+	"github.com/skygeario/skygear-server/pkg/server/skydb"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type recordingSender struct {
+	sent []skydb.Device
+}
+
+func (s *recordingSender) Send(m push.Mapper, device skydb.Device) error {
+	s.sent = append(s.sent, device)
+	return nil
+}
+
+func TestPushNotifier(t *testing.T) {
+	Convey("pushNotifier", t, func() {
+		sender := &recordingSender{}
+		notifier := NewPushNotifier(sender)
+
+		device1 := skydb.Device{ID: "device1", Type: "ios", Token: "token1"}
+		device2 := skydb.Device{ID: "device2", Type: "ios", Token: "token1"}
+		device3 := skydb.Device{ID: "device3", Type: "ios", Token: "token3"}
+
+		Convey("pushes a notice once per push token", func() {
+			notice := Notice{1, "sub1", skydb.RecordUpdated, nil}
+			So(notifier.Notify(device1, notice), ShouldBeNil)
+			So(notifier.Notify(device2, notice), ShouldBeNil)
+			So(notifier.Notify(device3, notice), ShouldBeNil)
+
+			So(sender.sent, ShouldResemble, []skydb.Device{device1, device3})
+		})
+
+		Convey("pushes every distinct notice to a push token", func() {
+			So(notifier.Notify(device1, Notice{1, "sub1", skydb.RecordUpdated, nil}), ShouldBeNil)
+			So(notifier.Notify(device2, Notice{1, "sub2", skydb.RecordUpdated, nil}), ShouldBeNil)
+			So(notifier.Notify(device1, Notice{2, "sub1", skydb.RecordUpdated, nil}), ShouldBeNil)
+
+			So(sender.sent, ShouldResemble, []skydb.Device{device1, device2, device1})
+		})
+
+		Convey("tells push tokens of different device types apart", func() {
+			android := skydb.Device{ID: "device4", Type: "android", Token: "token1"}
+			notice := Notice{1, "sub1", skydb.RecordUpdated, nil}
+			So(notifier.Notify(device1, notice), ShouldBeNil)
+			So(notifier.(*pushNotifier).markSent(android, notice), ShouldBeTrue)
+		})
+
+		Convey("skips notices of a batch already pushed", func() {
+			notice := Notice{1, "sub1", skydb.RecordUpdated, nil}
+			So(notifier.Notify(device1, notice), ShouldBeNil)
+			So(notifyBatch(notifier, device2, BatchNotification{[]Notice{notice}}), ShouldBeNil)
+			So(notifyBatch(notifier, device2, BatchNotification{[]Notice{
+				notice,
+				{1, "sub2", skydb.RecordUpdated, nil},
+			}}), ShouldBeNil)
+
+			So(sender.sent, ShouldResemble, []skydb.Device{device1, device2})
+		})
+	})
+}